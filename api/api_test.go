@@ -443,6 +443,234 @@ func TestStartOver(t *testing.T) {
 	tester.Run()
 }
 
+func TestReplayResolution(t *testing.T) {
+	tester := iffy.NewTester(t, hdl)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := resolverInputTemplate()
+
+	_, err = tasktemplate.LoadFromName(dbp, tmpl.Name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		if err := dbp.DB().Insert(&tmpl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tester.AddCall("newTask", http.MethodPost, "/task", `{"template_name":"`+tmpl.Name+`","input":{"id":"replay-me"}}`).
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(201))
+
+	tester.AddCall("createResolution", http.MethodPost, "/resolution", `{"task_id":"{{.newTask.id}}","resolver_inputs":{"ri1":"foo"}}`).
+		Headers(adminHeaders).
+		Checkers(iffy.ExpectStatus(201))
+
+	tester.AddCall("runResolution", http.MethodPost, "/resolution/{{.createResolution.id}}/run", "").
+		Headers(adminHeaders).
+		Checkers(
+			iffy.ExpectStatus(204),
+			waitChecker(time.Second), // fugly... need to give resolution manager some time to asynchronously finish running
+		)
+
+	tester.AddCall("getResolution", http.MethodGet, "/resolution/{{.createResolution.id}}", "").
+		Headers(adminHeaders).
+		Checkers(
+			iffy.ExpectStatus(200),
+			iffy.ExpectJSONBranch("state", resolution.StateBlockedBadRequest),
+			iffy.ExpectJSONBranch("steps", "step1", "state", step.StateDone),
+		)
+
+	tester.AddCall("replayForbidden", http.MethodPost, "/resolution/{{.createResolution.id}}/replay", `{}`).
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(403))
+
+	// resolvers of a task are not allowed to run the template on their own
+	tester.AddCall("newResolvableTask", http.MethodPost, "/task", `{"template_name":"`+tmpl.Name+`","input":{"id":"replay-me-too"},"resolver_usernames":["`+regularUser+`"]}`).
+		Headers(adminHeaders).
+		Checkers(iffy.ExpectStatus(201))
+
+	tester.AddCall("createResolvableResolution", http.MethodPost, "/resolution", `{"task_id":"{{.newResolvableTask.id}}","resolver_inputs":{"ri1":"foo"}}`).
+		Headers(adminHeaders).
+		Checkers(iffy.ExpectStatus(201))
+
+	tester.AddCall("replayTemplateForbidden", http.MethodPost, "/resolution/{{.createResolvableResolution.id}}/replay", `{}`).
+		Headers(regularHeaders).
+		Checkers(
+			iffy.ExpectStatus(403),
+			iffy.ExpectJSONBranch("error", `You are not allowed to run tasks from template "`+tmpl.Name+`"`),
+		)
+
+	tester.AddCall("replayNotIdempotent", http.MethodPost, "/resolution/{{.createResolution.id}}/replay", `{"carry_over_steps":["step1"]}`).
+		Headers(adminHeaders).
+		Checkers(
+			iffy.ExpectStatus(400),
+			iffy.ExpectJSONBranch("error", `Can't carry over step "step1": step is not idempotent`),
+		)
+
+	tester.AddCall("replayNotDone", http.MethodPost, "/resolution/{{.createResolution.id}}/replay", `{"carry_over_steps":["step2"],"force":true}`).
+		Headers(adminHeaders).
+		Checkers(iffy.ExpectStatus(400))
+
+	tester.AddCall("replay", http.MethodPost, "/resolution/{{.createResolution.id}}/replay", `{"input":{"id":"replayed"},"resolver_inputs":{"ri1":"bar"},"carry_over_steps":["step1"],"force":true}`).
+		Headers(adminHeaders).
+		Checkers(
+			iffy.ExpectStatus(201),
+			iffy.ExpectJSONBranch("input", "id", "replayed"),
+			iffy.ExpectJSONBranch("steps_done", "1"),
+		)
+
+	tester.AddCall("getReplayedResolution", http.MethodGet, "/resolution/{{.replay.resolution}}", "").
+		Headers(adminHeaders).
+		Checkers(
+			iffy.ExpectStatus(200),
+			iffy.ExpectJSONBranch("resolver_inputs", "ri1", "bar"),
+			iffy.ExpectJSONBranch("steps", "step1", "state", step.StateDone),
+			iffy.ExpectJSONBranch("steps", "step1", "output", "foo", "bar"),
+		)
+
+	tester.Run()
+}
+
+func TestAPITokens(t *testing.T) {
+	tester := iffy.NewTester(t, hdl)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := dummyTemplate()
+
+	_, err = tasktemplate.LoadFromName(dbp, tmpl.Name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		if err := dbp.DB().Insert(&tmpl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tester.AddCall("createAdminScopeForbidden", http.MethodPost, "/token", `{"name":"nope","scopes":["admin"]}`).
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(403))
+
+	tester.AddCall("createServiceTokenForbidden", http.MethodPost, "/token", `{"name":"nope","scopes":["read-only"],"owner":"robot"}`).
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(403))
+
+	tester.AddCall("createInvalidScope", http.MethodPost, "/token", `{"name":"nope","scopes":["everything"]}`).
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(400))
+
+	tester.AddCall("createReadOnly", http.MethodPost, "/token", `{"name":"read only","scopes":["read-only"],"ttl":"1h"}`).
+		Headers(regularHeaders).
+		Checkers(
+			iffy.ExpectStatus(201),
+			iffy.ExpectJSONBranch("owner_username", regularUser),
+		)
+
+	tester.AddCall("createService", http.MethodPost, "/token", `{"name":"ci","scopes":["create-task:`+tmpl.Name+`"],"owner":"robot"}`).
+		Headers(adminHeaders).
+		Checkers(
+			iffy.ExpectStatus(201),
+			iffy.ExpectJSONBranch("owner_username", "robot"),
+			iffy.ExpectJSONBranch("created_by", adminUser),
+		)
+
+	tester.AddCall("readWithToken", http.MethodGet, "/template/"+tmpl.Name, "").
+		Headers(iffy.Headers{"Authorization": "Bearer {{.createReadOnly.token}}"}).
+		Checkers(iffy.ExpectStatus(200))
+
+	tester.AddCall("createTaskReadOnly", http.MethodPost, "/task", `{"template_name":"`+tmpl.Name+`","input":{"id":"token"}}`).
+		Headers(iffy.Headers{"Authorization": "Bearer {{.createReadOnly.token}}"}).
+		Checkers(iffy.ExpectStatus(403))
+
+	tester.AddCall("createTaskService", http.MethodPost, "/task", `{"template_name":"`+tmpl.Name+`","input":{"id":"token"}}`).
+		Headers(iffy.Headers{"Authorization": "Bearer {{.createService.token}}"}).
+		Checkers(
+			iffy.ExpectStatus(201),
+			iffy.ExpectJSONBranch("requester_username", "robot"),
+		)
+
+	tester.AddCall("wontfixService", http.MethodPost, "/task/{{.createTaskService.id}}/wontfix", "").
+		Headers(iffy.Headers{"Authorization": "Bearer {{.createService.token}}"}).
+		Checkers(iffy.ExpectStatus(403))
+
+	tester.AddCall("invalidToken", http.MethodGet, "/task", "").
+		Headers(iffy.Headers{"Authorization": "Bearer utask_invalid"}).
+		Checkers(iffy.ExpectStatus(401))
+
+	tester.AddCall("revokeForbidden", http.MethodDelete, "/token/{{.createService.id}}", "").
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(403))
+
+	tester.AddCall("revoke", http.MethodDelete, "/token/{{.createReadOnly.id}}", "").
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(204))
+
+	tester.AddCall("readWithRevokedToken", http.MethodGet, "/template/"+tmpl.Name, "").
+		Headers(iffy.Headers{"Authorization": "Bearer {{.createReadOnly.token}}"}).
+		Checkers(iffy.ExpectStatus(401))
+
+	tester.Run()
+}
+
+func TestSecrets(t *testing.T) {
+	tester := iffy.NewTester(t, hdl)
+
+	tester.AddCall("createSecretForbidden", http.MethodPost, "/secret", `{"name":"api-token","value":"hunter2"}`).
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(401))
+
+	tester.AddCall("createSecretInvalid", http.MethodPost, "/secret", `{"name":"api token","value":"hunter2"}`).
+		Headers(adminHeaders).
+		Checkers(iffy.ExpectStatus(400))
+
+	tester.AddCall("createSecret", http.MethodPost, "/secret", `{"name":"API-Token","description":"token for the foobar API","value":"hunter2","allowed_templates":["hello-world-now"]}`).
+		Headers(adminHeaders).
+		Checkers(
+			iffy.ExpectStatus(201),
+			iffy.ExpectJSONBranch("name", "api-token"),
+			iffy.ExpectJSONBranch("allowed_templates", "[hello-world-now]"),
+		)
+
+	tester.AddCall("getSecret", http.MethodGet, "/secret/api-token", "").
+		Headers(adminHeaders).
+		Checkers(
+			iffy.ExpectStatus(200),
+			iffy.ExpectJSONBranch("description", "token for the foobar API"),
+		)
+
+	tester.AddCall("updateSecret", http.MethodPut, "/secret/api-token", `{"value":"hunter3","allowed_templates":[]}`).
+		Headers(adminHeaders).
+		Checkers(
+			iffy.ExpectStatus(200),
+			iffy.ExpectJSONBranch("description", "token for the foobar API"),
+			iffy.ExpectJSONBranch("allowed_templates", "[]"),
+		)
+
+	tester.AddCall("listSecrets", http.MethodGet, "/secret", "").
+		Headers(adminHeaders).
+		Checkers(iffy.ExpectStatus(200))
+
+	tester.AddCall("deleteSecret", http.MethodDelete, "/secret/api-token", "").
+		Headers(adminHeaders).
+		Checkers(iffy.ExpectStatus(204))
+
+	tester.AddCall("getDeletedSecret", http.MethodGet, "/secret/api-token", "").
+		Headers(adminHeaders).
+		Checkers(iffy.ExpectStatus(404))
+
+	tester.Run()
+}
+
 func TestPagination(t *testing.T) {
 	tester := iffy.NewTester(t, hdl)
 
@@ -775,6 +1003,19 @@ func blockedHidden(name string, blocked, hidden bool) tasktemplate.TaskTemplate
 	}
 }
 
+func TestTemplateFunctions(t *testing.T) {
+	tester := iffy.NewTester(t, hdl)
+
+	tester.AddCall("listTemplateFunctions", http.MethodGet, "/template-function", "").
+		Headers(regularHeaders).
+		Checkers(
+			iffy.ExpectStatus(200),
+			iffy.ExpectListLength(len(values.Functions())),
+		)
+
+	tester.Run()
+}
+
 func Test_staticMiddleware(t *testing.T) {
 	ginEngine := gin.Default()
 	ginEngine.
@@ -827,3 +1068,89 @@ func marshalJSON(t *testing.T, i interface{}) string {
 }
 
 func strPtr(s string) *string { return &s }
+
+func TestAuditEvents(t *testing.T) {
+	tester := iffy.NewTester(t, hdl)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := dummyTemplate()
+
+	_, err = tasktemplate.LoadFromName(dbp, tmpl.Name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		if err := dbp.DB().Insert(&tmpl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tester.AddCall("createTask", http.MethodPost, "/task", `{"template_name":"`+tmpl.Name+`","input":{"id":"audit"}}`).
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(201))
+
+	tester.AddCall("getTask", http.MethodGet, "/task/{{.createTask.id}}", "").
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(200))
+
+	tester.AddCall("wontfixTask", http.MethodPost, "/task/{{.createTask.id}}/wontfix", "").
+		Headers(adminHeaders).
+		Checkers(iffy.ExpectStatus(204))
+
+	// read-only requests are not recorded
+	tester.AddCall("listTaskEvents", http.MethodGet, "/task/{{.createTask.id}}/audit-event", "").
+		Headers(regularHeaders).
+		Checkers(
+			iffy.ExpectStatus(200),
+			iffy.ExpectListLength(2),
+			expectFirstAuditEvent(map[string]interface{}{
+				"actor":     adminUser,
+				"action":    "CancelTask",
+				"sudo":      true,
+				"status":    float64(204),
+				"old_state": "TODO",
+				"new_state": "WONTFIX",
+			}),
+		)
+
+	tester.AddCall("listEventsForbidden", http.MethodGet, "/audit-event", "").
+		Headers(regularHeaders).
+		Checkers(iffy.ExpectStatus(403))
+
+	tester.AddCall("listEvents", http.MethodGet, "/audit-event?task_id={{.createTask.id}}&action=CreateTask", "").
+		Headers(adminHeaders).
+		Checkers(
+			iffy.ExpectStatus(200),
+			iffy.ExpectListLength(1),
+			expectFirstAuditEvent(map[string]interface{}{
+				"actor":         regularUser,
+				"sudo":          false,
+				"template_name": tmpl.Name,
+				"new_state":     "TODO",
+			}),
+		)
+
+	tester.Run()
+}
+
+func expectFirstAuditEvent(expected map[string]interface{}) iffy.Checker {
+	return func(r *http.Response, body string, respObject interface{}) error {
+		var events []map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &events); err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return fmt.Errorf("no audit event")
+		}
+		for k, v := range expected {
+			if events[0][k] != v {
+				return fmt.Errorf("audit event %s: expected %v, got %v", k, v, events[0][k])
+			}
+		}
+		return nil
+	}
+}
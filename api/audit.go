@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/loopfz/gadgeto/zesty"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/models/auditlog"
+	"github.com/ovh/utask/pkg/metadata"
+	"github.com/ovh/utask/pkg/utils"
+)
+
+// auditWebhookQueueSize is the number of events waiting to be forwarded to the webhook,
+// beyond which new events are only persisted in DB
+const auditWebhookQueueSize = 1000
+
+// auditRecorder persists the audit events of the API, and forwards them to an optional webhook
+type auditRecorder struct {
+	disabled bool
+	webhook  *utask.AuditLogWebhook
+	queue    chan *auditlog.Event
+	client   *http.Client
+}
+
+func newAuditRecorder(ctx context.Context, cfg utask.AuditLog) *auditRecorder {
+	r := &auditRecorder{
+		disabled: cfg.Disabled,
+		webhook:  cfg.Webhook,
+	}
+	if !r.disabled && r.webhook != nil {
+		r.queue = make(chan *auditlog.Event, auditWebhookQueueSize)
+		r.client = &http.Client{Timeout: 10 * time.Second}
+		go r.forward(ctx)
+	}
+	return r
+}
+
+// auditedRequest tells whether a request changes something, read-only requests are not recorded
+func auditedRequest(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// newAuditEvent builds the audit event of a request, out of its action metadata
+func newAuditEvent(c *gin.Context, action, actor, tokenID string) *auditlog.Event {
+	e := &auditlog.Event{
+		Actor:     actor,
+		TokenID:   tokenID,
+		SUDO:      metadata.IsSUDO(c),
+		Action:    action,
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		Status:    c.Writer.Status(),
+		RequestID: c.Request.Header.Get(requestIDHeader),
+		Metadata:  map[string]interface{}{},
+	}
+	for k, v := range metadata.GetActionMetadata(c) {
+		switch k {
+		case metadata.TaskID:
+			e.TaskID = fmt.Sprint(v)
+		case metadata.ResolutionID:
+			e.ResolutionID = fmt.Sprint(v)
+		case metadata.TemplateName:
+			e.TemplateName = fmt.Sprint(v)
+		case metadata.OldState:
+			e.OldState = fmt.Sprint(v)
+		case metadata.NewState:
+			e.NewState = fmt.Sprint(v)
+		default:
+			e.Metadata[k] = v
+		}
+	}
+	return e
+}
+
+// record persists an event, and queues it for the webhook
+// failures are only logged: the response has already been sent to the caller
+func (r *auditRecorder) record(e *auditlog.Event) {
+	if r.disabled {
+		return
+	}
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err == nil {
+		err = e.Insert(dbp)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("action", e.Action).Error("Failed to persist audit event")
+	}
+
+	if r.queue != nil {
+		select {
+		case r.queue <- e:
+		default:
+			logrus.WithField("action", e.Action).Warn("Audit webhook queue is full, event not forwarded")
+		}
+	}
+}
+
+func (r *auditRecorder) forward(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-r.queue:
+			if err := r.send(ctx, e); err != nil {
+				logrus.WithError(err).WithField("action", e.Action).Error("Failed to forward audit event to webhook")
+			}
+		}
+	}
+}
+
+func (r *auditRecorder) send(ctx context.Context, e *auditlog.Event) error {
+	b, err := utils.JSONMarshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.webhook.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range r.webhook.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("webhook returned with status code %d: %s", res.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
+	"github.com/loopfz/gadgeto/zesty"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/models/auditlog"
+	"github.com/ovh/utask/models/resolution"
+	"github.com/ovh/utask/models/task"
+	"github.com/ovh/utask/models/tasktemplate"
+	"github.com/ovh/utask/pkg/auth"
+	"github.com/ovh/utask/pkg/metadata"
+)
+
+type listAuditEventsIn struct {
+	Actor        string     `query:"actor"`
+	Action       string     `query:"action"`
+	TaskID       string     `query:"task_id"`
+	ResolutionID string     `query:"resolution_id"`
+	TemplateName string     `query:"template_name"`
+	SUDO         *bool      `query:"sudo"`
+	After        *time.Time `query:"after"`
+	Before       *time.Time `query:"before"`
+	PageSize     uint64     `query:"page_size"`
+	Last         *int64     `query:"last"`
+}
+
+// ListAuditEvents returns the audit events of the API, most recent first
+// events can be filtered by actor, action, task, resolution, template, SUDO flag and creation time
+// including the events of deleted tasks, this action can only be performed by administrators
+func ListAuditEvents(c *gin.Context, in *listAuditEventsIn) ([]*auditlog.Event, error) {
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	in.PageSize = normalizePageSize(in.PageSize)
+
+	events, err := auditlog.ListEvents(dbp, auditlog.Filter{
+		Actor:        in.Actor,
+		Action:       in.Action,
+		TaskID:       in.TaskID,
+		ResolutionID: in.ResolutionID,
+		TemplateName: in.TemplateName,
+		SUDO:         in.SUDO,
+		After:        in.After,
+		Before:       in.Before,
+	}, in.PageSize, in.Last)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(events)) == in.PageSize {
+		c.Header(
+			linkHeader,
+			buildAuditEventsNextLink("/audit-event", c.Request.URL.Query(), in.PageSize, events[len(events)-1].ID),
+		)
+	}
+
+	c.Header(pageSizeHeader, fmt.Sprintf("%v", in.PageSize))
+
+	return events, nil
+}
+
+type listTaskAuditEventsIn struct {
+	PublicID string `path:"id,required"`
+	Action   string `query:"action"`
+	PageSize uint64 `query:"page_size"`
+	Last     *int64 `query:"last"`
+}
+
+// ListTaskAuditEvents returns the audit events of a task, most recent first
+// they are visible to anyone allowed to display the task
+func ListTaskAuditEvents(c *gin.Context, in *listTaskAuditEventsIn) ([]*auditlog.Event, error) {
+	metadata.AddActionMetadata(c, metadata.TaskID, in.PublicID)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := task.LoadFromPublicID(dbp, in.PublicID)
+	if err != nil {
+		return nil, err
+	}
+
+	tt, err := tasktemplate.LoadFromID(dbp, t.TemplateID)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.AddActionMetadata(c, metadata.TemplateName, tt.Name)
+
+	var res *resolution.Resolution
+	if t.Resolution != nil {
+		res, err = resolution.LoadFromPublicID(dbp, *t.Resolution)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	admin := auth.IsAdmin(c) == nil
+	requester := auth.IsRequester(c, t) == nil
+	watcher := auth.IsWatcher(c, t) == nil
+	resolutionManager := auth.IsResolutionManager(c, tt, t, res) == nil
+
+	if !admin && !requester && !watcher && !resolutionManager {
+		return nil, errors.Forbiddenf("Can't display task audit events")
+	} else if !requester && !watcher && !resolutionManager {
+		metadata.SetSUDO(c)
+	}
+
+	in.PageSize = normalizePageSize(in.PageSize)
+
+	events, err := auditlog.ListEvents(dbp, auditlog.Filter{
+		TaskID: t.PublicID,
+		Action: in.Action,
+	}, in.PageSize, in.Last)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(events)) == in.PageSize {
+		c.Header(
+			linkHeader,
+			buildAuditEventsNextLink(fmt.Sprintf("/task/%s/audit-event", t.PublicID), c.Request.URL.Query(), in.PageSize, events[len(events)-1].ID),
+		)
+	}
+
+	c.Header(pageSizeHeader, fmt.Sprintf("%v", in.PageSize))
+
+	return events, nil
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/ovh/utask"
 	"github.com/ovh/utask/models/task"
+	"github.com/ovh/utask/pkg/auth"
 	"github.com/ovh/utask/pkg/batch"
 	"github.com/ovh/utask/pkg/metadata"
 	"github.com/ovh/utask/pkg/utils"
@@ -32,6 +33,10 @@ func CreateBatch(c *gin.Context, in *createBatchIn) (*task.Batch, error) {
 
 	metadata.AddActionMetadata(c, metadata.TemplateName, in.TemplateName)
 
+	if err := auth.HasScope(c, auth.CreateTaskScope(in.TemplateName)); err != nil {
+		return nil, err
+	}
+
 	if err := utils.ValidateTags(in.Tags); err != nil {
 		return nil, err
 	}
@@ -47,6 +47,40 @@ func buildFunctionNextLink(pageSize uint64, last string) string {
 	return buildLink("next", "/function", values.Encode())
 }
 
+func buildStepAttemptsNextLink(publicID, stepName string, pageSize uint64, last int64) string {
+	values := &url.Values{}
+	values.Add("page_size", strconv.FormatUint(pageSize, 10))
+	values.Add("last", strconv.FormatInt(last, 10))
+	return buildLink("next", fmt.Sprintf("/resolution/%s/step/%s/attempts", publicID, url.PathEscape(stepName)), values.Encode())
+}
+
+// buildAuditEventsNextLink keeps the filters of the current request
+func buildAuditEventsNextLink(path string, values url.Values, pageSize uint64, last int64) string {
+	values.Set("page_size", strconv.FormatUint(pageSize, 10))
+	values.Set("last", strconv.FormatInt(last, 10))
+	return buildLink("next", path, values.Encode())
+}
+
+func buildSecretNextLink(pageSize uint64, last string) string {
+	values := &url.Values{}
+	values.Add("page_size", strconv.FormatUint(pageSize, 10))
+	values.Add("last", last)
+	return buildLink("next", "/secret", values.Encode())
+}
+
+func buildTokenNextLink(owner *string, all bool, pageSize uint64, last string) string {
+	values := &url.Values{}
+	if owner != nil {
+		values.Add("owner", *owner)
+	}
+	if all {
+		values.Add("all", "true")
+	}
+	values.Add("page_size", strconv.FormatUint(pageSize, 10))
+	values.Add("last", last)
+	return buildLink("next", "/token", values.Encode())
+}
+
 func buildTaskNextLink(typ string, state, batch *string, pageSize uint64, last string) string {
 	values := &url.Values{}
 	values.Add("type", typ)
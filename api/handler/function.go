@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/juju/errors"
 	"github.com/ovh/utask/engine/functions"
+	"github.com/ovh/utask/engine/values"
 	"github.com/ovh/utask/pkg/metadata"
 )
 
@@ -67,3 +68,9 @@ func GetFunction(c *gin.Context, in *getFunctionIn) (*functions.Function, error)
 	return function, nil
 
 }
+
+// ListTemplateFunctions returns the functions of the templating language implemented by µTask
+// and contributed by plugins (Golang and Sprig functions are not listed)
+func ListTemplateFunctions(c *gin.Context) ([]values.TemplateFunction, error) {
+	return values.Functions(), nil
+}
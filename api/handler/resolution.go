@@ -2,6 +2,7 @@ package handler
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,10 +14,14 @@ import (
 	"github.com/ovh/utask/engine"
 	"github.com/ovh/utask/engine/step"
 	"github.com/ovh/utask/models/resolution"
+	"github.com/ovh/utask/models/secret"
 	"github.com/ovh/utask/models/task"
 	"github.com/ovh/utask/models/tasktemplate"
 	"github.com/ovh/utask/pkg/auth"
+	"github.com/ovh/utask/pkg/constants"
 	"github.com/ovh/utask/pkg/metadata"
+	"github.com/ovh/utask/pkg/taskutils"
+	"github.com/ovh/utask/pkg/utils"
 )
 
 type createResolutionIn struct {
@@ -97,6 +102,7 @@ func CreateResolution(c *gin.Context, in *createResolutionIn) (*resolution.Resol
 		}
 
 		logrus.WithFields(logrus.Fields{"resolution_id": res.PublicID, "task_id": t.PublicID}).Debugf("Handler CreateResolution: start-over the resolution, deleting old resolution %s", res.PublicID)
+		metadata.AddActionMetadata(c, metadata.OldState, res.State)
 
 		if err := res.Delete(dbp); err != nil {
 			_ = dbp.Rollback()
@@ -111,6 +117,7 @@ func CreateResolution(c *gin.Context, in *createResolutionIn) (*resolution.Resol
 	}
 
 	metadata.AddActionMetadata(c, metadata.ResolutionID, r.PublicID)
+	metadata.AddActionMetadata(c, metadata.NewState, r.State)
 	logrus.WithFields(logrus.Fields{"resolution_id": r.PublicID}).Debugf("Handler CreateResolution: created resolution %s", r.PublicID)
 
 	if err := dbp.Commit(); err != nil {
@@ -221,6 +228,10 @@ func GetResolution(c *gin.Context, in *getResolutionIn) (*resolution.Resolution,
 		r.ClearOutputs()
 	}
 
+	if err := concealSecrets(dbp, r, tt.Name); err != nil {
+		return nil, err
+	}
+
 	if !resolutionManager && !requester && !watcher {
 		metadata.SetSUDO(c)
 	}
@@ -228,6 +239,16 @@ func GetResolution(c *gin.Context, in *getResolutionIn) (*resolution.Resolution,
 	return r, nil
 }
 
+// concealSecrets hides the values of the secrets readable by a template from the steps of its resolution
+func concealSecrets(dbp zesty.DBProvider, r *resolution.Resolution, templateName string) error {
+	secrets, err := secret.LoadValuesForTemplate(dbp, templateName)
+	if err != nil {
+		return err
+	}
+	r.ConcealSecrets(secrets)
+	return nil
+}
+
 type updateResolutionIn struct {
 	PublicID       string                 `path:"id, required"`
 	Steps          map[string]*step.Step  `json:"steps"` // persisted in encrypted blob
@@ -318,7 +339,6 @@ func UpdateResolution(c *gin.Context, in *updateResolutionIn) error {
 	}
 
 	logrus.WithFields(logrus.Fields{"resolution_id": r.PublicID}).Debugf("Handler UpdateResolution: manual update of resolution %s", r.PublicID)
-
 	if err := r.Update(dbp); err != nil {
 		dbp.Rollback()
 		return err
@@ -389,11 +409,22 @@ func RunResolution(c *gin.Context, in *runResolutionIn) error {
 	}
 
 	logrus.WithFields(logrus.Fields{"resolution_id": r.PublicID}).Debugf("Handler RunResolution: manual resolve %s", r.PublicID)
+	metadata.AddActionMetadata(c, metadata.OldState, r.State)
+
+	paused := r.State == resolution.StatePaused
 
 	ch := make(chan struct{})
 	go func() {
+		defer close(ch)
 		err = engine.GetEngine().Resolve(in.PublicID, nil)
-		close(ch)
+		if err != nil || !paused {
+			return
+		}
+		// children paused along with the resolution are resumed along with it,
+		// once it has left its paused state
+		if resumeErr := resumeChildren(dbp, t, reqUsername); resumeErr != nil {
+			logrus.WithFields(logrus.Fields{"resolution_id": r.PublicID}).Errorf("Handler RunResolution: failed to resume children of %s: %s", r.PublicID, resumeErr)
+		}
 	}()
 
 	timeout := time.NewTicker(5 * time.Second)
@@ -404,12 +435,31 @@ func RunResolution(c *gin.Context, in *runResolutionIn) error {
 	// start correctly when the Execution pool gets available, and prevent API thread to be blocked
 	select {
 	case <-ch:
+		if err == nil {
+			metadata.AddActionMetadata(c, metadata.NewState, resolution.StateRunning)
+		}
 		return err
 	case <-timeout.C:
+		// the outcome is unknown yet: no new state is recorded
 		return nil
 	}
 }
 
+func resumeChildren(dbp zesty.DBProvider, t *task.Task, username string) error {
+	if err := dbp.Tx(); err != nil {
+		return err
+	}
+	if err := taskutils.CascadeResume(dbp, t, username); err != nil {
+		dbp.Rollback()
+		return err
+	}
+	if err := dbp.Commit(); err != nil {
+		dbp.Rollback()
+		return err
+	}
+	return nil
+}
+
 type extendResolutionIn struct {
 	PublicID string `path:"id, required"`
 }
@@ -478,6 +528,9 @@ func ExtendResolution(c *gin.Context, in *extendResolutionIn) error {
 		r.ExtendRunMax(utask.DefaultRetryMax)
 	}
 
+	metadata.AddActionMetadata(c, metadata.OldState, r.State)
+	metadata.AddActionMetadata(c, metadata.NewState, resolution.StateError)
+
 	r.SetState(resolution.StateError)
 	r.SetNextRetry(time.Now())
 
@@ -550,6 +603,17 @@ func CancelResolution(c *gin.Context, in *cancelResolutionIn) error {
 		return errors.BadRequestf("Can't cancel resolution: state %s", r.State)
 	}
 
+	reqUsername := auth.GetIdentity(c)
+
+	// children spawned by subtask and batch steps are cancelled, detached or prevent the cancellation
+	if err := taskutils.CascadeCancel(dbp, t, r, reqUsername); err != nil {
+		dbp.Rollback()
+		return err
+	}
+
+	metadata.AddActionMetadata(c, metadata.OldState, r.State)
+	metadata.AddActionMetadata(c, metadata.NewState, resolution.StateCancelled)
+
 	r.SetState(resolution.StateCancelled)
 
 	if err := r.Update(dbp); err != nil {
@@ -564,7 +628,6 @@ func CancelResolution(c *gin.Context, in *cancelResolutionIn) error {
 		return err
 	}
 
-	reqUsername := auth.GetIdentity(c)
 	_, err = task.CreateComment(dbp, t, reqUsername, "cancelled resolution")
 	if err != nil {
 		dbp.Rollback()
@@ -645,6 +708,17 @@ func PauseResolution(c *gin.Context, in *pauseResolutionIn) error {
 		}
 	}
 
+	reqUsername := auth.GetIdentity(c)
+
+	// children spawned by subtask and batch steps are paused, left running or prevent the pause
+	if err := taskutils.CascadePause(dbp, t, r, reqUsername, in.Force); err != nil {
+		dbp.Rollback()
+		return err
+	}
+
+	metadata.AddActionMetadata(c, metadata.OldState, r.State)
+	metadata.AddActionMetadata(c, metadata.NewState, resolution.StatePaused)
+
 	r.SetState(resolution.StatePaused)
 
 	logrus.WithFields(logrus.Fields{"resolution_id": r.PublicID}).Debugf("Handler PauseResolution: pause of resolution %s", r.PublicID)
@@ -654,7 +728,6 @@ func PauseResolution(c *gin.Context, in *pauseResolutionIn) error {
 		return err
 	}
 
-	reqUsername := auth.GetIdentity(c)
 	_, err = task.CreateComment(dbp, t, reqUsername, "manually paused resolution")
 	if err != nil {
 		dbp.Rollback()
@@ -669,6 +742,242 @@ func PauseResolution(c *gin.Context, in *pauseResolutionIn) error {
 	return nil
 }
 
+type replayResolutionIn struct {
+	PublicID       string                 `path:"id, required"`
+	Input          map[string]interface{} `json:"input"`
+	ResolverInputs map[string]interface{} `json:"resolver_inputs"`
+	CarryOverSteps []string               `json:"carry_over_steps"`
+	Force          bool                   `json:"force"`
+	Comment        string                 `json:"comment"`
+	Tags           map[string]string      `json:"tags"`
+}
+
+// ReplayResolution clones the task of an existing resolution into a new task and resolution,
+// the original inputs can be overridden, and the results of the steps listed in carry_over_steps
+// are copied into the new resolution, in state DONE, so that they won't be executed again.
+// Only steps that were DONE and are declared as idempotent can be carried over,
+// unless "force" is set by an admin user.
+// As when creating a task, the requester must be allowed to run tasks from the template.
+func ReplayResolution(c *gin.Context, in *replayResolutionIn) (*task.Task, error) {
+	metadata.AddActionMetadata(c, metadata.ResolutionID, in.PublicID)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := utils.ValidateTags(in.Tags); err != nil {
+		return nil, err
+	}
+
+	if err := dbp.Tx(); err != nil {
+		return nil, err
+	}
+
+	r, err := resolution.LoadFromPublicID(dbp, in.PublicID)
+	if err != nil {
+		dbp.Rollback()
+		return nil, err
+	}
+
+	t, err := task.LoadFromID(dbp, r.TaskID)
+	if err != nil {
+		dbp.Rollback()
+		return nil, err
+	}
+
+	metadata.AddActionMetadata(c, metadata.TaskID, t.PublicID)
+
+	tt, err := tasktemplate.LoadFromID(dbp, t.TemplateID)
+	if err != nil {
+		dbp.Rollback()
+		return nil, err
+	}
+
+	metadata.AddActionMetadata(c, metadata.TemplateName, tt.Name)
+
+	// replaying creates a new task from the template
+	if err := auth.HasScope(c, auth.CreateTaskScope(tt.Name)); err != nil {
+		dbp.Rollback()
+		return nil, err
+	}
+
+	admin := auth.IsAdmin(c) == nil
+	resolutionManager := auth.IsResolutionManager(c, tt, t, r) == nil
+
+	if !admin && !resolutionManager {
+		dbp.Rollback()
+		return nil, errors.Forbiddenf("You are not allowed to replay this resolution")
+	} else if !resolutionManager {
+		metadata.SetSUDO(c)
+	}
+
+	if in.Force {
+		if !admin {
+			dbp.Rollback()
+			return nil, errors.Forbiddenf("Only admin users can force the carry over of non-idempotent steps")
+		}
+		metadata.SetSUDO(c)
+	}
+
+	if tt.Blocked {
+		dbp.Rollback()
+		return nil, errors.NewNotValid(nil, "Template not available (blocked)")
+	}
+
+	// the replay is run on behalf of the requester, who needs the same rights
+	// on the template as to create a task and run it right away
+	if !tt.IsAutoRunnable() && tt.AllowAllResolverUsernames {
+		dbp.Rollback()
+		return nil, errors.Errorf("invalid tasktemplate: %q should be auto_runnable", tt.Name)
+	}
+	templateOwner := auth.IsTemplateOwner(c, tt) == nil
+	if !admin && !templateOwner && !tt.AllowAllResolverUsernames {
+		dbp.Rollback()
+		return nil, errors.Forbiddenf("You are not allowed to run tasks from template %q", tt.Name)
+	} else if !templateOwner && !tt.AllowAllResolverUsernames {
+		metadata.SetSUDO(c)
+	}
+
+	switch r.State {
+	case resolution.StateRunning, resolution.StateAutorunning:
+		dbp.Rollback()
+		return nil, errors.BadRequestf("Can't replay resolution: state %s", r.State)
+	}
+
+	for _, stepName := range in.CarryOverSteps {
+		s, ok := r.Steps[stepName]
+		if !ok {
+			dbp.Rollback()
+			return nil, errors.NotFoundf("given stepName %q for this resolution", stepName)
+		}
+		if s.IsChild() {
+			dbp.Rollback()
+			return nil, errors.BadRequestf("Can't carry over step %q: it was spawned by a foreach step, carry over the foreach step instead", stepName)
+		}
+		if s.State != step.StateDone {
+			dbp.Rollback()
+			return nil, errors.BadRequestf("Can't carry over step %q: state %s", stepName, s.State)
+		}
+		if !s.Idempotent && !in.Force {
+			dbp.Rollback()
+			return nil, errors.BadRequestf("Can't carry over step %q: step is not idempotent", stepName)
+		}
+	}
+
+	input := make(map[string]interface{}, len(t.Input)+len(in.Input))
+	for k, v := range t.Input {
+		input[k] = v
+	}
+	for k, v := range in.Input {
+		input[k] = v
+	}
+
+	resolverInputs := make(map[string]interface{}, len(r.ResolverInput)+len(in.ResolverInputs))
+	for k, v := range r.ResolverInput {
+		resolverInputs[k] = v
+	}
+	for k, v := range in.ResolverInputs {
+		resolverInputs[k] = v
+	}
+
+	tags := make(map[string]string, len(t.Tags)+len(in.Tags))
+	for k, v := range t.Tags {
+		// a replayed task is never the subtask of the original parent task
+		if k == constants.SubtaskTagParentTaskID {
+			continue
+		}
+		tags[k] = v
+	}
+	for k, v := range in.Tags {
+		tags[k] = v
+	}
+
+	// as when creating a task, only admins and template owners can grant the resolution of the new task
+	var resolverUsernames, resolverGroups []string
+	if admin || templateOwner {
+		resolverUsernames, resolverGroups = t.ResolverUsernames, t.ResolverGroups
+	}
+
+	reqUsername := auth.GetIdentity(c)
+
+	newT, err := task.Create(dbp, tt, reqUsername, auth.GetGroups(c), t.WatcherUsernames, t.WatcherGroups, resolverUsernames, resolverGroups, input, tags, nil, false)
+	if err != nil {
+		dbp.Rollback()
+		return nil, err
+	}
+
+	// a template which isn't auto runnable is left to be run manually by its resolvers
+	newR, err := resolution.Create(dbp, newT, resolverInputs, reqUsername, tt.IsAutoRunnable(), nil)
+	if err != nil {
+		dbp.Rollback()
+		return nil, err
+	}
+	newT.Resolution = &newR.PublicID
+
+	for _, stepName := range in.CarryOverSteps {
+		if err := newR.CarryOverStep(stepName, r.Steps[stepName]); err != nil {
+			dbp.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := newR.Update(dbp); err != nil {
+		dbp.Rollback()
+		return nil, err
+	}
+
+	if len(in.CarryOverSteps) > 0 {
+		// carried over steps are already done, as the engine would count them
+		for _, s := range newR.Steps {
+			if s.IsFinal() && !s.IsChild() {
+				newT.StepsDone++
+			}
+		}
+		if err := newT.Update(dbp, false, false); err != nil {
+			dbp.Rollback()
+			return nil, err
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{"resolution_id": r.PublicID, "task_id": newT.PublicID}).Debugf("Handler ReplayResolution: replayed resolution %s into task %s", r.PublicID, newT.PublicID)
+	// the replayed resolution is left untouched: the new state is the one of its replay
+	metadata.AddActionMetadata(c, metadata.OldState, r.State)
+	metadata.AddActionMetadata(c, metadata.NewState, newR.State)
+
+	content := fmt.Sprintf("replay of task %s (resolution %s)", t.PublicID, r.PublicID)
+	if len(in.CarryOverSteps) > 0 {
+		content += ", carrying over steps " + strings.Join(in.CarryOverSteps, ", ")
+	}
+	com, err := task.CreateComment(dbp, newT, reqUsername, content)
+	if err != nil {
+		dbp.Rollback()
+		return nil, err
+	}
+	newT.Comments = []*task.Comment{com}
+
+	if in.Comment != "" {
+		com, err := task.CreateComment(dbp, newT, reqUsername, in.Comment)
+		if err != nil {
+			dbp.Rollback()
+			return nil, err
+		}
+		newT.Comments = append(newT.Comments, com)
+	}
+
+	if _, err := task.CreateComment(dbp, t, reqUsername, "replayed as task "+newT.PublicID); err != nil {
+		dbp.Rollback()
+		return nil, err
+	}
+
+	if err := dbp.Commit(); err != nil {
+		dbp.Rollback()
+		return nil, err
+	}
+
+	return newT, nil
+}
+
 type getResolutionStepIn struct {
 	PublicID string `path:"id" validate:"required"`
 	StepName string `path:"stepName" validate:"required"`
@@ -722,6 +1031,10 @@ func GetResolutionStep(c *gin.Context, in *getResolutionStepIn) (*step.Step, err
 		r.ClearOutputs()
 	}
 
+	if err := concealSecrets(dbp, r, tt.Name); err != nil {
+		return nil, err
+	}
+
 	if !resolutionManager && !requester && !watcher {
 		metadata.SetSUDO(c)
 	}
@@ -729,6 +1042,88 @@ func GetResolutionStep(c *gin.Context, in *getResolutionStepIn) (*step.Step, err
 	return step, nil
 }
 
+type listResolutionStepAttemptsIn struct {
+	PublicID string `path:"id" validate:"required"`
+	StepName string `path:"stepName" validate:"required"`
+	PageSize uint64 `query:"page_size"`
+	Last     *int64 `query:"last"`
+}
+
+// ListResolutionStepAttempts returns the attempt log of a step, oldest attempts first
+// outputs are only visible to resolution managers and administrators
+func ListResolutionStepAttempts(c *gin.Context, in *listResolutionStepAttemptsIn) ([]*resolution.StepAttempt, error) {
+	metadata.AddActionMetadata(c, metadata.ResolutionID, in.PublicID)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := resolution.LoadFromPublicID(dbp, in.PublicID)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.AddActionMetadata(c, metadata.StepName, in.StepName)
+
+	t, err := task.LoadFromID(dbp, r.TaskID)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.AddActionMetadata(c, metadata.TaskID, t.PublicID)
+
+	tt, err := tasktemplate.LoadFromID(dbp, t.TemplateID)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.AddActionMetadata(c, metadata.TemplateName, tt.Name)
+
+	admin := auth.IsAdmin(c) == nil
+	requester := auth.IsRequester(c, t) == nil
+	watcher := auth.IsWatcher(c, t) == nil
+	resolutionManager := auth.IsResolutionManager(c, tt, t, r) == nil
+
+	if !admin && !requester && !watcher && !resolutionManager {
+		return nil, errors.Forbiddenf("Can't display resolution details")
+	}
+
+	if !resolutionManager && !requester && !watcher {
+		metadata.SetSUDO(c)
+	}
+
+	in.PageSize = normalizePageSize(in.PageSize)
+
+	attempts, err := resolution.ListStepAttempts(dbp, r, in.StepName, in.PageSize, in.Last)
+	if err != nil {
+		return nil, err
+	}
+
+	// the attempts of a step outlive it: the children of a foreach step are
+	// removed from the resolution once contracted, but their attempts are kept
+	if _, ok := r.Steps[in.StepName]; !ok && in.Last == nil && len(attempts) == 0 {
+		return nil, errors.NotFoundf("given stepName %q for this resolution", in.StepName)
+	}
+
+	if !resolutionManager && !admin {
+		for _, a := range attempts {
+			a.ClearOutput()
+		}
+	}
+
+	if uint64(len(attempts)) == in.PageSize {
+		c.Header(
+			linkHeader,
+			buildStepAttemptsNextLink(r.PublicID, in.StepName, in.PageSize, attempts[len(attempts)-1].ID),
+		)
+	}
+
+	c.Header(pageSizeHeader, fmt.Sprintf("%v", in.PageSize))
+
+	return attempts, nil
+}
+
 type updateResolutionStepIn struct {
 	step.Step
 	PublicID string `path:"id" validate:"required"`
@@ -792,6 +1187,7 @@ func UpdateResolutionStep(c *gin.Context, in *updateResolutionStepIn) error {
 
 	metadata.AddActionMetadata(c, metadata.TemplateName, tt.Name)
 
+	oldState := r.Steps[in.StepName].State
 	r.Steps[in.StepName] = &in.Step
 
 	if err := r.Steps[in.StepName].ValidAndNormalize(in.StepName, tt.BaseConfigurations, r.Steps); err != nil {
@@ -811,6 +1207,8 @@ func UpdateResolutionStep(c *gin.Context, in *updateResolutionStepIn) error {
 	}
 
 	logrus.WithFields(logrus.Fields{"resolution_id": r.PublicID}).Debugf("Handler UpdateResolutionStep: manual update of resolution %s step %s", r.PublicID, in.StepName)
+	metadata.AddActionMetadata(c, metadata.OldState, oldState)
+	metadata.AddActionMetadata(c, metadata.NewState, r.Steps[in.StepName].State)
 
 	if err := r.Update(dbp); err != nil {
 		dbp.Rollback()
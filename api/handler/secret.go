@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/loopfz/gadgeto/zesty"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/models/secret"
+	"github.com/ovh/utask/pkg/metadata"
+)
+
+type createSecretIn struct {
+	Name             string   `json:"name" binding:"required"`
+	Description      string   `json:"description"`
+	Value            string   `json:"value" binding:"required"`
+	AllowedTemplates []string `json:"allowed_templates"`
+}
+
+// CreateSecret stores a new encrypted secret, readable by the templates listed in its ACL
+// the secret's value is never returned by the API
+func CreateSecret(c *gin.Context, in *createSecretIn) (*secret.Secret, error) {
+	metadata.AddActionMetadata(c, metadata.SecretName, in.Name)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret.Create(dbp, in.Name, in.Description, in.Value, in.AllowedTemplates)
+}
+
+type listSecretsIn struct {
+	PageSize uint64  `query:"page_size"`
+	Last     *string `query:"last"`
+}
+
+// ListSecrets returns a list of secrets, without their values
+func ListSecrets(c *gin.Context, in *listSecretsIn) ([]*secret.Secret, error) {
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	in.PageSize = normalizePageSize(in.PageSize)
+
+	ss, err := secret.ListSecrets(dbp, in.PageSize, in.Last)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(ss)) == in.PageSize {
+		lastS := ss[len(ss)-1].Name
+		c.Header(
+			linkHeader,
+			buildSecretNextLink(in.PageSize, lastS),
+		)
+	}
+
+	c.Header(pageSizeHeader, fmt.Sprintf("%v", in.PageSize))
+
+	return ss, nil
+}
+
+type getSecretIn struct {
+	Name string `path:"name, required"`
+}
+
+// GetSecret returns the representation of a secret, without its value
+func GetSecret(c *gin.Context, in *getSecretIn) (*secret.Secret, error) {
+	metadata.AddActionMetadata(c, metadata.SecretName, in.Name)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret.LoadFromName(dbp, in.Name)
+}
+
+type updateSecretIn struct {
+	Name             string   `path:"name, required"`
+	Description      *string  `json:"description"`
+	Value            *string  `json:"value"`
+	AllowedTemplates []string `json:"allowed_templates"`
+}
+
+// UpdateSecret changes the value, description or ACL of a secret
+func UpdateSecret(c *gin.Context, in *updateSecretIn) (*secret.Secret, error) {
+	metadata.AddActionMetadata(c, metadata.SecretName, in.Name)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := secret.LoadFromName(dbp, in.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Update(dbp, in.Description, in.Value, in.AllowedTemplates); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type deleteSecretIn struct {
+	Name string `path:"name, required"`
+}
+
+// DeleteSecret removes a secret
+// running tasks which read it will fail on their next templating attempt
+func DeleteSecret(c *gin.Context, in *deleteSecretIn) error {
+	metadata.AddActionMetadata(c, metadata.SecretName, in.Name)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return err
+	}
+
+	s, err := secret.LoadFromName(dbp, in.Name)
+	if err != nil {
+		return err
+	}
+
+	return s.Delete(dbp)
+}
@@ -57,6 +57,10 @@ func CreateTask(c *gin.Context, in *createTaskIn) (*task.Task, error) {
 		return nil, err
 	}
 
+	if err := auth.HasScope(c, auth.CreateTaskScope(tt.Name)); err != nil {
+		return nil, err
+	}
+
 	if err := dbp.Tx(); err != nil {
 		return nil, err
 	}
@@ -92,6 +96,7 @@ func CreateTask(c *gin.Context, in *createTaskIn) (*task.Task, error) {
 	}
 
 	metadata.AddActionMetadata(c, metadata.TaskID, t.PublicID)
+	metadata.AddActionMetadata(c, metadata.NewState, t.State)
 
 	return t, nil
 }
@@ -257,6 +262,70 @@ func GetTask(c *gin.Context, in *getTaskIn) (*task.Task, error) {
 	return t, nil
 }
 
+type getTaskTreeIn struct {
+	PublicID string `path:"id,required"`
+}
+
+// GetTaskTree returns the tree of tasks spawned by subtask and batch steps which includes a task,
+// from its oldest ancestor down to its descendants, with a roll-up of their states
+// the titles of the tasks the caller isn't allowed to view are left out
+func GetTaskTree(c *gin.Context, in *getTaskTreeIn) (*taskutils.TreeNode, error) {
+	metadata.AddActionMetadata(c, metadata.TaskID, in.PublicID)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := task.LoadFromPublicID(dbp, in.PublicID)
+	if err != nil {
+		return nil, err
+	}
+
+	tt, err := tasktemplate.LoadFromID(dbp, t.TemplateID)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.AddActionMetadata(c, metadata.TemplateName, tt.Name)
+
+	var res *resolution.Resolution
+	if t.Resolution != nil {
+		res, err = resolution.LoadFromPublicID(dbp, *t.Resolution)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	admin := auth.IsAdmin(c) == nil
+	requester := auth.IsRequester(c, t) == nil
+	watcher := auth.IsWatcher(c, t) == nil
+	resolutionManager := auth.IsResolutionManager(c, tt, t, res) == nil
+
+	if !admin && !requester && !watcher && !resolutionManager {
+		return nil, errors.Forbiddenf("Can't display task tree")
+	}
+
+	templates := map[int64]*tasktemplate.TaskTemplate{tt.ID: tt}
+	canView := func(nt *task.Task) bool {
+		if admin || auth.IsRequester(c, nt) == nil || auth.IsWatcher(c, nt) == nil {
+			return true
+		}
+		ntt, ok := templates[nt.TemplateID]
+		if !ok {
+			loaded, err := tasktemplate.LoadFromID(dbp, nt.TemplateID)
+			if err != nil {
+				return false
+			}
+			ntt = loaded
+			templates[nt.TemplateID] = ntt
+		}
+		return auth.IsResolutionManager(c, ntt, nt, nil) == nil
+	}
+
+	return taskutils.Tree(dbp, t, canView)
+}
+
 type updateTaskIn struct {
 	PublicID         string                 `path:"id,required"`
 	Input            map[string]interface{} `json:"input"`
@@ -396,6 +465,8 @@ func DeleteTask(c *gin.Context, in *deleteTaskIn) error {
 		return errors.BadRequestf("Task can't be deleted while in state %q", t.State)
 	}
 
+	metadata.AddActionMetadata(c, metadata.OldState, t.State)
+
 	return t.Delete(dbp)
 }
 
@@ -446,6 +517,9 @@ func WontfixTask(c *gin.Context, in *wontfixTaskIn) error {
 		metadata.SetSUDO(c)
 	}
 
+	metadata.AddActionMetadata(c, metadata.OldState, t.State)
+	metadata.AddActionMetadata(c, metadata.NewState, task.StateWontfix)
+
 	t.SetState(task.StateWontfix)
 
 	err = t.Update(dbp,
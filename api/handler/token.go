@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
+	"github.com/loopfz/gadgeto/zesty"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/models/apitoken"
+	"github.com/ovh/utask/pkg/auth"
+	"github.com/ovh/utask/pkg/metadata"
+	"github.com/ovh/utask/pkg/now"
+)
+
+type createTokenIn struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL       string     `json:"ttl"`
+	// service accounts, admin only
+	Owner  *string  `json:"owner"`
+	Groups []string `json:"groups"`
+}
+
+// CreateToken generates a new API token
+// regular users create personal tokens, carrying their current groups
+// admins can also create tokens for service accounts
+// the token's secret is only returned in this response
+func CreateToken(c *gin.Context, in *createTokenIn) (*apitoken.Token, error) {
+	requester := auth.GetIdentity(c)
+	admin := auth.IsAdmin(c) == nil
+
+	owner, groups := requester, auth.GetGroups(c)
+	if in.Owner != nil && *in.Owner != requester {
+		if !admin {
+			return nil, errors.Forbiddenf("Only admin users can create tokens for another owner")
+		}
+		metadata.SetSUDO(c)
+		owner, groups = *in.Owner, in.Groups
+	} else if in.Groups != nil {
+		return nil, errors.BadRequestf("Personal tokens carry the groups of their owner")
+	}
+
+	for _, s := range in.Scopes {
+		if s == auth.ScopeAdmin && !admin {
+			return nil, errors.Forbiddenf("Only admin users can create tokens with the %q scope", auth.ScopeAdmin)
+		}
+	}
+
+	expiresAt := in.ExpiresAt
+	if in.TTL != "" {
+		if expiresAt != nil {
+			return nil, errors.BadRequestf("expires_at and ttl can't be set at the same time")
+		}
+		ttl, err := time.ParseDuration(in.TTL)
+		if err != nil {
+			return nil, errors.NewBadRequest(err, "invalid ttl")
+		}
+		e := now.Get().Add(ttl)
+		expiresAt = &e
+	}
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := apitoken.Create(dbp, in.Name, owner, requester, groups, in.Scopes, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.AddActionMetadata(c, metadata.TokenID, t.PublicID)
+
+	return t, nil
+}
+
+type listTokensIn struct {
+	Owner    *string `query:"owner"`
+	All      bool    `query:"all"`
+	PageSize uint64  `query:"page_size"`
+	Last     *string `query:"last"`
+}
+
+// ListTokens returns the caller's API tokens
+// admins can list the tokens of another owner, or all of them
+func ListTokens(c *gin.Context, in *listTokensIn) ([]*apitoken.Token, error) {
+	requester := auth.GetIdentity(c)
+	owner := &requester
+
+	if in.All || (in.Owner != nil && *in.Owner != requester) {
+		if err := auth.IsAdmin(c); err != nil {
+			return nil, err
+		}
+		metadata.SetSUDO(c)
+		owner = in.Owner
+		if in.All {
+			owner = nil
+		}
+	}
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	in.PageSize = normalizePageSize(in.PageSize)
+
+	tt, err := apitoken.ListTokens(dbp, owner, in.PageSize, in.Last)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(tt)) == in.PageSize {
+		lastT := tt[len(tt)-1].PublicID
+		c.Header(
+			linkHeader,
+			buildTokenNextLink(in.Owner, in.All, in.PageSize, lastT),
+		)
+	}
+
+	c.Header(pageSizeHeader, fmt.Sprintf("%v", in.PageSize))
+
+	return tt, nil
+}
+
+type revokeTokenIn struct {
+	PublicID string `path:"id,required"`
+}
+
+// RevokeToken deletes an API token, its owner or an admin can revoke it
+func RevokeToken(c *gin.Context, in *revokeTokenIn) error {
+	metadata.AddActionMetadata(c, metadata.TokenID, in.PublicID)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return err
+	}
+
+	t, err := apitoken.LoadFromPublicID(dbp, in.PublicID)
+	if err != nil {
+		return err
+	}
+
+	if t.OwnerUsername != auth.GetIdentity(c) {
+		if err := auth.IsAdmin(c); err != nil {
+			return err
+		}
+		metadata.SetSUDO(c)
+	}
+
+	return t.Revoke(dbp)
+}
@@ -3,22 +3,33 @@ package api
 import (
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/juju/errors"
+	"github.com/loopfz/gadgeto/zesty"
 	"github.com/sirupsen/logrus"
 
 	"github.com/ovh/utask"
+	"github.com/ovh/utask/models/apitoken"
 	"github.com/ovh/utask/pkg/auth"
 	"github.com/ovh/utask/pkg/metadata"
+	"github.com/ovh/utask/pkg/utils"
 	"github.com/wI2L/fizz"
 )
 
 var requestIDHeader = http.CanonicalHeaderKey("X-Request-Id")
 
-func auditLogsMiddleware(c *gin.Context) {
+// auditLogsMiddleware logs every request, and records the requests changing something as audit events
+func auditLogsMiddleware(recorder *auditRecorder) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		auditLogs(c, recorder)
+	}
+}
+
+func auditLogs(c *gin.Context, recorder *auditRecorder) {
 	now := time.Now()
 	c.Next()
 	requestDuration := time.Since(now)
@@ -40,12 +51,19 @@ func auditLogsMiddleware(c *gin.Context) {
 		"request_id":      c.Request.Header.Get(requestIDHeader),
 		"log_type":        "api",
 	}
+	var action string
 	if op, _ := fizz.OperationFromContext(c); op != nil {
-		fields["action"] = op.ID
+		action = op.ID
+		fields["action"] = action
 	}
-	if user := c.GetString(auth.IdentityProviderCtxKey); user != "" {
+	user := c.GetString(auth.IdentityProviderCtxKey)
+	if user != "" {
 		fields["user"] = user
 	}
+	tokenID := c.GetString(auth.TokenIDCtxKey)
+	if tokenID != "" {
+		fields["token_id"] = tokenID
+	}
 	for k, v := range metadata.GetActionMetadata(c) {
 		fields["action_metadata_"+k] = v
 	}
@@ -64,6 +82,10 @@ func auditLogsMiddleware(c *gin.Context) {
 		fields["success"] = true
 		logrus.WithFields(fields).Info("success")
 	}
+
+	if action != "" && auditedRequest(c) {
+		recorder.record(newAuditEvent(c, action, user, tokenID))
+	}
 }
 
 func ajaxHeadersMiddleware(c *gin.Context) {
@@ -115,8 +137,104 @@ func groupAuthMiddleware(authProvider func(*http.Request) (string, []string, err
 			}
 			c.Set(auth.IdentityProviderCtxKey, user)
 			c.Set(auth.GroupProviderCtxKey, groups)
+			recordOwnerGroups(user, groups)
 			c.Next()
 		}
 	}
 	return func(c *gin.Context) { c.Next() }
 }
+
+// ownerGroupsCacheSize bounds the number of users whose groups are remembered by an instance
+const ownerGroupsCacheSize = 10000
+
+// ownerGroups holds the groups each user was last recorded with, by this instance
+var ownerGroups = utils.NewLRU[string, string](ownerGroupsCacheSize)
+
+// recordOwnerGroups records the current groups of a user for all instances, so that their personal tokens
+// carrying other groups get revoked. The DB is only queried when the groups of the user changed.
+func recordOwnerGroups(user string, groups []string) {
+	sorted := append([]string{}, groups...)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, "\n")
+
+	if last, seen := ownerGroups.Get(user); seen && last == key {
+		return
+	}
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err == nil {
+		err = apitoken.SetOwnerGroups(dbp, user, sorted)
+	}
+	if err != nil {
+		// try again on the next request
+		logrus.Warnf("Failed to record the groups of %s: %s", user, err)
+		return
+	}
+	ownerGroups.Add(user, key)
+}
+
+// tokenAuthMiddleware authenticates callers presenting an API token as bearer token,
+// and delegates all other requests to the next auth middleware
+func tokenAuthMiddleware(next func(c *gin.Context)) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		header := c.Request.Header.Get("Authorization")
+		if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") || !strings.HasPrefix(strings.TrimSpace(header[7:]), apitoken.Prefix) {
+			next(c)
+			return
+		}
+
+		dbp, err := zesty.NewDBProvider(utask.DBName)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		t, err := apitoken.Authenticate(dbp, strings.TrimSpace(header[7:]))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.IsUnauthorized(err) {
+				status = http.StatusUnauthorized
+			}
+			_ = c.AbortWithError(status, err)
+			return
+		}
+
+		c.Set(auth.IdentityProviderCtxKey, t.OwnerUsername)
+		c.Set(auth.GroupProviderCtxKey, t.Groups)
+		c.Set(auth.ScopesCtxKey, t.Scopes)
+		c.Set(auth.TokenIDCtxKey, t.PublicID)
+		c.Next()
+	}
+}
+
+// tokenScopesMiddleware enforces the scopes of API tokens:
+// - any scope grants read access
+// - creating tasks and batches, or replaying a resolution into a new task, needs a "create-task:<template>" scope,
+// the template being checked by handlers
+// - acting on resolutions and commenting tasks needs the "resolve" scope
+// - everything else needs the "admin" scope
+func tokenScopesMiddleware(c *gin.Context) {
+	if _, restricted := auth.GetScopes(c); !restricted {
+		c.Next()
+		return
+	}
+
+	route := c.FullPath()
+	var err error
+	switch {
+	case c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead:
+	case c.Request.Method == http.MethodPost && (route == "/task" || route == "/batch" || route == "/resolution/:id/replay"):
+		err = auth.HasScopePrefix(c, auth.ScopeCreateTaskPrefix)
+	case strings.HasPrefix(route, "/resolution") || strings.HasPrefix(route, "/task/:id/comment"):
+		err = auth.HasScope(c, auth.ScopeResolve)
+	default:
+		err = auth.HasScope(c, auth.ScopeAdmin)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.Next()
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/ovh/utask/api/handler"
 	"github.com/ovh/utask/db"
 	"github.com/ovh/utask/models/resolution"
+	"github.com/ovh/utask/models/secret"
 	"github.com/ovh/utask/models/task"
 	"github.com/ovh/utask/pkg/auth"
 )
@@ -55,6 +56,7 @@ type Server struct {
 	maxBodyBytes           int64
 	customMiddlewares      []gin.HandlerFunc
 	pluginRoutes           []PluginRouterGroup
+	auditLog               utask.AuditLog
 }
 
 // NewServer returns a new Server
@@ -111,6 +113,11 @@ func (s *Server) SetMaxBodyBytes(max int64) {
 	s.maxBodyBytes = max
 }
 
+// SetAuditLog configures the recording of audit events, and their forwarding to a webhook
+func (s *Server) SetAuditLog(cfg utask.AuditLog) {
+	s.auditLog = cfg
+}
+
 // ListenAndServe launches an http server and stays blocked until
 // the server is shut down by a system signal
 func (s *Server) ListenAndServe() error {
@@ -212,13 +219,15 @@ func (s *Server) build(ctx context.Context) {
 		})
 
 		router.Use(s.customMiddlewares...)
-		router.Use(ajaxHeadersMiddleware, auditLogsMiddleware)
+		router.Use(ajaxHeadersMiddleware, auditLogsMiddleware(newAuditRecorder(ctx, s.auditLog)))
 
 		tonic.SetErrorHook(jujerr.ErrHook)
 		tonic.SetBindHook(defaultBindingHook(s.maxBodyBytes))
 		tonic.SetRenderHook(yamljsonRenderHook, "application/json")
 
-		authRoutes := router.Group("/", "x-misc", "Misc authenticated routes", s.authMiddleware)
+		authMiddleware := tokenAuthMiddleware(s.authMiddleware)
+
+		authRoutes := router.Group("/", "x-misc", "Misc authenticated routes", authMiddleware, tokenScopesMiddleware)
 		{
 			templateRoutes := authRoutes.Group("/", "04 - template", "Manage uTask task templates")
 			{
@@ -252,6 +261,13 @@ func (s *Server) build(ctx context.Context) {
 						fizz.Summary("Get task function details"),
 					},
 					tonic.Handler(handler.GetFunction, 200))
+				functionRoutes.GET("/template-function",
+					[]fizz.OperationOption{
+						fizz.ID("ListTemplateFunctions"),
+						fizz.Summary("List templating functions"),
+						fizz.Description("List the functions available in templates, on top of Golang and Sprig functions, including the ones contributed by plugins"),
+					},
+					tonic.Handler(handler.ListTemplateFunctions, 200))
 			}
 
 			// task
@@ -284,6 +300,13 @@ func (s *Server) build(ctx context.Context) {
 						fizz.Summary("Get task details"),
 					},
 					tonic.Handler(handler.GetTask, 200))
+				taskRoutes.GET("/task/:id/tree",
+					[]fizz.OperationOption{
+						fizz.ID("GetTaskTree"),
+						fizz.Summary("Get the tree of a task's parent and child tasks"),
+						fizz.Description("Tasks spawned by subtask and batch steps, from the oldest ancestor of the task down to its descendants, with the roll-up state of each task and its descendants"),
+					},
+					tonic.Handler(handler.GetTaskTree, 200))
 				taskRoutes.PUT("/task/:id",
 					[]fizz.OperationOption{
 						fizz.ID("EditTask"),
@@ -403,6 +426,14 @@ func (s *Server) build(ctx context.Context) {
 					},
 					maintenanceMode,
 					tonic.Handler(handler.CancelResolution, 204))
+				resolutionRoutes.POST("/resolution/:id/replay",
+					[]fizz.OperationOption{
+						fizz.ID("ReplayTaskResolution"),
+						fizz.Summary("Replay a task's resolution in a new task"),
+						fizz.Description("Creates a new task and resolution from an existing one, with optional input overrides. Idempotent steps in state DONE can be carried over (non-idempotent ones only with force, by admin users). As when creating a task, the requester must be allowed to run tasks from the template."),
+					},
+					maintenanceMode,
+					tonic.Handler(handler.ReplayResolution, 201))
 				resolutionRoutes.GET("/resolution/:id/step/:stepName",
 					[]fizz.OperationOption{
 						fizz.ID("GetTaskResolutionStep"),
@@ -410,6 +441,13 @@ func (s *Server) build(ctx context.Context) {
 						fizz.Description("Returns the current implementation of the step, including the output of the step."),
 					},
 					tonic.Handler(handler.GetResolutionStep, 200))
+				resolutionRoutes.GET("/resolution/:id/step/:stepName/attempts",
+					[]fizz.OperationOption{
+						fizz.ID("ListTaskResolutionStepAttempts"),
+						fizz.Summary("List the attempts of the step of a task resolution"),
+						fizz.Description("Returns the log of the executions of the step, oldest first. Outputs are truncated, and only visible to resolution managers and administrators."),
+					},
+					tonic.Handler(handler.ListResolutionStepAttempts, 200))
 				resolutionRoutes.PUT("/resolution/:id/step/:stepName",
 					[]fizz.OperationOption{
 						fizz.ID("EditTaskResolutionStep"),
@@ -435,6 +473,99 @@ func (s *Server) build(ctx context.Context) {
 				//		tonic.Handler(handler.ResolutionRollback, 200))
 			}
 
+			secretRoutes := authRoutes.Group("/", "06 - secret", "Manage uTask secrets")
+			{
+				secretRoutes.POST("/secret",
+					[]fizz.OperationOption{
+						fizz.ID("CreateSecret"),
+						fizz.Summary("Create a new secret"),
+						fizz.Description("Store an encrypted secret, readable from the templates listed in its ACL. Admin users only."),
+					},
+					requireAdmin,
+					maintenanceMode,
+					tonic.Handler(handler.CreateSecret, 201))
+				secretRoutes.GET("/secret",
+					[]fizz.OperationOption{
+						fizz.ID("ListSecrets"),
+						fizz.Summary("List secrets"),
+						fizz.Description("Secret values are never returned. Admin users only."),
+					},
+					requireAdmin,
+					tonic.Handler(handler.ListSecrets, 200))
+				secretRoutes.GET("/secret/:name",
+					[]fizz.OperationOption{
+						fizz.ID("GetSecret"),
+						fizz.Summary("Get secret details"),
+						fizz.Description("Secret values are never returned. Admin users only."),
+					},
+					requireAdmin,
+					tonic.Handler(handler.GetSecret, 200))
+				secretRoutes.PUT("/secret/:name",
+					[]fizz.OperationOption{
+						fizz.ID("EditSecret"),
+						fizz.Summary("Edit a secret's value, description or ACL"),
+						fizz.Description("Admin users only."),
+					},
+					requireAdmin,
+					maintenanceMode,
+					tonic.Handler(handler.UpdateSecret, 200))
+				secretRoutes.DELETE("/secret/:name",
+					[]fizz.OperationOption{
+						fizz.ID("DeleteSecret"),
+						fizz.Summary("Delete a secret"),
+						fizz.Description("Admin users only."),
+					},
+					requireAdmin,
+					maintenanceMode,
+					tonic.Handler(handler.DeleteSecret, 204))
+			}
+
+			tokenRoutes := authRoutes.Group("/", "07 - token", "Manage uTask API tokens")
+			{
+				tokenRoutes.POST("/token",
+					[]fizz.OperationOption{
+						fizz.ID("CreateToken"),
+						fizz.Summary("Create a new API token"),
+						fizz.Description("The token's secret is only returned once. Admin users can create tokens for service accounts."),
+					},
+					maintenanceMode,
+					tonic.Handler(handler.CreateToken, 201))
+				tokenRoutes.GET("/token",
+					[]fizz.OperationOption{
+						fizz.ID("ListTokens"),
+						fizz.Summary("List API tokens"),
+						fizz.Description("Lists the caller's tokens. Admin users can list the tokens of another owner, or all of them."),
+					},
+					tonic.Handler(handler.ListTokens, 200))
+				tokenRoutes.DELETE("/token/:id",
+					[]fizz.OperationOption{
+						fizz.ID("RevokeToken"),
+						fizz.Summary("Revoke an API token"),
+						fizz.Description("Its owner or an admin user can revoke a token."),
+					},
+					maintenanceMode,
+					tonic.Handler(handler.RevokeToken, 204))
+			}
+
+			auditRoutes := authRoutes.Group("/", "08 - audit", "Query uTask audit events")
+			{
+				auditRoutes.GET("/audit-event",
+					[]fizz.OperationOption{
+						fizz.ID("ListAuditEvents"),
+						fizz.Summary("List audit events"),
+						fizz.Description("Lists the actions performed through the API, most recent first, including those on deleted tasks. Admin rights required"),
+					},
+					requireAdmin,
+					tonic.Handler(handler.ListAuditEvents, 200))
+				auditRoutes.GET("/task/:id/audit-event",
+					[]fizz.OperationOption{
+						fizz.ID("ListTaskAuditEvents"),
+						fizz.Summary("List the audit events of a task"),
+						fizz.Description("Lists the actions performed on a task and its resolution, most recent first"),
+					},
+					tonic.Handler(handler.ListTaskAuditEvents, 200))
+			}
+
 			authRoutes.GET("/",
 				[]fizz.OperationOption{
 					fizz.Summary("Redirect to /meta"),
@@ -486,7 +617,7 @@ func (s *Server) build(ctx context.Context) {
 					routeHandlers = append(routeHandlers, maintenanceMode)
 				}
 				if r.Secured {
-					routeHandlers = append(routeHandlers, s.authMiddleware)
+					routeHandlers = append(routeHandlers, authMiddleware, tokenScopesMiddleware)
 				}
 
 				routeHandlers = append(routeHandlers, r.Handlers...)
@@ -574,5 +705,11 @@ func keyRotate(c *gin.Context) error {
 	if err := task.RotateTasks(dbp); err != nil {
 		return err
 	}
-	return resolution.RotateResolutions(dbp)
+	if err := secret.RotateSecrets(dbp); err != nil {
+		return err
+	}
+	if err := resolution.RotateResolutions(dbp); err != nil {
+		return err
+	}
+	return resolution.RotateStepAttempts(dbp)
 }
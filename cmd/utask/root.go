@@ -27,6 +27,7 @@ import (
 	functionsrunner "github.com/ovh/utask/engine/functions/runner"
 	"github.com/ovh/utask/models/tasktemplate"
 	"github.com/ovh/utask/pkg/auth"
+	"github.com/ovh/utask/pkg/auth/oidc"
 	compress "github.com/ovh/utask/pkg/compress/init"
 	notify "github.com/ovh/utask/pkg/notify/init"
 	"github.com/ovh/utask/pkg/plugins"
@@ -137,12 +138,32 @@ var rootCmd = &cobra.Command{
 		store = configstore.DefaultStore
 		store.InitFromEnvironment()
 
-		defaultAuthHandler, err := basicAuthHandler(store)
+		oidcCfg, err := oidc.LoadConfig(store)
+		if err != nil {
+			return err
+		}
+
+		// the x-remote-user header can't be trusted once tokens are expected
+		defaultAuthHandler, err := basicAuthHandler(store, oidcCfg == nil)
 		if err != nil {
 			return err
 		}
 
 		server = api.NewServer()
+
+		if oidcCfg != nil {
+			oidcProvider, err := oidc.New(context.Background(), *oidcCfg)
+			if err != nil {
+				return err
+			}
+			defaultAuthHandler = oidcProvider.AuthHandler(defaultAuthHandler)
+			if routes := oidcProvider.SessionRoutes(); routes != nil {
+				if err := server.RegisterPluginRoutes(*routes); err != nil {
+					return err
+				}
+			}
+		}
+
 		server.WithGroupAuth(defaultAuthHandler)
 
 		service := &plugins.Service{Store: store, Server: server}
@@ -180,6 +201,7 @@ var rootCmd = &cobra.Command{
 		server.SetDashboardAPIPathPrefix(cfg.DashboardAPIPathPrefix)
 		server.SetDashboardSentryDSN(cfg.DashboardSentryDSN)
 		server.SetMaxBodyBytes(cfg.ServerOptions.MaxBodyBytes)
+		server.SetAuditLog(cfg.AuditLog)
 
 		utask.StepsCompressionAlg = cfg.StepsCompressionAlg
 
@@ -250,9 +272,12 @@ var rootCmd = &cobra.Command{
 // configuration in configstore. If nothing is found, the zero value of a slice
 // is returned (i.e. `nil`).
 //
+// If trustRemoteUser is false, a nil handler is returned instead of the
+// x-remote-user fallback.
+//
 // It is a default implementation which can be overridden by Server.WithAuth or
 // Server.WithGroupAuth functions in api package.
-func basicAuthHandler(store *configstore.Store) (func(*http.Request) (string, []string, error), error) {
+func basicAuthHandler(store *configstore.Store, trustRemoteUser bool) (func(*http.Request) (string, []string, error), error) {
 	userGroupsMap := map[string][]string{}
 	groupsAuthStr, err := configstore.Filter().Slice(groupsAuthKey).Squash().Store(store).MustGetFirstItem().Value()
 	if err == nil {
@@ -289,6 +314,9 @@ func basicAuthHandler(store *configstore.Store) (func(*http.Request) (string, []
 			return user, userGroupsMap[user], nil
 		}, nil
 	}
+	if !trustRemoteUser {
+		return nil, nil
+	}
 	// fallback to expecting a username in x-remote-user header
 	return func(r *http.Request) (string, []string, error) {
 		user := r.Header.Get("x-remote-user")
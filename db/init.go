@@ -12,8 +12,11 @@ import (
 
 	"github.com/ovh/utask"
 	"github.com/ovh/utask/models"
+	"github.com/ovh/utask/models/apitoken"
+	"github.com/ovh/utask/models/auditlog"
 	"github.com/ovh/utask/models/resolution"
 	"github.com/ovh/utask/models/runnerinstance"
+	"github.com/ovh/utask/models/secret"
 	"github.com/ovh/utask/models/task"
 	"github.com/ovh/utask/models/tasktemplate"
 	"github.com/ovh/utask/pkg/now"
@@ -40,7 +43,11 @@ var schema = []tableModel{
 	{task.Comment{}, "task_comment", []string{"id"}, true},
 	{task.BatchDBModel{}, "batch", []string{"id"}, true},
 	{resolution.DBModel{}, "resolution", []string{"id"}, true},
+	{resolution.StepAttempt{}, "resolution_step_attempt", []string{"id"}, true},
 	{runnerinstance.Instance{}, "runner_instance", []string{"id"}, true},
+	{secret.Secret{}, "secret", []string{"id"}, true},
+	{apitoken.Token{}, "api_token", []string{"id"}, true},
+	{auditlog.Event{}, "audit_event", []string{"id"}, true},
 }
 
 // RegisterTableModel registers a new table model
@@ -69,6 +76,7 @@ func Init(store *configstore.Store) error {
 	if err != nil {
 		return err
 	}
+	connString = dbConn
 
 	if cfg == nil {
 		cfg = &utask.DatabaseConfig{}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// ResolutionChannel is the postgres channel on which resolution insertions and state
+// changes are notified, with a JSON payload holding the resolution's public ID and state
+const ResolutionChannel = "utask_resolution"
+
+const (
+	listenerMinReconnectInterval = time.Second
+	listenerMaxReconnectInterval = time.Minute
+)
+
+// connection string of the database registered by Init, reused to open listeners
+var connString string
+
+// NewListener opens a dedicated connection to the database registered by Init,
+// and listens for notifications on the given channels
+func NewListener(channels ...string) (*pq.Listener, error) {
+	if connString == "" {
+		return nil, errors.New("database is not initialized")
+	}
+
+	l := pq.NewListener(connString, listenerMinReconnectInterval, listenerMaxReconnectInterval, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logrus.Warnf("Database listener: %s", err)
+		}
+	})
+
+	for _, channel := range channels {
+		if err := l.Listen(channel); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
@@ -19,11 +19,11 @@ func AutorunCollector(ctx context.Context) error {
 		return err
 	}
 
-	sl := newSleeper()
+	sl := newSleeper(autorunWakeup)
 
 	go func() {
 		for running := true; running; {
-			sl.sleep()
+			wokenUp := sl.sleep()
 
 			select {
 			case <-ctx.Done():
@@ -32,6 +32,7 @@ func AutorunCollector(ctx context.Context) error {
 				r, _ := getUpdateAutorunResolution(dbp)
 				if r != nil {
 					sl.wakeup()
+					observePickup(autorunCollectorName, r.PublicID, wokenUp)
 					logrus.WithFields(logrus.Fields{
 						"resolution_id": r.PublicID,
 						"log_type":      "engine",
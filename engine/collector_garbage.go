@@ -8,6 +8,8 @@ import (
 	"github.com/loopfz/gadgeto/zesty"
 	"github.com/ovh/utask"
 	"github.com/ovh/utask/db/pgjuju"
+	"github.com/ovh/utask/models/auditlog"
+	"github.com/ovh/utask/models/resolution"
 	"github.com/ovh/utask/models/task"
 	"github.com/ovh/utask/pkg/now"
 )
@@ -18,8 +20,9 @@ const (
 )
 
 // GarbageCollector launches a process that cleans up finished tasks
-// (ie are in a final state) older than a given threshold
-func GarbageCollector(ctx context.Context, completedTaskExpiration string) error {
+// (ie are in a final state) and step attempts older than a given threshold,
+// as well as audit events older than their retention period
+func GarbageCollector(ctx context.Context, completedTaskExpiration string, auditLogRetention time.Duration) error {
 	dbp, err := zesty.NewDBProvider(utask.DBName)
 	if err != nil {
 		return err
@@ -60,6 +63,48 @@ func GarbageCollector(ctx context.Context, completedTaskExpiration string) error
 		}
 	}()
 
+	// delete old step attempts, those of running tasks included
+	go func() {
+		// Run it immediately and wait for new tick
+		if err := resolution.DeleteOldStepAttempts(dbp, threshold); err != nil {
+			log.Printf("GarbageCollector: failed to trash old step attempts: %s", err)
+		}
+
+		for running := true; running; {
+			time.Sleep(sleepDuration)
+
+			select {
+			case <-ctx.Done():
+				running = false
+			default:
+				if err := resolution.DeleteOldStepAttempts(dbp, threshold); err != nil {
+					log.Printf("GarbageCollector: failed to trash old step attempts: %s", err)
+				}
+			}
+		}
+	}()
+
+	// delete old audit events, regardless of the tasks they refer to
+	go func() {
+		// Run it immediately and wait for new tick
+		if err := auditlog.DeleteOldEvents(dbp, auditLogRetention); err != nil {
+			log.Printf("GarbageCollector: failed to trash old audit events: %s", err)
+		}
+
+		for running := true; running; {
+			time.Sleep(sleepDuration)
+
+			select {
+			case <-ctx.Done():
+				running = false
+			default:
+				if err := auditlog.DeleteOldEvents(dbp, auditLogRetention); err != nil {
+					log.Printf("GarbageCollector: failed to trash old audit events: %s", err)
+				}
+			}
+		}
+	}()
+
 	// delete un-referenced batches
 	go func() {
 		// Run it immediately and wait for new tick
@@ -31,19 +31,26 @@ func InstanceCollector(ctx context.Context, maxConcurrentExecutions int, waitDur
 
 	go func() {
 		// Start immediately
-		if err := collect(dbp, sm, waitDuration); err != nil {
+		if err := collect(dbp, sm, waitDuration, false); err != nil {
 			log.Printf("InstanceCollector: failed to collect resolution: %s", err)
 		}
 
 		for running := true; running; {
-			// wake up every minute
-			time.Sleep(time.Minute)
+			// wake up every minute, or when notified of crashed resolutions
+			wokenUp := false
+			t := time.NewTimer(time.Minute)
+			select {
+			case <-t.C:
+			case <-instanceWakeup:
+				wokenUp = true
+			}
+			t.Stop()
 
 			select {
 			case <-ctx.Done():
 				running = false
 			default:
-				if err := collect(dbp, sm, waitDuration); err != nil {
+				if err := collect(dbp, sm, waitDuration, wokenUp); err != nil {
 					log.Printf("InstanceCollector: failed to collect resolution: %s", err)
 				}
 			}
@@ -53,7 +60,7 @@ func InstanceCollector(ctx context.Context, maxConcurrentExecutions int, waitDur
 	return nil
 }
 
-func collect(dbp zesty.DBProvider, sm *semaphore.Weighted, waitDuration time.Duration) error {
+func collect(dbp zesty.DBProvider, sm *semaphore.Weighted, waitDuration time.Duration, wokenUp bool) error {
 	// get a list of all instances
 	instances, err := runnerinstance.ListInstances(dbp)
 	if err != nil {
@@ -74,6 +81,7 @@ func collect(dbp zesty.DBProvider, sm *semaphore.Weighted, waitDuration time.Dur
 				} else {
 					// run found resolution
 					log.WithFields(logrus.Fields{"resolution_id": r.PublicID}).Debugf("collected crashed resolution %s", r.PublicID)
+					observePickup(instanceCollectorName, r.PublicID, wokenUp)
 					_ = GetEngine().Resolve(r.PublicID, sm)
 
 					// waiting between two resolve, so others instances can also select tasks
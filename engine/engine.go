@@ -24,6 +24,7 @@ import (
 	"github.com/ovh/utask/engine/values"
 	"github.com/ovh/utask/models/resolution"
 	"github.com/ovh/utask/models/runnerinstance"
+	"github.com/ovh/utask/models/secret"
 	"github.com/ovh/utask/models/task"
 	"github.com/ovh/utask/models/tasktemplate"
 	"github.com/ovh/utask/pkg/jsonschema"
@@ -132,8 +133,14 @@ func Init(ctx context.Context, wg *sync.WaitGroup, store *configstore.Store) err
 	// perform administration chores, so collectors are switched off
 	if !utask.FMaintenanceMode {
 
-		// init garbage collector (delete tasks completed more than x time ago (x from global config) + delete orphaned batches)
-		if err := GarbageCollector(ctx, cfg.CompletedTaskExpiration); err != nil {
+		// init garbage collector (delete tasks completed more than x time ago (x from global config) + old audit events + delete orphaned batches)
+		if err := GarbageCollector(ctx, cfg.CompletedTaskExpiration, cfg.AuditLog.RetentionDuration); err != nil {
+			return err
+		}
+		// wake up collectors upon database notifications, polling remains as a fallback
+		listenNotifications(ctx)
+		// expose the amount of resolutions waiting to be collected, if enabled
+		if err := collectQueueDepth(ctx, cfg.QueueDepthIntervalDuration); err != nil {
 			return err
 		}
 		// init autorun collector (create resolution + run for tasks with state == autorun)
@@ -309,10 +316,13 @@ func initialize(dbp zesty.DBProvider, publicID string, debugLogger *logrus.Entry
 		}
 		fallthrough
 	default:
+		// runs waking up polling steps don't count against the max number of runs
+		if !isPolling(res) {
+			res.IncrementRunCount()
+		}
 		res.SetState(resolution.StateRunning)
 		res.SetInstanceID(utask.InstanceID)
 		res.SetLastStart(now.Get())
-		res.IncrementRunCount()
 	}
 
 	if err := res.Update(dbp); err != nil {
@@ -375,6 +385,12 @@ func initialize(dbp zesty.DBProvider, publicID string, debugLogger *logrus.Entry
 	res.Values.SetResolverInput(res.ResolverInput)
 	res.Values.SetVariables(tt.Variables)
 
+	secrets, err := secret.LoadValuesForTemplate(dbp, tt.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	res.Values.SetSecrets(secrets)
+
 	return res, t, nil
 }
 
@@ -409,7 +425,8 @@ forLoop:
 				if v == "" {
 					delete(t.Tags, k)
 				} else {
-					t.Tags[k] = v
+					// conceal secrets which might have leaked into the tags
+					t.Tags[k] = res.Values.ConcealString(v)
 				}
 			}
 
@@ -435,6 +452,8 @@ forLoop:
 			}
 			step.AfterRun(s, res.Values, resolutionStateSetter(res, modifiedSteps))
 			pruneSteps(res, modifiedSteps)
+			observeStep(t.TemplateName, s)
+			recordStepAttempt(dbp, res, s, debugLogger)
 
 			// loop step: kept in the "available" pool, to collect children's results
 			if s.ForEach == "" {
@@ -484,12 +503,17 @@ forLoop:
 
 	// review all step states, collect potential resolution states
 	mapStatus := map[string]bool{}
-	for _, s := range res.Steps {
+	progress := foreachProgresses(res)
+	for name, s := range res.Steps {
+		if p, ok := progress[name]; ok && p.name != name && p.tolerates(s) {
+			// failures tolerated by a loop step are accounted for by the loop step itself
+			continue
+		}
 		switch s.State {
 		case step.StateClientError:
 			mapStatus[resolution.StateBlockedBadRequest] = true
 			allDone = false
-		case step.StateFatalError:
+		case step.StateFatalError, step.StateFailureThresholdExceeded:
 			mapStatus[resolution.StateBlockedFatal] = true
 			allDone = false
 		case step.StateServerError, step.StateToRetry, step.StateAfterrunError:
@@ -527,7 +551,8 @@ forLoop:
 					for name, s := range res.Steps {
 						// Steps using the batch plugin shouldn't be run again when WAITING. Running them second time
 						// may lead to a race condition when the last task of a sub-batch tries to resume its parent
-						if s.State == step.StateWaiting && s.Action.Type != pluginbatch.Plugin.PluginName() {
+						// Polling steps wait for their next poll
+						if s.State == step.StateWaiting && s.Action.Type != pluginbatch.Plugin.PluginName() && !s.IsPolling() {
 							delete(executedSteps, name)
 						}
 					}
@@ -551,6 +576,10 @@ forLoop:
 		if err := t.SetResult(res.Values); err != nil {
 			debugLogger.Debugf("Engine: resolve() %s loop, task SetResult error: %s", res.PublicID, err)
 		}
+		// conceal secrets which might have leaked into the task's result
+		if result, ok := res.Values.Conceal(t.Result).(map[string]interface{}); ok {
+			t.Result = result
+		}
 
 		// register task duration statistics
 		task.RegisterTaskTime(t.TemplateName, t.DBModel.Created, res.Created)
@@ -567,6 +596,10 @@ forLoop:
 		}
 	case resolution.StateWaiting:
 		t.SetState(task.StateWaiting)
+		if next := nextPoll(res); next != nil {
+			// steps waiting for their next poll wake the resolution up
+			res.NextRetry = next
+		}
 	case resolution.StateToAutorunDelayed:
 		t.SetState(task.StateDelayed)
 	case resolution.StateBlockedBadRequest, resolution.StateBlockedFatal, resolution.StateBlockedDeadlock:
@@ -639,6 +672,31 @@ func wakeParentTask(dbp zesty.DBProvider, currentTask *task.Task, debugLogger *l
 	return nil
 }
 
+// recordStepAttempt appends the last execution of a step to its attempt log, with the state given by its check conditions
+// the log is informative, a failure to record an attempt doesn't interrupt the resolution
+func recordStepAttempt(dbp zesty.DBProvider, res *resolution.Resolution, s *step.Step, debugLogger *logrus.Entry) {
+	attempt := resolution.NewStepAttempt(res, s)
+	if attempt == nil {
+		return
+	}
+	// conceal secrets which might have leaked into the step's results
+	attempt.Output = res.Values.ConcealString(attempt.Output)
+	attempt.Error = res.Values.ConcealString(attempt.Error)
+	sp, err := dbp.TxSavepoint()
+	if err != nil {
+		debugLogger.Debugf("Engine: resolve() %s loop, failed to record attempt of step %s: %s", res.PublicID, s.Name, err)
+		return
+	}
+	if err := attempt.Insert(dbp); err != nil {
+		dbp.RollbackTo(sp)
+		debugLogger.Debugf("Engine: resolve() %s loop, failed to record attempt of step %s: %s", res.PublicID, s.Name, err)
+		return
+	}
+	if err := dbp.Commit(); err != nil {
+		debugLogger.Debugf("Engine: resolve() %s loop, failed to record attempt of step %s: %s", res.PublicID, s.Name, err)
+	}
+}
+
 func commit(dbp zesty.DBProvider, res *resolution.Resolution, t *task.Task) error {
 	sp, err := dbp.TxSavepoint()
 	defer dbp.RollbackTo(sp)
@@ -674,7 +732,7 @@ func runAvailableSteps(dbp zesty.DBProvider, modifiedSteps map[string]bool, res
 			if s.ForEach != "" { // loop step
 				// run "skip" step conditions in step in in todo or to_retry
 				switch s.State {
-				case step.StateTODO, step.StateToRetry:
+				case step.StateTODO, step.StateToRetry, step.StateFailureThresholdExceeded:
 					step.PreRun(s, res.Values, resolutionStateSetter(res, preRunModifiedSteps), executedSteps)
 					_ = commit(dbp, res, nil)
 				}
@@ -684,7 +742,7 @@ func runAvailableSteps(dbp zesty.DBProvider, modifiedSteps map[string]bool, res
 					expanded++
 					expandStep(s, res)
 					expandedSteps = append(expandedSteps, s.ChildrenSteps...)
-				case step.StateToRetry:
+				case step.StateToRetry, step.StateFailureThresholdExceeded:
 					// attempt contracting step, clean up any children steps
 					// any available children have been ignored by availableSteps()
 					if s.ChildrenSteps != nil && len(s.ChildrenSteps) > 0 {
@@ -696,8 +754,20 @@ func runAvailableSteps(dbp zesty.DBProvider, modifiedSteps map[string]bool, res
 						expandedSteps = append(expandedSteps, s.ChildrenSteps...)
 					}
 				case step.StateExpanded:
-					contractStep(s, res)
-					res.SetStepState(s.Name, step.StateDone)
+					total := len(s.ChildrenSteps)
+					failed := contractStep(s, res)
+					if s.ForEachFailureThreshold != "" {
+						s.Metadata = map[string]interface{}{
+							"failed_children": failed,
+							"total_children":  total,
+						}
+					}
+					if failed > 0 && s.FailureThresholdExceeded(failed, total) {
+						s.Error = fmt.Sprintf("%d out of %d children failed, exceeding failure threshold %s", failed, total, s.ForEachFailureThreshold)
+						res.SetStepState(s.Name, step.StateFailureThresholdExceeded)
+					} else {
+						res.SetStepState(s.Name, step.StateDone)
+					}
 				default:
 					// if the ForEach task is in another state, we do nothing, but need to return the step in the stepChan
 					// otherwise the task will wait infinitely for this step
@@ -762,6 +832,9 @@ func expandStep(s *step.Step, res *resolution.Resolution) {
 		s.Error = err.Error()
 		return
 	}
+	if s.ForEachChunkSize > 0 {
+		items = chunkItems(items, s.ForEachChunkSize)
+	}
 
 	var previousChildStepName string
 	// generate all children steps
@@ -799,12 +872,18 @@ func expandStep(s *step.Step, res *resolution.Resolution) {
 			CustomStates: customStates,
 			Conditions:   conditions,
 			Resources:    resources,
+			Until:        s.Until,
 			Item:         item,
 		}
 
 		if s.ForEachStrategy == step.ForEachStrategySequence {
 			if previousChildStepName != "" {
-				res.Steps[childStepName].Dependencies = append(res.Steps[childStepName].Dependencies, previousChildStepName)
+				previousDependency := previousChildStepName
+				if s.ForEachFailureThreshold != "" {
+					// a tolerated failure doesn't stop the sequence
+					previousDependency = fmt.Sprintf("%s:%s,%s,%s", previousChildStepName, step.StateDone, step.StateClientError, step.StateFatalError)
+				}
+				res.Steps[childStepName].Dependencies = append(res.Steps[childStepName].Dependencies, previousDependency)
 			}
 
 			previousChildStepName = childStepName
@@ -824,32 +903,21 @@ func expandStep(s *step.Step, res *resolution.Resolution) {
 	res.SetStepState(s.Name, step.StateExpanded)
 }
 
-func contractStep(s *step.Step, res *resolution.Resolution) {
+// contractStep collects the results of a loop step's children and removes them from the resolution,
+// returning how many of them failed
+func contractStep(s *step.Step, res *resolution.Resolution) int {
 	// collect results, metadata and errors
 	collectedChildren := []interface{}{}
+	failed := 0
 	for _, childStepName := range s.ChildrenSteps {
 		child, ok := res.Steps[childStepName]
 		res.ForeachChildrenAlreadyContracted[childStepName] = true
 		if ok {
+			if child.IsFailedChild() {
+				failed++
+			}
 			if child.State != step.StatePrune {
-				childM := map[string]interface{}{}
-				if child.Output != nil {
-					childM[values.OutputKey] = child.Output
-				}
-				var childMetadata map[string]interface{}
-				if child.Metadata != nil {
-					childMetadata, _ = child.Metadata.(map[string]interface{})
-				}
-				if childMetadata == nil {
-					childMetadata = make(map[string]interface{})
-				}
-
-				childMetadata[values.IteratorKey] = make(map[string]interface{})
-				childMetadata[values.IteratorKey] = child.Item
-				childM[values.MetadataKey] = childMetadata
-				childM[values.StateKey] = child.State
-				var i interface{} = childM
-				collectedChildren = append(collectedChildren, i)
+				collectedChildren = append(collectedChildren, collectChild(s, child)...)
 			}
 			delete(res.Steps, childStepName)
 		}
@@ -868,6 +936,105 @@ func contractStep(s *step.Step, res *resolution.Resolution) {
 	s.Dependencies = cleanDependencies
 	s.ChildrenSteps = nil
 	s.ChildrenStepMap = nil
+	return failed
+}
+
+// chunkItems groups the items of a loop step into lists of at most size items, in their original order
+func chunkItems(items []interface{}, size int) []interface{} {
+	chunks := make([]interface{}, 0, (len(items)+size-1)/size)
+	for start := 0; start < len(items); start += size {
+		end := min(start+size, len(items))
+		chunks = append(chunks, items[start:end])
+	}
+	return chunks
+}
+
+// collectChild returns the results of a loop step's child, as collected into the loop step's children
+// a chunk of items is flattened back into one result per item: an output listing one element per item
+// is split between them, any other output is shared by all the items of the chunk
+func collectChild(s *step.Step, child *step.Step) []interface{} {
+	chunk, ok := child.Item.([]interface{})
+	if s.ForEachChunkSize == 0 || !ok {
+		return []interface{}{childResult(child, child.Output, child.Item)}
+	}
+
+	outputs, split := child.Output.([]interface{})
+	split = split && len(outputs) == len(chunk)
+	results := make([]interface{}, 0, len(chunk))
+	for i, item := range chunk {
+		output := child.Output
+		if split {
+			output = outputs[i]
+		}
+		results = append(results, childResult(child, output, item))
+	}
+	return results
+}
+
+// childResult returns the output, metadata and state of a loop step's child for one of its items
+func childResult(child *step.Step, output interface{}, item interface{}) interface{} {
+	childM := map[string]interface{}{}
+	if output != nil {
+		childM[values.OutputKey] = output
+	}
+	childMetadata := make(map[string]interface{})
+	if m, ok := child.Metadata.(map[string]interface{}); ok {
+		for k, v := range m {
+			childMetadata[k] = v
+		}
+	}
+	childMetadata[values.IteratorKey] = item
+	childM[values.MetadataKey] = childMetadata
+	childM[values.StateKey] = child.State
+	return childM
+}
+
+// foreachProgress tracks the children of an expanded loop step which bounds its concurrency or tolerates failures
+type foreachProgress struct {
+	name       string
+	loop       *step.Step
+	inProgress int
+	failed     int
+}
+
+// foreachProgresses returns the progress of the bounded loop steps of a resolution,
+// indexed by the names of the loop steps and of their children
+func foreachProgresses(res *resolution.Resolution) map[string]*foreachProgress {
+	progress := map[string]*foreachProgress{}
+	for name, s := range res.Steps {
+		if s.ForEach == "" || s.State != step.StateExpanded || (s.ForEachConcurrency == 0 && s.ForEachFailureThreshold == "") {
+			continue
+		}
+		p := &foreachProgress{name: name, loop: s}
+		progress[name] = p
+		for _, childStepName := range s.ChildrenSteps {
+			child, ok := res.Steps[childStepName]
+			if !ok {
+				continue
+			}
+			progress[childStepName] = p
+			if child.IsFailedChild() {
+				p.failed++
+			} else if child.IsInProgressChild() {
+				p.inProgress++
+			}
+		}
+	}
+	return progress
+}
+
+// exceeded asserts that the loop step gave up on its children, too many of them having failed
+func (p *foreachProgress) exceeded() bool {
+	return p.loop.ForEachFailureThreshold != "" && p.loop.FailureThresholdExceeded(p.failed, len(p.loop.ChildrenSteps))
+}
+
+// tolerates asserts that the loop step doesn't need to wait on a child anymore:
+// either the child is over, or it failed within the failure threshold, or the loop gave up and the child is not running
+func (p *foreachProgress) tolerates(child *step.Step) bool {
+	if p.loop.ForEachFailureThreshold == "" {
+		return false
+	}
+	return child.IsFinal() || child.IsFailedChild() || (p.exceeded() && child.State != step.StateRunning)
 }
 
 func pruneSteps(res *resolution.Resolution, modifiedSteps map[string]bool) {
@@ -955,6 +1122,23 @@ func availableSteps(modifiedSteps map[string]bool, res *resolution.Resolution, e
 		candidateSteps[s] = struct{}{}
 	}
 
+	// children of a loop step with a bounded concurrency wait for a free slot rather than for a dependency:
+	// when one of them changes, the ones which were not started yet are reconsidered
+	progress := foreachProgresses(res)
+	reconsideredLoops := map[*step.Step]bool{}
+	for modifStep := range modifiedSteps {
+		p, ok := progress[modifStep]
+		if !ok || p.name == modifStep || reconsideredLoops[p.loop] {
+			continue
+		}
+		reconsideredLoops[p.loop] = true
+		for _, childStepName := range p.loop.ChildrenSteps {
+			if child, ok := res.Steps[childStepName]; ok && child.State == step.StateTODO {
+				candidateSteps[childStepName] = struct{}{}
+			}
+		}
+	}
+
 	// look for runnable steps among candidates
 	// make sure their dependencies are met
 	available := make(map[string]*step.Step)
@@ -968,6 +1152,14 @@ func availableSteps(modifiedSteps map[string]bool, res *resolution.Resolution, e
 		if executedSteps[name] {
 			continue
 		}
+		if s.IsPolling() && s.NextPoll().After(time.Now()) {
+			// too early for the next poll
+			continue
+		}
+		if p, ok := progress[name]; ok && p.name != name && p.exceeded() {
+			// too many children failed, the loop step gave up on the others
+			continue
+		}
 		eligible := true // eligible unless dependencies are not met
 		for _, dep := range s.Dependencies {
 			depStep, depStates := step.DependencyParts(dep)
@@ -1005,6 +1197,12 @@ func availableSteps(modifiedSteps map[string]bool, res *resolution.Resolution, e
 				continue
 			}
 
+			// a loop step tolerating failures doesn't wait on its failed children
+			if p, ok := progress[name]; ok && p.name == name &&
+				s.ChildrenStepMap[depStep] && p.tolerates(res.Steps[depStep]) {
+				continue
+			}
+
 			// in every other case, an unmet dependency
 			eligible = false
 			break
@@ -1027,6 +1225,24 @@ func availableSteps(modifiedSteps map[string]bool, res *resolution.Resolution, e
 		}
 	}
 
+	// loop steps with a bounded concurrency only start as many children as they have free slots,
+	// in the order of their items
+	for name, p := range progress {
+		if p.name != name || p.loop.ForEachConcurrency == 0 {
+			continue
+		}
+		free := p.loop.ForEachConcurrency - p.inProgress
+		for _, ch := range p.loop.ChildrenSteps {
+			if s, ok := available[ch]; ok && s.State == step.StateTODO {
+				if free > 0 {
+					free--
+				} else {
+					delete(available, ch)
+				}
+			}
+		}
+	}
+
 	recap := make([]string, 0)
 	for av, stp := range available {
 		recap = append(recap, fmt.Sprintf("step %s = %s", av, stp.State))
@@ -1079,6 +1295,38 @@ func nextRetry(res *resolution.Resolution) *time.Time {
 	return &nextRetry
 }
 
+// isPolling asserts that a resolution is only waiting for the next poll of some of its steps
+func isPolling(res *resolution.Resolution) bool {
+	if res.State != resolution.StateWaiting {
+		return false
+	}
+	polling := false
+	for _, s := range res.Steps {
+		if s.State != step.StateWaiting {
+			continue
+		}
+		if !s.IsPolling() {
+			return false
+		}
+		polling = true
+	}
+	return polling
+}
+
+// nextPoll returns when the earliest of the polling steps of a resolution should run again, nil if no step is polling
+func nextPoll(res *resolution.Resolution) *time.Time {
+	var next *time.Time
+	for _, s := range res.Steps {
+		if !s.IsPolling() {
+			continue
+		}
+		if t := s.NextPoll(); next == nil || t.Before(*next) {
+			next = &t
+		}
+	}
+	return next
+}
+
 func minDuration(a, b time.Duration) time.Duration {
 	if a < b {
 		return a
@@ -34,9 +34,11 @@ import (
 	"github.com/ovh/utask/engine/step/executor"
 	"github.com/ovh/utask/engine/values"
 	"github.com/ovh/utask/models/resolution"
+	"github.com/ovh/utask/models/secret"
 	"github.com/ovh/utask/models/task"
 	"github.com/ovh/utask/models/tasktemplate"
 	compress "github.com/ovh/utask/pkg/compress/init"
+	"github.com/ovh/utask/pkg/constants"
 	"github.com/ovh/utask/pkg/now"
 	"github.com/ovh/utask/pkg/plugins"
 	pluginbatch "github.com/ovh/utask/pkg/plugins/builtin/batch"
@@ -347,6 +349,39 @@ func TestStepMaxRetries(t *testing.T) {
 	assert.Equal(t, step.StateFatalError, res.Steps["stepOne"].State)
 }
 
+func TestStepAttempts(t *testing.T) {
+	res, err := createResolution("stepMaxRetries.yaml", map[string]interface{}{}, nil)
+	require.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		res, err = runResolution(res)
+		require.Nil(t, err)
+	}
+	assert.Equal(t, 2, res.Steps["stepOne"].TryCount)
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	require.Nil(t, err)
+
+	// the last run doesn't execute the action, having reached max retries
+	attempts, err := resolution.ListStepAttempts(dbp, res, "stepOne", 10, nil)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(attempts))
+	for i, a := range attempts {
+		assert.Equal(t, i+1, a.TryCount)
+		assert.Equal(t, "echo", a.Plugin)
+		assert.Equal(t, step.StateServerError, a.State)
+		assert.Equal(t, "server error", a.Error)
+		assert.NotEmpty(t, a.ConfigHash)
+		assert.False(t, a.End.Before(a.Start))
+	}
+	assert.Equal(t, attempts[0].ConfigHash, attempts[1].ConfigHash)
+
+	attempts, err = resolution.ListStepAttempts(dbp, res, "stepOne", 10, &attempts[0].ID)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(attempts))
+	assert.Equal(t, 2, attempts[0].TryCount)
+}
+
 func TestLintingAndValidation(t *testing.T) {
 	expectedResult := map[string]struct {
 		nilResolution bool
@@ -896,6 +931,149 @@ func TestForeachWithErrors(t *testing.T) {
 	assert.Equal(t, resolution.StateBlockedFatal, res.State)
 }
 
+func TestForeachFailureThreshold(t *testing.T) {
+	res, err := createResolution("foreachThreshold.yaml", map[string]interface{}{
+		"list": []interface{}{"a", "bad", "c", "d"},
+	}, nil)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateDone, res.State)
+
+	for _, name := range []string{"boundedLoop", "sequenceLoop"} {
+		s := res.Steps[name]
+		assert.Equal(t, step.StateDone, s.State, name)
+		require.Len(t, s.Children, 4, name)
+		assert.Equal(t, step.StateClientError, s.Children[1].(map[string]interface{})[values.StateKey], name)
+		assert.Equal(t, step.StateDone, s.Children[3].(map[string]interface{})[values.StateKey], name)
+		metadata, ok := s.Metadata.(map[string]interface{})
+		require.True(t, ok, name)
+		assert.EqualValues(t, 1, metadata["failed_children"], name)
+		assert.EqualValues(t, 4, metadata["total_children"], name)
+	}
+
+	res, err = createResolution("foreachThreshold.yaml", map[string]interface{}{
+		"list": []interface{}{"a", "bad", "bad", "d"},
+	}, nil)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateBlockedFatal, res.State)
+
+	for _, name := range []string{"boundedLoop", "sequenceLoop"} {
+		s := res.Steps[name]
+		assert.Equal(t, step.StateFailureThresholdExceeded, s.State, name)
+		assert.Contains(t, s.Error, "exceeding failure threshold", name)
+	}
+}
+
+func TestForeachChunk(t *testing.T) {
+	res, err := createResolution("foreachChunk.yaml", map[string]interface{}{
+		"list": []interface{}{"a", "b", "c", "d", "e"},
+	}, nil)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateDone, res.State)
+
+	prefixed := res.Steps["prefixChunks"].Children
+	require.Len(t, prefixed, 5)
+	counted := res.Steps["countChunks"].Children
+	require.Len(t, counted, 5)
+	for i, item := range []string{"a", "b", "c", "d", "e"} {
+		child := prefixed[i].(map[string]interface{})
+		assert.Equal(t, "pre-"+item, child[values.OutputKey])
+		assert.Equal(t, item, child[values.MetadataKey].(map[string]interface{})[values.IteratorKey])
+		assert.Equal(t, step.StateDone, child[values.StateKey])
+
+		expectedCount := "2"
+		if item == "e" {
+			expectedCount = "1"
+		}
+		child = counted[i].(map[string]interface{})
+		assert.Equal(t, map[string]interface{}{"count": expectedCount}, child[values.OutputKey])
+	}
+}
+
+func TestUntil(t *testing.T) {
+	res, err := createResolution("until.yaml", map[string]interface{}{"status": "ready"}, nil)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateDone, res.State)
+	assert.Equal(t, step.StateDone, res.Steps["pollReady"].State)
+	assert.Equal(t, 1, res.Steps["pollReady"].PollCount)
+	assert.Equal(t, step.StateDone, res.Steps["afterReady"].State)
+
+	res, err = createResolution("until.yaml", map[string]interface{}{"status": "pending"}, nil)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateWaiting, res.State)
+	require.NotNil(t, res.NextRetry)
+	assert.True(t, res.NextRetry.After(res.Steps["pollReady"].LastRun))
+	assert.Equal(t, step.StateWaiting, res.Steps["pollReady"].State)
+	assert.Equal(t, 0, res.Steps["pollReady"].TryCount)
+	assert.Equal(t, 1, res.Steps["pollReady"].PollCount)
+	assert.Contains(t, res.Steps["pollReady"].Metadata, step.PollCountKey)
+	assert.Equal(t, step.StateTODO, res.Steps["afterReady"].State)
+	runMax := res.RunMax
+
+	// too early for the next poll
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateWaiting, res.State)
+	assert.Equal(t, 1, res.Steps["pollReady"].PollCount)
+
+	time.Sleep(time.Second)
+
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateWaiting, res.State)
+	assert.Equal(t, 2, res.Steps["pollReady"].PollCount)
+	assert.Equal(t, 0, res.Steps["pollReady"].TryCount)
+	// polls don't count against the max number of runs
+	assert.Equal(t, 1, res.RunCount)
+	assert.Equal(t, runMax, res.RunMax)
+}
+
+func TestSecretConcealedInResult(t *testing.T) {
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	require.Nil(t, err)
+
+	_, err = secret.Create(dbp, "engine-result-token", "", "hunter2", []string{"secretresult"})
+	require.Nil(t, err)
+
+	res, err := runTask("secretResult.yaml", map[string]interface{}{}, nil)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateDone, res.State)
+
+	tt, err := task.LoadFromID(dbp, res.TaskID)
+	require.Nil(t, err)
+	assert.Equal(t, values.ConcealedValue, tt.Result["revealed"])
+	assert.Equal(t, values.ConcealedValue, tt.Tags["token"])
+	// the resolution keeps the real value for the steps relying on it
+	assert.Equal(t, "hunter2", res.Steps["tagStep"].Tags["token"])
+}
+
 func TestVariables(t *testing.T) {
 	res, err := createResolution("variables.yaml", map[string]interface{}{}, nil)
 	assert.NotNil(t, res)
@@ -1219,6 +1397,24 @@ func TestScriptPluginEnvironmentVariables(t *testing.T) {
 	assert.Equal(t, "bar", environment["variable_value"])
 }
 
+func TestScriptPluginInlineContent(t *testing.T) {
+	res, err := createResolution("execScriptInline.yaml", map[string]interface{}{}, nil)
+	assert.NotNil(t, res)
+	assert.Nil(t, err)
+
+	res, err = runResolution(res)
+	assert.NotNil(t, res)
+	assert.Nil(t, err)
+
+	assert.Equal(t, step.StateDone, res.State)
+	assert.Equal(t, step.StateDone, res.Steps["stepOne"].State)
+
+	output := res.Steps["stepOne"].Output.(map[string]interface{})
+	assert.Equal(t, "bar", output["variable_value"])
+	assert.Equal(t, "baz", output["env_value"])
+	assert.Equal(t, "stepOne", output["step"])
+}
+
 func TestBaseBaseConfiguration(t *testing.T) {
 	res, err := createResolution("base_configuration.yaml", nil, nil)
 	assert.NotNil(t, res)
@@ -1319,6 +1515,216 @@ func TestResolveSubTask(t *testing.T) {
 	assert.Equal(t, resolution.StateDone, res.State)
 }
 
+func TestSubTaskTree(t *testing.T) {
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	require.Nil(t, err)
+
+	_, err = templateFromYAML(dbp, "variables.yaml")
+	require.Nil(t, err)
+
+	res, err := createResolution("subtask.yaml", map[string]interface{}{}, nil)
+	require.Nil(t, err, "failed to create resolution: %s", err)
+
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateWaiting, res.State)
+
+	parent, err := task.LoadFromID(dbp, res.TaskID)
+	require.Nil(t, err)
+
+	subtaskPublicID := res.Steps["jsonInputSubtask"].Output.(map[string]interface{})["id"].(string)
+	subtask, err := task.LoadFromPublicID(dbp, subtaskPublicID)
+	require.Nil(t, err)
+
+	viewAll := func(*task.Task) bool { return true }
+
+	// the tree is rooted on the parent, whichever task it's requested for
+	tree, err := taskutils.Tree(dbp, subtask, viewAll)
+	require.Nil(t, err)
+	assert.Equal(t, parent.PublicID, tree.ID)
+	assert.Equal(t, parent.StepsTotal, tree.StepsTotal)
+	assert.Equal(t, parent.State, tree.RollupState)
+	require.Len(t, tree.Children, 3)
+
+	steps := map[string]string{}
+	for _, c := range tree.Children {
+		steps[c.ID] = c.ParentStep
+		assert.Equal(t, task.StateTODO, c.RollupState)
+		assert.NotEmpty(t, c.Title)
+	}
+	for _, name := range []string{"subtaskCreation", "jsonInputSubtask", "templatingJsonInputSubtask"} {
+		id := res.Steps[name].Output.(map[string]interface{})["id"].(string)
+		assert.Equal(t, name, steps[id])
+	}
+
+	// a blocked child blocks the whole tree
+	subtask.SetState(task.StateBlocked)
+	require.Nil(t, subtask.Update(dbp, true, true))
+
+	tree, err = taskutils.Tree(dbp, parent, func(nt *task.Task) bool { return nt.ID == parent.ID })
+	require.Nil(t, err)
+	assert.Equal(t, task.StateBlocked, tree.RollupState)
+	assert.Equal(t, []string{subtaskPublicID}, tree.BlockedTasks)
+	assert.NotEmpty(t, tree.Title)
+	for _, c := range tree.Children {
+		assert.Empty(t, c.Title)
+	}
+}
+
+func TestSubTaskCascadeCancel(t *testing.T) {
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	require.Nil(t, err)
+
+	_, err = templateFromYAML(dbp, "variables.yaml")
+	require.Nil(t, err)
+	_, err = templateFromYAML(dbp, "input.yaml")
+	require.Nil(t, err)
+
+	res, err := createResolution("subtask.yaml", map[string]interface{}{}, nil)
+	require.Nil(t, err, "failed to create resolution: %s", err)
+
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateWaiting, res.State)
+
+	parent, err := task.LoadFromID(dbp, res.TaskID)
+	require.Nil(t, err)
+
+	require.Nil(t, taskutils.CascadeCancel(dbp, parent, res, "admin"))
+
+	for _, subtaskName := range []string{"subtaskCreation", "jsonInputSubtask", "templatingJsonInputSubtask"} {
+		subtaskPublicID := res.Steps[subtaskName].Output.(map[string]interface{})["id"].(string)
+		subtask, err := task.LoadFromPublicID(dbp, subtaskPublicID)
+		require.Nil(t, err)
+		assert.Equal(t, task.StateCancelled, subtask.State)
+
+		comments, err := task.LoadCommentsFromTaskID(dbp, subtask.ID)
+		require.Nil(t, err)
+		contents := map[string]string{}
+		for _, c := range comments {
+			contents[c.Content] = c.Username
+		}
+		assert.Equal(t, "admin", contents["cancelled along with parent task "+parent.PublicID])
+	}
+}
+
+func TestSubTaskChildrenPolicy(t *testing.T) {
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	require.Nil(t, err)
+
+	_, err = templateFromYAML(dbp, "variables.yaml")
+	require.Nil(t, err)
+	_, err = templateFromYAML(dbp, "input.yaml")
+	require.Nil(t, err)
+
+	res, err := createResolution("subtaskChildrenPolicy.yaml", map[string]interface{}{}, nil)
+	require.Nil(t, err, "failed to create resolution: %s", err)
+
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateWaiting, res.State)
+
+	parent, err := task.LoadFromID(dbp, res.TaskID)
+	require.Nil(t, err)
+
+	detached, err := task.LoadFromPublicID(dbp, res.Steps["detachedSubtask"].Output.(map[string]interface{})["id"].(string))
+	require.Nil(t, err)
+	guarded, err := task.LoadFromPublicID(dbp, res.Steps["guardedSubtask"].Output.(map[string]interface{})["id"].(string))
+	require.Nil(t, err)
+
+	// the guarded subtask prevents its parent from being interrupted while it's not done
+	err = taskutils.CascadePause(dbp, parent, res, "admin", false)
+	assert.True(t, errors.IsBadRequest(err), "unexpected error: %s", err)
+	err = taskutils.CascadeCancel(dbp, parent, res, "admin")
+	assert.True(t, errors.IsBadRequest(err), "unexpected error: %s", err)
+
+	guarded.SetState(task.StateDone)
+	require.Nil(t, guarded.Update(dbp, true, true))
+
+	// the detached subtask keeps running, and doesn't refer to its cancelled parent anymore
+	require.Nil(t, taskutils.CascadeCancel(dbp, parent, res, "admin"))
+
+	detached, err = task.LoadFromPublicID(dbp, detached.PublicID)
+	require.Nil(t, err)
+	assert.Equal(t, task.StateTODO, detached.State)
+	assert.NotContains(t, detached.Tags, constants.SubtaskTagParentTaskID)
+
+	comments, err := task.LoadCommentsFromTaskID(dbp, detached.ID)
+	require.Nil(t, err)
+	contents := []string{}
+	for _, c := range comments {
+		contents = append(contents, c.Content)
+	}
+	assert.Contains(t, contents, "detached from parent task "+parent.PublicID+", which was cancelled")
+
+	children, err := task.ListChildren(dbp, parent.PublicID)
+	require.Nil(t, err)
+	require.Len(t, children, 1)
+	assert.Equal(t, guarded.PublicID, children[0].PublicID)
+}
+
+func TestSubTaskCascadePauseResume(t *testing.T) {
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	require.Nil(t, err)
+
+	_, err = templateFromYAML(dbp, "variables.yaml")
+	require.Nil(t, err)
+	_, err = templateFromYAML(dbp, "input.yaml")
+	require.Nil(t, err)
+
+	res, err := createResolution("subtask.yaml", map[string]interface{}{}, nil)
+	require.Nil(t, err, "failed to create resolution: %s", err)
+
+	res, err = runResolution(res)
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, resolution.StateWaiting, res.State)
+
+	parent, err := task.LoadFromID(dbp, res.TaskID)
+	require.Nil(t, err)
+
+	subtask, err := task.LoadFromPublicID(dbp, res.Steps["subtaskCreation"].Output.(map[string]interface{})["id"].(string))
+	require.Nil(t, err)
+	subtaskResolution, err := resolution.Create(dbp, subtask, nil, "", false, nil)
+	require.Nil(t, err)
+
+	// a running child is only paused by a forced pause
+	subtaskResolution.SetState(resolution.StateRunning)
+	require.Nil(t, subtaskResolution.Update(dbp))
+	err = taskutils.CascadePause(dbp, parent, res, "admin", false)
+	assert.True(t, errors.IsBadRequest(err), "unexpected error: %s", err)
+	require.Nil(t, taskutils.CascadePause(dbp, parent, res, "admin", true))
+
+	subtaskResolution, err = resolution.LoadFromPublicID(dbp, subtaskResolution.PublicID)
+	require.Nil(t, err)
+	assert.Equal(t, resolution.StatePaused, subtaskResolution.State)
+	subtask, err = task.LoadFromPublicID(dbp, subtask.PublicID)
+	require.Nil(t, err)
+	assert.Equal(t, parent.PublicID, subtask.Tags[constants.SubtaskTagPausedWithParentTaskID])
+
+	// the child is resumed along with its parent
+	require.Nil(t, taskutils.CascadeResume(dbp, parent, "admin"))
+
+	subtaskResolution, err = resolution.LoadFromPublicID(dbp, subtaskResolution.PublicID)
+	require.Nil(t, err)
+	assert.Equal(t, resolution.StateToAutorun, subtaskResolution.State)
+	subtask, err = task.LoadFromPublicID(dbp, subtask.PublicID)
+	require.Nil(t, err)
+	assert.NotContains(t, subtask.Tags, constants.SubtaskTagPausedWithParentTaskID)
+
+	comments, err := task.LoadCommentsFromTaskID(dbp, subtask.ID)
+	require.Nil(t, err)
+	contents := []string{}
+	for _, c := range comments {
+		contents = append(contents, c.Content)
+	}
+	assert.Contains(t, contents, "paused along with parent task "+parent.PublicID)
+	assert.Contains(t, contents, "resumed along with parent task "+parent.PublicID)
+}
+
 func TestResolveSubTaskParentTaskPaused(t *testing.T) {
 	dbp, err := zesty.NewDBProvider(utask.DBName)
 	require.Nil(t, err)
@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/loopfz/gadgeto/zesty"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/engine/step"
+	"github.com/ovh/utask/models/resolution"
+)
+
+// names of the collectors, as exposed in metrics
+const (
+	autorunCollectorName  = "autorun"
+	retryCollectorName    = "retry"
+	instanceCollectorName = "instance"
+
+	pickupSourceNotify = "notify"
+	pickupSourcePoll   = "poll"
+)
+
+var (
+	collectorPickups       = promauto.NewCounterVec(prometheus.CounterOpts{Name: "utask_collector_pickups_total"}, []string{"collector", "source"})
+	collectorPickupLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{Name: "utask_collector_pickup_latency_seconds", Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120}}, []string{"collector"})
+	collectorQueueDepth    = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "utask_collector_queue_depth"}, []string{"collector"})
+
+	stepExecutionTimes = promauto.NewHistogramVec(prometheus.HistogramOpts{Name: "utask_step_execution_seconds", Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}}, []string{"plugin", "template", "step"})
+	stepOutcomes       = promauto.NewCounterVec(prometheus.CounterOpts{Name: "utask_step_outcomes_total"}, []string{"plugin", "template", "step", "state"})
+	stepRetries        = promauto.NewCounterVec(prometheus.CounterOpts{Name: "utask_step_retries_total"}, []string{"plugin", "template", "step"})
+)
+
+// observePickup records the collection of a resolution by a collector,
+// and the latency since its notification, if any
+func observePickup(collector, publicID string, wokenUp bool) {
+	source := pickupSourcePoll
+	if wokenUp {
+		source = pickupSourceNotify
+	}
+	collectorPickups.WithLabelValues(collector, source).Inc()
+
+	notifiedMu.Lock()
+	t, ok := notified[publicID]
+	delete(notified, publicID)
+	notifiedMu.Unlock()
+
+	if ok {
+		collectorPickupLatency.WithLabelValues(collector).Observe(time.Since(t).Seconds())
+	}
+}
+
+// observeStep records the outcome of a step's run, and the duration of its action's execution
+func observeStep(templateName string, s *step.Step) {
+	if s.ForEach != "" {
+		// loop steps are accounted for through their children
+		return
+	}
+
+	plugin, duration := s.LastExecution()
+	if plugin == "" {
+		// action was not executed (skipped, pre-hook failure, ...)
+		plugin = s.Action.Type
+	}
+
+	// foreach children share the metrics of their parent step
+	stepName := s.Name
+	if s.IsChild() {
+		if i := strings.LastIndex(stepName, "-"); i > 0 {
+			stepName = stepName[:i]
+		}
+	}
+
+	stepOutcomes.WithLabelValues(plugin, templateName, stepName, s.State).Inc()
+
+	if duration > 0 {
+		stepExecutionTimes.WithLabelValues(plugin, templateName, stepName).Observe(duration.Seconds())
+		if s.TryCount > 1 {
+			stepRetries.WithLabelValues(plugin, templateName, stepName).Inc()
+		}
+	}
+}
+
+// queueDepthQueries count the resolutions waiting to be picked up by each collector
+var queueDepthQueries = []struct {
+	collector string
+	query     string
+	params    []interface{}
+}{
+	{
+		collector: autorunCollectorName,
+		query:     `SELECT COUNT(id) FROM "resolution" WHERE state = $1`,
+		params:    []interface{}{resolution.StateToAutorun},
+	},
+	{
+		collector: retryCollectorName,
+		query: `SELECT COUNT(id) FROM "resolution"
+			WHERE ((state = $1 OR state = $2) AND next_retry < NOW()) OR
+				  (state = $3 AND next_retry > last_start AND next_retry < NOW())`,
+		params: []interface{}{resolution.StateError, resolution.StateToAutorunDelayed, resolution.StateWaiting},
+	},
+	{
+		collector: instanceCollectorName,
+		query:     `SELECT COUNT(id) FROM "resolution" WHERE state = $1`,
+		params:    []interface{}{resolution.StateCrashed},
+	},
+}
+
+func updateQueueDepth(dbp zesty.DBProvider) {
+	for _, q := range queueDepthQueries {
+		count, err := dbp.DB().SelectInt(q.query, q.params...)
+		if err != nil {
+			logrus.Warnf("Failed to compute the queue depth of collector %s: %s", q.collector, err)
+			continue
+		}
+		collectorQueueDepth.WithLabelValues(q.collector).Set(float64(count))
+	}
+}
+
+// collectQueueDepth periodically measures how many resolutions are waiting to be collected,
+// counting them in DB: as every instance runs these queries, they are only enabled through configuration
+func collectQueueDepth(ctx context.Context, interval time.Duration) error {
+	if interval == 0 {
+		return nil
+	}
+
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return err
+	}
+
+	tick := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-tick.C:
+				updateQueueDepth(dbp)
+			case <-ctx.Done():
+				tick.Stop()
+				return
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ovh/utask/db"
+	"github.com/ovh/utask/models/resolution"
+	"github.com/ovh/utask/models/runnerinstance"
+)
+
+const (
+	listenerPingInterval = 90 * time.Second
+	notifiedExpiration   = 10 * time.Minute
+)
+
+var (
+	// wakeup channels of the collectors, signaled upon database notifications
+	autorunWakeup  = make(chan struct{}, 1)
+	retryWakeup    = make(chan struct{}, 1)
+	instanceWakeup = make(chan struct{}, 1)
+
+	// reception time of the latest notification for a resolution, to measure pickup latency
+	notified   = map[string]time.Time{}
+	notifiedMu sync.Mutex
+)
+
+type resolutionNotification struct {
+	ID        string     `json:"id"`
+	State     string     `json:"state"`
+	NextRetry *time.Time `json:"next_retry"`
+}
+
+// listenNotifications wakes up the collectors when the database notifies that a resolution
+// became collectable. If notifications can't be received, collectors keep on polling the database.
+func listenNotifications(ctx context.Context) {
+	l, err := db.NewListener(db.ResolutionChannel)
+	if err != nil {
+		logrus.Warnf("Unable to listen to database notifications, collectors will only poll: %s", err)
+		return
+	}
+
+	go func() {
+		defer l.Close()
+
+		ticker := time.NewTicker(listenerPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-l.Notify:
+				handleNotification(n)
+			case <-ticker.C:
+				go func() { _ = l.Ping() }()
+				pruneNotified()
+			}
+		}
+	}()
+}
+
+func handleNotification(n *pq.Notification) {
+	if n == nil {
+		// connection was re-established, notifications might have been missed
+		signal(autorunWakeup)
+		signal(retryWakeup)
+		signal(instanceWakeup)
+		return
+	}
+
+	var rn resolutionNotification
+	if err := json.Unmarshal([]byte(n.Extra), &rn); err != nil {
+		logrus.Warnf("Invalid database notification %q: %s", n.Extra, err)
+		return
+	}
+
+	switch rn.State {
+	case resolution.StateToAutorun:
+		recordNotified(rn.ID)
+		signal(autorunWakeup)
+	case resolution.StateRetry:
+		recordNotified(rn.ID)
+		signal(retryWakeup)
+	case resolution.StateError, resolution.StateWaiting, resolution.StateToAutorunDelayed:
+		// only collectable once their next_retry is reached
+		if rn.NextRetry == nil {
+			return
+		}
+		delay := time.Until(*rn.NextRetry)
+		if delay > notifiedExpiration {
+			// far ahead: left to the polling of the collector
+			return
+		}
+		time.AfterFunc(delay, func() {
+			recordNotified(rn.ID)
+			signal(retryWakeup)
+		})
+	case resolution.StateCrashed:
+		// resolutions are set as crashed by instances shutting down, which will
+		// only be considered dead once they've missed their heartbeats
+		recordNotified(rn.ID)
+		time.AfterFunc(2*runnerinstance.HeartbeatInterval+time.Second, func() { signal(instanceWakeup) })
+	}
+}
+
+// signal wakes up a collector, without blocking if it is already signaled
+func signal(c chan<- struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func recordNotified(publicID string) {
+	notifiedMu.Lock()
+	defer notifiedMu.Unlock()
+	notified[publicID] = time.Now()
+}
+
+func pruneNotified() {
+	notifiedMu.Lock()
+	defer notifiedMu.Unlock()
+	for id, t := range notified {
+		if time.Since(t) > notifiedExpiration {
+			delete(notified, id)
+		}
+	}
+}
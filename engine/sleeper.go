@@ -4,19 +4,39 @@ import "time"
 
 type sleeper struct {
 	sleepCount int
+	notify     <-chan struct{}
 }
 
-func newSleeper() *sleeper {
-	return &sleeper{}
+// newSleeper returns a sleeper whose naps can be interrupted by the notify channel (optional)
+func newSleeper(notify <-chan struct{}) *sleeper {
+	return &sleeper{notify: notify}
 }
 
-func (s *sleeper) sleep() {
+// sleep waits for a delay increasing with the number of consecutive naps,
+// it returns true if the nap was interrupted by a notification
+func (s *sleeper) sleep() bool {
+	var d time.Duration
 	if s.sleepCount >= 10 {
-		time.Sleep(time.Second * 10)
+		d = time.Second * 10
 	} else {
-		time.Sleep(time.Second * time.Duration(s.sleepCount))
+		d = time.Second * time.Duration(s.sleepCount)
 		s.sleepCount++
 	}
+
+	if s.notify == nil {
+		time.Sleep(d)
+		return false
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return false
+	case <-s.notify:
+		return true
+	}
 }
 
 func (s *sleeper) wakeup() {
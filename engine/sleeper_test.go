@@ -0,0 +1,24 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSleeperNotify(t *testing.T) {
+	notify := make(chan struct{}, 1)
+	sl := newSleeper(notify)
+	assert.False(t, sl.sleep())
+	assert.False(t, sl.sleep())
+
+	signal(notify)
+	signal(notify) // already signaled, should not block
+	before := time.Now()
+	assert.True(t, sl.sleep())
+	assert.True(t, time.Since(before) < time.Second)
+
+	sl.wakeup()
+	assert.False(t, sl.sleep())
+}
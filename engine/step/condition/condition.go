@@ -31,12 +31,15 @@ type (
 	// an expected value is compared through an operator
 	// the intent of this condition can be explained through a contextual message
 	// for clearer error surfacing
+	// with the "cel" engine, the value and the expected value are CEL expressions instead of templates,
+	// and the operator can be omitted for a value evaluating to a boolean, asserted to be true
 	Assert struct {
 		Value         string `json:"value"`
 		Operator      string `json:"operator"`
 		Expected      string `json:"expected"`
 		ListSeparator string `json:"list_separator"`
 		Message       string `json:"message"`
+		Engine        string `json:"engine,omitempty"`
 	}
 
 	// ErrConditionNotMet is the typed error returned by Condition when its evaluation fails
@@ -46,6 +49,9 @@ type (
 // Eval applies a condition on a particular item, asserting if the item meets the condition or not
 func (a *Assert) Eval(v *values.Values, item interface{}, stepName string) error {
 	if a != nil {
+		if a.Engine == values.ExpressionEngineCEL {
+			return a.evalCEL(v, item, stepName)
+		}
 		val, err := v.Apply(a.Value, item, stepName)
 		if err != nil {
 			return err
@@ -57,59 +63,87 @@ func (a *Assert) Eval(v *values.Values, item interface{}, stepName string) error
 		valStr := strings.Replace(string(val), "<no value>", "", -1)
 		expStr := strings.Replace(string(expected), "<no value>", "", -1)
 
-		switch strings.ToUpper(a.Operator) { // normalized operator, accept both lower case and upper case from template
-		case EQ:
-			if valStr != expStr {
-				return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected '%s', got '%s': %s", expStr, valStr, a.Message))
-			}
-		case NE:
-			if valStr == expStr {
-				return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected a value different from '%s': %s", expStr, a.Message))
-			}
-		case GT, LT, GE, LE:
-			valInt, err := strconv.ParseInt(valStr, 10, 32)
-			if err != nil {
-				return err
-			}
-			expInt, err := strconv.ParseInt(expStr, 10, 32)
-			if err != nil {
-				return err
-			}
-			switch a.Operator {
-			case GT:
-				if valInt <= expInt {
-					return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %d > %d: %s", valInt, expInt, a.Message))
-				}
-			case LT:
-				if valInt >= expInt {
-					return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %d < %d: %s", valInt, expInt, a.Message))
-				}
-			case GE:
-				if valInt < expInt {
-					return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %d >= %d: %s", valInt, expInt, a.Message))
-				}
-			case LE:
-				if valInt > expInt {
-					return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %d <= %d: %s", valInt, expInt, a.Message))
-				}
-			}
-		case REGEXP:
-			if !regexp.MustCompile(expStr).MatchString(valStr) {
-				return ErrConditionNotMet(fmt.Sprintf("Condition not met: %s does not match regular expression %s", valStr, expStr))
+		return a.compare(valStr, expStr)
+	}
+	return nil
+}
+
+func (a *Assert) evalCEL(v *values.Values, item interface{}, stepName string) error {
+	val, err := v.EvalCEL(a.Value, item, stepName, 0)
+	if err != nil {
+		return err
+	}
+	if a.Operator == "" {
+		b, ok := val.(bool)
+		if !ok {
+			return errors.BadRequestf("CEL expression %q returned %v, expected a boolean", a.Value, val)
+		}
+		if !b {
+			return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %s: %s", a.Value, a.Message))
+		}
+		return nil
+	}
+	expected, err := v.EvalCEL(a.Expected, item, stepName, 0)
+	if err != nil {
+		return err
+	}
+	return a.compare(values.CELString(val), values.CELString(expected))
+}
+
+// compare applies the operator of the condition on a value and an expected value
+func (a *Assert) compare(valStr, expStr string) error {
+	switch strings.ToUpper(a.Operator) { // normalized operator, accept both lower case and upper case from template
+	case EQ:
+		if valStr != expStr {
+			return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected '%s', got '%s': %s", expStr, valStr, a.Message))
+		}
+	case NE:
+		if valStr == expStr {
+			return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected a value different from '%s': %s", expStr, a.Message))
+		}
+	case GT, LT, GE, LE:
+		valInt, err := strconv.ParseInt(valStr, 10, 32)
+		if err != nil {
+			return err
+		}
+		expInt, err := strconv.ParseInt(expStr, 10, 32)
+		if err != nil {
+			return err
+		}
+		switch a.Operator {
+		case GT:
+			if valInt <= expInt {
+				return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %d > %d: %s", valInt, expInt, a.Message))
 			}
-		case NOTREGEXP:
-			if regexp.MustCompile(expStr).MatchString(valStr) {
-				return ErrConditionNotMet(fmt.Sprintf("Condition not met: %s match regular expression %s and expected that it shouldn't", valStr, expStr))
+		case LT:
+			if valInt >= expInt {
+				return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %d < %d: %s", valInt, expInt, a.Message))
 			}
-		case IN:
-			if !matchList(valStr, expStr, a.ListSeparator) {
-				return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %s to be found in list of acceptable values", valStr))
+		case GE:
+			if valInt < expInt {
+				return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %d >= %d: %s", valInt, expInt, a.Message))
 			}
-		case NOTIN:
-			if matchList(valStr, expStr, a.ListSeparator) {
-				return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %s not to be found in list of unacceptable values", valStr))
+		case LE:
+			if valInt > expInt {
+				return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %d <= %d: %s", valInt, expInt, a.Message))
 			}
 		}
+	case REGEXP:
+		if !regexp.MustCompile(expStr).MatchString(valStr) {
+			return ErrConditionNotMet(fmt.Sprintf("Condition not met: %s does not match regular expression %s", valStr, expStr))
+		}
+	case NOTREGEXP:
+		if regexp.MustCompile(expStr).MatchString(valStr) {
+			return ErrConditionNotMet(fmt.Sprintf("Condition not met: %s match regular expression %s and expected that it shouldn't", valStr, expStr))
+		}
+	case IN:
+		if !matchList(valStr, expStr, a.ListSeparator) {
+			return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %s to be found in list of acceptable values", valStr))
+		}
+	case NOTIN:
+		if matchList(valStr, expStr, a.ListSeparator) {
+			return ErrConditionNotMet(fmt.Sprintf("Condition not met: expected %s not to be found in list of unacceptable values", valStr))
+		}
 	}
 	return nil
 }
@@ -118,9 +152,27 @@ func (a *Assert) Eval(v *values.Values, item interface{}, stepName string) error
 // ie. the operator is among the accepted values listed above
 func (a *Assert) Valid() error {
 	if a != nil {
+		switch a.Engine {
+		case "":
+		case values.ExpressionEngineCEL:
+			if err := values.CheckCEL(a.Value); err != nil {
+				return errors.NewBadRequest(err, "Invalid CEL value")
+			}
+			if a.Operator == "" {
+				return nil
+			}
+			if err := values.CheckCEL(a.Expected); err != nil {
+				return errors.NewBadRequest(err, "Invalid CEL expected value")
+			}
+		default:
+			return errors.BadRequestf("Unknown condition engine: %s", a.Engine)
+		}
 		switch strings.ToUpper(a.Operator) {
 		case EQ, NE, GT, LT, GE, LE, IN, NOTIN:
 		case REGEXP, NOTREGEXP:
+			if a.Engine == values.ExpressionEngineCEL {
+				break
+			}
 			if _, err := regexp.Compile(a.Expected); err != nil {
 				return err
 			}
@@ -46,6 +46,7 @@ const (
 	OutputStrategynone OutputStrategy = iota
 	OutputStrategymerge
 	OutputStrategytemplate
+	OutputStrategyjq
 )
 
 type Output struct {
@@ -12,12 +12,14 @@ var (
 		"OutputStrategynone":     OutputStrategynone,
 		"OutputStrategymerge":    OutputStrategymerge,
 		"OutputStrategytemplate": OutputStrategytemplate,
+		"OutputStrategyjq":       OutputStrategyjq,
 	}
 
 	_OutputStrategyValueToName = map[OutputStrategy]string{
 		OutputStrategynone:     "OutputStrategynone",
 		OutputStrategymerge:    "OutputStrategymerge",
 		OutputStrategytemplate: "OutputStrategytemplate",
+		OutputStrategyjq:       "OutputStrategyjq",
 	}
 )
 
@@ -28,6 +30,7 @@ func init() {
 			interface{}(OutputStrategynone).(fmt.Stringer).String():     OutputStrategynone,
 			interface{}(OutputStrategymerge).(fmt.Stringer).String():    OutputStrategymerge,
 			interface{}(OutputStrategytemplate).(fmt.Stringer).String(): OutputStrategytemplate,
+			interface{}(OutputStrategyjq).(fmt.Stringer).String():       OutputStrategyjq,
 		}
 	}
 }
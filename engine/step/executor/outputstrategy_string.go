@@ -11,11 +11,12 @@ func _() {
 	_ = x[OutputStrategynone-0]
 	_ = x[OutputStrategymerge-1]
 	_ = x[OutputStrategytemplate-2]
+	_ = x[OutputStrategyjq-3]
 }
 
-const _OutputStrategy_name = "nonemergetemplate"
+const _OutputStrategy_name = "nonemergetemplatejq"
 
-var _OutputStrategy_index = [...]uint8{0, 4, 9, 17}
+var _OutputStrategy_index = [...]uint8{0, 4, 9, 17, 19}
 
 func (i OutputStrategy) String() string {
 	if i < 0 || i >= OutputStrategy(len(_OutputStrategy_index)-1) {
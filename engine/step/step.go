@@ -3,10 +3,13 @@ package step
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -51,6 +54,8 @@ const (
 
 	// steps that carry a foreach list of arguments
 	StateExpanded = "EXPANDED"
+	// foreach steps whose failed children exceeded the failure threshold
+	StateFailureThresholdExceeded = "FAILURE_THRESHOLD_EXCEEDED"
 )
 
 const (
@@ -62,9 +67,10 @@ const (
 )
 
 var (
-	builtinStates            = []string{StateTODO, StateWaiting, StateRunning, StateDone, StateClientError, StateServerError, StateFatalError, StateCrashed, StatePrune, StateToRetry, StateRetryNow, StateAfterrunError, StateAny, StateExpanded}
+	builtinStates            = []string{StateTODO, StateWaiting, StateRunning, StateDone, StateClientError, StateServerError, StateFatalError, StateCrashed, StatePrune, StateToRetry, StateRetryNow, StateAfterrunError, StateAny, StateExpanded, StateFailureThresholdExceeded}
 	stepConditionValidStates = []string{StateDone, StatePrune, StateToRetry, StateRetryNow, StateFatalError, StateClientError}
-	runnableStates           = []string{StateTODO, StateServerError, StateClientError, StateFatalError, StateCrashed, StateToRetry, StateRetryNow, StateAfterrunError, StateExpanded, StateWaiting} // everything but RUNNING, DONE, PRUNE
+	runnableStates           = []string{StateTODO, StateServerError, StateClientError, StateFatalError, StateCrashed, StateToRetry, StateRetryNow, StateAfterrunError, StateExpanded, StateWaiting, StateFailureThresholdExceeded} // everything but RUNNING, DONE, PRUNE
+	failedChildStates        = []string{StateClientError, StateFatalError}
 	retriableStates          = []string{StateServerError, StateToRetry, StateAfterrunError}
 	validAfterRunStates      = []string{StateDone, StateClientError, StateAfterrunError}
 )
@@ -78,7 +84,10 @@ var (
 // without blocking).
 // Through the "foreach" parameter, a step can be configured to spawn sub-steps for a list of items:
 // the result of such a step will be the collection of results of all sub-steps, which can be fed
-// into another "foreach" step
+// into another "foreach" step. The number of sub-steps running at once can be bounded, and a number
+// of failed sub-steps can be tolerated before the step itself is considered as failed
+// Items can also be grouped into chunks, each sub-step iterating over a list of items
+// Through the "until" parameter, a step can be configured to poll: its action is run again until its result meets a condition
 // A step can be configured to evaluate "conditions" before and after the action is performed:
 //   - a "skip" condition will be run before and might determine that the step's action can be skipped entirely
 //   - a "check" condition will be run after the action, and can control execution flow by examining
@@ -111,16 +120,33 @@ type Step struct {
 	CustomStates []string               `json:"custom_states,omitempty"`
 	Conditions   []*condition.Condition `json:"conditions,omitempty"`
 	skipped      bool
+	// polling
+	Until     *Until     `json:"until,omitempty"`
+	PollCount int        `json:"poll_count,omitempty"`
+	PollStart *time.Time `json:"poll_start,omitempty"`
 	// loop
-	ForEach         string          `json:"foreach,omitempty"` // "parent" step: expression for list of items
-	ForEachStrategy string          `json:"foreach_strategy"`
-	ChildrenSteps   []string        `json:"children_steps,omitempty"` // list of children names
-	ChildrenStepMap map[string]bool `json:"children_steps_map,omitempty"`
-	Item            interface{}     `json:"item,omitempty"` // "child" step: item value, issued from foreach
+	ForEach                 string          `json:"foreach,omitempty"` // "parent" step: expression for list of items
+	ForEachStrategy         string          `json:"foreach_strategy"`
+	ForEachConcurrency      int             `json:"foreach_concurrency,omitempty"`       // max number of children in progress at once, 0 for no limit
+	ForEachFailureThreshold string          `json:"foreach_failure_threshold,omitempty"` // number ("5") or percentage ("10%") of children allowed to fail
+	ForEachChunkSize        int             `json:"foreach_chunk_size,omitempty"`        // number of items per child, 0 for one child per item
+	ChildrenSteps           []string        `json:"children_steps,omitempty"`            // list of children names
+	ChildrenStepMap         map[string]bool `json:"children_steps_map,omitempty"`
+	Item                    interface{}     `json:"item,omitempty"` // "child" step: item value, issued from foreach
 
 	Resources []string `json:"resources"` // resource limits to enforce
 
 	Tags map[string]string `json:"tags"`
+
+	lastExecution *executionStats
+}
+
+// executionStats holds measures about the execution of a step's action, not persisted
+type executionStats struct {
+	plugin     string
+	start      time.Time
+	duration   time.Duration
+	configHash string
 }
 
 // Context provides a step with extra metadata about the task
@@ -156,8 +182,21 @@ type execution struct {
 	outputs     []*executor.Output
 	config      json.RawMessage
 	runner      Runner
+	pluginName  string
 	ctx         interface{}
 	shutdownCtx context.Context
+	executed    bool
+	start       time.Time
+	duration    time.Duration
+}
+
+// configHash returns a hash of the configuration of an execution, once templated
+func (e *execution) configHash() string {
+	h := sha256.New()
+	h.Write(e.baseCfgRaw)
+	h.Write([]byte{0})
+	h.Write(e.config)
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 func (e *execution) generateOutput(st *Step, v *values.Values) error {
@@ -193,6 +232,18 @@ func (e *execution) generateOutput(st *Step, v *values.Values) error {
 			if err != nil {
 				return err
 			}
+
+		case executor.OutputStrategyjq:
+			query, ok := output.Format.(string)
+			if !ok {
+				return errors.New("invalid output jq format: expected a query")
+			}
+
+			var err error
+			st.Output, err = v.ApplyJQ(query, st.Output, st.Metadata, st.Item, st.Name)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -279,6 +330,7 @@ func (st *Step) generateExecution(action executor.Executor, baseConfig map[strin
 		ret.config = functionRunner.Action.Configuration
 		action = functionRunner.Action
 	}
+	ret.pluginName = action.Type
 
 	ret.ctx = ret.runner.Context(st.Name)
 	if ret.ctx != nil {
@@ -319,7 +371,9 @@ func (st *Step) execute(execution *execution, callback func(interface{}, interfa
 	}
 	defer utask.ReleaseResources(limits)
 
+	execution.start = time.Now()
 	output, metadata, tags, err := execution.runner.Exec(st.Name, execution.baseCfgRaw, execution.config, execution.ctx)
+	execution.executed, execution.duration = true, time.Since(execution.start)
 	callback(output, metadata, tags, err)
 }
 
@@ -328,6 +382,7 @@ func (st *Step) execute(execution *execution, callback func(interface{}, interfa
 // - a shutdownCtx context is provided to interrupt execution in flight
 // values IS NOT CONCURRENT SAFE, DO NOT SHARE WITH OTHER GOROUTINES
 func Run(st *Step, baseConfig map[string]json.RawMessage, stepValues *values.Values, stepChan chan<- *Step, wg *sync.WaitGroup, shutdownCtx context.Context) {
+	st.lastExecution = nil
 
 	// Step already ran, directly going to afterrun process
 	if st.State == StateAfterrunError {
@@ -433,6 +488,14 @@ func Run(st *Step, baseConfig map[string]json.RawMessage, stepValues *values.Val
 
 		st.execute(execution, func(output interface{}, metadata interface{}, tags map[string]string, err error) {
 			st.Output, st.Metadata, st.Tags = output, metadata, tags
+			if execution.executed {
+				st.lastExecution = &executionStats{
+					plugin:     execution.pluginName,
+					start:      execution.start,
+					duration:   execution.duration,
+					configHash: execution.configHash(),
+				}
+			}
 
 			outputErr := execution.generateOutput(st, preHookValues)
 			if outputErr != nil {
@@ -440,7 +503,9 @@ func Run(st *Step, baseConfig map[string]json.RawMessage, stepValues *values.Val
 				st.Error = "unable to format output: " + outputErr.Error()
 			} else {
 				if err != nil {
-					if errors.IsBadRequest(err) {
+					if utils.IsFatalError(err) {
+						st.State = StateFatalError
+					} else if errors.IsBadRequest(err) {
 						st.State = StateClientError
 					} else if errors.IsNotAssigned(err) {
 						st.State = StateWaiting
@@ -468,6 +533,11 @@ func Run(st *Step, baseConfig map[string]json.RawMessage, stepValues *values.Val
 				}
 			}
 
+			if st.State == StateDone && st.Until != nil && st.poll(preHookValues, time.Now()) {
+				// the action ran fine, polling again is not a retry
+				return
+			}
+
 			st.TryCount++
 		})
 
@@ -609,6 +679,29 @@ func (st *Step) ValidAndNormalize(name string, baseConfigs map[string]json.RawMe
 		return errors.NewNotValid(nil, "step foreach_strategy can't be set without foreach")
 	}
 
+	if st.ForEachConcurrency != 0 && st.ForEach == "" {
+		return errors.NewNotValid(nil, "step foreach_concurrency can't be set without foreach")
+	}
+	if st.ForEachConcurrency < 0 {
+		return errors.NewNotValid(nil, fmt.Sprintf("step foreach_concurrency %d can't be negative", st.ForEachConcurrency))
+	}
+
+	if st.ForEachChunkSize != 0 && st.ForEach == "" {
+		return errors.NewNotValid(nil, "step foreach_chunk_size can't be set without foreach")
+	}
+	if st.ForEachChunkSize < 0 {
+		return errors.NewNotValid(nil, fmt.Sprintf("step foreach_chunk_size %d can't be negative", st.ForEachChunkSize))
+	}
+
+	if st.ForEachFailureThreshold != "" {
+		if st.ForEach == "" {
+			return errors.NewNotValid(nil, "step foreach_failure_threshold can't be set without foreach")
+		}
+		if _, _, err := parseFailureThreshold(st.ForEachFailureThreshold); err != nil {
+			return err
+		}
+	}
+
 	if st.ForEach != "" {
 		switch st.ForEachStrategy {
 		case ForEachStrategyParallel, ForEachStrategySequence:
@@ -643,6 +736,13 @@ func (st *Step) ValidAndNormalize(name string, baseConfigs map[string]json.RawMe
 		}
 	}
 
+	// valid polling loop
+	if st.Until != nil {
+		if err := st.Until.Valid(st.CustomStates); err != nil {
+			return err
+		}
+	}
+
 	// valid step conditions
 	for _, sc := range st.Conditions {
 		if st.ForEach != "" && sc.Type == condition.SKIP && sc.ForEach == "" {
@@ -750,6 +850,10 @@ func (st *Step) ValidAndNormalizeNewStep() error {
 		return errors.NewNotValid(nil, "step item must not be set")
 	}
 
+	if st.PollCount != 0 || st.PollStart != nil {
+		return errors.NewNotValid(nil, "step poll_count and poll_start must not be set")
+	}
+
 	return nil
 }
 
@@ -773,6 +877,62 @@ func (st *Step) IsChild() bool {
 	return st.Item != nil
 }
 
+// IsFailedChild asserts that a child of a foreach step failed, and counts against its failure threshold
+func (st *Step) IsFailedChild() bool {
+	return slices.Contains(failedChildStates, st.State)
+}
+
+// IsInProgressChild asserts that a child of a foreach step was started and is not done yet,
+// and counts against its concurrency
+func (st *Step) IsInProgressChild() bool {
+	return st.State != StateTODO && !st.IsFailedChild() && (st.State == StateRunning || st.IsRunnable())
+}
+
+// FailureThresholdExceeded asserts that the failed children of a foreach step exceed its failure threshold,
+// out of the total number of children. A step without a failure threshold doesn't tolerate any failure.
+func (st *Step) FailureThresholdExceeded(failed, total int) bool {
+	if st.ForEachFailureThreshold == "" {
+		return failed > 0
+	}
+	threshold, percent, err := parseFailureThreshold(st.ForEachFailureThreshold)
+	if err != nil {
+		return failed > 0
+	}
+	if percent {
+		return failed*100 > threshold*total
+	}
+	return failed > threshold
+}
+
+// parseFailureThreshold parses a failure threshold, either a number of children or a percentage of them
+func parseFailureThreshold(threshold string) (int, bool, error) {
+	value, percent := strings.CutSuffix(threshold, "%")
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || (percent && n > 100) {
+		return 0, false, errors.NewNotValid(nil, fmt.Sprintf("step foreach_failure_threshold %q is not a valid value, expected a positive number or percentage", threshold))
+	}
+	return n, percent, nil
+}
+
+// LastExecution returns the plugin which executed the step's action during the current run,
+// and how long the execution took. The returned plugin is empty if the action was not executed.
+func (st *Step) LastExecution() (string, time.Duration) {
+	if st.lastExecution == nil {
+		return "", 0
+	}
+	return st.lastExecution.plugin, st.lastExecution.duration
+}
+
+// LastExecutionDetails returns when the last execution of the step's action started,
+// and a hash of its configuration once templated
+// the start time is zero if the action was not executed during the last run
+func (st *Step) LastExecutionDetails() (time.Time, string) {
+	if st.lastExecution == nil {
+		return time.Time{}, ""
+	}
+	return st.lastExecution.start, st.lastExecution.configHash
+}
+
 // ExecutorMetadata returns the step's runner metadata schema
 func (st *Step) ExecutorMetadata() json.RawMessage {
 	runner, err := getRunner(st.Action.Type)
@@ -868,6 +1028,21 @@ func annotateFunctions(functions []string, err error) error {
 	return err
 }
 
+// validOutput asserts that the queries of "jq" output strategies compile
+func validOutput(output *executor.Output) error {
+	if output == nil || output.Strategy != executor.OutputStrategyjq {
+		return nil
+	}
+	query, ok := output.Format.(string)
+	if !ok {
+		return errors.New("invalid output jq format: expected a query")
+	}
+	if _, err := values.CompileJQ(query, values.JQOutputVariables...); err != nil {
+		return errors.Annotate(err, "invalid output jq format")
+	}
+	return nil
+}
+
 func validExecutor(baseConfigs map[string]json.RawMessage, ex executor.Executor, preHook *executor.Executor) (*executor.Executor, error) {
 	if len(ex.BaseConfiguration) > 0 {
 		if _, ok := baseConfigs[ex.BaseConfiguration]; !ok {
@@ -875,6 +1050,10 @@ func validExecutor(baseConfigs map[string]json.RawMessage, ex executor.Executor,
 		}
 	}
 
+	if err := validOutput(ex.Output); err != nil {
+		return nil, err
+	}
+
 	runnerType := ex.Type
 	configuration := ex.Configuration
 	var functionNames []string
@@ -899,6 +1078,10 @@ func validExecutor(baseConfigs map[string]json.RawMessage, ex executor.Executor,
 
 		functionNames = append(functionNames, runnerType)
 
+		if err := validOutput(functionRunner.Action.Output); err != nil {
+			return nil, annotateFunctions(functionNames, err)
+		}
+
 		runnerType, configuration = functionRunner.Action.Type, functionRunner.Action.Configuration
 		if functionRunner.PreHook != nil {
 			if preHook != nil {
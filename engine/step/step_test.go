@@ -0,0 +1,209 @@
+package step
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"github.com/ovh/utask/engine/step/condition"
+	"github.com/ovh/utask/engine/step/executor"
+	"github.com/ovh/utask/engine/values"
+)
+
+type sleepRunner struct{}
+
+func (sleepRunner) Exec(stepName string, baseConfig json.RawMessage, config json.RawMessage, ctx interface{}) (interface{}, interface{}, map[string]string, error) {
+	time.Sleep(10 * time.Millisecond)
+	return map[string]interface{}{"foo": "bar"}, nil, nil, nil
+}
+func (sleepRunner) ValidConfig(baseConfig json.RawMessage, config json.RawMessage) error { return nil }
+func (sleepRunner) Context(stepName string) interface{}                                  { return nil }
+func (sleepRunner) Resources(baseConfig json.RawMessage, config json.RawMessage) []string {
+	return nil
+}
+func (sleepRunner) MetadataSchema() json.RawMessage { return nil }
+
+func TestLastExecution(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	require.CmpNoError(RegisterRunner("test-sleep", sleepRunner{}))
+
+	st := &Step{
+		Name:   "sleep",
+		State:  StateRunning,
+		Action: executor.Executor{Type: "test-sleep", Configuration: json.RawMessage(`{}`)},
+	}
+
+	plugin, duration := st.LastExecution()
+	assert.Cmp(plugin, "")
+	assert.Cmp(duration, time.Duration(0))
+	start, configHash := st.LastExecutionDetails()
+	assert.Zero(start)
+	assert.Empty(configHash)
+
+	stepChan := make(chan *Step, 1)
+	var wg sync.WaitGroup
+	Run(st, nil, values.NewValues(), stepChan, &wg, context.Background())
+	res := <-stepChan
+
+	assert.Cmp(res.State, StateDone)
+	plugin, duration = res.LastExecution()
+	assert.Cmp(plugin, "test-sleep")
+	assert.Gte(duration, 10*time.Millisecond)
+
+	start, configHash = res.LastExecutionDetails()
+	assert.Between(start, time.Now().Add(-time.Second), time.Now().Add(-10*time.Millisecond), td.BoundsInIn)
+	assert.Len(configHash, 64)
+}
+
+func TestOutputStrategyJQ(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	require.CmpNoError(RegisterRunner("test-sleep-jq", sleepRunner{}))
+
+	output := &executor.Output{Strategy: executor.OutputStrategyjq, Format: `{foo: .foo, input: $input.id}`}
+	require.CmpNoError(validOutput(output))
+	assert.CmpError(validOutput(&executor.Output{Strategy: executor.OutputStrategyjq, Format: `{foo: `}))
+	assert.CmpError(validOutput(&executor.Output{Strategy: executor.OutputStrategyjq, Format: map[string]interface{}{}}))
+
+	st := &Step{
+		Name:   "jq",
+		State:  StateRunning,
+		Action: executor.Executor{Type: "test-sleep-jq", Configuration: json.RawMessage(`{}`), Output: output},
+	}
+
+	v := values.NewValues()
+	v.SetInput(map[string]interface{}{"id": json.Number("42")})
+
+	stepChan := make(chan *Step, 1)
+	var wg sync.WaitGroup
+	Run(st, nil, v, stepChan, &wg, context.Background())
+	res := <-stepChan
+
+	assert.Cmp(res.State, StateDone)
+	assert.Cmp(res.Output, map[string]interface{}{"foo": "bar", "input": 42})
+}
+
+func TestFailureThresholdExceeded(t *testing.T) {
+	assert := td.Assert(t)
+
+	for _, tc := range []struct {
+		threshold string
+		failed    int
+		total     int
+		exceeded  bool
+	}{
+		{"", 0, 10, false},
+		{"", 1, 10, true},
+		{"0", 1, 10, true},
+		{"2", 2, 10, false},
+		{"2", 3, 10, true},
+		{"25%", 1, 4, false},
+		{"25%", 2, 4, true},
+		{"100%", 4, 4, false},
+	} {
+		st := &Step{ForEach: "[]", ForEachFailureThreshold: tc.threshold}
+		assert.Cmp(st.FailureThresholdExceeded(tc.failed, tc.total), tc.exceeded,
+			"threshold %q, %d out of %d failed", tc.threshold, tc.failed, tc.total)
+	}
+
+	for _, threshold := range []string{"-1", "abc", "101%", "%"} {
+		_, _, err := parseFailureThreshold(threshold)
+		assert.CmpError(err, "threshold %q", threshold)
+	}
+}
+
+func TestUntil(t *testing.T) {
+	assert, require := td.AssertRequire(t)
+
+	require.CmpNoError(RegisterRunner("test-poll", sleepRunner{}))
+
+	run := func(st *Step) *Step {
+		stepChan := make(chan *Step, 1)
+		var wg sync.WaitGroup
+		Run(st, nil, values.NewValues(), stepChan, &wg, context.Background())
+		return <-stepChan
+	}
+	newStep := func(expected string) *Step {
+		return &Step{
+			Name:   "poll",
+			State:  StateRunning,
+			Action: executor.Executor{Type: "test-poll", Configuration: json.RawMessage(`{}`)},
+			Until: &Until{
+				If:           []*condition.Assert{{Value: "{{.step.this.output.foo}}", Operator: condition.EQ, Expected: expected}},
+				PollInterval: "1s",
+				MaxDuration:  "1h",
+			},
+		}
+	}
+
+	// condition met on the first poll
+	res := run(newStep("bar"))
+	assert.Cmp(res.State, StateDone)
+	assert.Cmp(res.TryCount, 1)
+	assert.Cmp(res.PollCount, 1)
+	assert.Cmp(res.Metadata, map[string]interface{}{PollCountKey: 1})
+	assert.False(res.IsPolling())
+
+	// condition not met, polling again is not a retry
+	st := newStep("baz")
+	res = run(st)
+	assert.Cmp(res.State, StateWaiting)
+	assert.Cmp(res.Error, "")
+	assert.Cmp(res.TryCount, 0)
+	assert.True(res.IsPolling())
+
+	res.State = StateRunning
+	res = run(res)
+	assert.Cmp(res.State, StateWaiting)
+	assert.Cmp(res.PollCount, 2)
+	assert.Cmp(res.TryCount, 0)
+
+	// condition still not met past the max duration
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	res.State = StateRunning
+	res.PollStart = &twoHoursAgo
+	res = run(res)
+	assert.Cmp(res.State, StateFatalError)
+	assert.HasPrefix(res.Error, "until: condition not met after 3 polls in 1h")
+	assert.Cmp(res.TryCount, 1)
+	assert.False(res.IsPolling())
+
+	// custom timeout state
+	st = newStep("baz")
+	st.Until.TimeoutState = "GAVE_UP"
+	st.PollStart = &twoHoursAgo
+	res = run(st)
+	assert.Cmp(res.State, "GAVE_UP")
+
+	// the poll count is merged into metadata which are an object
+	type pluginMetadata struct {
+		Code int `json:"code"`
+	}
+	assert.Cmp(metadataWithPollCount(pluginMetadata{Code: 200}, 2), map[string]interface{}{"code": json.Number("200"), PollCountKey: 2})
+	assert.Cmp(metadataWithPollCount("raw", 2), "raw")
+}
+
+func TestUntilValid(t *testing.T) {
+	assert := td.Assert(t)
+
+	assertion := []*condition.Assert{{Value: "{{.step.this.output.foo}}", Operator: condition.EQ, Expected: "bar"}}
+
+	assert.CmpNoError((&Until{If: assertion, MaxDuration: "1h"}).Valid(nil))
+	assert.CmpNoError((&Until{If: assertion, PollInterval: "1m", MaxDuration: "1h", TimeoutState: "GAVE_UP"}).Valid([]string{"GAVE_UP"}))
+
+	for _, u := range []*Until{
+		{MaxDuration: "1h"},
+		{If: assertion},
+		{If: assertion, MaxDuration: "forever"},
+		{If: assertion, PollInterval: "10ms", MaxDuration: "1h"},
+		{If: assertion, PollInterval: "1h", MaxDuration: "1m"},
+		{If: assertion, MaxDuration: "1h", TimeoutState: "TO_RETRY"},
+	} {
+		assert.CmpError(u.Valid(nil), "%+v", u)
+	}
+}
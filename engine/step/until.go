@@ -0,0 +1,184 @@
+package step
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/ovh/utask/engine/step/condition"
+	"github.com/ovh/utask/engine/values"
+	"github.com/ovh/utask/pkg/utils"
+)
+
+const (
+	defaultPollInterval = 30 * time.Second
+	minPollInterval     = time.Second
+
+	// PollCountKey is the key of the step's metadata holding how many times the action was run while polling
+	PollCountKey = "poll_count"
+)
+
+var untilTimeoutValidStates = []string{StateDone, StatePrune, StateClientError, StateFatalError}
+
+// Until describes a polling loop: the action of a step is run again, every poll interval,
+// until all its assertions hold. Runs of the action whose result doesn't meet the condition
+// are not errors, and don't count against the step's max retries.
+// Past its max duration, the step is set to the timeout state (FATAL_ERROR by default).
+type Until struct {
+	If           []*condition.Assert `json:"if"`
+	PollInterval string              `json:"poll_interval,omitempty"`
+	MaxDuration  string              `json:"max_duration"`
+	TimeoutState string              `json:"timeout_state,omitempty"`
+	Message      string              `json:"message,omitempty"`
+}
+
+// Valid asserts that the definition of a polling loop is valid, the timeout state being either
+// a builtin final state, a blocking error, or one of the custom states of the step
+func (u *Until) Valid(customStates []string) error {
+	if len(u.If) == 0 {
+		return errors.BadRequestf("until: at least one assertion is required")
+	}
+	for _, a := range u.If {
+		if err := a.Valid(); err != nil {
+			return errors.Annotate(err, "until")
+		}
+	}
+
+	pollInterval, err := u.pollInterval()
+	if err != nil {
+		return err
+	}
+	if pollInterval < minPollInterval {
+		return errors.BadRequestf("until: poll_interval %s is too short, expected at least %s", pollInterval, minPollInterval)
+	}
+	maxDuration, err := u.maxDuration()
+	if err != nil {
+		return err
+	}
+	if maxDuration < pollInterval {
+		return errors.BadRequestf("until: max_duration %s is shorter than poll_interval %s", maxDuration, pollInterval)
+	}
+
+	if u.TimeoutState != "" && !utils.ListContainsString(utils.AppendUniq(untilTimeoutValidStates, customStates...), u.TimeoutState) {
+		return errors.BadRequestf("until: invalid timeout_state %q", u.TimeoutState)
+	}
+	return nil
+}
+
+func (u *Until) pollInterval() (time.Duration, error) {
+	if u.PollInterval == "" {
+		return defaultPollInterval, nil
+	}
+	d, err := time.ParseDuration(u.PollInterval)
+	if err != nil {
+		return 0, errors.BadRequestf("until: invalid poll_interval %q: %s", u.PollInterval, err)
+	}
+	return d, nil
+}
+
+func (u *Until) maxDuration() (time.Duration, error) {
+	if u.MaxDuration == "" {
+		return 0, errors.BadRequestf("until: max_duration is required")
+	}
+	d, err := time.ParseDuration(u.MaxDuration)
+	if err != nil {
+		return 0, errors.BadRequestf("until: invalid max_duration %q: %s", u.MaxDuration, err)
+	}
+	return d, nil
+}
+
+// IsPolling asserts that the step is waiting for its next poll, its "until" condition not being met yet
+func (st *Step) IsPolling() bool {
+	return st.Until != nil && st.State == StateWaiting && st.PollStart != nil
+}
+
+// NextPoll returns when a polling step should run its action again
+func (st *Step) NextPoll() time.Time {
+	pollInterval, err := st.Until.pollInterval()
+	if err != nil {
+		pollInterval = defaultPollInterval
+	}
+	return st.LastRun.Add(pollInterval)
+}
+
+// poll evaluates the "until" condition of a step once its action succeeded: the step stays DONE if the condition holds,
+// goes back to WAITING for its next poll if it doesn't, or to its timeout state past its max duration.
+// It returns true while the step keeps polling.
+func (st *Step) poll(v *values.Values, now time.Time) bool {
+	if st.PollStart == nil {
+		// first poll of a new loop
+		st.PollStart = &now
+		st.PollCount = 0
+	}
+	st.PollCount++
+	st.Metadata = metadataWithPollCount(st.Metadata, st.PollCount)
+
+	v.SetOutput(st.Name, st.Output)
+	v.SetMetadata(st.Name, st.Metadata)
+	v.SetState(st.Name, st.State)
+
+	var condErr error
+	for _, a := range st.Until.If {
+		if condErr = a.Eval(v, st.Item, st.Name); condErr != nil {
+			break
+		}
+	}
+	if condErr == nil {
+		st.PollStart = nil
+		return false
+	}
+	if _, ok := condErr.(condition.ErrConditionNotMet); !ok {
+		// templating errors are not going to fix themselves by polling again
+		st.PollStart = nil
+		st.State = StateFatalError
+		st.Error = fmt.Sprintf("until: %s", condErr)
+		return false
+	}
+
+	maxDuration, err := st.Until.maxDuration()
+	if err == nil && now.Sub(*st.PollStart) < maxDuration {
+		st.State = StateWaiting
+		st.Error = ""
+		return true
+	}
+
+	timeoutState := st.Until.TimeoutState
+	if timeoutState == "" {
+		timeoutState = StateFatalError
+	}
+	reason := condErr.Error()
+	if st.Until.Message != "" {
+		if msg, err := v.Apply(st.Until.Message, st.Item, st.Name); err == nil {
+			reason = string(msg)
+		}
+	}
+	st.PollStart = nil
+	st.State = timeoutState
+	st.Error = fmt.Sprintf("until: condition not met after %d polls in %s: %s", st.PollCount, st.Until.MaxDuration, reason)
+	return false
+}
+
+// metadataWithPollCount merges the poll count into the metadata of a step, when they're an object.
+// Other metadata are left as is, the count still being available as the step's poll_count.
+func metadataWithPollCount(metadata interface{}, pollCount int) interface{} {
+	switch m := metadata.(type) {
+	case nil:
+		return map[string]interface{}{PollCountKey: pollCount}
+	case map[string]interface{}:
+		m[PollCountKey] = pollCount
+		return m
+	}
+
+	b, err := utils.JSONMarshal(metadata)
+	if err != nil {
+		return metadata
+	}
+	var m map[string]interface{}
+	if err := utils.JSONnumberUnmarshal(bytes.NewReader(b), &m); err != nil || m == nil {
+		return metadata
+	}
+	m[PollCountKey] = pollCount
+	return m
+}
@@ -0,0 +1,325 @@
+package values
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+	"github.com/juju/errors"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/ovh/utask/pkg/utils"
+)
+
+// expression engines
+const (
+	// ExpressionEngineJS evaluates expressions as JavaScript, in an otto VM, after applying templating handles
+	// this is the default engine
+	ExpressionEngineJS = "js"
+	// ExpressionEngineCEL evaluates expressions written in the Common Expression Language (https://cel.dev),
+	// which have a direct access to the values of the task
+	ExpressionEngineCEL = "cel"
+)
+
+// DefaultCELCostLimit is the runtime cost after which the evaluation of a CEL expression is interrupted
+const DefaultCELCostLimit uint64 = 1000000
+
+// celRootKeys are the values exposed to CEL expressions; variables are left out,
+// as they can be evaluated by the JS engine
+var celRootKeys = []string{InputKey, ResolverInputKey, FunctionsArgsKey, StepKey, ConfigKey, TaskKey, IteratorKey, PreHookKey}
+
+// celCacheSize bounds the number of compiled CEL programs kept in memory
+const celCacheSize = 1000
+
+var (
+	celEnvOnce sync.Once
+	celEnv     *cel.Env
+	celEnvErr  error
+	celProgs   = utils.NewLRU[string, cel.Program](celCacheSize)
+)
+
+func celOptions() []cel.EnvOption {
+	return []cel.EnvOption{
+		cel.CrossTypeNumericComparisons(true),
+		cel.OptionalTypes(),
+		ext.Strings(),
+		ext.Encoders(),
+		ext.Math(),
+		ext.Lists(),
+		ext.Sets(),
+	}
+}
+
+// runtimeCELEnv returns the environment expressions are compiled with before being evaluated:
+// every value is dynamically typed
+func runtimeCELEnv() (*cel.Env, error) {
+	celEnvOnce.Do(func() {
+		opts := celOptions()
+		for _, k := range celRootKeys {
+			t := cel.MapType(cel.StringType, cel.DynType)
+			if k == IteratorKey {
+				t = cel.DynType
+			}
+			opts = append(opts, cel.Variable(k, t))
+		}
+		celEnv, celEnvErr = cel.NewEnv(opts...)
+	})
+	return celEnv, celEnvErr
+}
+
+func celProgram(expression string, costLimit uint64) (cel.Program, error) {
+	if costLimit == 0 {
+		costLimit = DefaultCELCostLimit
+	}
+	key := fmt.Sprintf("%d:%s", costLimit, expression)
+	if prg, ok := celProgs.Get(key); ok {
+		return prg, nil
+	}
+
+	env, err := runtimeCELEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expression)
+	if iss.Err() != nil {
+		return nil, errors.NewBadRequest(iss.Err(), "CEL expression error")
+	}
+	prg, err := env.Program(ast, cel.CostLimit(costLimit), cel.InterruptCheckFrequency(100))
+	if err != nil {
+		return nil, errors.NewBadRequest(err, "CEL expression error")
+	}
+	celProgs.Add(key, prg)
+	return prg, nil
+}
+
+// EvalCEL evaluates a CEL expression against the values of a task,
+// with the same handles as templates (item is exposed as "iterator", stepName as the step "this")
+// the evaluation is interrupted once it exceeds costLimit (DefaultCELCostLimit if 0)
+func (v *Values) EvalCEL(expression string, item interface{}, stepName string, costLimit uint64) (interface{}, error) {
+	prg, err := celProgram(expression, costLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer v.setContext(item, stepName)()
+
+	activation := make(map[string]interface{}, len(celRootKeys))
+	for _, k := range celRootKeys {
+		val := celNative(v.m[k])
+		if val == nil && k != IteratorKey {
+			val = map[string]interface{}{}
+		}
+		activation[k] = val
+	}
+
+	out, _, err := prg.Eval(activation)
+	if err != nil {
+		return nil, errors.NewBadRequest(err, "CEL evaluation error")
+	}
+	return celResult(out)
+}
+
+// celNative converts values to types understood by CEL: numbers are integers when they can be,
+// and data not made of maps, lists and scalars is converted through its JSON representation
+func celNative(i interface{}) interface{} {
+	switch t := i.(type) {
+	case nil, string, bool, float64, int, int64, time.Time:
+		return t
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[k] = celNative(val)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for idx, val := range t {
+			l[idx] = celNative(val)
+		}
+		return l
+	case map[string]string:
+		return t
+	}
+
+	b, err := utils.JSONMarshal(i)
+	if err != nil {
+		return nil
+	}
+	var generic interface{}
+	if err := utils.JSONnumberUnmarshal(bytes.NewReader(b), &generic); err != nil {
+		return nil
+	}
+	return celNative(generic)
+}
+
+var structpbValueType = reflect.TypeOf(&structpb.Value{})
+
+// celResult converts the result of an expression to plain data
+func celResult(out ref.Val) (interface{}, error) {
+	switch out.Type() {
+	case types.IntType, types.UintType, types.StringType, types.BoolType, types.DoubleType:
+		return out.Value(), nil
+	case types.NullType:
+		return nil, nil
+	}
+	native, err := out.ConvertToNative(structpbValueType)
+	if err != nil {
+		return nil, errors.NewBadRequest(err, "CEL evaluation error")
+	}
+	return native.(*structpb.Value).AsInterface(), nil
+}
+
+// CELString represents the result of an expression as a string, as a template would print it
+func CELString(i interface{}) string {
+	switch t := i.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case []interface{}, map[string]interface{}:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+	return fmt.Sprint(i)
+}
+
+// CELSchema describes the values known when a template is validated, to type-check CEL expressions:
+// references to undeclared inputs, steps or task information are rejected
+type CELSchema struct {
+	Inputs         map[string]*cel.Type
+	ResolverInputs map[string]*cel.Type
+	Steps          []string
+	TaskKeys       []string
+
+	once sync.Once
+	env  *cel.Env
+	err  error
+}
+
+// object types of the values described by a CELSchema
+const (
+	celInputType         = "utask.Input"
+	celResolverInputType = "utask.ResolverInput"
+	celStepsType         = "utask.Steps"
+	celTaskType          = "utask.Task"
+)
+
+func (s *CELSchema) environment() (*cel.Env, error) {
+	s.once.Do(func() {
+		provider := &celProvider{
+			Registry: types.NewEmptyRegistry(),
+			objects: map[string]map[string]*cel.Type{
+				celInputType:         s.Inputs,
+				celResolverInputType: s.ResolverInputs,
+				celStepsType:         {},
+				celTaskType:          {},
+			},
+		}
+		for _, st := range s.Steps {
+			provider.objects[celStepsType][st] = cel.MapType(cel.StringType, cel.DynType)
+		}
+		for _, k := range s.TaskKeys {
+			provider.objects[celTaskType][k] = cel.DynType
+		}
+
+		opts := append([]cel.EnvOption{cel.CustomTypeProvider(provider)}, celOptions()...)
+		for _, k := range celRootKeys {
+			var t *cel.Type
+			switch k {
+			case InputKey:
+				t = cel.ObjectType(celInputType)
+			case ResolverInputKey:
+				t = cel.ObjectType(celResolverInputType)
+			case StepKey:
+				t = cel.ObjectType(celStepsType)
+			case TaskKey:
+				t = cel.ObjectType(celTaskType)
+			case IteratorKey:
+				t = cel.DynType
+			default:
+				t = cel.MapType(cel.StringType, cel.DynType)
+			}
+			opts = append(opts, cel.Variable(k, t))
+		}
+		s.env, s.err = cel.NewEnv(opts...)
+	})
+	return s.env, s.err
+}
+
+// Check type-checks a CEL expression, and asserts that its result is of the expected type, if not nil
+func (s *CELSchema) Check(expression string, expected *cel.Type) error {
+	env, err := s.environment()
+	if err != nil {
+		return err
+	}
+	ast, iss := env.Compile(expression)
+	if iss.Err() != nil {
+		return iss.Err()
+	}
+	if expected != nil && !expected.IsAssignableType(ast.OutputType()) && ast.OutputType() != cel.DynType {
+		return fmt.Errorf("expression %q returns a %s, expected a %s", expression, ast.OutputType(), expected)
+	}
+	return nil
+}
+
+// CheckCEL compiles a CEL expression, without knowledge of the values available
+func CheckCEL(expression string) error {
+	env, err := runtimeCELEnv()
+	if err != nil {
+		return err
+	}
+	_, iss := env.Compile(expression)
+	return iss.Err()
+}
+
+// celProvider declares object types whose fields are known, on top of a registry
+type celProvider struct {
+	*types.Registry
+	objects map[string]map[string]*cel.Type
+}
+
+func (p *celProvider) FindStructType(structType string) (*types.Type, bool) {
+	if _, ok := p.objects[structType]; ok {
+		return types.NewTypeTypeWithParam(types.NewObjectType(structType)), true
+	}
+	return p.Registry.FindStructType(structType)
+}
+
+func (p *celProvider) FindStructFieldNames(structType string) ([]string, bool) {
+	fields, ok := p.objects[structType]
+	if !ok {
+		return p.Registry.FindStructFieldNames(structType)
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+func (p *celProvider) FindStructFieldType(structType, fieldName string) (*types.FieldType, bool) {
+	fields, ok := p.objects[structType]
+	if !ok {
+		return p.Registry.FindStructFieldType(structType, fieldName)
+	}
+	t, ok := fields[fieldName]
+	if !ok {
+		return nil, false
+	}
+	return &types.FieldType{Type: t}, true
+}
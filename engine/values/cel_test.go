@@ -0,0 +1,92 @@
+package values_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/juju/errors"
+	"github.com/maxatome/go-testdeep/td"
+
+	"github.com/ovh/utask/engine/values"
+)
+
+func TestCEL(t *testing.T) {
+	v := values.NewValues()
+	v.SetInput(map[string]interface{}{"name": "utask", "count": json.Number("3"), "ratio": json.Number("0.5")})
+	v.SetOutput("first", map[string]interface{}{"ids": []interface{}{json.Number("1"), json.Number("2")}})
+	v.SetState("first", "DONE")
+	v.SetVariables([]values.Variable{
+		{Name: "greeting", Expression: `"hello " + input.name`, ExpressionEngine: values.ExpressionEngineCEL},
+		{Name: "double", Expression: `input.count * 2`, ExpressionEngine: values.ExpressionEngineCEL},
+		{Name: "ids", Expression: `step.first.output.ids.map(i, i + 10)`, ExpressionEngine: values.ExpressionEngineCEL},
+		{Name: "loop", Expression: `[1,2,3,4,5,6,7,8,9,10].map(a, [1,2,3,4,5,6,7,8,9,10].map(b, [1,2,3,4,5,6,7,8,9,10].map(c, a*b*c)))`, ExpressionEngine: values.ExpressionEngineCEL, ExpressionCostLimit: 100},
+		{Name: "js", Expression: `"{{.input.name}}".length`},
+	})
+
+	output, err := v.Apply("{{ eval `greeting` }} {{ eval `double` }} {{ eval `js` }}", nil, "")
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, string(output), "hello utask 6 5")
+
+	res, err := v.EvalCEL(`[input.ratio > 0.2, input.count > 2.5, has(input.missing)]`, nil, "", 0)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, res, []interface{}{true, true, false})
+
+	res, err = v.EvalCEL(`step.this.state == "DONE" && iterator.id == 42`, map[string]interface{}{"id": json.Number("42")}, "first", 0)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, res, true)
+
+	output, err = v.Apply("{{ eval `ids` | toJson }}", nil, "")
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, string(output), "[11,12]")
+
+	// expensive expressions are interrupted
+	_, err = v.Apply("{{ eval `loop` }}", nil, "")
+	td.CmpContains(t, err, "cost limit exceeded")
+
+	_, err = v.EvalCEL(`input.missing == 1`, nil, "", 0)
+	td.CmpTrue(t, errors.IsBadRequest(err))
+	_, err = v.EvalCEL(`input.name +`, nil, "", 0)
+	td.CmpTrue(t, errors.IsBadRequest(err))
+
+	td.Cmp(t, values.CELString([]interface{}{"a", 1.5}), `["a",1.5]`)
+	td.Cmp(t, values.CELString(int64(3)), "3")
+	td.Cmp(t, values.CELString(nil), "")
+}
+
+func TestCELSchema(t *testing.T) {
+	schema := &values.CELSchema{
+		Inputs:   map[string]*cel.Type{"name": cel.StringType, "flags": cel.ListType(cel.BoolType), "count": cel.DynType},
+		Steps:    []string{"this", "first"},
+		TaskKeys: []string{"task_id"},
+	}
+
+	for _, exp := range []string{
+		`input.name.startsWith("u")`,
+		`input.count + 1`,
+		`input.flags.all(f, f)`,
+		`has(input.name) && size(input.name) > 2`,
+		`step.first.output.id`,
+		`step.this.state == "DONE"`,
+		`task.task_id + config.region`,
+		`iterator.foo`,
+	} {
+		td.CmpNoError(t, schema.Check(exp, nil), exp)
+	}
+
+	for _, exp := range []string{
+		`input.unknown`,
+		`input.name > 3`,
+		`input.flags[0] + 1`,
+		`step.second.output`,
+		`task.unknown`,
+		`var.foo`,
+		`input.name +`,
+	} {
+		td.CmpError(t, schema.Check(exp, nil), exp)
+	}
+
+	td.CmpNoError(t, schema.Check(`input.name == "utask"`, cel.BoolType))
+	td.CmpNoError(t, schema.Check(`step.first.output.ok`, cel.BoolType))
+	td.CmpError(t, schema.Check(`input.name`, cel.BoolType))
+}
@@ -0,0 +1,127 @@
+package values
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/juju/errors"
+)
+
+// TemplateFunction describes a function of the templating language
+// plugins contribute functions through RegisterFunction, their Func is added to the funcMap of every Values
+type TemplateFunction struct {
+	Name        string      `json:"name"`
+	Signature   string      `json:"signature"`
+	Description string      `json:"description"`
+	Plugin      string      `json:"plugin,omitempty"`
+	Func        interface{} `json:"-"`
+}
+
+// builtinFunctions describes the functions implemented by Values, on top of Golang and Sprig functions
+var builtinFunctions = []TemplateFunction{
+	{Name: "field", Signature: "field KEY...", Description: "Equivalent to the dot notation, for entries with forbidden characters"},
+	{Name: "fieldFrom", Signature: "fieldFrom KEY... SOURCE", Description: "Equivalent to the dot notation on the given source, for entries with forbidden characters"},
+	{Name: "eval", Signature: "eval VARIABLE", Description: "Evaluates the value of a template variable"},
+	{Name: "evalCache", Signature: "evalCache VARIABLE", Description: "Evaluates the value of a template variable, and caches it for future usage"},
+	{Name: "fromJson", Signature: "fromJson STRING", Description: "Decodes a JSON document into a structure, returns an empty string if it can't be decoded"},
+	{Name: "mustFromJson", Signature: "mustFromJson STRING", Description: "Decodes a JSON document into a structure, returns an error if it can't be decoded"},
+	{Name: "uuid", Signature: "uuid", Description: "Generates a random UUID"},
+	{Name: "b64RawEnc", Signature: "b64RawEnc STRING", Description: "Encodes a string in raw base64 (RFC 4648 section 3.2)"},
+	{Name: "b64RawDec", Signature: "b64RawDec STRING", Description: "Decodes a raw base64 string (RFC 4648 section 3.2)"},
+	{Name: "secret", Signature: "secret NAME", Description: "Returns the value of a secret from the vault"},
+	{Name: "jq", Signature: "jq QUERY DATA", Description: "Runs a jq query on data, returns a single result as is, several results as a list"},
+	{Name: "jsonpath", Signature: "jsonpath PATH DATA", Description: "Extracts values from data with a JSONPath expression, returns a single result as is, several results as a list"},
+}
+
+var (
+	pluginFunctionsMu sync.RWMutex
+	pluginFunctions   = map[string]TemplateFunction{}
+
+	functionNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	errorType         = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RegisterFunction adds a function contributed by a plugin to the templating language
+// the function must return a single value, or a value and an error, as required by text/template
+// its name can't shadow a Golang, Sprig or builtin function, nor a function already registered
+// the signature is derived from the type of the function if it's left empty
+func RegisterFunction(plugin string, f TemplateFunction) error {
+	if !functionNameRegex.MatchString(f.Name) {
+		return errors.NotValidf("templating function name %q", f.Name)
+	}
+	if f.Func == nil {
+		return errors.NotValidf("templating function %q: nil function", f.Name)
+	}
+	t := reflect.TypeOf(f.Func)
+	if t.Kind() != reflect.Func {
+		return errors.NotValidf("templating function %q: expected a function, got %T", f.Name, f.Func)
+	}
+	switch {
+	case t.NumOut() == 1:
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+	default:
+		return errors.NotValidf("templating function %q: expected to return a value, or a value and an error", f.Name)
+	}
+	if isReservedFunction(f.Name) {
+		return errors.AlreadyExistsf("templating function %q", f.Name)
+	}
+	if f.Signature == "" {
+		f.Signature = f.Name + strings.TrimPrefix(t.String(), "func")
+	}
+	f.Plugin = plugin
+
+	pluginFunctionsMu.Lock()
+	defer pluginFunctionsMu.Unlock()
+	if existing, ok := pluginFunctions[f.Name]; ok {
+		return errors.AlreadyExistsf("templating function %q, registered by plugin %q,", f.Name, existing.Plugin)
+	}
+	pluginFunctions[f.Name] = f
+	return nil
+}
+
+// Functions lists the builtin functions of µTask and the functions registered by plugins, sorted by name
+// Golang and Sprig functions are not listed
+func Functions() []TemplateFunction {
+	pluginFunctionsMu.RLock()
+	defer pluginFunctionsMu.RUnlock()
+
+	ret := make([]TemplateFunction, 0, len(builtinFunctions)+len(pluginFunctions))
+	ret = append(ret, builtinFunctions...)
+	for _, f := range pluginFunctions {
+		ret = append(ret, f)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+func isReservedFunction(name string) bool {
+	if _, ok := sprig.FuncMap()[name]; ok {
+		return true
+	}
+	switch name {
+	case "and", "call", "html", "index", "slice", "js", "len", "not", "or", "print", "printf", "println", "urlquery",
+		"eq", "ge", "gt", "le", "lt", "ne":
+		return true
+	}
+	for _, f := range builtinFunctions {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addPluginFunctions completes a funcMap with the functions registered by plugins
+func addPluginFunctions(funcMap template.FuncMap) {
+	pluginFunctionsMu.RLock()
+	defer pluginFunctionsMu.RUnlock()
+
+	for name, f := range pluginFunctions {
+		funcMap[name] = f.Func
+	}
+}
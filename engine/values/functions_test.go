@@ -0,0 +1,65 @@
+package values_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/maxatome/go-testdeep/td"
+
+	"github.com/ovh/utask/engine/values"
+)
+
+func TestRegisterFunction(t *testing.T) {
+	ipInNetwork := func(ip, network string) (bool, error) {
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, err
+		}
+		return n.Contains(net.ParseIP(ip)), nil
+	}
+
+	td.Require(t).CmpNoError(values.RegisterFunction("netutils", values.TemplateFunction{
+		Name:        "ipInNetwork",
+		Description: "Asserts that an IP address belongs to a network",
+		Func:        ipInNetwork,
+	}))
+
+	err := values.RegisterFunction("other", values.TemplateFunction{Name: "ipInNetwork", Func: ipInNetwork})
+	td.CmpTrue(t, errors.IsAlreadyExists(err))
+	err = values.RegisterFunction("other", values.TemplateFunction{Name: "upper", Func: ipInNetwork})
+	td.CmpTrue(t, errors.IsAlreadyExists(err))
+	err = values.RegisterFunction("other", values.TemplateFunction{Name: "eval", Func: ipInNetwork})
+	td.CmpTrue(t, errors.IsAlreadyExists(err))
+	err = values.RegisterFunction("other", values.TemplateFunction{Name: "bad-name", Func: ipInNetwork})
+	td.CmpTrue(t, errors.IsNotValid(err))
+	err = values.RegisterFunction("other", values.TemplateFunction{Name: "noFunc"})
+	td.CmpTrue(t, errors.IsNotValid(err))
+	err = values.RegisterFunction("other", values.TemplateFunction{Name: "noReturn", Func: func() {}})
+	td.CmpTrue(t, errors.IsNotValid(err))
+	err = values.RegisterFunction("other", values.TemplateFunction{Name: "badReturn", Func: func() (int, int) { return 0, 0 }})
+	td.CmpTrue(t, errors.IsNotValid(err))
+
+	v := values.NewValues()
+	v.SetInput(map[string]interface{}{"ip": "10.0.0.12"})
+	output, err := v.Apply(`{{ ipInNetwork .input.ip "10.0.0.0/24" }} {{ ipInNetwork .input.ip "192.168.0.0/16" }}`, nil, "")
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, string(output), "true false")
+
+	_, err = v.Apply(`{{ ipInNetwork .input.ip "foo" }}`, nil, "")
+	td.CmpContains(t, err, "invalid CIDR address")
+
+	functions := values.Functions()
+	td.Cmp(t, functions, td.SuperBagOf(
+		td.Struct(values.TemplateFunction{
+			Name:        "ipInNetwork",
+			Signature:   "ipInNetwork(string, string) (bool, error)",
+			Description: "Asserts that an IP address belongs to a network",
+			Plugin:      "netutils",
+		}, td.StructFields{"Func": td.NotNil()}),
+		td.Struct(values.TemplateFunction{Name: "jq", Signature: "jq QUERY DATA"}, td.StructFields{"Description": td.NotEmpty()}),
+	))
+	for i := 1; i < len(functions); i++ {
+		td.CmpLt(t, functions[i-1].Name, functions[i].Name)
+	}
+}
@@ -0,0 +1,255 @@
+package values
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/itchyny/gojq"
+	"github.com/juju/errors"
+	"github.com/ohler55/ojg/jp"
+
+	"github.com/ovh/utask/pkg/utils"
+)
+
+// JQOutputVariables are the variables available to the queries of the "jq" output strategy,
+// on top of the output of the step given as input
+var JQOutputVariables = []string{"$metadata", "$iterator", "$step", "$input"}
+
+// queryCacheSize bounds the number of compiled jq queries, and of parsed JSONPath expressions, kept in memory
+const queryCacheSize = 1000
+
+var (
+	jqQueries     = utils.NewLRU[string, *gojq.Code](queryCacheSize)
+	jsonPathExprs = utils.NewLRU[string, jp.Expr](queryCacheSize)
+)
+
+// CompileJQ parses and compiles a jq query, declaring the given variables;
+// the most recently used compiled queries are cached
+func CompileJQ(query string, variables ...string) (*gojq.Code, error) {
+	key := strings.Join(variables, ",") + ":" + query
+	if code, ok := jqQueries.Get(key); ok {
+		return code, nil
+	}
+
+	q, err := gojq.Parse(query)
+	if err != nil {
+		return nil, errors.NewBadRequest(err, "jq query error")
+	}
+	code, err := gojq.Compile(q, gojq.WithVariables(variables))
+	if err != nil {
+		return nil, errors.NewBadRequest(err, "jq query error")
+	}
+	jqQueries.Add(key, code)
+	return code, nil
+}
+
+// CompileJSONPath parses a JSONPath expression; the most recently used parsed expressions are cached
+func CompileJSONPath(path string) (jp.Expr, error) {
+	if x, ok := jsonPathExprs.Get(path); ok {
+		return x, nil
+	}
+
+	x, err := jp.ParseString(path)
+	if err != nil {
+		return nil, errors.NewBadRequest(err, "JSONPath error")
+	}
+	jsonPathExprs.Add(path, x)
+	return x, nil
+}
+
+// runJQ runs a compiled query on an input: a single result is returned as is,
+// several results as a list, and no result as nil
+func runJQ(code *gojq.Code, input interface{}, vars ...interface{}) (interface{}, error) {
+	for i := range vars {
+		vars[i] = queryNative(vars[i])
+	}
+
+	results := []interface{}{}
+	iter := code.Run(queryNative(input), vars...)
+	for {
+		res, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok := res.(error); ok {
+			var haltErr *gojq.HaltError
+			if errors.As(err, &haltErr) && haltErr.Value() == nil {
+				break
+			}
+			return nil, errors.NewBadRequest(err, "jq evaluation error")
+		}
+		results = append(results, res)
+	}
+	return queryResult(results), nil
+}
+
+func queryResult(results []interface{}) interface{} {
+	switch len(results) {
+	case 0:
+		return nil
+	case 1:
+		return results[0]
+	}
+	return results
+}
+
+// jqTmpl is the "jq" templating function, the data comes last to be given through a pipeline:
+// {{ .step.foo.output | jq ".items[].id" }}
+func jqTmpl(query string, data interface{}) (interface{}, error) {
+	code, err := CompileJQ(query)
+	if err != nil {
+		return nil, err
+	}
+	return runJQ(code, data)
+}
+
+// jsonPathTmpl is the "jsonpath" templating function:
+// {{ .step.foo.output | jsonpath "$.items[*].id" }}
+func jsonPathTmpl(path string, data interface{}) (interface{}, error) {
+	x, err := CompileJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return queryResult(x.Get(queryNative(data))), nil
+}
+
+// ApplyJQ runs a jq query on the output of a step, exposing its metadata, iterator,
+// the values of the step and the inputs of the task as variables (see JQOutputVariables)
+func (v *Values) ApplyJQ(query string, output, metadata, item interface{}, stepName string) (interface{}, error) {
+	code, err := CompileJQ(query, JQOutputVariables...)
+	if err != nil {
+		return nil, err
+	}
+	return runJQ(code, output, metadata, item, v.GetSteps()[stepName], v.m[InputKey])
+}
+
+// queryNative converts values to types understood by gojq and ojg: numbers are integers when they can be,
+// and data not made of maps, lists and scalars is converted through its JSON representation
+func queryNative(i interface{}) interface{} {
+	switch t := i.(type) {
+	case nil, string, bool, float64, int:
+		return t
+	case int64:
+		return int(t)
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return int(n)
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[k] = queryNative(val)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for idx, val := range t {
+			l[idx] = queryNative(val)
+		}
+		return l
+	}
+
+	b, err := utils.JSONMarshal(i)
+	if err != nil {
+		return nil
+	}
+	var generic interface{}
+	if err := utils.JSONnumberUnmarshal(bytes.NewReader(b), &generic); err != nil {
+		return nil
+	}
+	return queryNative(generic)
+}
+
+// CheckQueries compiles the literal queries given to the "jq" and "jsonpath" functions
+// in a template, to report their errors before the template is executed
+// templates which can't be parsed are left to the templating engine
+func CheckQueries(tmpl string) error {
+	if !strings.Contains(tmpl, "jq") && !strings.Contains(tmpl, "jsonpath") {
+		return nil
+	}
+	t, err := template.New("check").Funcs(NewValues().funcMap).Parse(tmpl)
+	if err != nil {
+		return nil
+	}
+
+	var walkErr error
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		if walkErr != nil || n == nil {
+			return
+		}
+		switch node := n.(type) {
+		case *parse.ListNode:
+			if node == nil {
+				return
+			}
+			for _, c := range node.Nodes {
+				walk(c)
+			}
+		case *parse.ActionNode:
+			walk(node.Pipe)
+		case *parse.PipeNode:
+			if node == nil {
+				return
+			}
+			for _, cmd := range node.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			walkErr = checkQueryCommand(node)
+			for _, arg := range node.Args {
+				walk(arg)
+			}
+		case *parse.IfNode:
+			walk(node.Pipe)
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.RangeNode:
+			walk(node.Pipe)
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.WithNode:
+			walk(node.Pipe)
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.TemplateNode:
+			walk(node.Pipe)
+		}
+	}
+	for _, tree := range t.Templates() {
+		if tree.Tree != nil {
+			walk(tree.Tree.Root)
+		}
+	}
+	return walkErr
+}
+
+func checkQueryCommand(cmd *parse.CommandNode) error {
+	if len(cmd.Args) < 2 {
+		return nil
+	}
+	fn, ok := cmd.Args[0].(*parse.IdentifierNode)
+	if !ok {
+		return nil
+	}
+	query, ok := cmd.Args[1].(*parse.StringNode)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch fn.Ident {
+	case "jq":
+		_, err = CompileJQ(query.Text)
+	case "jsonpath":
+		_, err = CompileJSONPath(query.Text)
+	}
+	if err != nil {
+		return errors.Annotatef(err, "%s %q", fn.Ident, query.Text)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package values_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/maxatome/go-testdeep/td"
+
+	"github.com/ovh/utask/engine/values"
+)
+
+func TestQueries(t *testing.T) {
+	v := values.NewValues()
+	v.SetInput(map[string]interface{}{"zone": "eu"})
+	v.SetOutput("servers", map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"id": json.Number("1"), "zone": "eu"},
+			map[string]interface{}{"id": json.Number("2"), "zone": "us"},
+			map[string]interface{}{"id": json.Number("3"), "zone": "eu"},
+		},
+	})
+	v.SetMetadata("servers", map[string]interface{}{"status": json.Number("200")})
+
+	output, err := v.Apply(`{{ .step.servers.output | jq "[.items[] | select(.zone == \"eu\") | .id]" | toJson }}`, nil, "")
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, string(output), "[1,3]")
+
+	output, err = v.Apply(`{{ .step.servers.output | jq ".items[0].id" }} {{ .step.servers.metadata | jq ".status + 1" }} {{ .step.servers.output | jq ".missing" }}`, nil, "")
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, string(output), "1 201 <no value>")
+
+	output, err = v.Apply(`{{ .step.servers.output | jsonpath "$.items[?(@.zone == 'eu')].id" | toJson }} {{ .step.servers.output | jsonpath "$.items[1].zone" }}`, nil, "")
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, string(output), "[1,3] us")
+
+	_, err = v.Apply(`{{ .step.servers.output | jq ".items[] | error(\"boom\")" }}`, nil, "")
+	td.CmpContains(t, err, "boom")
+
+	res, err := v.ApplyJQ(`{ids: [.items[] | select(.zone == $input.zone) | .id], status: $metadata.status, index: $iterator}`,
+		v.GetOutput("servers"), v.GetMetadata("servers"), json.Number("4"), "servers")
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, res, map[string]interface{}{"ids": []interface{}{1, 3}, "status": 200, "index": 4})
+
+	_, err = v.ApplyJQ(`.items[`, nil, nil, nil, "servers")
+	td.CmpTrue(t, errors.IsBadRequest(err))
+}
+
+func TestCheckQueries(t *testing.T) {
+	for _, tmpl := range []string{
+		`no query here`,
+		`{{ .step.foo.output | jq ".items[] | .id" }}`,
+		`{{ if true }}{{ jsonpath "$.items[*]" .input }}{{ end }}`,
+		`{{ jq .input.query .input }}`,
+		`{{ .input.foo`,
+	} {
+		td.CmpNoError(t, values.CheckQueries(tmpl), tmpl)
+	}
+
+	for _, tmpl := range []string{
+		`{{ .step.foo.output | jq ".items[" }}`,
+		`{{ range .input.list }}{{ . | jq "{" }}{{ end }}`,
+		`{{ .step.foo.output | jsonpath "$.items[" | toJson }}`,
+	} {
+		td.CmpError(t, values.CheckQueries(tmpl), tmpl)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 	"text/template"
 	"time"
 
@@ -39,20 +41,32 @@ const (
 	MaxRetriesKey = "max_retries"
 )
 
+// ConcealedValue replaces the values of secrets wherever they appear in step results
+const ConcealedValue = "**__SECRET__**"
+
+// MinConcealedLength is the length under which a secret value is not concealed:
+// masking shorter values would hide unrelated substrings of step results
+const MinConcealedLength = 6
+
 // Values is a container for all the live data of a running task
 type Values struct {
 	m       map[string]interface{}
 	funcMap map[string]interface{}
+	secrets map[string]string
+	// secret values, longest first, to be concealed from step results
+	concealed []string
 }
 
-// Variable holds a named variable, with either a JS expression to be evalued
-// or a concrete value
+// Variable holds a named variable, with either an expression to be evalued
+// (JS by default, or CEL) or a concrete value
 type Variable struct {
-	Name              string      `json:"name"`
-	Expression        string      `json:"expression"`
-	ExpressionTimeout string      `json:"expression_timeout"`
-	Value             interface{} `json:"value"`
-	evalCachedResult  interface{}
+	Name                string      `json:"name"`
+	Expression          string      `json:"expression"`
+	ExpressionEngine    string      `json:"expression_engine,omitempty"`
+	ExpressionTimeout   string      `json:"expression_timeout"`
+	ExpressionCostLimit uint64      `json:"expression_cost_limit,omitempty"`
+	Value               interface{} `json:"value"`
+	evalCachedResult    interface{}
 }
 
 // NewValues instantiates a new Values holder,
@@ -80,6 +94,10 @@ func NewValues() *Values {
 	v.funcMap["uuid"] = uuid.NewV4
 	v.funcMap["b64RawEnc"] = v.b64RawEnc
 	v.funcMap["b64RawDec"] = v.b64RawDec
+	v.funcMap["secret"] = v.secret
+	v.funcMap["jq"] = jqTmpl
+	v.funcMap["jsonpath"] = jsonPathTmpl
+	addPluginFunctions(v.funcMap)
 
 	return v
 }
@@ -87,6 +105,8 @@ func NewValues() *Values {
 // Clone duplicates the values object
 func (v *Values) Clone() (*Values, error) {
 	n := NewValues()
+	n.secrets = v.secrets
+	n.concealed = v.concealed
 
 	for key, val := range v.m {
 		if val == nil {
@@ -139,6 +159,76 @@ func (v *Values) SetConfig(cfg map[string]interface{}) {
 	v.m[ConfigKey] = cfg
 }
 
+// SetSecrets stores the secrets readable by the running task, indexed by name
+// they are never exposed in the values map, only through the "secret" templating function
+func (v *Values) SetSecrets(secrets map[string]string) {
+	v.secrets = secrets
+	v.concealed = make([]string, 0, len(secrets))
+	for _, s := range secrets {
+		if len(s) >= MinConcealedLength {
+			v.concealed = append(v.concealed, s)
+		}
+	}
+	sort.Slice(v.concealed, func(i, j int) bool { return len(v.concealed[i]) > len(v.concealed[j]) })
+}
+
+// Conceal returns a copy of the given data where every occurrence
+// of a secret value has been replaced by ConcealedValue
+// data is returned untouched if it doesn't contain any secret
+func (v *Values) Conceal(data interface{}) interface{} {
+	if len(v.concealed) == 0 || data == nil {
+		return data
+	}
+
+	ba, err := utils.JSONMarshal(data)
+	if err != nil {
+		return data
+	}
+	var generic interface{}
+	if err := utils.JSONnumberUnmarshal(bytes.NewReader(ba), &generic); err != nil {
+		return data
+	}
+
+	concealed, changed := v.conceal(generic)
+	if !changed {
+		return data
+	}
+	return concealed
+}
+
+// ConcealString replaces every occurrence of a secret value in a string by ConcealedValue
+func (v *Values) ConcealString(s string) string {
+	for _, secret := range v.concealed {
+		s = strings.ReplaceAll(s, secret, ConcealedValue)
+	}
+	return s
+}
+
+func (v *Values) conceal(data interface{}) (interface{}, bool) {
+	switch d := data.(type) {
+	case string:
+		s := v.ConcealString(d)
+		return s, s != d
+	case map[string]interface{}:
+		changed := false
+		for k, val := range d {
+			n, c := v.conceal(val)
+			d[k] = n
+			changed = changed || c
+		}
+		return d, changed
+	case []interface{}:
+		changed := false
+		for i, val := range d {
+			n, c := v.conceal(val)
+			d[i] = n
+			changed = changed || c
+		}
+		return d, changed
+	}
+	return data, false
+}
+
 // GetOutput returns the output of a named step
 func (v *Values) GetOutput(stepName string) interface{} {
 	return v.getStepData(stepName, OutputKey)
@@ -332,40 +422,47 @@ func (v *Values) Apply(templateStr string, item interface{}, stepName string) ([
 
 	b := new(bytes.Buffer)
 
+	defer v.setContext(item, stepName)()
+
+	err = tmpl.Execute(b, v.m)
+	if err != nil {
+		return nil, errors.NewBadRequest(err, "Templating error")
+	}
+
+	return b.Bytes(), nil
+}
+
+// setContext exposes the current item of an iteration, and the data of the step
+// being evaluated as the step "this"; the returned function cleans them up
+func (v *Values) setContext(item interface{}, stepName string) func() {
 	if item != nil {
 		v.SetIterator(item)
-		defer v.UnsetIterator()
 	}
 
 	if stepName != "" {
 		v.SetOutput(utask.This, v.GetOutput(stepName))
-		defer v.UnsetOutput(utask.This)
-
 		v.SetMetadata(utask.This, v.GetMetadata(stepName))
-		defer v.UnsetMetadata(utask.This)
-
 		v.SetChildren(utask.This, v.GetChildren(stepName))
-		defer v.UnsetChildren(utask.This)
-
 		v.SetError(utask.This, v.GetError(stepName))
-		defer v.UnsetError(utask.This)
-
 		v.SetTryCount(utask.This, v.GetTryCount(stepName))
-		defer v.UnsetTryCount(utask.This)
-
 		v.SetMaxRetries(utask.This, v.GetMaxRetries(stepName))
-		defer v.UnsetMaxRetries(utask.This)
-
 		v.SetState(utask.This, v.GetState(stepName))
-		defer v.UnsetState(utask.This)
 	}
 
-	err = tmpl.Execute(b, v.m)
-	if err != nil {
-		return nil, errors.NewBadRequest(err, "Templating error")
+	return func() {
+		if stepName != "" {
+			v.UnsetState(utask.This)
+			v.UnsetMaxRetries(utask.This)
+			v.UnsetTryCount(utask.This)
+			v.UnsetError(utask.This)
+			v.UnsetChildren(utask.This)
+			v.UnsetMetadata(utask.This)
+			v.UnsetOutput(utask.This)
+		}
+		if item != nil {
+			v.UnsetIterator()
+		}
 	}
-
-	return b.Bytes(), nil
 }
 
 // templating funcs
@@ -468,6 +565,10 @@ func (v *Values) varEval(varName string) (interface{}, error) {
 		return string(valS), nil
 	}
 
+	if i.ExpressionEngine == ExpressionEngineCEL {
+		return v.EvalCEL(i.Expression, nil, "", i.ExpressionCostLimit)
+	}
+
 	exp, err := v.Apply(i.Expression, nil, "")
 	if err != nil {
 		return nil, err
@@ -514,6 +615,14 @@ func (v *Values) b64RawEnc(s string) string {
 	return base64.RawStdEncoding.EncodeToString([]byte(s))
 }
 
+func (v *Values) secret(name string) (string, error) {
+	s, ok := v.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("secret %q not found or not readable by this template", name)
+	}
+	return s, nil
+}
+
 var errTimedOut = errors.New("Timed out variable evaluation")
 
 func evalUnsafe(exp []byte, delay time.Duration) (v otto.Value, err error) {
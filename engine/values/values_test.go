@@ -150,3 +150,51 @@ foo.foo;`,
 	require.Nil(err)
 	assert.Cmp(string(outputba), "buzz")
 }
+
+func TestSecrets(t *testing.T) {
+	v := values.NewValues()
+	v.SetSecrets(map[string]string{
+		"db-password": "hunter2",
+		"token":       "s3cr3t-t0k3n",
+	})
+
+	output, err := v.Apply("{{ secret `db-password` }}", nil, "")
+	td.CmpNil(t, err)
+	td.Cmp(t, string(output), "hunter2")
+
+	_, err = v.Apply("{{ secret `unknown` }}", nil, "")
+	td.CmpContains(t, err, `secret "unknown" not found or not readable by this template`)
+
+	// secrets are carried over in cloned values
+	clone, err := v.Clone()
+	td.CmpNil(t, err)
+	output, err = clone.Apply("{{ secret `token` }}", nil, "")
+	td.CmpNil(t, err)
+	td.Cmp(t, string(output), "s3cr3t-t0k3n")
+
+	td.Cmp(t, v.ConcealString("password=hunter2"), "password="+values.ConcealedValue)
+
+	out := map[string]interface{}{
+		"headers": map[string]interface{}{"Authorization": "Bearer s3cr3t-t0k3n"},
+		"list":    []interface{}{"hunter2", 42},
+		"other":   "value",
+	}
+	td.Cmp(t, v.Conceal(out), map[string]interface{}{
+		"headers": map[string]interface{}{"Authorization": "Bearer " + values.ConcealedValue},
+		"list":    []interface{}{values.ConcealedValue, td.Ignore()},
+		"other":   "value",
+	})
+
+	// untouched data is returned as is
+	type result struct {
+		Value string `json:"value"`
+	}
+	res := result{Value: "nothing to hide"}
+	td.Cmp(t, v.Conceal(res), res)
+	td.Cmp(t, v.Conceal(result{Value: "hunter2"}), map[string]interface{}{"value": values.ConcealedValue})
+
+	// short secrets are not concealed, they would mask unrelated substrings
+	short := values.NewValues()
+	short.SetSecrets(map[string]string{"pin": "1234"})
+	td.Cmp(t, short.ConcealString("order 12345"), "order 12345")
+}
@@ -0,0 +1,115 @@
+// Command template-functions updates the list of templating functions declared in hack/template-schema.json,
+// with the builtin functions of µTask and the functions contributed by builtin plugins
+// and by the executor plugins found in an optional folder
+//
+//	go run ./hack/template-functions [-plugins ./plugins] [-schema hack/template-schema.json]
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ovh/utask/engine/values"
+	"github.com/ovh/utask/pkg/plugins"
+	"github.com/ovh/utask/pkg/plugins/builtin"
+)
+
+const (
+	definitionName   = "TemplateFunctions"
+	definitionIndent = "        "
+)
+
+func main() {
+	schemaPath := flag.String("schema", "hack/template-schema.json", "path of the template json-schema to update")
+	pluginsPath := flag.String("plugins", "", "folder of executor plugins contributing templating functions")
+	flag.Parse()
+
+	if err := run(*schemaPath, *pluginsPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(schemaPath, pluginsPath string) error {
+	if err := builtin.Register(); err != nil {
+		return err
+	}
+	if pluginsPath != "" {
+		if err := plugins.ExecutorsFromFolder(pluginsPath); err != nil {
+			return err
+		}
+	}
+
+	schema, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return err
+	}
+
+	definition, err := functionsDefinition(values.Functions())
+	if err != nil {
+		return err
+	}
+
+	// replace the definition in place, to keep the layout of the rest of the file
+	lines := strings.Split(string(schema), "\n")
+	start := -1
+	for i, l := range lines {
+		if l == definitionIndent+fmt.Sprintf("%q: {", definitionName) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return fmt.Errorf("definition %q not found in %s", definitionName, schemaPath)
+	}
+	end := -1
+	for i := start + 1; i < len(lines); i++ {
+		if lines[i] == definitionIndent+"}" || lines[i] == definitionIndent+"}," {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return fmt.Errorf("end of definition %q not found in %s", definitionName, schemaPath)
+	}
+
+	replacement := definitionIndent + fmt.Sprintf("%q: ", definitionName) + definition + strings.TrimPrefix(lines[end], definitionIndent+"}")
+	updated := append(append(append([]string{}, lines[:start]...), replacement), lines[end+1:]...)
+	return os.WriteFile(schemaPath, []byte(strings.Join(updated, "\n")), 0644)
+}
+
+func functionsDefinition(functions []values.TemplateFunction) (string, error) {
+	type function struct {
+		Const       string `json:"const"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	}
+	definition := struct {
+		Type        string     `json:"type"`
+		Description string     `json:"description"`
+		AnyOf       []function `json:"anyOf"`
+	}{
+		Type:        "string",
+		Description: "Functions available in templates, on top of Golang and Sprig functions",
+	}
+	for _, f := range functions {
+		description := f.Description
+		if f.Plugin != "" {
+			description = fmt.Sprintf("%s (plugin %s)", description, f.Plugin)
+		}
+		definition.AnyOf = append(definition.AnyOf, function{Const: f.Name, Title: f.Signature, Description: description})
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent(definitionIndent, "    ")
+	if err := enc.Encode(definition); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,286 @@
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/gofrs/uuid"
+	"github.com/juju/errors"
+	"github.com/loopfz/gadgeto/zesty"
+
+	"github.com/ovh/utask/db/pgjuju"
+	"github.com/ovh/utask/db/sqlgenerator"
+	"github.com/ovh/utask/pkg/auth"
+	"github.com/ovh/utask/pkg/now"
+	"github.com/ovh/utask/pkg/utils"
+)
+
+// Prefix is prepended to every generated token, to tell them apart from other bearer tokens
+const Prefix = "utask_"
+
+// LastUsedResolution is the minimum duration between two updates of a token's last usage timestamp
+var LastUsedResolution = time.Minute
+
+// Token is an API token, owned by a user or a service account,
+// restricted to a set of scopes. Only a hash of its secret is stored.
+// The groups of the owner are captured when the token is created, personal tokens
+// are revoked once their owner is seen with other groups.
+type Token struct {
+	ID            int64      `json:"-" db:"id"`
+	PublicID      string     `json:"id" db:"public_id"`
+	Name          string     `json:"name" db:"name"`
+	OwnerUsername string     `json:"owner_username" db:"owner_username"`
+	CreatedBy     string     `json:"created_by" db:"created_by"`
+	Groups        []string   `json:"groups" db:"groups"`
+	Scopes        []string   `json:"scopes" db:"scopes"`
+	Hash          string     `json:"-" db:"token_hash"`
+	Created       time.Time  `json:"created" db:"created"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	LastUsed      *time.Time `json:"last_used,omitempty" db:"last_used"`
+	// Secret is only known right after the token's creation
+	Secret string `json:"token,omitempty" db:"-"`
+}
+
+// Create generates a new token and stores its hash in DB
+// the returned token holds the secret, which can't be retrieved afterwards
+func Create(dbp zesty.DBProvider, name, owner, createdBy string, groups, scopes []string, expiresAt *time.Time) (t *Token, err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to create API token")
+
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	t = &Token{
+		PublicID:      uuid.Must(uuid.NewV4()).String(),
+		Name:          name,
+		OwnerUsername: owner,
+		CreatedBy:     createdBy,
+		Groups:        groups,
+		Scopes:        scopes,
+		Hash:          hash(secret),
+		Created:       now.Get(),
+		ExpiresAt:     expiresAt,
+		Secret:        secret,
+	}
+
+	if err := t.Valid(); err != nil {
+		return nil, err
+	}
+
+	if err := dbp.DB().Insert(t); err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+
+	return t, nil
+}
+
+// LoadFromPublicID returns a token, given its public identifier
+func LoadFromPublicID(dbp zesty.DBProvider, publicID string) (t *Token, err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to load API token from public id")
+
+	return load(dbp, squirrel.Eq{`"api_token".public_id`: publicID})
+}
+
+// Authenticate returns the token matching a secret, if it hasn't expired
+// a personal token is revoked if its owner was since authenticated with other groups
+// its last usage timestamp is updated along the way
+func Authenticate(dbp zesty.DBProvider, secret string) (*Token, error) {
+	if !strings.HasPrefix(secret, Prefix) {
+		return nil, errors.Unauthorizedf("Invalid API token")
+	}
+
+	t, err := load(dbp, squirrel.Eq{`"api_token".token_hash`: hash(secret)})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, errors.Unauthorizedf("Invalid API token")
+		}
+		return nil, err
+	}
+
+	n := now.Get()
+	if t.ExpiresAt != nil && t.ExpiresAt.Before(n) {
+		return nil, errors.Unauthorizedf("Expired API token")
+	}
+
+	outdated, err := t.outdated(dbp)
+	if err != nil {
+		return nil, err
+	}
+	if outdated {
+		if err := t.Revoke(dbp); err != nil {
+			return nil, err
+		}
+		return nil, errors.Unauthorizedf("Revoked API token: the groups of its owner changed")
+	}
+
+	if t.LastUsed == nil || n.Sub(*t.LastUsed) > LastUsedResolution {
+		t.LastUsed = &n
+		if _, err := dbp.DB().Exec(`UPDATE "api_token" SET last_used = $1 WHERE id = $2`, n, t.ID); err != nil {
+			return nil, pgjuju.Interpret(err)
+		}
+	}
+
+	return t, nil
+}
+
+func load(dbp zesty.DBProvider, where squirrel.Sqlizer) (*Token, error) {
+	query, params, err := tSelector.Where(where).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var t Token
+	if err := dbp.DB().SelectOne(&t, query, params...); err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+
+	return &t, nil
+}
+
+// ListTokens returns the tokens owned by a user, or all the tokens if owner is nil
+func ListTokens(dbp zesty.DBProvider, owner *string, pageSize uint64, last *string) (tt []*Token, err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to list API tokens")
+
+	sel := tSelector.Limit(pageSize)
+
+	if owner != nil {
+		sel = sel.Where(squirrel.Eq{`"api_token".owner_username`: *owner})
+	}
+
+	if last != nil {
+		lastT, err := LoadFromPublicID(dbp, *last)
+		if err != nil {
+			return nil, err
+		}
+		sel = sel.Where(`"api_token".id > ?`, lastT.ID)
+	}
+
+	query, params, err := sel.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = dbp.DB().Select(&tt, query, params...)
+	if err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+
+	return tt, nil
+}
+
+// Revoke removes a token from DB, it can't be used anymore
+func (t *Token) Revoke(dbp zesty.DBProvider) (err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to revoke API token")
+
+	rows, err := dbp.DB().Delete(t)
+	if err != nil {
+		return pgjuju.Interpret(err)
+	} else if rows == 0 {
+		return errors.NotFoundf("No such API token to revoke: %s", t.PublicID)
+	}
+
+	return nil
+}
+
+// SetOwnerGroups records the groups a user was last authenticated with, for all instances
+// the personal tokens of the user which carry other groups are revoked on their next use
+func SetOwnerGroups(dbp zesty.DBProvider, owner string, groups []string) (err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to record the groups of API tokens owner %q", owner)
+
+	groupsJSON, err := groupsJSON(groups)
+	if err != nil {
+		return err
+	}
+
+	_, err = dbp.DB().Exec(
+		`INSERT INTO "api_token_owner" (username, groups, updated) VALUES ($1, $2::jsonb, now())
+		ON CONFLICT (username) DO UPDATE SET groups = EXCLUDED.groups, updated = EXCLUDED.updated
+		WHERE NOT ("api_token_owner".groups @> EXCLUDED.groups AND "api_token_owner".groups <@ EXCLUDED.groups)`,
+		owner, groupsJSON,
+	)
+	if err != nil {
+		return pgjuju.Interpret(err)
+	}
+	return nil
+}
+
+// outdated tells whether a personal token carries other groups than those its owner was last authenticated with
+// tokens of service accounts never are
+func (t *Token) outdated(dbp zesty.DBProvider) (bool, error) {
+	if t.CreatedBy != t.OwnerUsername {
+		return false, nil
+	}
+
+	groupsJSON, err := groupsJSON(t.Groups)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := dbp.DB().SelectInt(
+		`SELECT count(*) FROM "api_token_owner" WHERE username = $1 AND NOT (groups @> $2::jsonb AND groups <@ $2::jsonb)`,
+		t.OwnerUsername, groupsJSON,
+	)
+	if err != nil {
+		return false, pgjuju.Interpret(err)
+	}
+	return count > 0, nil
+}
+
+func groupsJSON(groups []string) (string, error) {
+	if groups == nil {
+		groups = []string{}
+	}
+	ba, err := json.Marshal(groups)
+	return string(ba), err
+}
+
+// Valid asserts that a token's name, owner and scopes are correct
+func (t *Token) Valid() error {
+	if err := utils.ValidString("token name", t.Name); err != nil {
+		return err
+	}
+	if err := utils.ValidString("token owner", t.OwnerUsername); err != nil {
+		return err
+	}
+	if len(t.Scopes) == 0 {
+		return errors.BadRequestf("Token scopes can't be empty")
+	}
+	for _, s := range t.Scopes {
+		if err := auth.ValidScope(s); err != nil {
+			return err
+		}
+	}
+	if t.ExpiresAt != nil && t.ExpiresAt.Before(now.Get()) {
+		return errors.BadRequestf("Token expiration can't be in the past")
+	}
+	return nil
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return Prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// secrets are random and long enough for a fast hash to be safe
+func hash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+var tSelector = sqlgenerator.PGsql.Select(
+	`"api_token".id, "api_token".public_id, "api_token".name, "api_token".owner_username, "api_token".created_by, "api_token".groups, "api_token".scopes, "api_token".token_hash, "api_token".created, "api_token".expires_at, "api_token".last_used`,
+).From(
+	`"api_token"`,
+).OrderBy(
+	`"api_token".id`,
+)
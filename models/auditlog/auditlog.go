@@ -0,0 +1,130 @@
+package auditlog
+
+import (
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/juju/errors"
+	"github.com/loopfz/gadgeto/zesty"
+
+	"github.com/ovh/utask/db/pgjuju"
+	"github.com/ovh/utask/db/sqlgenerator"
+	"github.com/ovh/utask/pkg/now"
+)
+
+// Event is the record of an action performed through the API:
+// who did it, on behalf of which privileges, on which task, and what it changed
+// events are never modified, and survive the deletion of the tasks they refer to
+type Event struct {
+	ID           int64                  `json:"id" db:"id"`
+	Created      time.Time              `json:"created" db:"created"`
+	Actor        string                 `json:"actor,omitempty" db:"actor"`
+	TokenID      string                 `json:"token_id,omitempty" db:"token_id"`
+	SUDO         bool                   `json:"sudo" db:"sudo"`
+	Action       string                 `json:"action" db:"action"`
+	Method       string                 `json:"method" db:"method"`
+	Path         string                 `json:"path" db:"path"`
+	Status       int                    `json:"status" db:"status"`
+	RequestID    string                 `json:"request_id,omitempty" db:"request_id"`
+	TaskID       string                 `json:"task_id,omitempty" db:"task_id"`
+	ResolutionID string                 `json:"resolution_id,omitempty" db:"resolution_id"`
+	TemplateName string                 `json:"template_name,omitempty" db:"template_name"`
+	OldState     string                 `json:"old_state,omitempty" db:"old_state"`
+	NewState     string                 `json:"new_state,omitempty" db:"new_state"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty" db:"metadata"`
+}
+
+// Filter restricts the events returned by ListEvents, empty fields are ignored
+type Filter struct {
+	Actor        string
+	Action       string
+	TaskID       string
+	ResolutionID string
+	TemplateName string
+	SUDO         *bool
+	After        *time.Time
+	Before       *time.Time
+}
+
+// Insert stores an event
+func (e *Event) Insert(dbp zesty.DBProvider) (err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to insert audit event %q", e.Action)
+
+	if e.Created.IsZero() {
+		e.Created = now.Get()
+	}
+	if e.Metadata == nil {
+		e.Metadata = map[string]interface{}{}
+	}
+	if err := dbp.DB().Insert(e); err != nil {
+		return pgjuju.Interpret(err)
+	}
+	return nil
+}
+
+// ListEvents returns the events matching a filter, most recent events first
+func ListEvents(dbp zesty.DBProvider, f Filter, pageSize uint64, last *int64) (events []*Event, err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to list audit events")
+
+	sel := eSelector.Limit(pageSize)
+
+	eq := squirrel.Eq{}
+	for column, value := range map[string]string{
+		`"audit_event".actor`:         f.Actor,
+		`"audit_event".action`:        f.Action,
+		`"audit_event".task_id`:       f.TaskID,
+		`"audit_event".resolution_id`: f.ResolutionID,
+		`"audit_event".template_name`: f.TemplateName,
+	} {
+		if value != "" {
+			eq[column] = value
+		}
+	}
+	if f.SUDO != nil {
+		eq[`"audit_event".sudo`] = *f.SUDO
+	}
+	if len(eq) > 0 {
+		sel = sel.Where(eq)
+	}
+	if f.After != nil {
+		sel = sel.Where(squirrel.GtOrEq{`"audit_event".created`: *f.After})
+	}
+	if f.Before != nil {
+		sel = sel.Where(squirrel.Lt{`"audit_event".created`: *f.Before})
+	}
+	if last != nil {
+		sel = sel.Where(squirrel.Lt{`"audit_event".id`: *last})
+	}
+
+	query, params, err := sel.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	events = []*Event{}
+	if _, err := dbp.DB().Select(&events, query, params...); err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+	return events, nil
+}
+
+// DeleteOldEvents removes the events older than the retention period
+func DeleteOldEvents(dbp zesty.DBProvider, retention time.Duration) (err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to delete old audit events")
+
+	if _, err := dbp.DB().Exec(
+		`DELETE FROM "audit_event" WHERE created < $1`,
+		now.Get().Add(-retention),
+	); err != nil {
+		return pgjuju.Interpret(err)
+	}
+	return nil
+}
+
+var eSelector = sqlgenerator.PGsql.Select(
+	`"audit_event".id, "audit_event".created, "audit_event".actor, "audit_event".token_id, "audit_event".sudo, "audit_event".action, "audit_event".method, "audit_event".path, "audit_event".status, "audit_event".request_id, "audit_event".task_id, "audit_event".resolution_id, "audit_event".template_name, "audit_event".old_state, "audit_event".new_state, "audit_event".metadata`,
+).From(
+	`"audit_event"`,
+).OrderBy(
+	`"audit_event".id DESC`,
+)
@@ -0,0 +1,218 @@
+package resolution
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/juju/errors"
+	"github.com/loopfz/gadgeto/zesty"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/db/pgjuju"
+	"github.com/ovh/utask/db/sqlgenerator"
+	"github.com/ovh/utask/engine/step"
+	"github.com/ovh/utask/models"
+	"github.com/ovh/utask/pkg/now"
+	"github.com/ovh/utask/pkg/utils"
+)
+
+// MaxAttemptOutputSize is the size after which the output of a step is truncated in its attempt log
+const MaxAttemptOutputSize = 4096
+
+// StepAttempt is an entry of the attempt log of a resolution's step:
+// every execution of the step's action is recorded, encrypted in DB, and never modified afterwards
+type StepAttempt struct {
+	ID               int64     `json:"id" db:"id"`
+	ResolutionID     int64     `json:"-" db:"id_resolution"`
+	StepName         string    `json:"-" db:"step_name"`
+	Created          time.Time `json:"-" db:"created"`
+	EncryptedContent []byte    `json:"-" db:"encrypted_content"`
+
+	StepAttemptContent `db:"-"`
+}
+
+// StepAttemptContent is the content of an attempt, persisted in an encrypted blob
+type StepAttemptContent struct {
+	TryCount        int       `json:"try_count" db:"-"`
+	Plugin          string    `json:"plugin" db:"-"`
+	ConfigHash      string    `json:"config_hash" db:"-"`
+	Start           time.Time `json:"start" db:"-"`
+	End             time.Time `json:"end" db:"-"`
+	State           string    `json:"state" db:"-"`
+	Error           string    `json:"error,omitempty" db:"-"`
+	Output          string    `json:"output,omitempty" db:"-"`
+	OutputTruncated bool      `json:"output_truncated,omitempty" db:"-"`
+}
+
+// NewStepAttempt builds the attempt log entry of the last run of a step,
+// nil if its action was not executed during that run
+func NewStepAttempt(r *Resolution, s *step.Step) *StepAttempt {
+	plugin, duration := s.LastExecution()
+	start, configHash := s.LastExecutionDetails()
+	if plugin == "" || start.IsZero() {
+		return nil
+	}
+
+	a := &StepAttempt{
+		ResolutionID: r.ID,
+		StepName:     s.Name,
+		StepAttemptContent: StepAttemptContent{
+			TryCount:   s.TryCount,
+			Plugin:     plugin,
+			ConfigHash: configHash,
+			Start:      start,
+			End:        start.Add(duration),
+			State:      s.State,
+			Error:      s.Error,
+		},
+	}
+	if s.Output != nil {
+		output, err := utils.JSONMarshal(s.Output)
+		if err != nil {
+			output = []byte(fmt.Sprint(s.Output))
+		}
+		a.Output, a.OutputTruncated = truncate(string(output), MaxAttemptOutputSize)
+	}
+	return a
+}
+
+// truncate cuts a string to a maximum size in bytes, without breaking UTF-8 characters
+func truncate(s string, size int) (string, bool) {
+	if len(s) <= size {
+		return s, false
+	}
+	for size > 0 && !utf8.RuneStart(s[size]) {
+		size--
+	}
+	return s[:size], true
+}
+
+// Insert appends an attempt to the log of its step
+func (a *StepAttempt) Insert(dbp zesty.DBProvider) (err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to insert attempt of step %q", a.StepName)
+
+	a.Created = now.Get()
+	if err := a.encrypt(); err != nil {
+		return err
+	}
+	if err := dbp.DB().Insert(a); err != nil {
+		return pgjuju.Interpret(err)
+	}
+	return nil
+}
+
+// ListStepAttempts returns the attempt log of a resolution's step, oldest attempts first
+func ListStepAttempts(dbp zesty.DBProvider, r *Resolution, stepName string, pageSize uint64, last *int64) (attempts []*StepAttempt, err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to list attempts of step %q", stepName)
+
+	sel := saSelector.Where(squirrel.Eq{
+		`"resolution_step_attempt".id_resolution`: r.ID,
+		`"resolution_step_attempt".step_name`:     stepName,
+	}).Limit(pageSize)
+
+	if last != nil {
+		sel = sel.Where(squirrel.Gt{`"resolution_step_attempt".id`: *last})
+	}
+
+	query, params, err := sel.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	attempts = []*StepAttempt{}
+	if _, err := dbp.DB().Select(&attempts, query, params...); err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+
+	for _, a := range attempts {
+		if err := a.decrypt(); err != nil {
+			return nil, err
+		}
+	}
+	return attempts, nil
+}
+
+// DeleteOldStepAttempts removes the attempts older than a given threshold,
+// the attempts of deleted resolutions being deleted along with them
+func DeleteOldStepAttempts(dbp zesty.DBProvider, threshold time.Duration) (err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to delete old step attempts")
+
+	if _, err := dbp.DB().Exec(
+		`DELETE FROM "resolution_step_attempt" WHERE created < $1`,
+		now.Get().Add(-threshold),
+	); err != nil {
+		return pgjuju.Interpret(err)
+	}
+	return nil
+}
+
+// RotateStepAttempts makes sure that all the attempts stored in DB
+// have been encrypted with the latest available storage key
+func RotateStepAttempts(dbp zesty.DBProvider) (err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to rotate encrypted step attempts to new key")
+
+	var last int64
+	for {
+		query, params, err := saSelector.Where(
+			squirrel.Gt{`"resolution_step_attempt".id`: last},
+		).Limit(utask.MaxPageSize).ToSql()
+		if err != nil {
+			return err
+		}
+
+		var attempts []*StepAttempt
+		if _, err := dbp.DB().Select(&attempts, query, params...); err != nil {
+			return pgjuju.Interpret(err)
+		}
+		if len(attempts) == 0 {
+			break
+		}
+		last = attempts[len(attempts)-1].ID
+
+		for _, a := range attempts {
+			if err := a.decrypt(); err != nil {
+				return err
+			}
+			if err := a.encrypt(); err != nil {
+				return err
+			}
+			if _, err := dbp.DB().Update(a); err != nil {
+				return pgjuju.Interpret(err)
+			}
+		}
+	}
+	return nil
+}
+
+// ClearOutput removes the output of an attempt
+func (a *StepAttempt) ClearOutput() {
+	a.Output = ""
+	a.OutputTruncated = false
+}
+
+func (a *StepAttempt) extraData() []byte {
+	return []byte(fmt.Sprintf("%d/%s", a.ResolutionID, a.StepName))
+}
+
+func (a *StepAttempt) encrypt() error {
+	encrypted, err := models.EncryptionKey.EncryptMarshal(a.StepAttemptContent, a.extraData())
+	if err != nil {
+		return err
+	}
+	a.EncryptedContent = []byte(encrypted)
+	return nil
+}
+
+func (a *StepAttempt) decrypt() error {
+	return models.EncryptionKey.DecryptMarshal(string(a.EncryptedContent), &a.StepAttemptContent, a.extraData())
+}
+
+var saSelector = sqlgenerator.PGsql.Select(
+	`"resolution_step_attempt".id, "resolution_step_attempt".id_resolution, "resolution_step_attempt".step_name, "resolution_step_attempt".created, "resolution_step_attempt".encrypted_content`,
+).From(
+	`"resolution_step_attempt"`,
+).OrderBy(
+	`"resolution_step_attempt".id`,
+)
@@ -617,6 +617,22 @@ func (r *Resolution) ClearOutputs() {
 	r.ResolverInput = map[string]interface{}{}
 }
 
+// ConcealSecrets replaces every occurrence of the given secret values
+// in the results and tags of steps by values.ConcealedValue
+// -> renders a view of a resolution which can leave the engine
+func (r *Resolution) ConcealSecrets(secrets map[string]string) {
+	v := values.NewValues()
+	v.SetSecrets(secrets)
+	for _, s := range r.Steps {
+		s.Output = v.Conceal(s.Output)
+		s.Metadata = v.Conceal(s.Metadata)
+		s.Error = v.ConcealString(s.Error)
+		for k, tag := range s.Tags {
+			s.Tags[k] = v.ConcealString(tag)
+		}
+	}
+}
+
 ///
 
 func (r *Resolution) setSteps(st map[string]*step.Step) {
@@ -649,6 +665,28 @@ func (r *Resolution) SetStepState(stepName, state string) {
 	r.Values.SetState(stepName, state)
 }
 
+// CarryOverStep copies the outcome of a step coming from another resolution
+// (output, metadata, children) and marks it as DONE, so that it won't be executed again
+func (r *Resolution) CarryOverStep(stepName string, src *step.Step) error {
+	s, ok := r.Steps[stepName]
+	if !ok {
+		return errors.NotFoundf("step %q in resolution", stepName)
+	}
+
+	s.Output = src.Output
+	s.Metadata = src.Metadata
+	s.Children = src.Children
+
+	if r.Values != nil {
+		r.Values.SetOutput(stepName, s.Output)
+		r.Values.SetMetadata(stepName, s.Metadata)
+		r.Values.SetChildren(stepName, s.Children)
+	}
+	r.SetStepState(stepName, step.StateDone)
+
+	return nil
+}
+
 // SetInput stores the inputs provided by the task's resolver
 func (r *Resolution) SetInput(input map[string]interface{}) {
 	r.ResolverInput = input
@@ -0,0 +1,303 @@
+package secret
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/juju/errors"
+	"github.com/loopfz/gadgeto/zesty"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/db/pgjuju"
+	"github.com/ovh/utask/db/sqlgenerator"
+	"github.com/ovh/utask/models"
+	"github.com/ovh/utask/pkg/now"
+	"github.com/ovh/utask/pkg/utils"
+)
+
+var nameRegexp = regexp.MustCompile(`^[a-z0-9_\-\.]+$`)
+
+// Secret is a named value stored encrypted in DB,
+// readable from task templates explicitly allowed by its ACL
+type Secret struct {
+	ID               int64     `json:"-" db:"id"`
+	Name             string    `json:"name" db:"name"`
+	Description      string    `json:"description" db:"description"`
+	AllowedTemplates []string  `json:"allowed_templates" db:"allowed_templates"`
+	Created          time.Time `json:"created" db:"created"`
+	Updated          time.Time `json:"updated" db:"updated"`
+	EncryptedValue   []byte    `json:"-" db:"encrypted_value"`
+	Value            string    `json:"-" db:"-"`
+}
+
+// Create inserts a new secret in DB, its value encrypted with the storage key
+func Create(dbp zesty.DBProvider, name, description, value string, allowedTemplates []string) (s *Secret, err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to create secret")
+
+	s = &Secret{
+		Name:             name,
+		Description:      description,
+		AllowedTemplates: allowedTemplates,
+		Created:          now.Get(),
+		Updated:          now.Get(),
+		Value:            value,
+	}
+
+	s.Normalize()
+
+	if err := s.Valid(); err != nil {
+		return nil, err
+	}
+
+	if err := s.encrypt(); err != nil {
+		return nil, err
+	}
+
+	if err := dbp.DB().Insert(s); err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+
+	return s, nil
+}
+
+// LoadFromName returns a secret, given its unique name, with its value decrypted
+func LoadFromName(dbp zesty.DBProvider, name string) (s *Secret, err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to load secret %q from name", name)
+
+	return load(dbp, squirrel.Eq{`"secret".name`: utils.NormalizeName(name)}, false)
+}
+
+func load(dbp zesty.DBProvider, where squirrel.Sqlizer, locked bool) (*Secret, error) {
+	sel := sSelector.Where(where)
+
+	if locked {
+		sel = sel.Suffix(`FOR NO KEY UPDATE OF "secret"`)
+	}
+
+	query, params, err := sel.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var s Secret
+	if err := dbp.DB().SelectOne(&s, query, params...); err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+
+	if err := s.decrypt(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// ListSecrets returns a list of secrets, without their values
+func ListSecrets(dbp zesty.DBProvider, pageSize uint64, last *string) (ss []*Secret, err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to list secrets")
+
+	sel := sSelector.Limit(pageSize)
+
+	if last != nil {
+		sel = sel.Where(squirrel.Gt{`"secret".name`: *last})
+	}
+
+	query, params, err := sel.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = dbp.DB().Select(&ss, query, params...)
+	if err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+
+	return ss, nil
+}
+
+// LoadValuesForTemplate returns the decrypted values of all the secrets
+// that a given task template is allowed to read, indexed by secret name
+func LoadValuesForTemplate(dbp zesty.DBProvider, templateName string) (vals map[string]string, err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to load secrets for template %q", templateName)
+
+	query, params, err := sSelector.Where(
+		squirrel.Expr(`"secret".allowed_templates @> ?::jsonb`, fmt.Sprintf("[%q]", templateName)),
+	).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var ss []*Secret
+	if _, err := dbp.DB().Select(&ss, query, params...); err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+
+	vals = make(map[string]string, len(ss))
+	for _, s := range ss {
+		if err := s.decrypt(); err != nil {
+			return nil, err
+		}
+		vals[s.Name] = s.Value
+	}
+
+	return vals, nil
+}
+
+// Update changes the description, value and ACL of a secret
+// nil values are left untouched
+func (s *Secret) Update(dbp zesty.DBProvider, description, value *string, allowedTemplates []string) (err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to update secret")
+
+	if description != nil {
+		s.Description = *description
+	}
+	if value != nil {
+		s.Value = *value
+	}
+	if allowedTemplates != nil {
+		s.AllowedTemplates = allowedTemplates
+	}
+	s.Updated = now.Get()
+
+	return s.update(dbp)
+}
+
+func (s *Secret) update(dbp zesty.DBProvider) error {
+	s.Normalize()
+
+	if err := s.Valid(); err != nil {
+		return err
+	}
+
+	if err := s.encrypt(); err != nil {
+		return err
+	}
+
+	rows, err := dbp.DB().Update(s)
+	if err != nil {
+		return pgjuju.Interpret(err)
+	} else if rows == 0 {
+		return errors.NotFoundf("No such secret to update: %s", s.Name)
+	}
+
+	return nil
+}
+
+// Delete removes a secret from DB
+func (s *Secret) Delete(dbp zesty.DBProvider) (err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to delete secret")
+
+	rows, err := dbp.DB().Delete(s)
+	if err != nil {
+		return pgjuju.Interpret(err)
+	} else if rows == 0 {
+		return errors.NotFoundf("No such secret to delete: %s", s.Name)
+	}
+
+	return nil
+}
+
+// Normalize transforms a secret's name and ACL into a standard format
+func (s *Secret) Normalize() {
+	s.Name = utils.NormalizeName(s.Name)
+	allowed := make([]string, 0, len(s.AllowedTemplates))
+	for _, t := range s.AllowedTemplates {
+		allowed = utils.AppendUniq(allowed, utils.NormalizeName(t))
+	}
+	s.AllowedTemplates = allowed
+}
+
+// Valid asserts that a secret's name and description are correct
+func (s *Secret) Valid() error {
+	if err := utils.ValidString("secret name", s.Name); err != nil {
+		return err
+	}
+	if !nameRegexp.MatchString(s.Name) {
+		return errors.BadRequestf("secret name should only contain lowercase alphanumeric characters, dashes, dots and underscores")
+	}
+	if s.Description != "" {
+		if err := utils.ValidText("secret description", s.Description); err != nil {
+			return err
+		}
+	}
+	if s.Value == "" {
+		return errors.BadRequestf("secret value can't be empty")
+	}
+	return nil
+}
+
+// IsAllowed asserts that a task template is allowed to read the secret
+func (s *Secret) IsAllowed(templateName string) bool {
+	return utils.ListContainsString(s.AllowedTemplates, utils.NormalizeName(templateName))
+}
+
+func (s *Secret) encrypt() (err error) {
+	s.EncryptedValue, err = models.EncryptionKey.Encrypt([]byte(s.Value), []byte(s.Name))
+	return err
+}
+
+func (s *Secret) decrypt() error {
+	value, err := models.EncryptionKey.Decrypt(s.EncryptedValue, []byte(s.Name))
+	if err != nil {
+		return err
+	}
+	s.Value = string(value)
+	return nil
+}
+
+// RotateSecrets loads all secrets stored in DB and makes sure
+// that their cyphered content has been handled with the latest
+// available storage key
+func RotateSecrets(dbp zesty.DBProvider) (err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to rotate encrypted secrets to new key")
+
+	var last string
+	for {
+		var lastName *string
+		if last != "" {
+			lastName = &last
+		}
+		// load all secrets
+		secrets, err := ListSecrets(dbp, utask.MaxPageSize, lastName)
+		if err != nil {
+			return err
+		}
+		if len(secrets) == 0 {
+			break
+		}
+		last = secrets[len(secrets)-1].Name
+
+		for _, sec := range secrets {
+			sp, err := dbp.TxSavepoint()
+			if err != nil {
+				return err
+			}
+			// load secret locked (decrypt)
+			s, err := load(dbp, squirrel.Eq{`"secret".id`: sec.ID}, true)
+			if err != nil {
+				dbp.RollbackTo(sp)
+				return err
+			}
+			// update secret (encrypt)
+			if err := s.update(dbp); err != nil {
+				dbp.RollbackTo(sp)
+				return err
+			}
+			// commit
+			if err := dbp.Commit(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+var sSelector = sqlgenerator.PGsql.Select(
+	`"secret".id, "secret".name, "secret".description, "secret".allowed_templates, "secret".created, "secret".updated, "secret".encrypted_value`,
+).From(
+	`"secret"`,
+).OrderBy(
+	`"secret".name`,
+)
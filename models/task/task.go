@@ -20,6 +20,7 @@ import (
 	"github.com/ovh/utask/engine/values"
 	"github.com/ovh/utask/models"
 	"github.com/ovh/utask/models/tasktemplate"
+	"github.com/ovh/utask/pkg/constants"
 	"github.com/ovh/utask/pkg/notify"
 	"github.com/ovh/utask/pkg/now"
 	"github.com/ovh/utask/pkg/utils"
@@ -433,6 +434,33 @@ func ListTasks(dbp zesty.DBProvider, filter ListFilter) (t []*Task, err error) {
 	return t, nil
 }
 
+// ListChildren returns the tasks spawned by a parent task, through the subtask and batch plugins,
+// in their order of creation
+func ListChildren(dbp zesty.DBProvider, parentPublicID string) (t []*Task, err error) {
+	defer errors.DeferredAnnotatef(&err, "Failed to list children of task %q", parentPublicID)
+
+	b, err := json.Marshal(map[string]string{constants.SubtaskTagParentTaskID: parentPublicID})
+	if err != nil {
+		return nil, err
+	}
+
+	query, params, err := tSelector.Where(
+		`"task".tags @> ?::jsonb`, string(b),
+	).OrderBy(
+		`"task".created`, `"task".id`,
+	).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	t = []*Task{}
+	if _, err := dbp.DB().Select(&t, query, params...); err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+
+	return t, nil
+}
+
 // Update commits changes to a task's state to DB
 // A flag allows to skip validation: only exposed internally for special
 // situations, where a task could be out of sync with its template
@@ -18,9 +18,16 @@ var (
 )
 
 // LoadFromDir reads yaml-formatted task templates
-// from a folder and upserts them in database
+// from a folder and upserts them in database.
+// Fragments found in the "fragments" sub-directory of each folder
+// are loaded beforehand, so that the templates of this folder can include them.
 func LoadFromDir(dbp zesty.DBProvider, directories ...string) error {
 	for _, dir := range directories {
+		fragmentsDir := path.Join(dir, FragmentsDirectory)
+		if err := LoadFragmentsFromDir(fragmentsDir); err != nil {
+			return err
+		}
+
 		files, err := os.ReadDir(dir)
 		if err != nil {
 			return fmt.Errorf("failed to open template directory %s: %s", dir, err)
@@ -40,6 +47,10 @@ func LoadFromDir(dbp zesty.DBProvider, directories ...string) error {
 
 			tt.Normalize()
 
+			if err := tt.ResolveIncludesFrom(fragmentsDir); err != nil {
+				return fmt.Errorf("failed to resolve includes of template '%s': %s", file.Name(), err)
+			}
+
 			discoveredTemplates = append(discoveredTemplates, tt)
 			templateimport.AddTemplate(tt.Name)
 		}
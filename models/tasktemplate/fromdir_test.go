@@ -15,6 +15,9 @@ import (
 	"github.com/ovh/utask"
 	"github.com/ovh/utask/db"
 	"github.com/ovh/utask/engine/step"
+	"github.com/ovh/utask/engine/step/condition"
+	"github.com/ovh/utask/engine/step/executor"
+	"github.com/ovh/utask/engine/values"
 	"github.com/ovh/utask/models/task"
 	"github.com/ovh/utask/models/tasktemplate"
 	"github.com/ovh/utask/pkg/now"
@@ -214,3 +217,102 @@ func TestDependenciesValidation(t *testing.T) {
 	err = tt.Valid()
 	assert.Contains(t, fmt.Sprint(err), "Invalid dependency, already defined dependency to: \"sayHello\"")
 }
+
+func TestCELExpressionsValidation(t *testing.T) {
+	tt := tasktemplate.TaskTemplate{}
+	tmpl, err := os.ReadFile(path.Join("templates_errors_tests", "error-variables.yaml"))
+	assert.Nil(t, err, "unable to read file error-variables.yaml")
+	err = yaml.Unmarshal(tmpl, &tt)
+	assert.Nil(t, err, "unable to unmarshal tasktemplate")
+	tt.Variables[0].Value = nil
+	tt.Variables[0].ExpressionEngine = values.ExpressionEngineCEL
+
+	tt.Variables[0].Expression = `"Hello " + input.language`
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Nil(t, err, "validation failed: %s", err)
+
+	tt.Variables[0].Expression = `"Hello " + input.lang`
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Contains(t, fmt.Sprint(err), "undefined field 'lang'")
+
+	tt.Variables[0].Expression = `input.language + 1`
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Contains(t, fmt.Sprint(err), "found no matching overload")
+
+	tt.Variables[0].Expression = `"Hello " + input.language`
+	tt.Variables[0].ExpressionTimeout = "10s"
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Contains(t, fmt.Sprint(err), "expression timeout cannot be defined for cel expressions")
+
+	tt.Variables[0].ExpressionTimeout = ""
+	tt.Variables[0].ExpressionEngine = "lua"
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Contains(t, fmt.Sprint(err), "expression engine \"lua\" is invalid")
+
+	tt.Variables[0].ExpressionEngine = values.ExpressionEngineCEL
+	tt.Steps["step2"].Conditions = []*condition.Condition{{
+		Type: condition.CHECK,
+		If:   []*condition.Assert{{Engine: values.ExpressionEngineCEL, Value: `step.sayHello.output.message.size() > 0`}},
+		Then: map[string]string{"this": "DONE"},
+	}}
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Nil(t, err, "validation failed: %s", err)
+
+	tt.Steps["step2"].Conditions[0].If[0].Value = `step.sayHello.output.message`
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Nil(t, err, "validation failed: %s", err)
+
+	tt.Steps["step2"].Conditions[0].If[0].Value = `input.language`
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Contains(t, fmt.Sprint(err), "expected a bool")
+
+	tt.Steps["step2"].Conditions[0].If[0].Value = `step.unknown.state == "DONE"`
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Contains(t, fmt.Sprint(err), "undefined field 'unknown'")
+}
+
+func TestQueriesValidation(t *testing.T) {
+	tt := tasktemplate.TaskTemplate{}
+	tmpl, err := os.ReadFile(path.Join("templates_errors_tests", "error-variables.yaml"))
+	assert.Nil(t, err, "unable to read file error-variables.yaml")
+	err = yaml.Unmarshal(tmpl, &tt)
+	assert.Nil(t, err, "unable to unmarshal tasktemplate")
+	tt.Variables[0].Value = nil
+
+	tt.ResultFormat["echo_message"] = `{{ .step.sayHello.output | jq ".message | ascii_upcase" }}`
+	tt.ResultFormat["echo_when"] = `{{ .step.sayHello.output | jsonpath "$.when" }}`
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Nil(t, err, "validation failed: %s", err)
+
+	tt.ResultFormat["echo_message"] = `{{ .step.sayHello.output | jq ".message | ascii_upcase(" }}`
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Contains(t, fmt.Sprint(err), "Invalid jq or JSONPath queries")
+
+	tt.ResultFormat["echo_message"] = `{{ .step.sayHello.output.message }}`
+	tt.ResultFormat["echo_when"] = `{{ .step.sayHello.output | jsonpath "$.when[" }}`
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Contains(t, fmt.Sprint(err), "Invalid jq or JSONPath queries")
+
+	tt.ResultFormat["echo_when"] = `{{ .step.sayHello.output.when }}`
+	tt.Steps["step2"].Action.Output = &executor.Output{Strategy: executor.OutputStrategyjq, Format: `{message: .message, status: $metadata.status}`}
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Nil(t, err, "validation failed: %s", err)
+
+	tt.Steps["step2"].Action.Output.Format = `{message: .message,`
+	tt.Normalize()
+	err = tt.Valid()
+	assert.Contains(t, fmt.Sprint(err), "invalid output jq format")
+}
@@ -0,0 +1,571 @@
+package tasktemplate
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template/parse"
+
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/engine/step"
+	"github.com/ovh/utask/engine/values"
+	"github.com/ovh/utask/pkg/utils"
+)
+
+// FragmentsDirectory is the name of the sub-directory of a templates folder
+// holding the fragments that can be included by the templates of this folder
+const FragmentsDirectory = "fragments"
+
+var (
+	// fragmentsImported holds the fragments loaded from each fragments directory, by name
+	fragmentsImported   = make(map[string]map[string]*Fragment)
+	fragmentsImportedMu sync.RWMutex
+
+	fragmentArgsRegexp = regexp.MustCompile(`\{\{\s*\.fragment_args\.([a-zA-Z0-9_]+)\s*\}\}`)
+	// references to steps, as .step.name (or $.step.name), and as index .step "name"
+	stepFieldRegexp     = regexp.MustCompile(`(^|[^a-zA-Z0-9_)\]])(\$?\.step\.)([a-zA-Z0-9_]+)`)
+	stepIndexRegexp     = regexp.MustCompile("\\b((?:index|get)\\s+\\$?\\.step\\s+)(\"[^\"]*\"|`[^`]*`)")
+	evalReferenceRegexp = regexp.MustCompile("\\b((?:eval|evalCache)\\s+)(\"[^\"]*\"|`[^`]*`)")
+	identifierRegexp    = regexp.MustCompile(`^[a-zA-Z0-9_]*$`)
+)
+
+// Fragment is a named group of steps (and the variables they need) that can be
+// included in several templates, instead of copy-pasting whole blocks of steps.
+// Its content can be parameterized through {{ .fragment_args.xxx }} handles,
+// which are substituted when the fragment gets included in a template.
+type Fragment struct {
+	Name        string                `json:"name"`
+	Description string                `json:"description"`
+	Parameters  []FragmentParameter   `json:"parameters,omitempty"`
+	Variables   []values.Variable     `json:"variables,omitempty"`
+	Steps       map[string]*step.Step `json:"steps"`
+
+	fileName string
+}
+
+// FragmentParameter describes an argument expected by a fragment
+type FragmentParameter struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Optional    bool        `json:"optional"`
+	Default     interface{} `json:"default,omitempty"`
+}
+
+// Include instantiates a fragment within a template:
+// - the fragment's steps and variables are renamed with the given prefix, and the references to them rewired
+// - the steps of the fragment without dependencies inherit the include's dependencies
+// - the steps of the template can depend on the include's name, meaning all
+// the terminal steps of the fragment
+type Include struct {
+	Name         string                 `json:"name,omitempty"`
+	Fragment     string                 `json:"fragment"`
+	Prefix       string                 `json:"prefix,omitempty"`
+	Args         map[string]interface{} `json:"args,omitempty"`
+	Dependencies []string               `json:"dependencies,omitempty"`
+}
+
+// validFragment asserts that the content of a fragment is correct
+func validFragment(f *Fragment) error {
+	if err := utils.ValidString("fragment name", f.Name); err != nil {
+		return err
+	}
+	if len(f.Steps) == 0 {
+		return errors.BadRequestf("fragment %q has no steps", f.Name)
+	}
+	for _, p := range f.Parameters {
+		if !identifierRegexp.MatchString(p.Name) || p.Name == "" {
+			return errors.BadRequestf("fragment %q: invalid parameter name %q", f.Name, p.Name)
+		}
+	}
+	return nil
+}
+
+// GetFragment returns a fragment loaded from a given fragments directory, given its name
+func GetFragment(directory, name string) (*Fragment, bool) {
+	fragmentsImportedMu.RLock()
+	defer fragmentsImportedMu.RUnlock()
+
+	f, ok := fragmentsImported[path.Clean(directory)][name]
+	return f, ok
+}
+
+// LoadFragmentsFromDir loads all the yaml-formatted fragments of a given directory,
+// replacing the ones previously loaded from it.
+// A missing directory is not an error, since fragments are optional.
+func LoadFragmentsFromDir(directory string) error {
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open fragments directory %s: %s", directory, err)
+	}
+
+	fragments := make(map[string]*Fragment)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".yaml") || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		content, err := os.ReadFile(path.Join(directory, file.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read fragment '%s': %s", file.Name(), err)
+		}
+		var f Fragment
+		if err := yaml.Unmarshal(content, &f); err != nil {
+			return fmt.Errorf("failed to unmarshal fragment '%s': '%s'", file.Name(), err)
+		}
+		f.fileName = path.Join(directory, file.Name())
+
+		if err := validFragment(&f); err != nil {
+			return fmt.Errorf("failed to register fragment '%s': %s", file.Name(), err)
+		}
+		if previous, exists := fragments[f.Name]; exists {
+			return fmt.Errorf("failed to register fragment '%s': fragment %q already declared in %q", file.Name(), f.Name, previous.fileName)
+		}
+		fragments[f.Name] = &f
+		logrus.Infof("Imported fragment %q", f.Name)
+	}
+
+	fragmentsImportedMu.Lock()
+	fragmentsImported[path.Clean(directory)] = fragments
+	fragmentsImportedMu.Unlock()
+
+	return nil
+}
+
+// ResolveIncludes merges the fragments included by the template into its steps and variables,
+// looking them up among the ones loaded from the configured templates folders, in order.
+func (tt *TaskTemplate) ResolveIncludes() error {
+	directories := []string{}
+	for _, dir := range strings.Split(utask.FTemplatesFolders, ":") {
+		if dir != "" {
+			directories = append(directories, path.Join(dir, FragmentsDirectory))
+		}
+	}
+	return tt.ResolveIncludesFrom(directories...)
+}
+
+// ResolveIncludesFrom merges the fragments included by the template into its steps and variables,
+// looking them up among the ones loaded from the given fragments directories, in order.
+// Once resolved, the includes are dropped from the template: the merged template is
+// what gets stored, and what is displayed through the API.
+func (tt *TaskTemplate) ResolveIncludesFrom(fragmentsDirectories ...string) (err error) {
+	if len(tt.Includes) == 0 {
+		return nil
+	}
+
+	defer errors.DeferredAnnotatef(&err, "Failed to resolve includes")
+
+	if tt.Steps == nil {
+		tt.Steps = map[string]*step.Step{}
+	}
+
+	groups := map[string][]string{}
+	for i := range tt.Includes {
+		inc := &tt.Includes[i]
+		name := inc.groupName()
+		if _, exists := groups[name]; exists {
+			return errors.BadRequestf("include %q declared twice", name)
+		}
+
+		steps, variables, exits, err := inc.expand(fragmentsDirectories)
+		if err != nil {
+			return err
+		}
+
+		for stepName, st := range steps {
+			if _, exists := tt.Steps[stepName]; exists {
+				return errors.BadRequestf("include %q: step %q already exists in template, use a prefix", name, stepName)
+			}
+			tt.Steps[stepName] = st
+		}
+
+		for _, v := range variables {
+			for _, existing := range tt.Variables {
+				if existing.Name == v.Name {
+					return errors.BadRequestf("include %q: variable %q already exists in template", name, v.Name)
+				}
+			}
+			tt.Variables = append(tt.Variables, v)
+		}
+
+		groups[name] = exits
+	}
+
+	for name := range groups {
+		if _, exists := tt.Steps[name]; exists {
+			return errors.BadRequestf("include %q: name is already used by a step", name)
+		}
+	}
+
+	// rewire the dependencies on includes to the terminal steps of the fragments
+	for _, st := range tt.Steps {
+		if len(st.Dependencies) == 0 {
+			continue
+		}
+		deps := make([]string, 0, len(st.Dependencies))
+		for _, dep := range st.Dependencies {
+			depStep, _ := step.DependencyParts(dep)
+			exits, ok := groups[depStep]
+			if !ok {
+				deps = append(deps, dep)
+				continue
+			}
+			qualifier := strings.TrimPrefix(dep, depStep)
+			for _, e := range exits {
+				deps = append(deps, e+qualifier)
+			}
+		}
+		st.Dependencies = deps
+	}
+
+	tt.Includes = nil
+
+	return nil
+}
+
+func (inc *Include) groupName() string {
+	if inc.Name != "" {
+		return inc.Name
+	}
+	return inc.Fragment
+}
+
+// expand instantiates the included fragment: its steps and variables are deep-copied,
+// arguments are substituted, and steps and variables are renamed with the include's prefix.
+// The names of the terminal steps of the fragment are also returned, sorted.
+func (inc *Include) expand(fragmentsDirectories []string) (map[string]*step.Step, []values.Variable, []string, error) {
+	var f *Fragment
+	ok := false
+	for _, dir := range fragmentsDirectories {
+		if f, ok = GetFragment(dir, inc.Fragment); ok {
+			break
+		}
+	}
+	if !ok {
+		return nil, nil, nil, errors.NotFoundf("fragment %q", inc.Fragment)
+	}
+
+	if !identifierRegexp.MatchString(inc.Prefix) {
+		return nil, nil, nil, errors.BadRequestf("include %q: prefix %q should only contain alphanumeric characters and underscores", inc.groupName(), inc.Prefix)
+	}
+
+	args, err := f.arguments(inc.Args)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	substituteArgs := func(s string) (interface{}, error) {
+		for _, m := range fragmentArgsRegexp.FindAllStringSubmatch(s, -1) {
+			if _, ok := args[m[1]]; !ok {
+				return nil, errors.BadRequestf("undeclared fragment argument %q", m[1])
+			}
+		}
+		if m := fragmentArgsRegexp.FindStringSubmatch(s); m != nil && m[0] == s {
+			// the whole string is an argument: keep the argument's type
+			return args[m[1]], nil
+		}
+		return fragmentArgsRegexp.ReplaceAllStringFunc(s, func(handle string) string {
+			return fmt.Sprint(args[fragmentArgsRegexp.FindStringSubmatch(handle)[1]])
+		}), nil
+	}
+
+	// variable names may be built from arguments: substitute them before renaming
+	var variables []values.Variable
+	if err := deepSubstitute(f.Variables, &variables, substituteArgs); err != nil {
+		return nil, nil, nil, errors.Annotatef(err, "fragment %q", f.Name)
+	}
+
+	renamed := make(map[string]string, len(f.Steps))
+	for name := range f.Steps {
+		renamed[name] = inc.Prefix + name
+	}
+	renamedVariables := make(map[string]string, len(variables))
+	for i := range variables {
+		renamedVariables[variables[i].Name] = inc.Prefix + variables[i].Name
+		variables[i].Name = inc.Prefix + variables[i].Name
+	}
+
+	rewire := func(s string) (string, error) {
+		if inc.Prefix == "" {
+			return s, nil
+		}
+		if err := checkRewirable(s); err != nil {
+			return "", err
+		}
+		s = stepFieldRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+			m := stepFieldRegexp.FindStringSubmatch(ref)
+			if newName, ok := renamed[m[3]]; ok {
+				return m[1] + m[2] + newName
+			}
+			return ref
+		})
+		s = replaceQuotedName(stepIndexRegexp, s, renamed)
+		return replaceQuotedName(evalReferenceRegexp, s, renamedVariables), nil
+	}
+	substitute := func(s string) (interface{}, error) {
+		v, err := substituteArgs(s)
+		if err != nil {
+			return nil, err
+		}
+		if str, ok := v.(string); ok {
+			return rewire(str)
+		}
+		return v, nil
+	}
+
+	var steps map[string]*step.Step
+	if err := deepSubstitute(f.Steps, &steps, substitute); err != nil {
+		return nil, nil, nil, errors.Annotatef(err, "fragment %q", f.Name)
+	}
+	var rewiredVariables []values.Variable
+	if err := deepSubstitute(variables, &rewiredVariables, func(s string) (interface{}, error) {
+		return rewire(s)
+	}); err != nil {
+		return nil, nil, nil, errors.Annotatef(err, "fragment %q", f.Name)
+	}
+
+	dependedOn := map[string]bool{}
+	result := make(map[string]*step.Step, len(steps))
+	for name, st := range steps {
+		for i, dep := range st.Dependencies {
+			depStep, _ := step.DependencyParts(dep)
+			newName, ok := renamed[depStep]
+			if !ok {
+				return nil, nil, nil, errors.BadRequestf("fragment %q: step %q depends on %q, which is not part of the fragment", f.Name, name, depStep)
+			}
+			dependedOn[depStep] = true
+			st.Dependencies[i] = newName + strings.TrimPrefix(dep, depStep)
+		}
+		if len(st.Dependencies) == 0 {
+			st.Dependencies = append(st.Dependencies, inc.Dependencies...)
+		}
+
+		for _, c := range st.Conditions {
+			then := make(map[string]string, len(c.Then))
+			for target, state := range c.Then {
+				if newName, ok := renamed[target]; ok {
+					target = newName
+				}
+				then[target] = state
+			}
+			c.Then = then
+		}
+
+		if st.Name != "" {
+			st.Name = renamed[name]
+		}
+		result[renamed[name]] = st
+	}
+
+	exits := []string{}
+	for name := range steps {
+		if !dependedOn[name] {
+			exits = append(exits, renamed[name])
+		}
+	}
+	sort.Strings(exits)
+
+	return result, rewiredVariables, exits, nil
+}
+
+// replaceQuotedName renames the quoted names captured by the second group of re
+func replaceQuotedName(re *regexp.Regexp, s string, renamed map[string]string) string {
+	return re.ReplaceAllStringFunc(s, func(ref string) string {
+		m := re.FindStringSubmatch(ref)
+		quote, name := m[2][:1], m[2][1:len(m[2])-1]
+		if newName, ok := renamed[name]; ok {
+			return m[1] + quote + newName + quote
+		}
+		return ref
+	})
+}
+
+// checkRewirable asserts that the steps and variables referenced by a templated string
+// can be renamed: steps must be referenced as .step.name or index .step "name",
+// variables as eval "name", rather than through expressions computed at runtime
+func checkRewirable(s string) error {
+	if !strings.Contains(s, "{{") {
+		return nil
+	}
+	tree := parse.New("fragment")
+	tree.Mode = parse.SkipFuncCheck
+	if _, err := tree.Parse(s, "", "", map[string]*parse.Tree{}); err != nil {
+		// invalid templates are reported by the validation of the template
+		return nil
+	}
+	return checkRewirableNode(tree.Root)
+}
+
+func checkRewirableNode(node parse.Node) error {
+	unsupported := func(what string) error {
+		return errors.BadRequestf("%s can't be renamed with the include's prefix in %q, use .step.name, index .step \"name\" or eval \"name\"", what, node)
+	}
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkRewirableNode(child); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return checkRewirableNode(n.Pipe)
+	case *parse.IfNode:
+		return checkRewirableBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		return checkRewirableBranch(&n.BranchNode)
+	case *parse.WithNode:
+		return checkRewirableBranch(&n.BranchNode)
+	case *parse.TemplateNode:
+		return checkRewirableNode(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			if err := checkRewirableNode(cmd); err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		args := n.Args
+		if len(args) >= 2 {
+			if ident, ok := args[0].(*parse.IdentifierNode); ok {
+				switch ident.Ident {
+				case "index", "get":
+					if isStepsNode(args[1]) {
+						if len(args) < 3 {
+							return unsupported("the steps referenced through .step")
+						}
+						if _, ok := args[2].(*parse.StringNode); !ok {
+							return unsupported("a step referenced by an expression")
+						}
+						args = args[3:]
+					}
+				case "eval", "evalCache":
+					if _, ok := args[1].(*parse.StringNode); !ok {
+						return unsupported("a variable referenced by an expression")
+					}
+				}
+			}
+		}
+		for _, arg := range args {
+			if err := checkRewirableNode(arg); err != nil {
+				return err
+			}
+		}
+	case *parse.ChainNode:
+		return checkRewirableNode(n.Node)
+	case *parse.FieldNode, *parse.VariableNode:
+		if isStepsNode(n) {
+			return unsupported("the steps referenced through .step")
+		}
+	}
+	return nil
+}
+
+func checkRewirableBranch(n *parse.BranchNode) error {
+	for _, child := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+		if err := checkRewirableNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isStepsNode tells whether a node is the whole .step map (or $.step), rather than one of its steps
+func isStepsNode(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		return len(n.Ident) == 1 && n.Ident[0] == "step"
+	case *parse.VariableNode:
+		return len(n.Ident) == 2 && n.Ident[0] == "$" && n.Ident[1] == "step"
+	}
+	return false
+}
+
+// arguments checks the arguments given to the fragment against its declared parameters,
+// and fills in default values
+func (f *Fragment) arguments(given map[string]interface{}) (map[string]interface{}, error) {
+	args := make(map[string]interface{}, len(f.Parameters))
+	declared := make(map[string]bool, len(f.Parameters))
+	for _, p := range f.Parameters {
+		declared[p.Name] = true
+		v, ok := given[p.Name]
+		switch {
+		case ok:
+			args[p.Name] = v
+		case p.Default != nil:
+			args[p.Name] = p.Default
+		case p.Optional:
+			args[p.Name] = ""
+		default:
+			return nil, errors.BadRequestf("fragment %q: missing argument %q", f.Name, p.Name)
+		}
+	}
+	for name := range given {
+		if !declared[name] {
+			return nil, errors.BadRequestf("fragment %q: unknown argument %q", f.Name, name)
+		}
+	}
+	return args, nil
+}
+
+// deepSubstitute deep-copies src into dst through its JSON representation,
+// applying fn to every string value met along the way
+func deepSubstitute(src interface{}, dst interface{}, fn func(string) (interface{}, error)) error {
+	b, err := utils.JSONMarshal(src)
+	if err != nil {
+		return err
+	}
+	var tree interface{}
+	if err := utils.JSONnumberUnmarshal(bytes.NewReader(b), &tree); err != nil {
+		return err
+	}
+	tree, err = walkStrings(tree, fn)
+	if err != nil {
+		return err
+	}
+	b, err = utils.JSONMarshal(tree)
+	if err != nil {
+		return err
+	}
+	return utils.JSONnumberUnmarshal(bytes.NewReader(b), dst)
+}
+
+func walkStrings(v interface{}, fn func(string) (interface{}, error)) (interface{}, error) {
+	switch value := v.(type) {
+	case string:
+		return fn(value)
+	case map[string]interface{}:
+		for k, item := range value {
+			newItem, err := walkStrings(item, fn)
+			if err != nil {
+				return nil, err
+			}
+			value[k] = newItem
+		}
+	case []interface{}:
+		for i, item := range value {
+			newItem, err := walkStrings(item, fn)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = newItem
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,124 @@
+package tasktemplate_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/models/tasktemplate"
+)
+
+var fragmentsDir = path.Join("templates_include_tests", tasktemplate.FragmentsDirectory)
+
+func loadIncludeTemplate(t *testing.T) tasktemplate.TaskTemplate {
+	err := tasktemplate.LoadFragmentsFromDir(fragmentsDir)
+	require.Nil(t, err, "unable to load fragments")
+
+	tt := tasktemplate.TaskTemplate{}
+	tmpl, err := os.ReadFile(path.Join("templates_include_tests", "include.yaml"))
+	require.Nil(t, err, "unable to read file include.yaml")
+	err = yaml.Unmarshal(tmpl, &tt)
+	require.Nil(t, err, "unable to unmarshal tasktemplate")
+
+	tt.Normalize()
+	return tt
+}
+
+func TestIncludes(t *testing.T) {
+	templatesFolders := utask.FTemplatesFolders
+	utask.FTemplatesFolders = "templates_include_tests"
+	defer func() { utask.FTemplatesFolders = templatesFolders }()
+
+	tt := loadIncludeTemplate(t)
+
+	// includes are resolved with the fragments of the configured templates folders
+	err := tt.Valid()
+	require.Nil(t, err, "validation failed: %s", err)
+
+	assert.Nil(t, tt.Includes, "includes should have been resolved")
+	assert.Len(t, tt.Steps, 6)
+	require.Len(t, tt.Variables, 2)
+	assert.ElementsMatch(t, []string{"world_greeting", "input_greeting"}, []string{tt.Variables[0].Name, tt.Variables[1].Name})
+
+	for _, name := range []string{"world_build", "world_say", "input_build", "input_say"} {
+		assert.Contains(t, tt.Steps, name)
+	}
+
+	assert.Equal(t, []string{"start"}, tt.Steps["world_build"].Dependencies)
+	assert.Equal(t, []string{"world_build"}, tt.Steps["world_say"].Dependencies)
+	assert.Len(t, tt.Steps["input_build"].Dependencies, 0)
+	assert.Equal(t, []string{"input_build"}, tt.Steps["input_say"].Dependencies)
+	assert.Equal(t, []string{"world_say", "input_say:ANY"}, tt.Steps["end"].Dependencies)
+
+	assert.Equal(t, "Build a greeting for world", tt.Steps["world_build"].Description)
+
+	var config map[string]map[string]interface{}
+	err = json.Unmarshal(tt.Steps["input_build"].Action.Configuration, &config)
+	require.Nil(t, err)
+	assert.Equal(t, `{{ eval "input_greeting" }}`, config["output"]["message"])
+	assert.Equal(t, float64(2), config["output"]["times"])
+
+	err = json.Unmarshal(tt.Steps["world_say"].Action.Configuration, &config)
+	require.Nil(t, err)
+	assert.Equal(t, "{{ .step.world_build.output.message }}", config["output"]["said"])
+	assert.Equal(t, `{{ index .step "world_build" "output" "times" }}`, config["output"]["times"])
+
+	// resolving again is a no-op
+	err = tt.ResolveIncludesFrom(fragmentsDir)
+	assert.Nil(t, err, "resolution failed: %s", err)
+	assert.Nil(t, err, "validation failed: %s", err)
+	assert.Len(t, tt.Steps, 6)
+}
+
+func TestIncludesErrors(t *testing.T) {
+	tt := loadIncludeTemplate(t)
+	tt.Includes[0].Fragment = "unknown"
+	err := tt.ResolveIncludesFrom(fragmentsDir)
+	assert.Contains(t, fmt.Sprint(err), `fragment "unknown" not found`)
+
+	tt = loadIncludeTemplate(t)
+	delete(tt.Includes[0].Args, "who")
+	err = tt.ResolveIncludesFrom(fragmentsDir)
+	assert.Contains(t, fmt.Sprint(err), `missing argument "who"`)
+
+	tt = loadIncludeTemplate(t)
+	tt.Includes[0].Args["foo"] = "bar"
+	err = tt.ResolveIncludesFrom(fragmentsDir)
+	assert.Contains(t, fmt.Sprint(err), `unknown argument "foo"`)
+
+	tt = loadIncludeTemplate(t)
+	tt.Includes[1].Prefix = tt.Includes[0].Prefix
+	tt.Includes[1].Args["who"] = "world"
+	err = tt.ResolveIncludesFrom(fragmentsDir)
+	assert.Contains(t, fmt.Sprint(err), "already exists in template")
+
+	tt = loadIncludeTemplate(t)
+	tt.Includes[0].Prefix = "world-"
+	err = tt.ResolveIncludesFrom(fragmentsDir)
+	assert.Contains(t, fmt.Sprint(err), "should only contain alphanumeric characters and underscores")
+
+	tt = loadIncludeTemplate(t)
+	err = tt.ResolveIncludesFrom("templates_include_tests")
+	assert.Contains(t, fmt.Sprint(err), `fragment "greet" not found`, "fragments are only available to the templates of their folder")
+
+	// references which can't be renamed are refused
+	for _, ref := range []string{
+		`{{ with .step }}{{ .build.output.message }}{{ end }}`,
+		`{{ index .step .input.name "output" }}`,
+		`{{ $.step | toJson }}`,
+	} {
+		tt = loadIncludeTemplate(t)
+		f, ok := tasktemplate.GetFragment(fragmentsDir, "greet")
+		require.True(t, ok)
+		f.Steps["say"].Description = ref
+		err = tt.ResolveIncludesFrom(fragmentsDir)
+		assert.Contains(t, fmt.Sprint(err), "can't be renamed with the include's prefix", ref)
+	}
+}
@@ -48,6 +48,9 @@ type TaskTemplate struct {
 	Tags               map[string]string          `json:"tags,omitempty" db:"tags"`
 	Steps              map[string]*step.Step      `json:"steps,omitempty" db:"steps"`
 	BaseConfigurations map[string]json.RawMessage `json:"base_configurations" db:"base_configurations"`
+
+	// Includes are resolved into Steps and Variables before the template is stored
+	Includes []Include `json:"includes,omitempty" db:"-"`
 }
 
 // Create inserts a new task template in DB
@@ -300,12 +303,17 @@ func (tt *TaskTemplate) Normalize() {
 }
 
 // Valid asserts that the content of a task template is correct:
+// - included fragments are resolved
 // - metadata (name, description, etc...) is valid
 // - inputs are correctly expressed
 // - steps are coherent (dependency graph, templating handles)
 func (tt *TaskTemplate) Valid() (err error) {
 	defer errors.DeferredAnnotatef(&err, "Invalid task template")
 
+	if err := tt.ResolveIncludes(); err != nil {
+		return err
+	}
+
 	if err := utils.ValidString("template name", tt.Name); err != nil {
 		return err
 	}
@@ -377,6 +385,14 @@ func (tt *TaskTemplate) Valid() (err error) {
 		return errors.NewNotValid(err, "Invalid text-template handles within task template")
 	}
 
+	if err := validQueries(tmplJSON); err != nil {
+		return errors.NewNotValid(err, "Invalid jq or JSONPath queries within task template")
+	}
+
+	if err := validExpressions(tt.Variables, tt.Inputs, tt.ResolverInputs, tt.Steps); err != nil {
+		return errors.NewNotValid(err, "Invalid CEL expressions within task template")
+	}
+
 	return nil
 }
 
@@ -455,6 +471,18 @@ func validateVariables(variables []values.Variable) error {
 		if variable.Value != nil && variable.ExpressionTimeout != "" {
 			return errors.BadRequestf("variable %q expression timeout cannot be defined when value is defined", variable.Name)
 		}
+		switch variable.ExpressionEngine {
+		case "", values.ExpressionEngineJS:
+			if variable.ExpressionCostLimit != 0 {
+				return errors.BadRequestf("variable %q expression cost limit can only be defined for %s expressions", variable.Name, values.ExpressionEngineCEL)
+			}
+		case values.ExpressionEngineCEL:
+			if variable.ExpressionTimeout != "" {
+				return errors.BadRequestf("variable %q expression timeout cannot be defined for %s expressions, use expression_cost_limit", variable.Name, values.ExpressionEngineCEL)
+			}
+		default:
+			return errors.BadRequestf("variable %q expression engine %q is invalid, must be either %v", variable.Name, variable.ExpressionEngine, []string{values.ExpressionEngineJS, values.ExpressionEngineCEL})
+		}
 		if variable.ExpressionTimeout != "" {
 			_, err := time.ParseDuration(variable.ExpressionTimeout)
 			if err != nil {
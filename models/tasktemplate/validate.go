@@ -6,9 +6,12 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/google/cel-go/cel"
 	"github.com/juju/errors"
 	"github.com/ovh/utask"
+	"github.com/ovh/utask/engine/input"
 	"github.com/ovh/utask/engine/step"
+	"github.com/ovh/utask/engine/step/condition"
 	"github.com/ovh/utask/engine/values"
 	"github.com/ovh/utask/pkg/jsonschema"
 	"github.com/ovh/utask/pkg/utils"
@@ -20,6 +23,8 @@ const (
 
 var (
 	tmplRegex = regexp.MustCompile(`{{[^}\.]*(\.[A-Za-z0-9_\.]+)[^{]*}}`)
+
+	taskInfoKeys = []string{"resolver_username", "created", "requester_username", "requester_groups", "task_id", "region", "resolution_id", "watcher_usernames", "watcher_groups"}
 )
 
 func validTemplate(template string, inputs, resolverInputs []string, steps map[string]*step.Step) error {
@@ -31,7 +36,6 @@ func validTemplate(template string, inputs, resolverInputs []string, steps map[s
 	}
 
 	stepNames := stepNames(steps)
-	taskInfoKeys := []string{"resolver_username", "created", "requester_username", "requester_groups", "task_id", "region", "resolution_id", "watcher_usernames", "watcher_groups"}
 	for _, m := range matches {
 		parts := strings.Split(m[1], ".")
 		if len(parts) >= 3 {
@@ -85,6 +89,88 @@ func validTemplate(template string, inputs, resolverInputs []string, steps map[s
 	return nil
 }
 
+// validQueries compiles the literal queries given to the "jq" and "jsonpath" templating functions
+// in every string of the template
+func validQueries(tmplJSON []byte) error {
+	var tmpl interface{}
+	if err := json.Unmarshal(tmplJSON, &tmpl); err != nil {
+		return err
+	}
+	_, err := walkStrings(tmpl, func(s string) (interface{}, error) {
+		return s, values.CheckQueries(s)
+	})
+	return err
+}
+
+// validExpressions type-checks the CEL expressions of variables and step conditions
+// against the inputs and steps declared by the template
+func validExpressions(variables []values.Variable, inputs, resolverInputs []input.Input, steps map[string]*step.Step) error {
+	schema := &values.CELSchema{
+		Inputs:         celInputTypes(inputs),
+		ResolverInputs: celInputTypes(resolverInputs),
+		Steps:          stepNames(steps),
+		TaskKeys:       taskInfoKeys,
+	}
+
+	for _, v := range variables {
+		if v.ExpressionEngine != values.ExpressionEngineCEL {
+			continue
+		}
+		if err := schema.Check(v.Expression, nil); err != nil {
+			return fmt.Errorf("variable %q: %s", v.Name, err)
+		}
+	}
+
+	for name, st := range steps {
+		conditions, err := st.GetConditions()
+		if err != nil {
+			return err
+		}
+		for _, c := range conditions {
+			for _, a := range c.If {
+				if err := validAssertExpressions(schema, a); err != nil {
+					return fmt.Errorf("step %q: %s", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validAssertExpressions(schema *values.CELSchema, a *condition.Assert) error {
+	if a == nil || a.Engine != values.ExpressionEngineCEL {
+		return nil
+	}
+	if a.Operator == "" {
+		return schema.Check(a.Value, cel.BoolType)
+	}
+	if err := schema.Check(a.Value, nil); err != nil {
+		return err
+	}
+	return schema.Check(a.Expected, nil)
+}
+
+// celInputTypes gives the types of inputs as seen by CEL expressions: numbers may be integers or doubles
+func celInputTypes(inputs []input.Input) map[string]*cel.Type {
+	types := make(map[string]*cel.Type, len(inputs))
+	for _, i := range inputs {
+		var t *cel.Type
+		switch i.Type {
+		case input.InputTypeBool:
+			t = cel.BoolType
+		case input.InputTypeNumber:
+			t = cel.DynType
+		default:
+			t = cel.StringType
+		}
+		if i.Collection {
+			t = cel.ListType(t)
+		}
+		types[i.Name] = t
+	}
+	return types
+}
+
 // expect parts to contain:
 // - {stepname}
 // - "output"
@@ -69,6 +69,11 @@ func GetGroups(ctx context.Context) []string {
 
 // IsAdmin asserts that identity data found in context represents an admin user
 func IsAdmin(ctx context.Context) error {
+	// API tokens only carry the admin rights of their owner with the admin scope
+	if err := HasScope(ctx, ScopeAdmin); err != nil {
+		return err
+	}
+
 	id := GetIdentity(ctx)
 	if utils.ListContainsString(adminUsers, id) {
 		return nil
@@ -0,0 +1,381 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/juju/errors"
+	"github.com/ovh/configstore"
+	"github.com/sirupsen/logrus"
+)
+
+// ConfigAlias is the configstore alias holding the OIDC provider configuration
+const ConfigAlias = "oidc-auth"
+
+const (
+	defaultUsernameClaim   = "sub"
+	defaultGroupsClaim     = "groups"
+	defaultRefreshInterval = time.Hour
+	// minimum delay between two JWKS fetches triggered by an unknown key ID
+	minRefreshInterval = time.Minute
+	discoveryPath      = "/.well-known/openid-configuration"
+)
+
+var defaultAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// Config holds the configuration of the OIDC provider
+type Config struct {
+	// Issuer is matched against the "iss" claim, and used to discover the JWKS and endpoints
+	Issuer string `json:"issuer"`
+	// Audiences lists the accepted "aud" claims, at least one must match
+	Audiences []string `json:"audiences"`
+	// JWKSURL overrides the JWKS location found through discovery
+	JWKSURL string `json:"jwks_url,omitempty"`
+	// JWKS holds local signing keys, no remote fetch is done when set
+	JWKS *jose.JSONWebKeySet `json:"jwks,omitempty"`
+	// JWKSRefreshInterval is the duration between two fetches of the remote JWKS
+	JWKSRefreshInterval string `json:"jwks_refresh_interval,omitempty"`
+	// Algorithms restricts the accepted signature algorithms
+	Algorithms []string `json:"algorithms,omitempty"`
+	// UsernameClaim and GroupsClaim are dot-separated paths to claims
+	UsernameClaim string `json:"username_claim,omitempty"`
+	GroupsClaim   string `json:"groups_claim,omitempty"`
+	// Session enables the login flow for the dashboard
+	Session *SessionConfig `json:"session,omitempty"`
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	JWKSURI               string `json:"jwks_uri"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// Provider authenticates requests carrying a JWT issued by an OIDC identity provider,
+// either as a bearer token, or in a session cookie set by the login flow
+type Provider struct {
+	cfg             Config
+	algorithms      []jose.SignatureAlgorithm
+	refreshInterval time.Duration
+	discovery       discovery
+	httpClient      *http.Client
+
+	mu          sync.RWMutex
+	keys        *jose.JSONWebKeySet
+	lastRefresh time.Time
+}
+
+// LoadConfig reads the provider configuration from configstore
+// a nil configuration is returned if the provider isn't configured
+func LoadConfig(store *configstore.Store) (*Config, error) {
+	items, err := configstore.Filter().Store(store).Slice(ConfigAlias).Squash().GetItemList()
+	if err != nil {
+		return nil, err
+	}
+	if items.Len() == 0 {
+		return nil, nil
+	}
+
+	jsonStr, err := items.Items[0].Value()
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal([]byte(jsonStr), &cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %q configuration: %s", ConfigAlias, err)
+	}
+	return &cfg, nil
+}
+
+// New validates the configuration and returns a ready to use Provider
+// the signing keys are fetched once, unless they are configured locally
+func New(ctx context.Context, cfg Config) (*Provider, error) {
+	p := &Provider{
+		cfg:             cfg,
+		algorithms:      defaultAlgorithms,
+		refreshInterval: defaultRefreshInterval,
+		httpClient:      &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if cfg.Issuer == "" {
+		return nil, errors.New("oidc: issuer can't be empty")
+	}
+	if len(cfg.Audiences) == 0 {
+		return nil, errors.New("oidc: audiences can't be empty")
+	}
+	if p.cfg.UsernameClaim == "" {
+		p.cfg.UsernameClaim = defaultUsernameClaim
+	}
+	if p.cfg.GroupsClaim == "" {
+		p.cfg.GroupsClaim = defaultGroupsClaim
+	}
+	if len(cfg.Algorithms) > 0 {
+		p.algorithms = make([]jose.SignatureAlgorithm, 0, len(cfg.Algorithms))
+		for _, alg := range cfg.Algorithms {
+			p.algorithms = append(p.algorithms, jose.SignatureAlgorithm(alg))
+		}
+	}
+	if cfg.JWKSRefreshInterval != "" {
+		d, err := time.ParseDuration(cfg.JWKSRefreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: invalid jwks_refresh_interval: %s", err)
+		}
+		p.refreshInterval = d
+	}
+
+	// discovery is needed to find the JWKS, and the endpoints of the login flow
+	if (cfg.JWKS == nil && cfg.JWKSURL == "") || cfg.Session != nil {
+		if err := p.discover(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.JWKSURL != "" {
+		p.discovery.JWKSURI = cfg.JWKSURL
+	}
+
+	if cfg.JWKS != nil {
+		p.keys = cfg.JWKS
+	} else if err := p.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+
+	if cfg.Session != nil {
+		if err := cfg.Session.valid(); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Authenticate extracts the caller's identity and groups from the token of a request
+// its signature matches the one expected by api.Server.WithGroupAuth
+func (p *Provider) Authenticate(r *http.Request) (string, []string, error) {
+	raw := bearerToken(r)
+	if raw == "" && p.cfg.Session != nil {
+		if c, err := r.Cookie(p.cfg.Session.cookieName()); err == nil {
+			raw = c.Value
+		}
+	}
+	if raw == "" {
+		return "", nil, errors.Unauthorizedf("Missing bearer token")
+	}
+
+	claims, err := p.Verify(r.Context(), raw)
+	if err != nil {
+		logrus.WithField("log_type", "auth").Debugf("oidc: rejected token: %s", err)
+		return "", nil, errors.Unauthorizedf("Invalid token")
+	}
+
+	return p.identity(claims)
+}
+
+// AuthHandler returns an auth handler which authenticates requests carrying a token,
+// and delegates the others to a fallback handler, if any
+func (p *Provider) AuthHandler(fallback func(*http.Request) (string, []string, error)) func(*http.Request) (string, []string, error) {
+	return func(r *http.Request) (string, []string, error) {
+		if fallback != nil && bearerToken(r) == "" && !p.hasSessionCookie(r) {
+			return fallback(r)
+		}
+		return p.Authenticate(r)
+	}
+}
+
+// Verify checks the signature and the registered claims of a raw token,
+// and returns all of its claims
+func (p *Provider) Verify(ctx context.Context, raw string) (map[string]interface{}, error) {
+	tok, err := jwt.ParseSigned(raw, p.algorithms)
+	if err != nil {
+		return nil, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, errors.New("unexpected number of signatures")
+	}
+
+	key, err := p.key(ctx, tok.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var registered jwt.Claims
+	claims := map[string]interface{}{}
+	if err := tok.Claims(key, &registered, &claims); err != nil {
+		return nil, err
+	}
+
+	if registered.Expiry == nil {
+		return nil, errors.New("missing exp claim")
+	}
+	if err := registered.Validate(jwt.Expected{
+		Issuer:      p.cfg.Issuer,
+		AnyAudience: jwt.Audience(p.cfg.Audiences),
+	}); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (p *Provider) identity(claims map[string]interface{}) (string, []string, error) {
+	username, ok := claimValue(claims, p.cfg.UsernameClaim).(string)
+	if !ok || username == "" {
+		return "", nil, errors.Unauthorizedf("Missing %q claim", p.cfg.UsernameClaim)
+	}
+
+	var groups []string
+	switch g := claimValue(claims, p.cfg.GroupsClaim).(type) {
+	case string:
+		groups = []string{g}
+	case []interface{}:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	return username, groups, nil
+}
+
+// key returns the public key matching a key ID
+// the remote JWKS is fetched again if the key is unknown, or if it has expired
+func (p *Provider) key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	p.mu.RLock()
+	keys, lastRefresh := p.keys, p.lastRefresh
+	p.mu.RUnlock()
+
+	remote := p.cfg.JWKS == nil
+	if remote && time.Since(lastRefresh) > p.refreshInterval {
+		if err := p.refreshKeys(ctx); err != nil {
+			logrus.WithField("log_type", "auth").Warnf("oidc: failed to refresh JWKS: %s", err)
+		}
+		p.mu.RLock()
+		keys, lastRefresh = p.keys, p.lastRefresh
+		p.mu.RUnlock()
+	}
+
+	if k := findKey(keys, kid); k != nil {
+		return k, nil
+	}
+
+	// the issuer may have rotated its keys
+	if remote && time.Since(lastRefresh) > minRefreshInterval {
+		if err := p.refreshKeys(ctx); err != nil {
+			return nil, err
+		}
+		p.mu.RLock()
+		keys = p.keys
+		p.mu.RUnlock()
+		if k := findKey(keys, kid); k != nil {
+			return k, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func findKey(keys *jose.JSONWebKeySet, kid string) *jose.JSONWebKey {
+	if keys == nil {
+		return nil
+	}
+	if kid == "" {
+		// without key ID, only a single signing key can be used unambiguously
+		if len(keys.Keys) == 1 {
+			return &keys.Keys[0]
+		}
+		return nil
+	}
+	for _, k := range keys.Key(kid) {
+		if k.Use == "" || k.Use == "sig" {
+			return &k
+		}
+	}
+	return nil
+}
+
+func (p *Provider) refreshKeys(ctx context.Context) error {
+	var keys jose.JSONWebKeySet
+	if err := p.getJSON(ctx, p.discovery.JWKSURI, &keys); err != nil {
+		return fmt.Errorf("oidc: failed to fetch JWKS: %s", err)
+	}
+
+	p.mu.Lock()
+	p.keys = &keys
+	p.lastRefresh = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Provider) discover(ctx context.Context) error {
+	u := strings.TrimSuffix(p.cfg.Issuer, "/") + discoveryPath
+	if err := p.getJSON(ctx, u, &p.discovery); err != nil {
+		return fmt.Errorf("oidc: failed to discover issuer configuration: %s", err)
+	}
+	if p.discovery.Issuer != p.cfg.Issuer {
+		return fmt.Errorf("oidc: issuer mismatch, expected %q, discovered %q", p.cfg.Issuer, p.discovery.Issuer)
+	}
+	return nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, dest interface{}) error {
+	if u == "" {
+		return errors.New("empty url")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, u)
+	}
+	return json.NewDecoder(resp.Body).Decode(dest)
+}
+
+func (p *Provider) hasSessionCookie(r *http.Request) bool {
+	if p.cfg.Session == nil {
+		return false
+	}
+	_, err := r.Cookie(p.cfg.Session.cookieName())
+	return err == nil
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// claimValue walks a dot-separated path through nested claims
+func claimValue(claims map[string]interface{}, path string) interface{} {
+	var cur interface{} = claims
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[part]
+	}
+	return cur
+}
@@ -0,0 +1,317 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ovh/utask/pkg/auth/oidc"
+)
+
+const audience = "utask"
+
+// testIssuer is a minimal OIDC identity provider, serving discovery, JWKS and token endpoints
+type testIssuer struct {
+	*httptest.Server
+	t *testing.T
+
+	mu    sync.Mutex
+	key   jose.JSONWebKey
+	codes map[string]map[string]interface{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	iss := &testIssuer{t: t, codes: map[string]map[string]interface{}{}}
+	iss.rotate("key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 iss.URL,
+			"jwks_uri":               iss.URL + "/jwks",
+			"authorization_endpoint": iss.URL + "/authorize",
+			"token_endpoint":         iss.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{iss.key.Public()}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		iss.mu.Lock()
+		claims, ok := iss.codes[r.Form.Get("code")]
+		iss.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "opaque",
+			"token_type":   "Bearer",
+			"id_token":     iss.sign(claims),
+		})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func (iss *testIssuer) rotate(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(iss.t, err)
+	iss.mu.Lock()
+	iss.key = jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"}
+	iss.mu.Unlock()
+}
+
+func (iss *testIssuer) claims(sub string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": iss.URL,
+		"aud": audience,
+		"sub": sub,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+}
+
+func (iss *testIssuer) sign(claims map[string]interface{}) string {
+	iss.mu.Lock()
+	key := iss.key
+	iss.mu.Unlock()
+	return signWith(iss.t, key, claims)
+}
+
+func signWith(t *testing.T, key jose.JSONWebKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.SignatureAlgorithm(key.Algorithm), Key: key},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	require.Nil(t, err)
+	raw, err := jwt.Signed(signer).Claims(claims).Serialize()
+	require.Nil(t, err)
+	return raw
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/task", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestBearerToken(t *testing.T) {
+	iss := newTestIssuer(t)
+
+	p, err := oidc.New(context.Background(), oidc.Config{
+		Issuer:        iss.URL,
+		Audiences:     []string{audience},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "realm_access.roles",
+	})
+	require.Nil(t, err)
+
+	claims := iss.claims("1234")
+	claims["preferred_username"] = "jdoe"
+	claims["realm_access"] = map[string]interface{}{"roles": []string{"admins", "ops"}}
+
+	user, groups, err := p.Authenticate(bearerRequest(iss.sign(claims)))
+	require.Nil(t, err)
+	assert.Equal(t, "jdoe", user)
+	assert.Equal(t, []string{"admins", "ops"}, groups)
+
+	// missing token
+	_, _, err = p.Authenticate(httptest.NewRequest(http.MethodGet, "/task", nil))
+	assert.True(t, errors.IsUnauthorized(err))
+
+	// invalid claims
+	for name, mutate := range map[string]func(map[string]interface{}){
+		"expired":        func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no expiry":      func(c map[string]interface{}) { delete(c, "exp") },
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = "someone-else" },
+		"wrong issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.org" },
+		"no username":    func(c map[string]interface{}) { delete(c, "preferred_username") },
+	} {
+		c := iss.claims("1234")
+		c["preferred_username"] = "jdoe"
+		mutate(c)
+		_, _, err := p.Authenticate(bearerRequest(iss.sign(c)))
+		assert.True(t, errors.IsUnauthorized(err), name)
+	}
+
+	// token signed by an unknown key
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	forged := signWith(t, jose.JSONWebKey{Key: other, KeyID: "key-1", Algorithm: string(jose.ES256)}, claims)
+	_, _, err = p.Authenticate(bearerRequest(forged))
+	assert.True(t, errors.IsUnauthorized(err))
+}
+
+func TestLocalJWKS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	jwk := jose.JSONWebKey{Key: key, KeyID: "local", Algorithm: string(jose.ES256)}
+	pub := jwk.Public()
+
+	// no network access is needed when keys are configured locally
+	p, err := oidc.New(context.Background(), oidc.Config{
+		Issuer:    "https://issuer.example.org",
+		Audiences: []string{audience},
+		JWKS:      &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{pub}},
+	})
+	require.Nil(t, err)
+
+	token := signWith(t, jwk, map[string]interface{}{
+		"iss":    "https://issuer.example.org",
+		"aud":    []string{"other", audience},
+		"sub":    "svc-account",
+		"exp":    time.Now().Add(time.Minute).Unix(),
+		"groups": "robots",
+	})
+	user, groups, err := p.Authenticate(bearerRequest(token))
+	require.Nil(t, err)
+	assert.Equal(t, "svc-account", user)
+	assert.Equal(t, []string{"robots"}, groups)
+
+	_, err = oidc.New(context.Background(), oidc.Config{Issuer: "https://issuer.example.org"})
+	assert.NotNil(t, err)
+}
+
+func TestKeyRotation(t *testing.T) {
+	iss := newTestIssuer(t)
+
+	p, err := oidc.New(context.Background(), oidc.Config{Issuer: iss.URL, Audiences: []string{audience}})
+	require.Nil(t, err)
+
+	_, _, err = p.Authenticate(bearerRequest(iss.sign(iss.claims("jdoe"))))
+	require.Nil(t, err)
+
+	// keys fetched at startup are considered fresh, an unknown key ID
+	// isn't enough to trigger a new fetch right away
+	iss.rotate("key-2")
+	_, _, err = p.Authenticate(bearerRequest(iss.sign(iss.claims("jdoe"))))
+	assert.True(t, errors.IsUnauthorized(err))
+
+	p, err = oidc.New(context.Background(), oidc.Config{Issuer: iss.URL, Audiences: []string{audience}, JWKSRefreshInterval: "1ns"})
+	require.Nil(t, err)
+	iss.rotate("key-3")
+	_, _, err = p.Authenticate(bearerRequest(iss.sign(iss.claims("jdoe"))))
+	assert.Nil(t, err)
+}
+
+func TestAuthHandlerFallback(t *testing.T) {
+	iss := newTestIssuer(t)
+
+	p, err := oidc.New(context.Background(), oidc.Config{Issuer: iss.URL, Audiences: []string{audience}})
+	require.Nil(t, err)
+
+	handler := p.AuthHandler(func(r *http.Request) (string, []string, error) {
+		return "basic-user", nil, nil
+	})
+
+	user, _, err := handler(httptest.NewRequest(http.MethodGet, "/task", nil))
+	require.Nil(t, err)
+	assert.Equal(t, "basic-user", user)
+
+	user, _, err = handler(bearerRequest(iss.sign(iss.claims("jdoe"))))
+	require.Nil(t, err)
+	assert.Equal(t, "jdoe", user)
+
+	_, _, err = handler(bearerRequest("not-a-token"))
+	assert.True(t, errors.IsUnauthorized(err))
+
+	_, _, err = p.AuthHandler(nil)(httptest.NewRequest(http.MethodGet, "/task", nil))
+	assert.True(t, errors.IsUnauthorized(err))
+}
+
+func TestSessionLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	iss := newTestIssuer(t)
+
+	p, err := oidc.New(context.Background(), oidc.Config{
+		Issuer:    iss.URL,
+		Audiences: []string{"dashboard"},
+		Session: &oidc.SessionConfig{
+			ClientID:     "dashboard",
+			ClientSecret: "secret",
+			RedirectURL:  "https://utask.example.org/unsecured/oidc/callback",
+		},
+	})
+	require.Nil(t, err)
+
+	routes := p.SessionRoutes()
+	require.NotNil(t, routes)
+	router := gin.New()
+	for _, r := range routes.Routes {
+		router.Handle(r.Method, routes.Path+r.Path, r.Handlers...)
+	}
+
+	// login redirects to the identity provider
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, oidc.SessionPathPrefix+"/login?redirect=/ui/dashboard/task/1", nil))
+	require.Equal(t, http.StatusFound, w.Code)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	require.Nil(t, err)
+	assert.Equal(t, iss.URL+"/authorize", loc.Scheme+"://"+loc.Host+loc.Path)
+	state := loc.Query().Get("state")
+	require.NotEmpty(t, state)
+	stateCookies := w.Result().Cookies()
+	require.Len(t, stateCookies, 1)
+
+	// the identity provider issues a code for the logged in user
+	claims := iss.claims("jdoe")
+	claims["aud"] = "dashboard"
+	claims["nonce"] = loc.Query().Get("nonce")
+	iss.mu.Lock()
+	iss.codes["code-1"] = claims
+	iss.mu.Unlock()
+
+	callback := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, oidc.SessionPathPrefix+"/callback?"+query, nil)
+		r.AddCookie(stateCookies[0])
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, callback("state=forged&code=code-1").Code)
+	assert.Equal(t, http.StatusUnauthorized, callback("state="+url.QueryEscape(state)+"&code=unknown").Code)
+
+	w = callback("state=" + url.QueryEscape(state) + "&code=code-1")
+	require.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/ui/dashboard/task/1", w.Header().Get("Location"))
+
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "utask_session" {
+			session = c
+		}
+	}
+	require.NotNil(t, session)
+	assert.True(t, session.HttpOnly)
+	assert.True(t, session.Secure)
+
+	// the session cookie authenticates API calls
+	r := httptest.NewRequest(http.MethodGet, "/task", nil)
+	r.AddCookie(session)
+	user, _, err := p.Authenticate(r)
+	require.Nil(t, err)
+	assert.Equal(t, "jdoe", user)
+}
@@ -0,0 +1,244 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/wI2L/fizz"
+	"golang.org/x/oauth2"
+
+	"github.com/ovh/utask/api"
+)
+
+const (
+	// SessionPathPrefix is the path under which the login flow routes are exposed
+	SessionPathPrefix = "/unsecured/oidc"
+
+	defaultCookieName        = "utask_session"
+	defaultPostLoginRedirect = "/ui/dashboard/"
+	stateCookieMaxAge        = 10 * time.Minute
+)
+
+// SessionConfig holds the configuration of the login flow for the dashboard:
+// the ID token obtained through the authorization code flow is kept in a cookie
+type SessionConfig struct {
+	ClientID          string   `json:"client_id"`
+	ClientSecret      string   `json:"client_secret"`
+	RedirectURL       string   `json:"redirect_url"`
+	Scopes            []string `json:"scopes,omitempty"`
+	CookieName        string   `json:"cookie_name,omitempty"`
+	InsecureCookie    bool     `json:"insecure_cookie,omitempty"`
+	PostLoginRedirect string   `json:"post_login_redirect,omitempty"`
+}
+
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+}
+
+func (s *SessionConfig) valid() error {
+	if s.ClientID == "" {
+		return errors.New("oidc: session client_id can't be empty")
+	}
+	if s.RedirectURL == "" {
+		return errors.New("oidc: session redirect_url can't be empty")
+	}
+	return nil
+}
+
+func (s *SessionConfig) cookieName() string {
+	if s.CookieName != "" {
+		return s.CookieName
+	}
+	return defaultCookieName
+}
+
+func (s *SessionConfig) stateCookieName() string {
+	return s.cookieName() + "_state"
+}
+
+func (s *SessionConfig) postLoginRedirect() string {
+	if s.PostLoginRedirect != "" {
+		return s.PostLoginRedirect
+	}
+	return defaultPostLoginRedirect
+}
+
+func (p *Provider) oauth2Config() *oauth2.Config {
+	scopes := p.cfg.Session.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	return &oauth2.Config{
+		ClientID:     p.cfg.Session.ClientID,
+		ClientSecret: p.cfg.Session.ClientSecret,
+		RedirectURL:  p.cfg.Session.RedirectURL,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.discovery.AuthorizationEndpoint,
+			TokenURL: p.discovery.TokenEndpoint,
+		},
+	}
+}
+
+// SessionRoutes returns the routes of the login flow, to be registered with api.Server.RegisterPluginRoutes
+// nil is returned if the session login isn't configured
+func (p *Provider) SessionRoutes() *api.PluginRouterGroup {
+	if p.cfg.Session == nil {
+		return nil
+	}
+	return &api.PluginRouterGroup{
+		Path:        SessionPathPrefix,
+		Name:        "oidc",
+		Description: "OIDC session login routes.",
+		Routes: []api.PluginRoute{
+			{
+				Path:   "/login",
+				Method: http.MethodGet,
+				Infos: []fizz.OperationOption{
+					fizz.ID("OIDCLogin"),
+					fizz.Summary("Redirect to the identity provider to log in"),
+				},
+				Handlers: []gin.HandlerFunc{p.login},
+			},
+			{
+				Path:   "/callback",
+				Method: http.MethodGet,
+				Infos: []fizz.OperationOption{
+					fizz.ID("OIDCCallback"),
+					fizz.Summary("Complete the login and open a session"),
+				},
+				Handlers: []gin.HandlerFunc{p.callback},
+			},
+			{
+				Path:   "/logout",
+				Method: http.MethodGet,
+				Infos: []fizz.OperationOption{
+					fizz.ID("OIDCLogout"),
+					fizz.Summary("Close the session"),
+				},
+				Handlers: []gin.HandlerFunc{p.logout},
+			},
+		},
+	}
+}
+
+func (p *Provider) login(c *gin.Context) {
+	st := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Redirect: p.cfg.Session.postLoginRedirect(),
+	}
+	if r := c.Query("redirect"); isLocalPath(r) {
+		st.Redirect = r
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	p.setCookie(c, p.cfg.Session.stateCookieName(), base64.RawURLEncoding.EncodeToString(b), stateCookieMaxAge)
+
+	c.Redirect(http.StatusFound, p.oauth2Config().AuthCodeURL(st.State, oauth2.SetAuthURLParam("nonce", st.Nonce)))
+}
+
+func (p *Provider) callback(c *gin.Context) {
+	logger := logrus.WithField("log_type", "auth")
+
+	var st loginState
+	cookie, err := c.Cookie(p.cfg.Session.stateCookieName())
+	if err == nil {
+		var b []byte
+		if b, err = base64.RawURLEncoding.DecodeString(cookie); err == nil {
+			err = json.Unmarshal(b, &st)
+		}
+	}
+	if err != nil || st.State == "" || st.State != c.Query("state") {
+		_ = c.AbortWithError(http.StatusBadRequest, errors.New("invalid login state"))
+		return
+	}
+	p.setCookie(c, p.cfg.Session.stateCookieName(), "", -1)
+
+	if e := c.Query("error"); e != "" {
+		logger.Warnf("oidc: login refused by identity provider: %s: %s", e, c.Query("error_description"))
+		_ = c.AbortWithError(http.StatusUnauthorized, errors.New("login refused by identity provider"))
+		return
+	}
+
+	token, err := p.oauth2Config().Exchange(c.Request.Context(), c.Query("code"))
+	if err != nil {
+		logger.Warnf("oidc: failed to exchange authorization code: %s", err)
+		_ = c.AbortWithError(http.StatusUnauthorized, errors.New("failed to exchange authorization code"))
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		_ = c.AbortWithError(http.StatusUnauthorized, errors.New("missing id_token in token response"))
+		return
+	}
+
+	claims, err := p.Verify(c.Request.Context(), rawIDToken)
+	if err != nil {
+		logger.Warnf("oidc: invalid id_token: %s", err)
+		_ = c.AbortWithError(http.StatusUnauthorized, errors.New("invalid id_token"))
+		return
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != st.Nonce {
+		_ = c.AbortWithError(http.StatusUnauthorized, errors.New("invalid id_token nonce"))
+		return
+	}
+	if _, _, err := p.identity(claims); err != nil {
+		_ = c.AbortWithError(http.StatusUnauthorized, err)
+		return
+	}
+
+	maxAge := time.Hour
+	if exp, ok := claims["exp"].(float64); ok {
+		maxAge = time.Until(time.Unix(int64(exp), 0))
+	}
+	p.setCookie(c, p.cfg.Session.cookieName(), rawIDToken, maxAge)
+
+	c.Redirect(http.StatusFound, st.Redirect)
+}
+
+func (p *Provider) logout(c *gin.Context) {
+	p.setCookie(c, p.cfg.Session.cookieName(), "", -1)
+
+	redirect := p.cfg.Session.postLoginRedirect()
+	if p.discovery.EndSessionEndpoint != "" {
+		redirect = p.discovery.EndSessionEndpoint
+	}
+	c.Redirect(http.StatusFound, redirect)
+}
+
+func (p *Provider) setCookie(c *gin.Context, name, value string, maxAge time.Duration) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   !p.cfg.Session.InsecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// isLocalPath prevents open redirects after login
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/ovh/utask/pkg/utils"
+)
+
+// ScopesCtxKey is the key used to store/retrieve the scopes of the API token
+// used by the caller. Callers authenticated otherwise have no scopes restriction.
+const ScopesCtxKey = "__scopes_provider_key"
+
+// TokenIDCtxKey is the key used to store/retrieve the public ID of the API token used by the caller
+const TokenIDCtxKey = "__token_id_key"
+
+// API token scopes
+const (
+	ScopeReadOnly = "read-only"
+	ScopeResolve  = "resolve"
+	ScopeAdmin    = "admin"
+	// ScopeCreateTaskPrefix is followed by the name of the template tasks can be created from
+	ScopeCreateTaskPrefix = "create-task:"
+)
+
+// CreateTaskScope returns the scope needed to create a task from a given template
+func CreateTaskScope(templateName string) string {
+	return ScopeCreateTaskPrefix + templateName
+}
+
+// ValidScope asserts that a scope is known
+func ValidScope(scope string) error {
+	switch scope {
+	case ScopeReadOnly, ScopeResolve, ScopeAdmin:
+		return nil
+	}
+	if strings.HasPrefix(scope, ScopeCreateTaskPrefix) && len(scope) > len(ScopeCreateTaskPrefix) {
+		return nil
+	}
+	return errors.BadRequestf("Unknown scope %q", scope)
+}
+
+// WithScopes adds API token scopes to a context
+func WithScopes(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, ScopesCtxKey, scopes) //nolint
+}
+
+// GetScopes returns the API token scopes stored in context
+// the boolean is false if the caller isn't restricted by scopes
+func GetScopes(ctx context.Context) ([]string, bool) {
+	scopes, ok := ctx.Value(ScopesCtxKey).([]string)
+	return scopes, ok
+}
+
+// HasScope asserts that the caller is allowed the given scope:
+// either it isn't restricted by scopes, or its token was granted
+// the scope itself or the admin scope
+func HasScope(ctx context.Context, scope string) error {
+	scopes, restricted := GetScopes(ctx)
+	if !restricted {
+		return nil
+	}
+	if utils.ListContainsString(scopes, scope) || utils.ListContainsString(scopes, ScopeAdmin) {
+		return nil
+	}
+	return errors.Forbiddenf("Token lacks the %q scope", scope)
+}
+
+// HasScopePrefix asserts that the caller is allowed at least one scope starting with prefix,
+// or isn't restricted by scopes
+func HasScopePrefix(ctx context.Context, prefix string) error {
+	scopes, restricted := GetScopes(ctx)
+	if !restricted {
+		return nil
+	}
+	for _, s := range scopes {
+		if s == ScopeAdmin || strings.HasPrefix(s, prefix) {
+			return nil
+		}
+	}
+	return errors.Forbiddenf("Token lacks a %q scope", prefix+"*")
+}
@@ -0,0 +1,32 @@
+package auth_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ovh/utask/pkg/auth"
+)
+
+func TestScopes(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, auth.HasScope(ctx, auth.ScopeAdmin), "callers without token are not restricted")
+
+	ctx = auth.WithScopes(ctx, []string{auth.ScopeReadOnly, auth.CreateTaskScope("hello-world")})
+	assert.Nil(t, auth.HasScope(ctx, auth.CreateTaskScope("hello-world")))
+	assert.NotNil(t, auth.HasScope(ctx, auth.CreateTaskScope("other")))
+	assert.NotNil(t, auth.HasScope(ctx, auth.ScopeResolve))
+	assert.Nil(t, auth.HasScopePrefix(ctx, auth.ScopeCreateTaskPrefix))
+
+	adminCtx := auth.WithScopes(context.Background(), []string{auth.ScopeAdmin})
+	assert.Nil(t, auth.HasScope(adminCtx, auth.ScopeResolve))
+	assert.Nil(t, auth.HasScopePrefix(adminCtx, auth.ScopeCreateTaskPrefix))
+
+	for _, s := range []string{auth.ScopeReadOnly, auth.ScopeResolve, auth.ScopeAdmin, "create-task:foo"} {
+		assert.Nil(t, auth.ValidScope(s), s)
+	}
+	for _, s := range []string{"", "create-task:", "write"} {
+		assert.NotNil(t, auth.ValidScope(s), s)
+	}
+}
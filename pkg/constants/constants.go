@@ -5,4 +5,7 @@ const (
 	// if a completed task has a parent task, and that parent task should be
 	// resumed.
 	SubtaskTagParentTaskID = "_utask_parent_task_id"
+	// SubtaskTagPausedWithParentTaskID is the tag key that utask sets on a subtask
+	// paused along with its parent task, so that it is resumed along with it.
+	SubtaskTagPausedWithParentTaskID = "_utask_paused_with_parent_task_id"
 )
@@ -14,6 +14,8 @@ const (
 	FunctionName = "function_name"
 	CommentID    = "comment_id"
 	BatchID      = "batch_id"
+	SecretName   = "secret_name"
+	TokenID      = "token_id"
 )
 
 func AddActionMetadata(c *gin.Context, name string, value interface{}) {
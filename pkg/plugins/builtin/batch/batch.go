@@ -21,6 +21,7 @@ import (
 	"github.com/ovh/utask/pkg/batchutils"
 	"github.com/ovh/utask/pkg/constants"
 	"github.com/ovh/utask/pkg/plugins/taskplugin"
+	"github.com/ovh/utask/pkg/taskutils"
 	"github.com/ovh/utask/pkg/templateimport"
 	"github.com/ovh/utask/pkg/utils"
 )
@@ -51,6 +52,8 @@ type BatchConfig struct {
 	// How many tasks will run concurrently. 0 for infinity (default). It's supplied as a string to support templating
 	SubBatchSizeStr string `json:"sub_batch_size"`
 	SubBatchSize    int64  `json:"-"`
+	// What happens to child tasks when the parent's resolution is cancelled or paused: cascade (default), detach or refuse
+	ChildrenPolicy string `json:"children_policy,omitempty"`
 }
 
 // quotedString is a string with doubly escaped quotes, so the string stays simply escaped after being processed
@@ -100,6 +103,10 @@ func validateConfigBatch(config any) error {
 		return err
 	}
 
+	if err := taskutils.ValidChildrenPolicy(conf.ChildrenPolicy); err != nil {
+		return err
+	}
+
 	dbp, err := zesty.NewDBProvider(utask.DBName)
 	if err != nil {
 		return fmt.Errorf("can't retrieve connection to DB: %s", err)
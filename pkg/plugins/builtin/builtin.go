@@ -1,7 +1,6 @@
 package builtin
 
 import (
-	"github.com/ovh/utask/engine/step"
 	"github.com/ovh/utask/pkg/plugins"
 	pluginapiovh "github.com/ovh/utask/pkg/plugins/builtin/apiovh"
 	pluginbatch "github.com/ovh/utask/pkg/plugins/builtin/batch"
@@ -9,10 +8,14 @@ import (
 	plugincallback "github.com/ovh/utask/pkg/plugins/builtin/callback"
 	pluginecho "github.com/ovh/utask/pkg/plugins/builtin/echo"
 	pluginemail "github.com/ovh/utask/pkg/plugins/builtin/email"
+	plugingrpc "github.com/ovh/utask/pkg/plugins/builtin/grpc"
 	pluginhttp "github.com/ovh/utask/pkg/plugins/builtin/http"
+	pluginkubernetes "github.com/ovh/utask/pkg/plugins/builtin/kubernetes"
+	pluginmq "github.com/ovh/utask/pkg/plugins/builtin/mq"
 	pluginnotify "github.com/ovh/utask/pkg/plugins/builtin/notify"
 	pluginping "github.com/ovh/utask/pkg/plugins/builtin/ping"
 	pluginscript "github.com/ovh/utask/pkg/plugins/builtin/script"
+	pluginsql "github.com/ovh/utask/pkg/plugins/builtin/sql"
 	pluginssh "github.com/ovh/utask/pkg/plugins/builtin/ssh"
 	pluginsubtask "github.com/ovh/utask/pkg/plugins/builtin/subtask"
 	plugintag "github.com/ovh/utask/pkg/plugins/builtin/tag"
@@ -24,6 +27,8 @@ func RegisterInit(service *plugins.Service) error {
 	for pluginName, pluginSymbol := range map[string]plugins.InitializerPlugin{
 		"callback": plugincallback.Init,
 		"cache":    plugincache.Init,
+		"script":   pluginscript.Init,
+		"ssh":      pluginssh.Init,
 	} {
 		if err := plugins.RegisterInit(pluginName, pluginSymbol, service); err != nil {
 			return err
@@ -32,7 +37,8 @@ func RegisterInit(service *plugins.Service) error {
 	return nil
 }
 
-// Register takes all builtin plugins and registers them as step executors
+// Register takes all builtin plugins and registers them as step executors,
+// along with their templating functions
 func Register() error {
 	for _, p := range []taskplugin.PluginExecutor{
 		pluginssh.Plugin,
@@ -48,8 +54,13 @@ func Register() error {
 		plugincallback.Plugin,
 		pluginbatch.Plugin,
 		plugincache.Plugin,
+		pluginsql.Plugin,
+		pluginkubernetes.Plugin,
+		plugingrpc.Plugin,
+		pluginmq.PublishPlugin,
+		pluginmq.ConsumePlugin,
 	} {
-		if err := step.RegisterRunner(p.PluginName(), p); err != nil {
+		if err := plugins.RegisterExecutor(p); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,217 @@
+package plugingrpc
+
+import (
+	"context"
+	"fmt"
+
+	jujuerrors "github.com/juju/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	reflectionv1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// resolveMethod finds the descriptor of a method, in the given descriptor set if any,
+// otherwise through the server reflection service of the target
+func resolveMethod(ctx context.Context, conn *grpc.ClientConn, descriptorSet, serviceName, methodName string) (protoreflect.MethodDescriptor, error) {
+	var files *protoregistry.Files
+	var err error
+	if descriptorSet != "" {
+		files, err = parseDescriptorSet(descriptorSet)
+		if err != nil {
+			return nil, jujuerrors.NewBadRequest(err, "")
+		}
+	} else {
+		files, err = reflectFiles(ctx, conn, serviceName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, jujuerrors.BadRequestf("service %s not found", serviceName)
+	}
+	service, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, jujuerrors.BadRequestf("%s is not a service", serviceName)
+	}
+	method := service.Methods().ByName(protoreflect.Name(methodName))
+	if method == nil {
+		return nil, jujuerrors.BadRequestf("method %s not found in service %s", methodName, serviceName)
+	}
+	return method, nil
+}
+
+// parseDescriptorSet reads a base64-encoded FileDescriptorSet, as generated by
+// protoc --include_imports --descriptor_set_out
+func parseDescriptorSet(s string) (*protoregistry.Files, error) {
+	b, err := decodeBase64(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor_set, expected base64: %s", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor_set: %s", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor_set: %s", err)
+	}
+	return files, nil
+}
+
+// reflectionRequest asks a reflection service for the file defining a symbol, or for a file by its name,
+// along with its dependencies
+type reflectionRequest func(symbol, filename string) ([][]byte, error)
+
+// reflectFiles retrieves the file defining a symbol and all its dependencies from the server reflection service
+func reflectFiles(ctx context.Context, conn *grpc.ClientConn, symbol string) (*protoregistry.Files, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	request, err := reflectionV1(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := request(symbol, "")
+	if status.Code(err) == codes.Unimplemented {
+		// servers predating the v1 reflection service
+		if request, err = reflectionV1alpha(ctx, conn); err != nil {
+			return nil, err
+		}
+		raw, err = request(symbol, "")
+	}
+	if status.Code(err) == codes.Unimplemented {
+		return nil, jujuerrors.BadRequestf("server reflection isn't supported by %s, a descriptor_set is required", conn.Target())
+	} else if status.Code(err) == codes.NotFound {
+		return nil, jujuerrors.BadRequestf("service %s not found", symbol)
+	} else if err != nil {
+		return nil, err
+	}
+
+	protos := map[string]*descriptorpb.FileDescriptorProto{}
+	if err := addFiles(protos, raw); err != nil {
+		return nil, err
+	}
+
+	// the files of the dependencies already sent on the stream aren't sent again
+	for missing := missingDependencies(protos); len(missing) > 0; missing = missingDependencies(protos) {
+		for _, name := range missing {
+			raw, err := request("", name)
+			if err != nil {
+				global, gerr := protoregistry.GlobalFiles.FindFileByPath(name)
+				if gerr != nil {
+					return nil, fmt.Errorf("can't retrieve file %s: %s", name, err)
+				}
+				protos[name] = protodesc.ToFileDescriptorProto(global)
+				continue
+			}
+			if err := addFiles(protos, raw); err != nil {
+				return nil, err
+			}
+			if _, ok := protos[name]; !ok {
+				return nil, fmt.Errorf("can't retrieve file %s", name)
+			}
+		}
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range protos {
+		set.File = append(set.File, fd)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptors from server reflection: %s", err)
+	}
+	return files, nil
+}
+
+func addFiles(protos map[string]*descriptorpb.FileDescriptorProto, raw [][]byte) error {
+	for _, b := range raw {
+		fd := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(b, fd); err != nil {
+			return fmt.Errorf("invalid descriptor from server reflection: %s", err)
+		}
+		protos[fd.GetName()] = fd
+	}
+	return nil
+}
+
+func missingDependencies(protos map[string]*descriptorpb.FileDescriptorProto) []string {
+	missing := []string{}
+	seen := map[string]bool{}
+	for _, fd := range protos {
+		for _, dep := range fd.GetDependency() {
+			if _, ok := protos[dep]; !ok && !seen[dep] {
+				seen[dep] = true
+				missing = append(missing, dep)
+			}
+		}
+	}
+	return missing
+}
+
+func reflectionV1(ctx context.Context, conn *grpc.ClientConn) (reflectionRequest, error) {
+	stream, err := reflectionv1.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(symbol, filename string) ([][]byte, error) {
+		req := &reflectionv1.ServerReflectionRequest{}
+		if symbol != "" {
+			req.MessageRequest = &reflectionv1.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol}
+		} else {
+			req.MessageRequest = &reflectionv1.ServerReflectionRequest_FileByFilename{FileByFilename: filename}
+		}
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		switch r := resp.MessageResponse.(type) {
+		case *reflectionv1.ServerReflectionResponse_FileDescriptorResponse:
+			return r.FileDescriptorResponse.GetFileDescriptorProto(), nil
+		case *reflectionv1.ServerReflectionResponse_ErrorResponse:
+			return nil, status.Error(codes.Code(r.ErrorResponse.GetErrorCode()), r.ErrorResponse.GetErrorMessage())
+		}
+		return nil, fmt.Errorf("unexpected response from server reflection: %T", resp.MessageResponse)
+	}, nil
+}
+
+func reflectionV1alpha(ctx context.Context, conn *grpc.ClientConn) (reflectionRequest, error) {
+	stream, err := reflectionv1alpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(symbol, filename string) ([][]byte, error) {
+		req := &reflectionv1alpha.ServerReflectionRequest{}
+		if symbol != "" {
+			req.MessageRequest = &reflectionv1alpha.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol}
+		} else {
+			req.MessageRequest = &reflectionv1alpha.ServerReflectionRequest_FileByFilename{FileByFilename: filename}
+		}
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		switch r := resp.MessageResponse.(type) {
+		case *reflectionv1alpha.ServerReflectionResponse_FileDescriptorResponse:
+			return r.FileDescriptorResponse.GetFileDescriptorProto(), nil
+		case *reflectionv1alpha.ServerReflectionResponse_ErrorResponse:
+			return nil, status.Error(codes.Code(r.ErrorResponse.GetErrorCode()), r.ErrorResponse.GetErrorMessage())
+		}
+		return nil, fmt.Errorf("unexpected response from server reflection: %T", resp.MessageResponse)
+	}, nil
+}
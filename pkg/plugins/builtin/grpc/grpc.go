@@ -0,0 +1,324 @@
+package plugingrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/pkg/plugins/taskplugin"
+	"github.com/ovh/utask/pkg/utils"
+)
+
+// the gRPC plugin performs a unary gRPC call
+var (
+	Plugin = taskplugin.New("grpc", "0.1", exec,
+		taskplugin.WithConfig(validConfig, GRPCConfig{}),
+		taskplugin.WithResources(resourcesgrpc),
+	)
+)
+
+const (
+	// TimeoutDefault represents the default value that will be used for gRPC calls, if not defined in configuration
+	TimeoutDefault = "30s"
+)
+
+// metadata keys of a gRPC call
+const (
+	GRPCStatus   = "grpc_status"
+	GRPCMessage  = "grpc_message"
+	GRPCHeaders  = "grpc_headers"
+	GRPCTrailers = "grpc_trailers"
+)
+
+// GRPCConfig is the configuration needed to perform a gRPC call
+type GRPCConfig struct {
+	Target             string      `json:"target"`
+	Method             string      `json:"method"`
+	Body               string      `json:"body,omitempty"`
+	Metadata           []parameter `json:"metadata,omitempty"`
+	Timeout            string      `json:"timeout,omitempty"`
+	Auth               auth        `json:"auth,omitempty"`
+	Plaintext          string      `json:"plaintext,omitempty"`
+	InsecureSkipVerify string      `json:"insecure_skip_verify,omitempty"`
+	RootCA             string      `json:"root_ca,omitempty"`
+	ServerName         string      `json:"server_name,omitempty"`
+	DescriptorSet      string      `json:"descriptor_set,omitempty"`
+}
+
+// parameter represents a metadata sent along with the call
+type parameter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// auth represents the authentication of the call
+type auth struct {
+	Bearer    *string `json:"bearer"`
+	MutualTLS *mTLS   `json:"mutual_tls"`
+}
+
+type mTLS struct {
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+}
+
+func validConfig(config interface{}) error {
+	cfg := config.(*GRPCConfig)
+
+	if cfg.Target == "" {
+		return errors.New("missing target")
+	}
+
+	if cfg.Method == "" {
+		return errors.New("missing method")
+	}
+	if !strings.Contains(cfg.Method, "{{") {
+		if _, _, err := splitMethod(cfg.Method); err != nil {
+			return err
+		}
+	}
+
+	// skip validation of Timeout, Plaintext and InsecureSkipVerify to allow runtime templating
+
+	for _, p := range cfg.Metadata {
+		if p.Name == "" {
+			return fmt.Errorf("missing metadata name (with value '%s')", p.Value)
+		}
+	}
+
+	if cfg.Auth.Bearer != nil && *cfg.Auth.Bearer == "" {
+		return fmt.Errorf("missing bearer token value")
+	}
+
+	if cfg.Auth.MutualTLS != nil {
+		if cfg.Auth.MutualTLS.ClientCert == "" || cfg.Auth.MutualTLS.ClientKey == "" {
+			return fmt.Errorf("missing either client_cert or client_key for mTLS")
+		}
+	}
+
+	if cfg.DescriptorSet != "" && !strings.Contains(cfg.DescriptorSet, "{{") {
+		if _, err := parseDescriptorSet(cfg.DescriptorSet); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitMethod returns the fully-qualified names of the service and of the method,
+// given as "package.Service/Method" or "package.Service.Method"
+func splitMethod(method string) (string, string, error) {
+	method = strings.TrimPrefix(method, "/")
+	i := strings.LastIndex(method, "/")
+	if i < 0 {
+		i = strings.LastIndex(method, ".")
+	}
+	if i <= 0 || i == len(method)-1 {
+		return "", "", fmt.Errorf("invalid method %q, expected package.Service/Method", method)
+	}
+	return method[:i], method[i+1:], nil
+}
+
+func resourcesgrpc(i interface{}) []string {
+	cfg := i.(*GRPCConfig)
+	return []string{
+		"socket",
+		"grpc:" + cfg.Target,
+	}
+}
+
+func exec(stepName string, config interface{}, ctx interface{}) (interface{}, interface{}, error) {
+	cfg := config.(*GRPCConfig)
+
+	if utask.FDebug {
+		fmt.Println(cfg.Body)
+	}
+
+	if cfg.Timeout == "" {
+		cfg.Timeout = TimeoutDefault
+	}
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse timeout: %s", err)
+	}
+
+	creds, err := transportCredentials(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := grpc.NewClient(cfg.Target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't create gRPC client: %s", err)
+	}
+	defer conn.Close()
+
+	callCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	md := grpcmetadata.MD{}
+	for _, p := range cfg.Metadata {
+		md.Append(p.Name, p.Value)
+	}
+	if cfg.Auth.Bearer != nil {
+		md.Set("authorization", "Bearer "+*cfg.Auth.Bearer)
+	}
+	callCtx = grpcmetadata.NewOutgoingContext(callCtx, md)
+
+	serviceName, methodName, err := splitMethod(cfg.Method)
+	if err != nil {
+		return nil, nil, jujuerrors.NewBadRequest(err, "")
+	}
+	method, err := resolveMethod(callCtx, conn, cfg.DescriptorSet, serviceName, methodName)
+	if err != nil {
+		return nil, nil, interpret(err)
+	}
+	if method.IsStreamingClient() || method.IsStreamingServer() {
+		return nil, nil, jujuerrors.BadRequestf("method %s is a streaming method, only unary methods are supported", method.FullName())
+	}
+
+	req := dynamicpb.NewMessage(method.Input())
+	if strings.TrimSpace(cfg.Body) != "" {
+		if err := protojson.Unmarshal([]byte(cfg.Body), req); err != nil {
+			return nil, nil, jujuerrors.NewBadRequest(err, fmt.Sprintf("invalid body for %s", method.Input().FullName()))
+		}
+	}
+	resp := dynamicpb.NewMessage(method.Output())
+
+	var header, trailer grpcmetadata.MD
+	callErr := conn.Invoke(callCtx, "/"+serviceName+"/"+methodName, req, resp, grpc.Header(&header), grpc.Trailer(&trailer))
+
+	st := status.Convert(callErr)
+	metadata := map[string]interface{}{
+		GRPCStatus:   st.Code().String(),
+		GRPCMessage:  st.Message(),
+		GRPCHeaders:  flattenMetadata(header),
+		GRPCTrailers: flattenMetadata(trailer),
+	}
+
+	if callErr != nil {
+		return nil, metadata, interpret(callErr)
+	}
+
+	body, err := protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}.Marshal(resp)
+	if err != nil {
+		return nil, metadata, fmt.Errorf("can't marshal response: %s", err)
+	}
+	var output interface{}
+	if err := utils.JSONnumberUnmarshal(bytes.NewReader(body), &output); err != nil {
+		return nil, metadata, fmt.Errorf("can't unmarshal response: %s", err)
+	}
+
+	return output, metadata, nil
+}
+
+func transportCredentials(cfg *GRPCConfig) (credentials.TransportCredentials, error) {
+	var err error
+	var plaintext, insecureSkipVerify bool
+	if cfg.Plaintext != "" {
+		plaintext, err = strconv.ParseBool(cfg.Plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse plaintext: %s", err)
+		}
+	}
+	if cfg.InsecureSkipVerify != "" {
+		insecureSkipVerify, err = strconv.ParseBool(cfg.InsecureSkipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse insecure_skip_verify: %s", err)
+		}
+	}
+
+	if plaintext {
+		if cfg.Auth.MutualTLS != nil || cfg.RootCA != "" || insecureSkipVerify {
+			return nil, jujuerrors.BadRequestf("plaintext conflicts with TLS options")
+		}
+		return insecure.NewCredentials(), nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+		ServerName:         cfg.ServerName,
+	}
+
+	if cfg.Auth.MutualTLS != nil {
+		cert, err := tls.X509KeyPair([]byte(cfg.Auth.MutualTLS.ClientCert), []byte(cfg.Auth.MutualTLS.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse x509 mTLS certificate or key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.RootCA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(cfg.RootCA)) {
+			return nil, errors.New("failed to add root CA: no certificate found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func flattenMetadata(md grpcmetadata.MD) map[string]string {
+	flat := map[string]string{}
+	for k, list := range md {
+		if len(list) > 0 && !strings.HasSuffix(k, "-bin") {
+			flat[k] = list[0]
+		}
+	}
+	return flat
+}
+
+// interpret maps the status of a gRPC call to the state of the step: statuses caused by the request itself
+// won't change if retried, and put the step in CLIENT_ERROR, while others put it in SERVER_ERROR
+func interpret(err error) error {
+	if jujuerrors.IsBadRequest(err) {
+		return err
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	err = fmt.Errorf("failed gRPC call: %s: %s", st.Code(), st.Message())
+	switch st.Code() {
+	case codes.InvalidArgument,
+		codes.NotFound,
+		codes.AlreadyExists,
+		codes.PermissionDenied,
+		codes.FailedPrecondition,
+		codes.OutOfRange,
+		codes.Unimplemented,
+		codes.Unauthenticated:
+		return jujuerrors.NewBadRequest(err, "Client error")
+	}
+	return err
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
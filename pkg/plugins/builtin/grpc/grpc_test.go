@@ -0,0 +1,233 @@
+package plugingrpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/maxatome/go-testdeep/td"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// startServer serves the health service, with its status set for the service "api"
+func startServer(t *testing.T, withReflection bool, opts ...grpc.ServerOption) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	td.Require(t).CmpNoError(err)
+
+	opts = append(opts, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := grpcmetadata.FromIncomingContext(ctx)
+		grpc.SetHeader(ctx, grpcmetadata.Pairs("x-request-id", "42"))
+		if auth := md.Get("authorization"); len(auth) > 0 {
+			grpc.SetTrailer(ctx, grpcmetadata.Pairs("x-authorization", auth[0]))
+		}
+		return handler(ctx, req)
+	}))
+	srv := grpc.NewServer(opts...)
+	hs := health.NewServer()
+	hs.SetServingStatus("api", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, hs)
+	if withReflection {
+		reflection.Register(srv)
+	}
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestConfig(t *testing.T) {
+	bearer := ""
+	for _, cfg := range []*GRPCConfig{
+		{Method: "grpc.health.v1.Health/Check"},
+		{Target: "localhost:443"},
+		{Target: "localhost:443", Method: "Check"},
+		{Target: "localhost:443", Method: "grpc.health.v1.Health/"},
+		{Target: "localhost:443", Method: "grpc.health.v1.Health/Check", Metadata: []parameter{{Value: "foo"}}},
+		{Target: "localhost:443", Method: "grpc.health.v1.Health/Check", Auth: auth{Bearer: &bearer}},
+		{Target: "localhost:443", Method: "grpc.health.v1.Health/Check", Auth: auth{MutualTLS: &mTLS{ClientCert: "cert"}}},
+		{Target: "localhost:443", Method: "grpc.health.v1.Health/Check", DescriptorSet: "not base64!"},
+	} {
+		td.CmpError(t, validConfig(cfg), "%+v", cfg)
+	}
+
+	for _, cfg := range []*GRPCConfig{
+		{Target: "localhost:443", Method: "grpc.health.v1.Health/Check"},
+		{Target: "localhost:443", Method: "grpc.health.v1.Health.Check"},
+		{Target: "localhost:443", Method: "/grpc.health.v1.Health/Check"},
+		{Target: "localhost:443", Method: "{{.input.method}}", DescriptorSet: "{{.config.descriptors}}"},
+		{Target: "localhost:443", Method: "grpc.health.v1.Health/Check", DescriptorSet: healthDescriptorSet(t)},
+	} {
+		td.CmpNoError(t, validConfig(cfg), "%+v", cfg)
+	}
+
+	td.Cmp(t, resourcesgrpc(&GRPCConfig{Target: "localhost:443"}), []string{"socket", "grpc:localhost:443"})
+}
+
+func healthDescriptorSet(t *testing.T) string {
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(healthpb.File_grpc_health_v1_health_proto),
+	}}
+	b, err := proto.Marshal(set)
+	td.Require(t).CmpNoError(err)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestCall(t *testing.T) {
+	target := startServer(t, true)
+	bearer := "s3cr3t"
+
+	cfg := &GRPCConfig{
+		Target:    target,
+		Method:    "grpc.health.v1.Health/Check",
+		Body:      `{"service": "api"}`,
+		Plaintext: "true",
+		Auth:      auth{Bearer: &bearer},
+	}
+	td.Require(t).CmpNoError(validConfig(cfg))
+	output, metadata, err := exec("step", cfg, nil)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, map[string]interface{}{"status": "SERVING"})
+	td.Cmp(t, metadata, map[string]interface{}{
+		GRPCStatus:   "OK",
+		GRPCMessage:  "",
+		GRPCHeaders:  td.SuperMapOf(map[string]string{"x-request-id": "42"}, nil),
+		GRPCTrailers: td.SuperMapOf(map[string]string{"x-authorization": "Bearer s3cr3t"}, nil),
+	})
+
+	// errors caused by the request are client errors
+	for _, c := range []struct {
+		method, body, status string
+	}{
+		{"grpc.health.v1.Health/Check", `{"service": "unknown"}`, "NotFound"},
+		{"grpc.health.v1.Health/Check", `{"unknown_field": true}`, ""},
+		{"grpc.health.v1.Health/Unknown", `{}`, ""},
+		{"grpc.health.v1.Unknown/Check", `{}`, ""},
+		{"grpc.health.v1.Health/Watch", `{}`, ""},
+	} {
+		_, metadata, err := exec("step", &GRPCConfig{Target: target, Method: c.method, Body: c.body, Plaintext: "true"}, nil)
+		td.CmpTrue(t, errors.IsBadRequest(err), "%s %s: %v", c.method, c.body, err)
+		if c.status != "" {
+			td.Cmp(t, metadata.(map[string]interface{})[GRPCStatus], c.status)
+		}
+	}
+
+	// descriptor set, on a server without reflection
+	target = startServer(t, false)
+	cfg = &GRPCConfig{Target: target, Method: "grpc.health.v1.Health/Check", Plaintext: "true"}
+	_, _, err = exec("step", cfg, nil)
+	td.CmpTrue(t, errors.IsBadRequest(err))
+	td.CmpContains(t, err, "descriptor_set")
+
+	cfg.DescriptorSet = healthDescriptorSet(t)
+	cfg.Body = `{"service": "api"}`
+	output, _, err = exec("step", cfg, nil)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, map[string]interface{}{"status": "SERVING"})
+
+	// unreachable servers are server errors, to be retried
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	td.Require(t).CmpNoError(err)
+	lis.Close()
+	_, _, err = exec("step", &GRPCConfig{Target: lis.Addr().String(), Method: "grpc.health.v1.Health/Check", Plaintext: "true", Timeout: "2s"}, nil)
+	td.CmpError(t, err)
+	td.CmpFalse(t, errors.IsBadRequest(err))
+}
+
+func TestMutualTLS(t *testing.T) {
+	caCert, caKey, caPEM := newCertificate(t, nil, nil, true)
+	serverCert, _, _ := newCertificate(t, caCert, caKey, false)
+	_, clientKey, clientPEM := newCertificate(t, caCert, caKey, false)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert.Certificate)
+	target := startServer(t, true, grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert.tls},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})))
+
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	td.Require(t).CmpNoError(err)
+	cfg := &GRPCConfig{
+		Target: target,
+		Method: "grpc.health.v1.Health/Check",
+		RootCA: caPEM,
+		Auth: auth{MutualTLS: &mTLS{
+			ClientCert: clientPEM,
+			ClientKey:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		}},
+	}
+	td.Require(t).CmpNoError(validConfig(cfg))
+	output, _, err := exec("step", cfg, nil)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, map[string]interface{}{"status": "SERVING"})
+
+	// without a client certificate
+	cfg.Auth.MutualTLS = nil
+	cfg.Timeout = "2s"
+	_, _, err = exec("step", cfg, nil)
+	td.CmpError(t, err)
+
+	// without the CA
+	cfg.RootCA = ""
+	_, _, err = exec("step", cfg, nil)
+	td.CmpError(t, err)
+}
+
+type certificate struct {
+	*x509.Certificate
+	tls tls.Certificate
+}
+
+// newCertificate generates a certificate for 127.0.0.1, signed by the given CA, or self-signed
+func newCertificate(t *testing.T, ca *certificate, caKey *ecdsa.PrivateKey, isCA bool) (*certificate, *ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	td.Require(t).CmpNoError(err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	td.Require(t).CmpNoError(err)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "utask"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca.Certificate, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	td.Require(t).CmpNoError(err)
+	cert, err := x509.ParseCertificate(der)
+	td.Require(t).CmpNoError(err)
+
+	return &certificate{
+		Certificate: cert,
+		tls:         tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}, key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
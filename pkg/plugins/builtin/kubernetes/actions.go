@@ -0,0 +1,311 @@
+package pluginkubernetes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// decodeManifest reads the objects of a YAML or JSON manifest, documents being separated by "---"
+func decodeManifest(manifest string) ([]*unstructured.Unstructured, error) {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 4096)
+	objects := []*unstructured.Unstructured{}
+	for {
+		var obj map[string]interface{}
+		if err := decoder.Decode(&obj); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.NewBadRequest(err, "invalid manifest")
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		u := &unstructured.Unstructured{Object: obj}
+		if u.GetAPIVersion() == "" || u.GetKind() == "" || u.GetName() == "" {
+			return nil, errors.BadRequestf("invalid manifest: object #%d is missing its apiVersion, kind or metadata.name", len(objects)+1)
+		}
+		objects = append(objects, u)
+	}
+	if len(objects) == 0 {
+		return nil, errors.BadRequestf("invalid manifest: no object found")
+	}
+	return objects, nil
+}
+
+// cleanObject returns the content of an object, without the bookkeeping of its managed fields
+func cleanObject(obj *unstructured.Unstructured) map[string]interface{} {
+	unstructured.RemoveNestedField(obj.Object, "metadata", "managedFields")
+	return obj.Object
+}
+
+func (cfg *Config) gvk() schema.GroupVersionKind {
+	return schema.FromAPIVersionAndKind(cfg.APIVersion, cfg.Kind)
+}
+
+// apply creates or updates the objects of a manifest, with a server-side apply
+func (c *client) apply(ctx context.Context, cfg *Config) (interface{}, interface{}, error) {
+	objects, err := decodeManifest(cfg.Manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fieldManager := cfg.FieldManager
+	if fieldManager == "" {
+		fieldManager = defaultFieldManager
+	}
+
+	applied := make([]interface{}, 0, len(objects))
+	for _, obj := range objects {
+		ri, err := c.resource(obj.GroupVersionKind(), obj.GetNamespace())
+		if err != nil {
+			return nil, nil, err
+		}
+		res, err := ri.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{FieldManager: fieldManager, Force: cfg.Force})
+		if err != nil {
+			return nil, nil, interpret(err)
+		}
+		applied = append(applied, cleanObject(res))
+	}
+
+	output := map[string]interface{}{
+		"objects": applied,
+	}
+	return output, nil, nil
+}
+
+// get retrieves an object by its name, or lists the objects matching the selectors
+func (c *client) get(ctx context.Context, cfg *Config) (interface{}, interface{}, error) {
+	ri, err := c.resource(cfg.gvk(), "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.Name != "" {
+		obj, err := ri.Get(ctx, cfg.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, interpret(err)
+		}
+		return cleanObject(obj), nil, nil
+	}
+
+	list, err := ri.List(ctx, metav1.ListOptions{LabelSelector: cfg.LabelSelector, FieldSelector: cfg.FieldSelector})
+	if err != nil {
+		return nil, nil, interpret(err)
+	}
+	items := make([]interface{}, 0, len(list.Items))
+	for i := range list.Items {
+		items = append(items, cleanObject(&list.Items[i]))
+	}
+
+	output := map[string]interface{}{
+		"items": items,
+	}
+	metadata := map[string]interface{}{
+		"count": len(items),
+	}
+	return output, metadata, nil
+}
+
+// delete removes an object
+func (c *client) delete(ctx context.Context, cfg *Config) (interface{}, interface{}, error) {
+	ri, err := c.resource(cfg.gvk(), "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := metav1.DeleteOptions{}
+	if cfg.PropagationPolicy != "" {
+		policy := metav1.DeletionPropagation(cfg.PropagationPolicy)
+		opts.PropagationPolicy = &policy
+	}
+
+	deleted := true
+	if err := ri.Delete(ctx, cfg.Name, opts); err != nil {
+		if !apierrors.IsNotFound(err) || !cfg.IgnoreNotFound {
+			return nil, nil, interpret(err)
+		}
+		deleted = false
+	}
+
+	output := map[string]interface{}{
+		"deleted": deleted,
+	}
+	return output, nil, nil
+}
+
+// patch updates some fields of an object
+func (c *client) patch(ctx context.Context, cfg *Config) (interface{}, interface{}, error) {
+	ri, err := c.resource(cfg.gvk(), "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := yaml.YAMLToJSON([]byte(cfg.Patch))
+	if err != nil {
+		return nil, nil, errors.NewBadRequest(err, "invalid patch")
+	}
+
+	patchType := types.MergePatchType
+	switch cfg.PatchType {
+	case PatchTypeJSON:
+		patchType = types.JSONPatchType
+	case PatchTypeStrategic:
+		patchType = types.StrategicMergePatchType
+	}
+
+	fieldManager := cfg.FieldManager
+	if fieldManager == "" {
+		fieldManager = defaultFieldManager
+	}
+
+	obj, err := ri.Patch(ctx, cfg.Name, patchType, data, metav1.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		return nil, nil, interpret(err)
+	}
+	return cleanObject(obj), nil, nil
+}
+
+// wait checks whether an object reached the expected state; when it did not, the returned error
+// puts the step in TO_RETRY, for the engine to check again according to the step's retry_pattern
+func (c *client) wait(ctx context.Context, cfg *Config) (interface{}, interface{}, error) {
+	ri, err := c.resource(cfg.gvk(), "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj, err := ri.Get(ctx, cfg.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if cfg.waitFor() == WaitForDeleted {
+			return map[string]interface{}{"deleted": true}, nil, nil
+		}
+		return nil, map[string]interface{}{"reason": "not found"}, errors.NotProvisionedf("%s %q not found", cfg.Kind, cfg.Name)
+	} else if err != nil {
+		return nil, nil, interpret(err)
+	}
+
+	var reason string
+	switch cfg.waitFor() {
+	case WaitForDeleted:
+		reason = "waiting for deletion"
+	case WaitForCondition:
+		status := cfg.ConditionStatus
+		if status == "" {
+			status = defaultConditionStatus
+		}
+		reason = conditionStatus(obj, cfg.Condition, status)
+	case WaitForRollout:
+		reason, err = rolloutStatus(obj)
+		if err != nil {
+			return cleanObject(obj), nil, err
+		}
+	}
+
+	if reason != "" {
+		metadata := map[string]interface{}{
+			"reason": reason,
+		}
+		return cleanObject(obj), metadata, errors.NotProvisionedf("%s %q: %s", cfg.Kind, cfg.Name, reason)
+	}
+	return cleanObject(obj), nil, nil
+}
+
+// conditionStatus tells why an object's condition doesn't have the expected status, empty if it does
+func conditionStatus(obj *unstructured.Unstructured, conditionType, status string) string {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != conditionType {
+			continue
+		}
+		if observed, ok, _ := unstructured.NestedInt64(condition, "observedGeneration"); ok && observed < obj.GetGeneration() {
+			return fmt.Sprintf("condition %s not observed for generation %d", conditionType, obj.GetGeneration())
+		}
+		if condition["status"] != status {
+			return fmt.Sprintf("condition %s is %v, expected %s", conditionType, condition["status"], status)
+		}
+		return ""
+	}
+	return fmt.Sprintf("condition %s not found", conditionType)
+}
+
+// rolloutStatus tells why the rollout of a workload isn't complete, empty if it is
+func rolloutStatus(obj *unstructured.Unstructured) (string, error) {
+	gvk := obj.GroupVersionKind()
+	if gvk.Group != "apps" {
+		return "", errors.BadRequestf("can't wait for the rollout of a %s", gvk.Kind)
+	}
+
+	if observed, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration"); observed < obj.GetGeneration() {
+		return "waiting for the rollout to be observed", nil
+	}
+
+	status := func(fields ...string) int64 {
+		v, _, _ := unstructured.NestedInt64(obj.Object, append([]string{"status"}, fields...)...)
+		return v
+	}
+	replicas, ok, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !ok {
+		replicas = 1
+	}
+
+	switch gvk.Kind {
+	case "Deployment":
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		for _, c := range conditions {
+			if condition, ok := c.(map[string]interface{}); ok && condition["type"] == "Progressing" && condition["reason"] == "ProgressDeadlineExceeded" {
+				return "", errors.BadRequestf("rollout of deployment %q exceeded its progress deadline", obj.GetName())
+			}
+		}
+		if updated := status("updatedReplicas"); updated < replicas {
+			return fmt.Sprintf("%d out of %d new replicas have been updated", updated, replicas), nil
+		}
+		if old := status("replicas") - status("updatedReplicas"); old > 0 {
+			return fmt.Sprintf("%d old replicas are pending termination", old), nil
+		}
+		if available := status("availableReplicas"); available < status("updatedReplicas") {
+			return fmt.Sprintf("%d of %d updated replicas are available", available, status("updatedReplicas")), nil
+		}
+	case "StatefulSet":
+		strategy, _, _ := unstructured.NestedString(obj.Object, "spec", "updateStrategy", "type")
+		if strategy == "OnDelete" {
+			return "", errors.BadRequestf("can't wait for the rollout of statefulset %q, its update strategy is OnDelete", obj.GetName())
+		}
+		if ready := status("readyReplicas"); ready < replicas {
+			return fmt.Sprintf("%d of %d replicas are ready", ready, replicas), nil
+		}
+		partition, _, _ := unstructured.NestedInt64(obj.Object, "spec", "updateStrategy", "rollingUpdate", "partition")
+		if partition > 0 {
+			if updated := status("updatedReplicas"); updated < replicas-partition {
+				return fmt.Sprintf("%d of %d new replicas have been updated", updated, replicas-partition), nil
+			}
+			return "", nil
+		}
+		current, _, _ := unstructured.NestedString(obj.Object, "status", "currentRevision")
+		update, _, _ := unstructured.NestedString(obj.Object, "status", "updateRevision")
+		if current != update {
+			return fmt.Sprintf("waiting for replicas to be updated to revision %s", update), nil
+		}
+	case "DaemonSet":
+		desired := status("desiredNumberScheduled")
+		if updated := status("updatedNumberScheduled"); updated < desired {
+			return fmt.Sprintf("%d out of %d new pods have been updated", updated, desired), nil
+		}
+		if available := status("numberAvailable"); available < desired {
+			return fmt.Sprintf("%d of %d updated pods are available", available, desired), nil
+		}
+	default:
+		return "", errors.BadRequestf("can't wait for the rollout of a %s", gvk.Kind)
+	}
+	return "", nil
+}
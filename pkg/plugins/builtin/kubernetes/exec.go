@@ -0,0 +1,83 @@
+package pluginkubernetes
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"path"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+
+	"github.com/ovh/utask/pkg/plugins/builtin/scriptutil"
+)
+
+// exec runs a command in a container of a pod
+func (c *client) exec(ctx context.Context, cfg *Config) (interface{}, interface{}, error) {
+	podsConfig := rest.CopyConfig(c.rest)
+	podsConfig.APIPath = "/api"
+	podsConfig.GroupVersion = &schema.GroupVersion{Version: "v1"}
+	u, apiPath, err := rest.DefaultServerUrlFor(podsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.Path = path.Join(apiPath, "namespaces", c.namespace, "pods", cfg.Name, "exec")
+	q := u.Query()
+	for _, arg := range cfg.Command {
+		q.Add("command", arg)
+	}
+	if cfg.Container != "" {
+		q.Set("container", cfg.Container)
+	}
+	q.Set("stdout", "true")
+	q.Set("stderr", "true")
+	if cfg.Stdin != "" {
+		q.Set("stdin", "true")
+	}
+	u.RawQuery = q.Encode()
+
+	// prefer websockets, falling back to SPDY for API servers that don't support them
+	ws, err := remotecommand.NewWebSocketExecutor(c.rest, "GET", u.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	spdy, err := remotecommand.NewSPDYExecutor(c.rest, "POST", u)
+	if err != nil {
+		return nil, nil, err
+	}
+	executor, err := remotecommand.NewFallbackExecutor(ws, spdy, func(err error) bool {
+		return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	opts := remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr}
+	if cfg.Stdin != "" {
+		opts.Stdin = strings.NewReader(cfg.Stdin)
+	}
+
+	exitCode := 0
+	streamErr := executor.StreamWithContext(ctx, opts)
+	var exitErr utilexec.ExitError
+	if stderrors.As(streamErr, &exitErr) {
+		exitCode = exitErr.ExitStatus()
+	} else if streamErr != nil {
+		return nil, nil, interpret(streamErr)
+	}
+
+	output := map[string]interface{}{
+		"stdout":    stdout.String(),
+		"stderr":    stderr.String(),
+		"exit_code": exitCode,
+	}
+	if exitCode != 0 {
+		return output, nil, scriptutil.FormatErrorExitCode(exitCode, cfg.ExitCodesUnrecoverable, streamErr)
+	}
+	return output, nil, nil
+}
@@ -0,0 +1,381 @@
+package pluginkubernetes
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ovh/configstore"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/ovh/utask/engine/values"
+	"github.com/ovh/utask/pkg/plugins/builtin/scriptutil"
+	"github.com/ovh/utask/pkg/plugins/taskplugin"
+)
+
+// the kubernetes plugin manages resources of a Kubernetes cluster
+var (
+	Plugin = taskplugin.New("kubernetes", "0.1", exec,
+		taskplugin.WithConfig(validConfig, Config{}),
+		taskplugin.WithResources(resourceskubernetes),
+	)
+)
+
+// actions of the kubernetes plugin
+const (
+	ActionApply  = "apply"
+	ActionGet    = "get"
+	ActionDelete = "delete"
+	ActionPatch  = "patch"
+	ActionWait   = "wait"
+	ActionExec   = "exec"
+)
+
+// conditions a wait action can wait for
+const (
+	WaitForCondition = "condition"
+	WaitForRollout   = "rollout"
+	WaitForDeleted   = "deleted"
+)
+
+// types of patch
+const (
+	PatchTypeMerge     = "merge"
+	PatchTypeJSON      = "json"
+	PatchTypeStrategic = "strategic"
+)
+
+const (
+	defaultFieldManager    = "utask"
+	defaultNamespace       = "default"
+	defaultConditionStatus = "True"
+	defaultTimeout         = time.Minute
+)
+
+var (
+	actions             = []string{ActionApply, ActionGet, ActionDelete, ActionPatch, ActionWait, ActionExec}
+	waitFors            = []string{WaitForCondition, WaitForRollout, WaitForDeleted}
+	patchTypes          = []string{PatchTypeMerge, PatchTypeJSON, PatchTypeStrategic}
+	propagationPolicies = []string{"Foreground", "Background", "Orphan"}
+)
+
+// Config holds the configuration of an action on a Kubernetes cluster
+type Config struct {
+	Kubeconfig string `json:"kubeconfig"`
+	Context    string `json:"context,omitempty"`
+	Action     string `json:"action"`
+	Timeout    string `json:"timeout,omitempty"`
+
+	// apply
+	Manifest     string `json:"manifest,omitempty"`
+	FieldManager string `json:"field_manager,omitempty"`
+	Force        bool   `json:"force,omitempty"`
+
+	// targeted resource, for all other actions
+	APIVersion    string `json:"api_version,omitempty"`
+	Kind          string `json:"kind,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Namespace     string `json:"namespace,omitempty"`
+	LabelSelector string `json:"label_selector,omitempty"`
+	FieldSelector string `json:"field_selector,omitempty"`
+
+	// delete
+	PropagationPolicy string `json:"propagation_policy,omitempty"`
+	IgnoreNotFound    bool   `json:"ignore_not_found,omitempty"`
+
+	// patch
+	Patch     string `json:"patch,omitempty"`
+	PatchType string `json:"patch_type,omitempty"`
+
+	// wait
+	WaitFor         string `json:"wait_for,omitempty"`
+	Condition       string `json:"condition,omitempty"`
+	ConditionStatus string `json:"condition_status,omitempty"`
+
+	// exec
+	Container              string   `json:"container,omitempty"`
+	Command                []string `json:"command,omitempty"`
+	Stdin                  string   `json:"stdin,omitempty"`
+	ExitCodesUnrecoverable []string `json:"exit_codes_unrecoverable,omitempty"`
+}
+
+func validConfig(config interface{}) error {
+	cfg := config.(*Config)
+
+	if cfg.Kubeconfig == "" {
+		return errors.New("missing kubeconfig")
+	}
+
+	// If the kubeconfig is a template, try to parse it.
+	if !strings.Contains(cfg.Kubeconfig, "{{") {
+		if _, err := loadKubeconfig(cfg.Kubeconfig, cfg.Context); err != nil {
+			return err
+		}
+	} else {
+		v := values.NewValues()
+		if _, err := v.Apply(cfg.Kubeconfig, nil, ""); err != nil {
+			return fmt.Errorf("failed to parse kubeconfig template: %w", err)
+		}
+	}
+
+	if cfg.Timeout != "" {
+		if _, err := time.ParseDuration(cfg.Timeout); err != nil {
+			return fmt.Errorf("can't parse timeout field %q: %s", cfg.Timeout, err)
+		}
+	}
+
+	switch cfg.Action {
+	case ActionApply:
+		if cfg.Manifest == "" {
+			return errors.New("missing manifest")
+		}
+		// A templated manifest can only be decoded once templated
+		if !strings.Contains(cfg.Manifest, "{{") {
+			if _, err := decodeManifest(cfg.Manifest); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ActionExec:
+		if cfg.Name == "" {
+			return errors.New("missing name of the pod")
+		}
+		if len(cfg.Command) == 0 {
+			return errors.New("missing command")
+		}
+		return scriptutil.ValidateExitCodesUnreachable(cfg.ExitCodesUnrecoverable)
+	case ActionGet, ActionDelete, ActionPatch, ActionWait:
+	default:
+		return fmt.Errorf("invalid value %q for action, allowed values are: %s", cfg.Action, strings.Join(actions, ", "))
+	}
+
+	if cfg.APIVersion == "" || cfg.Kind == "" {
+		return errors.New("missing api_version or kind")
+	}
+	if _, err := schema.ParseGroupVersion(cfg.APIVersion); err != nil {
+		return fmt.Errorf("invalid api_version: %s", err)
+	}
+	if cfg.Name == "" && cfg.Action != ActionGet {
+		return errors.New("missing name")
+	}
+	if (cfg.LabelSelector != "" || cfg.FieldSelector != "") && (cfg.Action != ActionGet || cfg.Name != "") {
+		return errors.New("label_selector and field_selector can only be used to list resources with the get action")
+	}
+
+	switch cfg.Action {
+	case ActionDelete:
+		if cfg.PropagationPolicy != "" && !contains(propagationPolicies, cfg.PropagationPolicy) {
+			return fmt.Errorf("invalid value %q for propagation_policy, allowed values are: %s", cfg.PropagationPolicy, strings.Join(propagationPolicies, ", "))
+		}
+	case ActionPatch:
+		if cfg.Patch == "" {
+			return errors.New("missing patch")
+		}
+		if cfg.PatchType != "" && !contains(patchTypes, cfg.PatchType) {
+			return fmt.Errorf("invalid value %q for patch_type, allowed values are: %s", cfg.PatchType, strings.Join(patchTypes, ", "))
+		}
+	case ActionWait:
+		switch cfg.waitFor() {
+		case WaitForCondition:
+			if cfg.Condition == "" {
+				return errors.New("missing condition")
+			}
+		case WaitForRollout, WaitForDeleted:
+			if cfg.Condition != "" {
+				return fmt.Errorf("condition can't be set when waiting for %s", cfg.WaitFor)
+			}
+		default:
+			return fmt.Errorf("invalid value %q for wait_for, allowed values are: %s", cfg.WaitFor, strings.Join(waitFors, ", "))
+		}
+	}
+
+	return nil
+}
+
+func (cfg *Config) waitFor() string {
+	if cfg.WaitFor == "" && cfg.Condition != "" {
+		return WaitForCondition
+	}
+	return cfg.WaitFor
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// loadKubeconfig retrieves a kubeconfig from configstore, and selects one of its contexts
+func loadKubeconfig(name, kubeContext string) (clientcmd.ClientConfig, error) {
+	str, err := configstore.GetItemValue(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve kubeconfig from configstore: %s", err)
+	}
+
+	kubeconfig, err := clientcmd.Load([]byte(str))
+	if err != nil {
+		return nil, fmt.Errorf("can't load kubeconfig %q: %s", name, err)
+	}
+
+	clientConfig := clientcmd.NewNonInteractiveClientConfig(*kubeconfig, kubeContext, &clientcmd.ConfigOverrides{}, nil)
+	if _, err := clientConfig.ClientConfig(); err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig %q: %s", name, err)
+	}
+	return clientConfig, nil
+}
+
+func resourceskubernetes(i interface{}) []string {
+	cfg := i.(*Config)
+	resources := []string{
+		"socket",
+	}
+
+	clientConfig, err := loadKubeconfig(cfg.Kubeconfig, cfg.Context)
+	if err != nil {
+		return resources
+	}
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return resources
+	}
+
+	host := restConfig.Host
+	if u, err := url.Parse(restConfig.Host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return append(resources, "kubernetes:"+host)
+}
+
+// client gathers what's needed to act on the resources of a cluster
+type client struct {
+	rest      *rest.Config
+	dynamic   dynamic.Interface
+	mapper    meta.RESTMapper
+	namespace string
+}
+
+func newClient(cfg *Config) (*client, error) {
+	clientConfig, err := loadKubeconfig(cfg.Kubeconfig, cfg.Context)
+	if err != nil {
+		return nil, err
+	}
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	restConfig.UserAgent = "utask"
+
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil || namespace == "" {
+		namespace = defaultNamespace
+	}
+	if cfg.Namespace != "" {
+		namespace = cfg.Namespace
+	}
+
+	dyn, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{
+		rest:      restConfig,
+		dynamic:   dyn,
+		namespace: namespace,
+	}
+
+	// exec only targets pods, it doesn't need to discover the resources served by the cluster
+	if cfg.Action != ActionExec {
+		disco, err := discovery.NewDiscoveryClientForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+		groupResources, err := restmapper.GetAPIGroupResources(disco)
+		if err != nil {
+			return nil, interpret(err)
+		}
+		c.mapper = restmapper.NewDiscoveryRESTMapper(groupResources)
+	}
+
+	return c, nil
+}
+
+// resource returns the client of a kind of resource, within a namespace if the resource is namespaced
+func (c *client) resource(gvk schema.GroupVersionKind, namespace string) (dynamic.ResourceInterface, error) {
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, interpret(err)
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return c.dynamic.Resource(mapping.Resource), nil
+	}
+	if namespace == "" {
+		namespace = c.namespace
+	}
+	return c.dynamic.Resource(mapping.Resource).Namespace(namespace), nil
+}
+
+func exec(stepName string, config interface{}, ctx interface{}) (interface{}, interface{}, error) {
+	cfg := config.(*Config)
+
+	timeout := defaultTimeout
+	if cfg.Timeout != "" {
+		timeout, _ = time.ParseDuration(cfg.Timeout)
+	}
+	actx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c, err := newClient(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch cfg.Action {
+	case ActionApply:
+		return c.apply(actx, cfg)
+	case ActionGet:
+		return c.get(actx, cfg)
+	case ActionDelete:
+		return c.delete(actx, cfg)
+	case ActionPatch:
+		return c.patch(actx, cfg)
+	case ActionWait:
+		return c.wait(actx, cfg)
+	case ActionExec:
+		return c.exec(actx, cfg)
+	}
+	return nil, nil, errors.BadRequestf("invalid action %q", cfg.Action)
+}
+
+// interpret tells errors due to the request itself, which won't succeed if retried, from transient ones
+func interpret(err error) error {
+	switch {
+	case meta.IsNoMatchError(err),
+		apierrors.IsNotFound(err),
+		apierrors.IsBadRequest(err),
+		apierrors.IsInvalid(err),
+		apierrors.IsForbidden(err),
+		apierrors.IsUnauthorized(err),
+		apierrors.IsConflict(err),
+		apierrors.IsAlreadyExists(err),
+		apierrors.IsMethodNotSupported(err),
+		apierrors.IsNotAcceptable(err),
+		apierrors.IsUnsupportedMediaType(err),
+		apierrors.IsRequestEntityTooLargeError(err):
+		return errors.NewBadRequest(err, "kubernetes plugin")
+	}
+	return err
+}
@@ -0,0 +1,362 @@
+package pluginkubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/maxatome/go-testdeep/td"
+	"github.com/ovh/configstore"
+	"sigs.k8s.io/yaml"
+)
+
+// fakeAPIServer serves the few routes of the Kubernetes API used by the plugin,
+// for config maps and deployments
+type fakeAPIServer struct {
+	mu      sync.Mutex
+	objects map[string]map[string]interface{}
+}
+
+var discoveryDocuments = map[string]string{
+	"/api":  `{"kind":"APIVersions","versions":["v1"]}`,
+	"/apis": `{"kind":"APIGroupList","apiVersion":"v1","groups":[{"name":"apps","versions":[{"groupVersion":"apps/v1","version":"v1"}],"preferredVersion":{"groupVersion":"apps/v1","version":"v1"}}]}`,
+	"/api/v1": `{"kind":"APIResourceList","groupVersion":"v1","resources":[
+		{"name":"configmaps","singularName":"configmap","namespaced":true,"kind":"ConfigMap","verbs":["get","list","patch","delete"]},
+		{"name":"namespaces","singularName":"namespace","namespaced":false,"kind":"Namespace","verbs":["get","list","patch","delete"]}]}`,
+	"/apis/apps/v1": `{"kind":"APIResourceList","groupVersion":"apps/v1","resources":[
+		{"name":"deployments","singularName":"deployment","namespaced":true,"kind":"Deployment","verbs":["get","list","patch","delete"]}]}`,
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if d, ok := discoveryDocuments[r.URL.Path]; ok {
+		fmt.Fprint(w, d)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodGet:
+		if obj, ok := s.objects[key]; ok {
+			json.NewEncoder(w).Encode(obj)
+			return
+		}
+		if strings.HasSuffix(key, "s") {
+			s.list(w, r)
+			return
+		}
+		notFound(w, key)
+	case http.MethodPatch:
+		body, _ := io.ReadAll(r.Body)
+		data, err := yaml.YAMLToJSON(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var patch map[string]interface{}
+		json.Unmarshal(data, &patch)
+
+		obj, exists := s.objects[key]
+		switch r.Header.Get("Content-Type") {
+		case "application/apply-patch+yaml":
+			if exists {
+				patch["status"] = obj["status"]
+			}
+			obj = patch
+		case "application/merge-patch+json":
+			if !exists {
+				notFound(w, key)
+				return
+			}
+			mergePatch(obj, patch)
+		default:
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		meta := obj["metadata"].(map[string]interface{})
+		generation, _ := meta["generation"].(float64)
+		meta["generation"] = generation + 1
+		meta["uid"] = "uid-" + meta["name"].(string)
+		meta["managedFields"] = []interface{}{map[string]interface{}{"manager": "utask"}}
+		s.objects[key] = obj
+		json.NewEncoder(w).Encode(obj)
+	case http.MethodDelete:
+		if _, ok := s.objects[key]; !ok {
+			notFound(w, key)
+			return
+		}
+		delete(s.objects, key)
+		fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Success"}`)
+	}
+}
+
+// list returns the objects of a collection, filtered by a label selector of the form key=value
+func (s *fakeAPIServer) list(w http.ResponseWriter, r *http.Request) {
+	items := []interface{}{}
+	selector := r.URL.Query().Get("labelSelector")
+	for key, obj := range s.objects {
+		if !strings.HasPrefix(key, r.URL.Path+"/") {
+			continue
+		}
+		if k, v, ok := strings.Cut(selector, "="); ok {
+			labels, _ := obj["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+			if labels[k] != v {
+				continue
+			}
+		}
+		items = append(items, obj)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"kind": "List", "apiVersion": "v1", "metadata": map[string]interface{}{}, "items": items})
+}
+
+func (s *fakeAPIServer) setStatus(key string, status map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key]["status"] = status
+}
+
+func notFound(w http.ResponseWriter, key string) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404,"message":"%s not found"}`, key)
+}
+
+func mergePatch(obj, patch map[string]interface{}) {
+	for k, v := range patch {
+		if v == nil {
+			delete(obj, k)
+		} else if pv, ok := v.(map[string]interface{}); ok {
+			if ov, ok := obj[k].(map[string]interface{}); ok {
+				mergePatch(ov, pv)
+				continue
+			}
+			obj[k] = pv
+		} else {
+			obj[k] = v
+		}
+	}
+}
+
+var (
+	apiServer = &fakeAPIServer{objects: map[string]map[string]interface{}{}}
+	serverURL string
+)
+
+func TestMain(m *testing.M) {
+	srv := httptest.NewServer(apiServer)
+	serverURL = srv.URL
+
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: %s
+users:
+- name: utask
+  user:
+    token: s3cr3t
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: utask
+    namespace: utask
+current-context: fake
+`, srv.URL)
+	configstore.RegisterProvider("tests", func() (configstore.ItemList, error) {
+		return configstore.ItemList{Items: []configstore.Item{
+			configstore.NewItem("cluster", kubeconfig, 1),
+			configstore.NewItem("broken", "clusters: [", 1),
+		}}, nil
+	})
+
+	code := m.Run()
+	srv.Close()
+	os.Exit(code)
+}
+
+const manifest = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  labels:
+    app: web
+data:
+  color: blue
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: prod
+spec:
+  replicas: 2
+`
+
+func TestConfig(t *testing.T) {
+	for _, cfg := range []*Config{
+		{Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap"},
+		{Kubeconfig: "unknown", Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap"},
+		{Kubeconfig: "broken", Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap"},
+		{Kubeconfig: "cluster", Context: "other", Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap"},
+		{Kubeconfig: "cluster", Action: "scale", APIVersion: "v1", Kind: "ConfigMap"},
+		{Kubeconfig: "cluster", Action: ActionApply},
+		{Kubeconfig: "cluster", Action: ActionApply, Manifest: "kind: ConfigMap"},
+		{Kubeconfig: "cluster", Action: ActionGet, Kind: "ConfigMap"},
+		{Kubeconfig: "cluster", Action: ActionDelete, APIVersion: "v1", Kind: "ConfigMap"},
+		{Kubeconfig: "cluster", Action: ActionDelete, APIVersion: "v1", Kind: "ConfigMap", Name: "a", PropagationPolicy: "Never"},
+		{Kubeconfig: "cluster", Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap", Name: "a", LabelSelector: "app=web"},
+		{Kubeconfig: "cluster", Action: ActionPatch, APIVersion: "v1", Kind: "ConfigMap", Name: "a"},
+		{Kubeconfig: "cluster", Action: ActionPatch, APIVersion: "v1", Kind: "ConfigMap", Name: "a", Patch: "{}", PatchType: "yaml"},
+		{Kubeconfig: "cluster", Action: ActionWait, APIVersion: "apps/v1", Kind: "Deployment", Name: "a"},
+		{Kubeconfig: "cluster", Action: ActionWait, APIVersion: "apps/v1", Kind: "Deployment", Name: "a", WaitFor: WaitForRollout, Condition: "Available"},
+		{Kubeconfig: "cluster", Action: ActionExec, Name: "pod"},
+		{Kubeconfig: "cluster", Action: ActionExec, Name: "pod", Command: []string{"ls"}, ExitCodesUnrecoverable: []string{"a"}},
+		{Kubeconfig: "cluster", Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap", Timeout: "soon"},
+	} {
+		td.CmpError(t, validConfig(cfg), "%+v", cfg)
+	}
+
+	for _, cfg := range []*Config{
+		{Kubeconfig: "cluster", Action: ActionApply, Manifest: manifest},
+		{Kubeconfig: "cluster", Action: ActionApply, Manifest: "{{.input.manifest}}"},
+		{Kubeconfig: "{{.input.cluster}}", Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap"},
+		{Kubeconfig: "cluster", Context: "fake", Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap", LabelSelector: "app=web"},
+		{Kubeconfig: "cluster", Action: ActionWait, APIVersion: "apps/v1", Kind: "Deployment", Name: "a", Condition: "Available"},
+		{Kubeconfig: "cluster", Action: ActionWait, APIVersion: "apps/v1", Kind: "Deployment", Name: "a", WaitFor: WaitForRollout, Timeout: "10s"},
+		{Kubeconfig: "cluster", Action: ActionExec, Name: "pod", Command: []string{"ls", "-l"}, ExitCodesUnrecoverable: []string{"1"}},
+	} {
+		td.CmpNoError(t, validConfig(cfg), "%+v", cfg)
+	}
+}
+
+func TestResources(t *testing.T) {
+	td.Cmp(t, resourceskubernetes(&Config{Kubeconfig: "cluster"}), []string{"socket", "kubernetes:" + strings.TrimPrefix(serverURL, "http://")})
+	td.Cmp(t, resourceskubernetes(&Config{Kubeconfig: "unknown"}), []string{"socket"})
+}
+
+func run(t *testing.T, cfg *Config) (interface{}, interface{}, error) {
+	t.Helper()
+	cfg.Kubeconfig = "cluster"
+	td.Require(t).CmpNoError(validConfig(cfg))
+	return exec("step", cfg, nil)
+}
+
+func TestActions(t *testing.T) {
+	output, _, err := run(t, &Config{Action: ActionApply, Manifest: manifest})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, map[string]interface{}{
+		"objects": []interface{}{
+			td.SuperMapOf(map[string]interface{}{
+				"kind":     "ConfigMap",
+				"metadata": td.SuperMapOf(map[string]interface{}{"name": "settings", "uid": "uid-settings"}, nil),
+			}, nil),
+			td.SuperMapOf(map[string]interface{}{
+				"kind":     "Deployment",
+				"metadata": td.Not(td.ContainsKey("managedFields")),
+			}, nil),
+		},
+	})
+	// objects without a namespace are applied in the namespace of the kubeconfig's context
+	td.CmpContainsKey(t, apiServer.objects, "/api/v1/namespaces/utask/configmaps/settings")
+	td.CmpContainsKey(t, apiServer.objects, "/apis/apps/v1/namespaces/prod/deployments/web")
+
+	output, metadata, err := run(t, &Config{Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap", LabelSelector: "app=web"})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, map[string]interface{}{"items": td.Len(1)})
+	td.Cmp(t, metadata, map[string]interface{}{"count": 1})
+
+	output, _, err = run(t, &Config{Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap", LabelSelector: "app=db"})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, map[string]interface{}{"items": td.Empty()})
+
+	output, _, err = run(t, &Config{Action: ActionPatch, APIVersion: "v1", Kind: "ConfigMap", Name: "settings", Patch: "data:\n  color: red\n"})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, td.SuperMapOf(map[string]interface{}{"data": map[string]interface{}{"color": "red"}}, nil))
+
+	output, _, err = run(t, &Config{Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap", Name: "settings"})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, td.SuperMapOf(map[string]interface{}{"data": map[string]interface{}{"color": "red"}}, nil))
+
+	_, _, err = run(t, &Config{Action: ActionGet, APIVersion: "v1", Kind: "ConfigMap", Name: "unknown"})
+	td.CmpTrue(t, errors.IsBadRequest(err))
+
+	_, _, err = run(t, &Config{Action: ActionGet, APIVersion: "v1", Kind: "Secret", Name: "settings"})
+	td.CmpTrue(t, errors.IsBadRequest(err))
+
+	output, _, err = run(t, &Config{Action: ActionDelete, APIVersion: "v1", Kind: "ConfigMap", Name: "settings"})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, map[string]interface{}{"deleted": true})
+
+	output, _, err = run(t, &Config{Action: ActionDelete, APIVersion: "v1", Kind: "ConfigMap", Name: "settings", IgnoreNotFound: true})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, map[string]interface{}{"deleted": false})
+
+	_, _, err = run(t, &Config{Action: ActionDelete, APIVersion: "v1", Kind: "ConfigMap", Name: "settings"})
+	td.CmpTrue(t, errors.IsBadRequest(err))
+}
+
+func TestWait(t *testing.T) {
+	_, _, err := run(t, &Config{Action: ActionApply, Manifest: manifest})
+	td.Require(t).CmpNoError(err)
+	key := "/apis/apps/v1/namespaces/prod/deployments/web"
+	wait := &Config{Action: ActionWait, APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Namespace: "prod", WaitFor: WaitForRollout}
+
+	// the rollout is in progress: the step is retried
+	apiServer.setStatus(key, map[string]interface{}{"observedGeneration": 2, "replicas": 3, "updatedReplicas": 1, "availableReplicas": 2})
+	_, metadata, err := run(t, wait)
+	td.CmpTrue(t, errors.IsNotProvisioned(err))
+	td.Cmp(t, metadata, map[string]interface{}{"reason": "1 out of 2 new replicas have been updated"})
+
+	apiServer.setStatus(key, map[string]interface{}{"observedGeneration": 2, "replicas": 3, "updatedReplicas": 2, "availableReplicas": 2})
+	_, metadata, err = run(t, wait)
+	td.CmpTrue(t, errors.IsNotProvisioned(err))
+	td.Cmp(t, metadata, map[string]interface{}{"reason": "1 old replicas are pending termination"})
+
+	apiServer.setStatus(key, map[string]interface{}{
+		"observedGeneration": 2, "replicas": 2, "updatedReplicas": 2, "availableReplicas": 2,
+		"conditions": []interface{}{map[string]interface{}{"type": "Available", "status": "True"}},
+	})
+	output, _, err := run(t, wait)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, td.SuperMapOf(map[string]interface{}{"kind": "Deployment"}, nil))
+
+	_, _, err = run(t, &Config{Action: ActionWait, APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Namespace: "prod", Condition: "Available"})
+	td.CmpNoError(t, err)
+
+	_, metadata, err = run(t, &Config{Action: ActionWait, APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Namespace: "prod", Condition: "Available", ConditionStatus: "False"})
+	td.CmpTrue(t, errors.IsNotProvisioned(err))
+	td.Cmp(t, metadata, map[string]interface{}{"reason": "condition Available is True, expected False"})
+
+	// a failed rollout won't succeed by waiting longer
+	apiServer.setStatus(key, map[string]interface{}{
+		"observedGeneration": 2,
+		"conditions":         []interface{}{map[string]interface{}{"type": "Progressing", "status": "False", "reason": "ProgressDeadlineExceeded"}},
+	})
+	_, _, err = run(t, wait)
+	td.CmpTrue(t, errors.IsBadRequest(err))
+
+	_, _, err = run(t, &Config{Action: ActionWait, APIVersion: "v1", Kind: "ConfigMap", Name: "settings", WaitFor: WaitForRollout})
+	td.CmpTrue(t, errors.IsBadRequest(err))
+
+	deleted := &Config{Action: ActionWait, APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Namespace: "prod", WaitFor: WaitForDeleted}
+	_, _, err = run(t, deleted)
+	td.CmpTrue(t, errors.IsNotProvisioned(err))
+
+	_, _, err = run(t, &Config{Action: ActionDelete, APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Namespace: "prod"})
+	td.Require(t).CmpNoError(err)
+	output, _, err = run(t, deleted)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, map[string]interface{}{"deleted": true})
+}
@@ -0,0 +1,153 @@
+package pluginmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// defaultPrefetch is the number of messages an AMQP consumer receives without acknowledging them
+const defaultPrefetch = 100
+
+type amqpBroker struct {
+	conn *amqp.Connection
+}
+
+func dialAMQP(cfg *brokerConfig) (broker, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	config := amqp.Config{TLSClientConfig: tlsConfig}
+	if cfg.Username != "" {
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: cfg.Username, Password: cfg.Password}}
+	}
+
+	conn, err := amqp.DialConfig(cfg.URL, config)
+	if err != nil {
+		return nil, interpretAMQP(err)
+	}
+	return &amqpBroker{conn: conn}, nil
+}
+
+// publish sends a message to an exchange (the topic, empty for the default exchange), with a routing key (the key)
+func (b *amqpBroker) publish(ctx context.Context, msg *message) (map[string]interface{}, error) {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, interpretAMQP(err)
+	}
+	defer ch.Close()
+
+	if err := ch.Confirm(false); err != nil {
+		return nil, interpretAMQP(err)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	publishing := amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		Body:         msg.Payload,
+	}
+	if ct, ok := msg.Headers["content-type"]; ok {
+		publishing.ContentType = ct
+	}
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, msg.Topic, msg.Key, false, false, publishing)
+	if err != nil {
+		return nil, interpretAMQP(err)
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("no confirmation received: %s", err)
+	}
+	if !acked {
+		return nil, errors.New("message was rejected by the broker")
+	}
+	return map[string]interface{}{
+		"delivery_tag": confirmation.DeliveryTag,
+	}, nil
+}
+
+// consume reads messages from a queue (the topic); messages not matching are left unacknowledged,
+// and requeued for other consumers once the channel is closed
+func (b *amqpBroker) consume(ctx context.Context, sub subscription, match func(*message) bool) (*message, error) {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, interpretAMQP(err)
+	}
+	defer ch.Close()
+
+	prefetch := sub.Prefetch
+	if prefetch <= 0 {
+		prefetch = defaultPrefetch
+	}
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return nil, interpretAMQP(err)
+	}
+
+	deliveries, err := ch.ConsumeWithContext(ctx, sub.Topic, "", false, false, false, false, nil)
+	if err != nil {
+		return nil, interpretAMQP(err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case d, ok := <-deliveries:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil, nil
+				}
+				return nil, errors.New("channel closed by the broker")
+			}
+			msg := &message{
+				Topic:   sub.Topic,
+				Key:     d.RoutingKey,
+				Headers: map[string]string{},
+				Payload: d.Body,
+				Info: map[string]interface{}{
+					"exchange":     d.Exchange,
+					"routing_key":  d.RoutingKey,
+					"message_id":   d.MessageId,
+					"redelivered":  d.Redelivered,
+					"delivery_tag": d.DeliveryTag,
+				},
+			}
+			for k, v := range d.Headers {
+				msg.Headers[k] = fmt.Sprint(v)
+			}
+			if d.ContentType != "" {
+				msg.Headers["content-type"] = d.ContentType
+			}
+			if !match(msg) {
+				continue
+			}
+			if err := d.Ack(false); err != nil {
+				return nil, fmt.Errorf("can't acknowledge message: %s", err)
+			}
+			return msg, nil
+		}
+	}
+}
+
+func (b *amqpBroker) close() {
+	b.conn.Close()
+}
+
+// interpretAMQP tells apart the errors caused by the step's configuration, which won't change if retried
+func interpretAMQP(err error) error {
+	var aerr *amqp.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code {
+		case amqp.NotFound, amqp.AccessRefused, amqp.PreconditionFailed, amqp.NotAllowed:
+			return badRequest(err)
+		}
+	}
+	return err
+}
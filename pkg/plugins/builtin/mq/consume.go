@@ -0,0 +1,209 @@
+package pluginmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+
+	"github.com/ovh/utask/pkg/plugins/taskplugin"
+)
+
+// the consume plugin waits for a message matching filters on a Kafka topic, an AMQP queue or a NATS subject
+// each execution polls the broker for a while: the step is put in TO_RETRY between polls, to free its executor slot
+var (
+	ConsumePlugin = taskplugin.New("consume", "0.1", execConsume,
+		taskplugin.WithConfig(validConsumeConfig, ConsumeConfig{}),
+		taskplugin.WithContextFunc(ctxConsume),
+		taskplugin.WithResources(resourcesConsume),
+	)
+)
+
+const (
+	// ConsumeTimeoutDefault represents the default time to wait for a matching message, if not defined in configuration
+	ConsumeTimeoutDefault = "1h"
+	// PollDurationDefault represents the default time a single execution polls the broker, if not defined in configuration
+	PollDurationDefault = "10s"
+	// PollDurationMax is the longest time a single execution polls the broker
+	PollDurationMax = time.Minute
+)
+
+const (
+	// WaitingSince is the metadata key holding the time of the first poll
+	WaitingSince = "waiting_since"
+	// Received is the metadata key telling whether a matching message was received
+	Received = "received"
+)
+
+// ConsumeConfig is the configuration needed to wait for a message
+type ConsumeConfig struct {
+	Broker        string   `json:"broker"`
+	Topic         string   `json:"topic"`
+	Group         string   `json:"group,omitempty"`
+	Filter        []filter `json:"filter,omitempty"`
+	FromBeginning bool     `json:"from_beginning,omitempty"`
+	Prefetch      int      `json:"prefetch,omitempty"`
+	PollDuration  string   `json:"poll_duration,omitempty"`
+	Timeout       string   `json:"timeout,omitempty"`
+	AllowEmpty    bool     `json:"allow_empty,omitempty"`
+}
+
+// ConsumeContext is the metadata inherited from the task and the previous polls of the step
+type ConsumeContext struct {
+	TaskID       string `json:"task_id"`
+	StepName     string `json:"step_name"`
+	WaitingSince string `json:"waiting_since"`
+}
+
+func ctxConsume(stepName string) interface{} {
+	return &ConsumeContext{
+		TaskID:       "{{ .task.task_id }}",
+		StepName:     stepName,
+		WaitingSince: fmt.Sprintf("{{ if (index .step `%s` ) }}{{ if (index .step `%s` `metadata`) }}{{ index .step `%s` `metadata` `%s` }}{{ end }}{{ end }}", stepName, stepName, stepName, WaitingSince),
+	}
+}
+
+func validConsumeConfig(config interface{}) error {
+	cfg := config.(*ConsumeConfig)
+
+	if cfg.Broker == "" {
+		return errors.New("missing broker")
+	}
+	if !strings.Contains(cfg.Broker, "{{") {
+		if _, err := loadBrokerConfig(cfg.Broker); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Topic == "" {
+		return errors.New("missing topic")
+	}
+
+	for i := range cfg.Filter {
+		if err := cfg.Filter[i].valid(); err != nil {
+			return fmt.Errorf("invalid filter #%d: %s", i, err)
+		}
+	}
+
+	if cfg.Prefetch < 0 {
+		return errors.New("prefetch must be positive")
+	}
+
+	for name, d := range map[string]string{"poll_duration": cfg.PollDuration, "timeout": cfg.Timeout} {
+		if d == "" || strings.Contains(d, "{{") {
+			continue
+		}
+		duration, err := time.ParseDuration(d)
+		if err != nil {
+			return fmt.Errorf("can't parse %s field %q: %s", name, d, err)
+		}
+		if duration <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+
+	return nil
+}
+
+func resourcesConsume(i interface{}) []string {
+	cfg := i.(*ConsumeConfig)
+	return resources(cfg.Broker)
+}
+
+func execConsume(stepName string, config interface{}, ctx interface{}) (interface{}, interface{}, error) {
+	cfg := config.(*ConsumeConfig)
+	stepContext := ctx.(*ConsumeContext)
+
+	if cfg.Timeout == "" {
+		cfg.Timeout = ConsumeTimeoutDefault
+	}
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse timeout: %s", err)
+	}
+	if cfg.PollDuration == "" {
+		cfg.PollDuration = PollDurationDefault
+	}
+	pollDuration, err := time.ParseDuration(cfg.PollDuration)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse poll_duration: %s", err)
+	}
+	if pollDuration > PollDurationMax {
+		pollDuration = PollDurationMax
+	}
+
+	now := time.Now()
+	// truncated as stored in metadata, for all the polls to start from the same time
+	waitingSince := now.Truncate(time.Second)
+	if stepContext.WaitingSince != "" && stepContext.WaitingSince != "<no value>" {
+		if t, err := time.Parse(time.RFC3339, stepContext.WaitingSince); err == nil {
+			waitingSince = t
+		}
+	}
+	metadata := map[string]interface{}{
+		WaitingSince: waitingSince.Format(time.RFC3339),
+	}
+
+	remaining := timeout - now.Sub(waitingSince)
+	if remaining <= 0 {
+		return nil, metadata, jujuerrors.BadRequestf("no matching message received within %s", timeout)
+	}
+	if pollDuration > remaining {
+		pollDuration = remaining
+	}
+
+	brokerCfg, err := loadBrokerConfig(cfg.Broker)
+	if err != nil {
+		return nil, metadata, err
+	}
+
+	b, err := dial(brokerCfg)
+	if err != nil {
+		return nil, metadata, fmt.Errorf("can't connect to broker %q: %s", cfg.Broker, err)
+	}
+	defer b.close()
+
+	sub := subscription{
+		Topic:         cfg.Topic,
+		Group:         cfg.Group,
+		FromBeginning: cfg.FromBeginning,
+		Since:         waitingSince,
+		Prefetch:      cfg.Prefetch,
+	}
+	if sub.Group == "" {
+		sub.Group = defaultGroup(stepContext)
+	}
+
+	pollCtx, cancel := context.WithTimeout(context.Background(), pollDuration)
+	defer cancel()
+
+	msg, err := b.consume(pollCtx, sub, matchAll(cfg.Filter))
+	if err != nil {
+		return nil, metadata, fmt.Errorf("failed to consume messages: %w", err)
+	}
+	if msg == nil {
+		if cfg.AllowEmpty {
+			// left to the "until" block of the step, whose polls don't count as retries
+			metadata[Received] = false
+			return nil, metadata, nil
+		}
+		return nil, metadata, jujuerrors.NotProvisionedf("no matching message received yet")
+	}
+
+	for k, v := range msg.Info {
+		metadata[k] = v
+	}
+	metadata[Received] = true
+	return msg.view(), metadata, nil
+}
+
+var invalidGroupChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// defaultGroup identifies the step, so that the messages read by a poll are not read again by the next ones
+func defaultGroup(stepContext *ConsumeContext) string {
+	return invalidGroupChars.ReplaceAllString("utask-"+stepContext.TaskID+"-"+stepContext.StepName, "_")
+}
@@ -0,0 +1,150 @@
+package pluginmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ovh/utask/engine/step/condition"
+)
+
+const defaultListSeparator = ","
+
+// filter is a criterion a consumed message must meet: the value of one of its fields is compared
+// to an expected value through one of the operators of step conditions
+// field: "topic", "key", "headers.<name>", "payload" or "payload.<path>" (e.g. payload.request.id, payload.items.0)
+type filter struct {
+	Field         string `json:"field"`
+	Operator      string `json:"operator"`
+	Expected      string `json:"expected"`
+	ListSeparator string `json:"list_separator,omitempty"`
+}
+
+func (f *filter) valid() error {
+	root, _, _ := strings.Cut(f.Field, ".")
+	switch root {
+	case "topic", "key", "payload":
+	case "headers":
+		if !strings.Contains(f.Field, ".") {
+			return fmt.Errorf("invalid filter field %q: missing header name", f.Field)
+		}
+	default:
+		return fmt.Errorf("invalid filter field %q, expected topic, key, headers.<name>, payload or payload.<path>", f.Field)
+	}
+	a := condition.Assert{Operator: f.Operator, Expected: f.Expected}
+	if strings.Contains(f.Expected, "{{") {
+		// the expected value is only known once templated
+		a.Expected = ""
+	}
+	if err := a.Valid(); err != nil {
+		return err
+	}
+	switch strings.ToUpper(f.Operator) {
+	case condition.GT, condition.LT, condition.GE, condition.LE:
+		if a.Expected != "" {
+			if _, err := strconv.ParseFloat(a.Expected, 64); err != nil {
+				return fmt.Errorf("operator %s expects a number, got %q", f.Operator, f.Expected)
+			}
+		}
+	}
+	return nil
+}
+
+// match tells whether a message meets the filter
+func (f *filter) match(view map[string]interface{}) bool {
+	value := lookup(view, strings.Split(f.Field, "."))
+
+	switch strings.ToUpper(f.Operator) {
+	case condition.EQ:
+		return value == f.Expected
+	case condition.NE:
+		return value != f.Expected
+	case condition.GT, condition.LT, condition.GE, condition.LE:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		e, err := strconv.ParseFloat(f.Expected, 64)
+		if err != nil {
+			return false
+		}
+		switch strings.ToUpper(f.Operator) {
+		case condition.GT:
+			return v > e
+		case condition.LT:
+			return v < e
+		case condition.GE:
+			return v >= e
+		default:
+			return v <= e
+		}
+	case condition.REGEXP, condition.NOTREGEXP:
+		re, err := regexp.Compile(f.Expected)
+		if err != nil {
+			return false
+		}
+		return re.MatchString(value) == (strings.ToUpper(f.Operator) == condition.REGEXP)
+	case condition.IN, condition.NOTIN:
+		sep := f.ListSeparator
+		if sep == "" {
+			sep = defaultListSeparator
+		}
+		found := false
+		for _, e := range strings.Split(f.Expected, sep) {
+			if strings.TrimSpace(e) == value {
+				found = true
+				break
+			}
+		}
+		return found == (strings.ToUpper(f.Operator) == condition.IN)
+	}
+	return false
+}
+
+// lookup returns the value found at a path of a message's view, as a string: empty if not found,
+// JSON-encoded if it's an object or a list
+func lookup(v interface{}, path []string) string {
+	for _, p := range path {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			v = t[p]
+		case map[string]string:
+			v = t[p]
+		case []interface{}:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(t) {
+				return ""
+			}
+			v = t[i]
+		default:
+			return ""
+		}
+	}
+
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number, bool:
+		return fmt.Sprint(t)
+	default:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+}
+
+// matchAll tells whether a message meets all filters
+func matchAll(filters []filter) func(*message) bool {
+	return func(m *message) bool {
+		view := m.view()
+		for i := range filters {
+			if !filters[i].match(view) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,330 @@
+package pluginmq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// SASL mechanisms of kafka brokers
+const (
+	saslPlain       = "PLAIN"
+	saslSCRAMSHA256 = "SCRAM-SHA-256"
+	saslSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+type kafkaBroker struct {
+	cfg       *brokerConfig
+	dialer    *kafka.Dialer
+	transport *kafka.Transport
+}
+
+func dialKafka(cfg *brokerConfig) (broker, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var mechanism sasl.Mechanism
+	switch cfg.SASLMechanism {
+	case saslPlain:
+		mechanism = plain.Mechanism{Username: cfg.Username, Password: cfg.Password}
+	case saslSCRAMSHA256:
+		mechanism, err = scram.Mechanism(scram.SHA256, cfg.Username, cfg.Password)
+	case saslSCRAMSHA512:
+		mechanism, err = scram.Mechanism(scram.SHA512, cfg.Username, cfg.Password)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't initialize sasl mechanism: %s", err)
+	}
+
+	return &kafkaBroker{
+		cfg: cfg,
+		dialer: &kafka.Dialer{
+			Timeout:       10 * time.Second,
+			DualStack:     true,
+			TLS:           tlsConfig,
+			SASLMechanism: mechanism,
+		},
+		transport: &kafka.Transport{
+			TLS:  tlsConfig,
+			SASL: mechanism,
+		},
+	}, nil
+}
+
+func (b *kafkaBroker) publish(ctx context.Context, msg *message) (map[string]interface{}, error) {
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(b.cfg.Brokers...),
+		Topic:        msg.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		Transport:    b.transport,
+	}
+	defer w.Close()
+
+	m := kafka.Message{
+		Key:   []byte(msg.Key),
+		Value: msg.Payload,
+	}
+	if msg.Key == "" {
+		m.Key = nil
+	}
+	for k, v := range msg.Headers {
+		m.Headers = append(m.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+
+	if err := w.WriteMessages(ctx, m); err != nil {
+		return nil, interpretKafka(err)
+	}
+	return map[string]interface{}{}, nil
+}
+
+func (b *kafkaBroker) consume(ctx context.Context, sub subscription, match func(*message) bool) (*message, error) {
+	key := readerKey(b.cfg.target(), b.cfg.Username, b.cfg.Password, sub.Group, sub.Topic)
+	r, cached := readers.acquire(key)
+	if r == nil {
+		startOffset := kafka.LastOffset
+		if sub.FromBeginning {
+			startOffset = kafka.FirstOffset
+		} else if err := b.seedOffsets(ctx, sub); err != nil {
+			return nil, interpretKafka(err)
+		}
+		r = kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     b.cfg.Brokers,
+			GroupID:     sub.Group,
+			Topic:       sub.Topic,
+			StartOffset: startOffset,
+			MaxWait:     time.Second,
+			Dialer:      b.dialer,
+		})
+	}
+	// the reader is kept between polls while no message matched, so that the group doesn't rebalance on every poll
+	keep := false
+	defer func() {
+		readers.release(key, r, cached, keep)
+	}()
+
+	for {
+		m, err := r.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				keep = true
+				return nil, nil
+			}
+			return nil, interpretKafka(err)
+		}
+
+		msg := &message{
+			Topic:   m.Topic,
+			Key:     string(m.Key),
+			Headers: map[string]string{},
+			Payload: m.Value,
+			Info: map[string]interface{}{
+				"partition": m.Partition,
+				"offset":    m.Offset,
+				"timestamp": m.Time,
+			},
+		}
+		for _, h := range m.Headers {
+			msg.Headers[h.Key] = string(h.Value)
+		}
+
+		// messages not matching are committed as well: they were meant for other consumers
+		if err := r.CommitMessages(context.Background(), m); err != nil {
+			return nil, fmt.Errorf("can't commit message: %s", err)
+		}
+		if match(msg) {
+			return msg, nil
+		}
+	}
+}
+
+func (b *kafkaBroker) close() {}
+
+// seedOffsets commits the offsets of the first messages published since the first poll, on the partitions
+// the group never committed an offset for: otherwise, the messages published before the group is joined would be skipped
+func (b *kafkaBroker) seedOffsets(ctx context.Context, sub subscription) error {
+	client := &kafka.Client{
+		Addr:      kafka.TCP(b.cfg.Brokers...),
+		Timeout:   10 * time.Second,
+		Transport: b.transport,
+	}
+
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{sub.Topic}})
+	if err != nil {
+		return err
+	}
+	partitions := []int{}
+	for _, t := range meta.Topics {
+		if t.Name != sub.Topic {
+			continue
+		}
+		if t.Error != nil {
+			return t.Error
+		}
+		for _, p := range t.Partitions {
+			partitions = append(partitions, p.ID)
+		}
+	}
+
+	committed, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: sub.Group,
+		Topics:  map[string][]int{sub.Topic: partitions},
+	})
+	if err != nil {
+		return err
+	}
+	if committed.Error != nil {
+		return committed.Error
+	}
+	requests := []kafka.OffsetRequest{}
+	for _, p := range committed.Topics[sub.Topic] {
+		if p.CommittedOffset < 0 {
+			requests = append(requests, kafka.TimeOffsetOf(p.Partition, sub.Since))
+		}
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+
+	listed, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{sub.Topic: requests}})
+	if err != nil {
+		return err
+	}
+	commits := []kafka.OffsetCommit{}
+	for _, p := range listed.Topics[sub.Topic] {
+		if p.Error != nil {
+			return p.Error
+		}
+		// no message since the first poll: the group starts from the end of the partition
+		offset := int64(-1)
+		for o := range p.Offsets {
+			if o >= 0 && (offset < 0 || o < offset) {
+				offset = o
+			}
+		}
+		if offset >= 0 {
+			commits = append(commits, kafka.OffsetCommit{Partition: p.Partition, Offset: offset})
+		}
+	}
+	if len(commits) == 0 {
+		return nil
+	}
+
+	// the group has no member yet, offsets are committed outside of any generation
+	res, err := client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      sub.Group,
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{sub.Topic: commits},
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range res.Topics[sub.Topic] {
+		if p.Error != nil {
+			return p.Error
+		}
+	}
+	return nil
+}
+
+// readerIdleTimeout is how long a reader is kept after a poll, waiting for the next one
+const readerIdleTimeout = 5 * time.Minute
+
+// readers keeps the kafka readers of the steps which are still waiting for a message
+// readerKey identifies the reader of a group on a topic, with the credentials it's connected with,
+// which are hashed not to be kept in memory
+func readerKey(parts ...string) string {
+	h := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+var readers = &readerCache{readers: map[string]*cachedReader{}}
+
+type cachedReader struct {
+	reader   *kafka.Reader
+	lastUsed time.Time
+	inUse    bool
+}
+
+type readerCache struct {
+	mu      sync.Mutex
+	readers map[string]*cachedReader
+	once    sync.Once
+}
+
+// acquire returns the reader kept for a group and topic, nil if there isn't any available
+func (c *readerCache) acquire(key string) (*kafka.Reader, bool) {
+	c.once.Do(func() { go c.closeIdle() })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cr, ok := c.readers[key]
+	if !ok || cr.inUse {
+		return nil, false
+	}
+	cr.inUse = true
+	return cr.reader, true
+}
+
+// release keeps a reader for the next poll, or closes it
+func (c *readerCache) release(key string, r *kafka.Reader, cached, keep bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cr, ok := c.readers[key]
+	switch {
+	case keep && cached:
+		cr.inUse = false
+		cr.lastUsed = time.Now()
+	case keep && !ok:
+		c.readers[key] = &cachedReader{reader: r, lastUsed: time.Now()}
+	default:
+		if cached {
+			delete(c.readers, key)
+		}
+		go r.Close()
+	}
+}
+
+// closeIdle closes the readers of the steps which weren't polled for a while: they are done, or polled by another instance
+func (c *readerCache) closeIdle() {
+	for range time.Tick(time.Minute) {
+		c.mu.Lock()
+		for key, cr := range c.readers {
+			if !cr.inUse && time.Since(cr.lastUsed) > readerIdleTimeout {
+				delete(c.readers, key)
+				go cr.reader.Close()
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// interpretKafka tells apart the errors caused by the step's configuration, which won't change if retried
+func interpretKafka(err error) error {
+	var kerr kafka.Error
+	if errors.As(err, &kerr) {
+		switch kerr {
+		case kafka.UnknownTopicOrPartition,
+			kafka.InvalidTopic,
+			kafka.MessageSizeTooLarge,
+			kafka.TopicAuthorizationFailed,
+			kafka.GroupAuthorizationFailed,
+			kafka.SASLAuthenticationFailed,
+			kafka.InvalidRecord:
+			return badRequest(err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package pluginmq
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+	"github.com/ovh/configstore"
+
+	"github.com/ovh/utask/pkg/utils"
+)
+
+// types of message brokers
+const (
+	BrokerKafka = "kafka"
+	BrokerAMQP  = "amqp"
+	BrokerNATS  = "nats"
+)
+
+// brokerConfig holds the connection to a message broker, stored in configstore
+type brokerConfig struct {
+	Type          string   `json:"type"`
+	Brokers       []string `json:"brokers,omitempty"`
+	URL           string   `json:"url,omitempty"`
+	Username      string   `json:"username,omitempty"`
+	Password      string   `json:"password,omitempty"`
+	SASLMechanism string   `json:"sasl_mechanism,omitempty"`
+	TLS           bool     `json:"tls,omitempty"`
+	RootCA        string   `json:"root_ca,omitempty"`
+}
+
+// parameter represents a header of a message
+type parameter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// message is a message published to or consumed from a broker
+type message struct {
+	Topic   string
+	Key     string
+	Headers map[string]string
+	Payload []byte
+	// Info holds the broker-specific coordinates of the message (partition, offset, sequence...)
+	Info map[string]interface{}
+}
+
+// subscription describes where a message is consumed from
+type subscription struct {
+	Topic string
+	// Group is the consumer group (kafka) or durable consumer (nats) keeping track of the consumed messages
+	Group         string
+	FromBeginning bool
+	// Since is the time from which a new group reads messages, unless it starts from the beginning
+	Since    time.Time
+	Prefetch int
+}
+
+// broker is a connection to a message broker
+type broker interface {
+	// publish sends a message, and returns its broker-specific coordinates
+	publish(ctx context.Context, msg *message) (map[string]interface{}, error)
+	// consume returns the first message matching a filter, or nil when none was received before ctx is done
+	consume(ctx context.Context, sub subscription, match func(*message) bool) (*message, error)
+	close()
+}
+
+// dial connects to a broker
+var dial = func(cfg *brokerConfig) (broker, error) {
+	switch cfg.Type {
+	case BrokerKafka:
+		return dialKafka(cfg)
+	case BrokerAMQP:
+		return dialAMQP(cfg)
+	case BrokerNATS:
+		return dialNATS(cfg)
+	}
+	return nil, fmt.Errorf("invalid broker type %q", cfg.Type)
+}
+
+func loadBrokerConfig(name string) (*brokerConfig, error) {
+	str, err := configstore.GetItemValue(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve broker from configstore: %s", err)
+	}
+
+	var cfg brokerConfig
+	if err := json.Unmarshal([]byte(str), &cfg); err != nil {
+		return nil, fmt.Errorf("can't unmarshal broker from configstore: %s", err)
+	}
+
+	switch cfg.Type {
+	case BrokerKafka:
+		if len(cfg.Brokers) == 0 {
+			return nil, fmt.Errorf("missing brokers for kafka broker %q", name)
+		}
+		switch cfg.SASLMechanism {
+		case "", saslPlain, saslSCRAMSHA256, saslSCRAMSHA512:
+		default:
+			return nil, fmt.Errorf("invalid sasl_mechanism %q for broker %q, allowed values are: %s, %s, %s", cfg.SASLMechanism, name, saslPlain, saslSCRAMSHA256, saslSCRAMSHA512)
+		}
+	case BrokerAMQP, BrokerNATS:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("missing url for %s broker %q", cfg.Type, name)
+		}
+		if _, err := url.Parse(cfg.URL); err != nil {
+			return nil, fmt.Errorf("invalid url for broker %q: %s", name, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid type %q for broker %q, allowed values are: %s, %s, %s", cfg.Type, name, BrokerKafka, BrokerAMQP, BrokerNATS)
+	}
+
+	return &cfg, nil
+}
+
+// target identifies the servers of a broker, without their credentials
+func (cfg *brokerConfig) target() string {
+	if cfg.Type == BrokerKafka {
+		return strings.Join(cfg.Brokers, ",")
+	}
+	hosts := []string{}
+	for _, s := range strings.Split(cfg.URL, ",") {
+		if u, err := url.Parse(strings.TrimSpace(s)); err == nil {
+			hosts = append(hosts, u.Host+strings.TrimSuffix(u.Path, "/"))
+		}
+	}
+	return strings.Join(hosts, ",")
+}
+
+func (cfg *brokerConfig) tlsConfig() (*tls.Config, error) {
+	if !cfg.TLS && cfg.RootCA == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if cfg.RootCA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(cfg.RootCA)) {
+			return nil, errors.New("failed to add root CA: no certificate found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func resources(brokerName string) []string {
+	resources := []string{
+		"socket",
+	}
+
+	cfg, err := loadBrokerConfig(brokerName)
+	if err != nil {
+		return resources
+	}
+
+	return append(resources, cfg.Type+":"+cfg.target())
+}
+
+// view represents a message for filters and outputs; its payload is decoded when it's JSON
+func (m *message) view() map[string]interface{} {
+	var payload interface{} = string(m.Payload)
+	var decoded interface{}
+	if err := utils.JSONnumberUnmarshal(bytes.NewReader(m.Payload), &decoded); err == nil {
+		payload = decoded
+	}
+	headers := m.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	return map[string]interface{}{
+		"topic":   m.Topic,
+		"key":     m.Key,
+		"headers": headers,
+		"payload": payload,
+	}
+}
+
+// badRequest marks an error caused by the step's configuration, putting the step in CLIENT_ERROR
+func badRequest(err error) error {
+	return jujuerrors.NewBadRequest(err, "Client error")
+}
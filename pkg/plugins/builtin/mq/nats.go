@@ -0,0 +1,171 @@
+package pluginmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// consumerInactiveThreshold is the time after which the durable consumer of a step that stopped polling is deleted
+const consumerInactiveThreshold = 24 * time.Hour
+
+type natsBroker struct {
+	conn *nats.Conn
+	js   jetstream.JetStream
+}
+
+func dialNATS(cfg *brokerConfig) (broker, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts := []nats.Option{nats.Name("utask"), nats.Timeout(10 * time.Second)}
+	if cfg.Username != "" {
+		opts = append(opts, nats.UserInfo(cfg.Username, cfg.Password))
+	}
+	if tlsConfig != nil {
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+
+	conn, err := nats.Connect(cfg.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &natsBroker{conn: conn, js: js}, nil
+}
+
+// publish sends a message to a subject (the topic), acknowledged by the stream it belongs to if any
+func (b *natsBroker) publish(ctx context.Context, msg *message) (map[string]interface{}, error) {
+	if msg.Key != "" {
+		return nil, badRequest(errors.New("nats messages have no key"))
+	}
+	m := nats.NewMsg(msg.Topic)
+	m.Data = msg.Payload
+	for k, v := range msg.Headers {
+		m.Header.Set(k, v)
+	}
+
+	ack, err := b.js.PublishMsg(ctx, m)
+	if errors.Is(err, jetstream.ErrNoStreamResponse) {
+		// no stream for this subject: plain publish, delivered to current subscribers only
+		if err := b.conn.PublishMsg(m); err != nil {
+			return nil, err
+		}
+		if err := b.conn.FlushWithContext(ctx); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"stream":   ack.Stream,
+		"sequence": ack.Sequence,
+	}, nil
+}
+
+// consume reads messages from the stream holding a subject (the topic), through a durable consumer
+// (the group) keeping track of the messages already read between polls
+func (b *natsBroker) consume(ctx context.Context, sub subscription, match func(*message) bool) (*message, error) {
+	streamName, err := b.js.StreamNameBySubject(ctx, sub.Topic)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrStreamNotFound) {
+			return nil, badRequest(fmt.Errorf("no stream found for subject %q", sub.Topic))
+		}
+		return nil, err
+	}
+	stream, err := b.js.Stream(ctx, streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	// a new consumer reads the messages published since the first poll, not only those following its creation
+	deliverPolicy, startTime := jetstream.DeliverByStartTimePolicy, &sub.Since
+	if sub.FromBeginning {
+		deliverPolicy, startTime = jetstream.DeliverAllPolicy, nil
+	}
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:           sub.Group,
+		FilterSubject:     sub.Topic,
+		DeliverPolicy:     deliverPolicy,
+		OptStartTime:      startTime,
+		AckPolicy:         jetstream.AckExplicitPolicy,
+		InactiveThreshold: consumerInactiveThreshold,
+	})
+	if err != nil {
+		var apiErr *jetstream.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == 400 {
+			return nil, badRequest(err)
+		}
+		return nil, err
+	}
+
+	prefetch := sub.Prefetch
+	if prefetch <= 0 {
+		prefetch = defaultPrefetch
+	}
+
+	for {
+		wait := time.Second
+		if deadline, ok := ctx.Deadline(); ok {
+			if remaining := time.Until(deadline); remaining < wait {
+				wait = remaining
+			}
+		}
+		if ctx.Err() != nil || wait <= 0 {
+			return nil, nil
+		}
+
+		batch, err := consumer.Fetch(prefetch, jetstream.FetchMaxWait(wait))
+		if err != nil {
+			return nil, err
+		}
+		var found *message
+		for m := range batch.Messages() {
+			if err := m.Ack(); err != nil {
+				return nil, fmt.Errorf("can't acknowledge message: %s", err)
+			}
+			if found != nil {
+				continue
+			}
+			msg := &message{
+				Topic:   m.Subject(),
+				Headers: map[string]string{},
+				Payload: m.Data(),
+				Info:    map[string]interface{}{"stream": streamName},
+			}
+			for k := range m.Headers() {
+				msg.Headers[k] = m.Headers().Get(k)
+			}
+			if meta, err := m.Metadata(); err == nil {
+				msg.Info["sequence"] = meta.Sequence.Stream
+				msg.Info["timestamp"] = meta.Timestamp
+			}
+			if match(msg) {
+				found = msg
+			}
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) && !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		if found != nil {
+			// the awaited message was received, the consumer is not needed anymore
+			_ = stream.DeleteConsumer(context.Background(), sub.Group)
+			return found, nil
+		}
+	}
+}
+
+func (b *natsBroker) close() {
+	b.conn.Close()
+}
@@ -0,0 +1,125 @@
+package pluginmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/pkg/plugins/taskplugin"
+)
+
+// the publish plugin sends a message to a Kafka, AMQP or NATS broker
+var (
+	PublishPlugin = taskplugin.New("publish", "0.1", execPublish,
+		taskplugin.WithConfig(validPublishConfig, PublishConfig{}),
+		taskplugin.WithResources(resourcesPublish),
+	)
+)
+
+const (
+	// PublishTimeoutDefault represents the default value that will be used to publish a message, if not defined in configuration
+	PublishTimeoutDefault = "30s"
+)
+
+// PublishConfig is the configuration needed to publish a message
+type PublishConfig struct {
+	Broker  string      `json:"broker"`
+	Topic   string      `json:"topic"`
+	Key     string      `json:"key,omitempty"`
+	Headers []parameter `json:"headers,omitempty"`
+	Payload string      `json:"payload"`
+	Timeout string      `json:"timeout,omitempty"`
+}
+
+func validPublishConfig(config interface{}) error {
+	cfg := config.(*PublishConfig)
+
+	if cfg.Broker == "" {
+		return errors.New("missing broker")
+	}
+	if !strings.Contains(cfg.Broker, "{{") {
+		if _, err := loadBrokerConfig(cfg.Broker); err != nil {
+			return err
+		}
+	}
+
+	// the topic can be empty for AMQP, publishing to the default exchange
+	for _, h := range cfg.Headers {
+		if h.Name == "" {
+			return fmt.Errorf("missing header name (with value '%s')", h.Value)
+		}
+	}
+
+	if cfg.Timeout != "" && !strings.Contains(cfg.Timeout, "{{") {
+		if _, err := time.ParseDuration(cfg.Timeout); err != nil {
+			return fmt.Errorf("can't parse timeout field %q: %s", cfg.Timeout, err)
+		}
+	}
+
+	return nil
+}
+
+func resourcesPublish(i interface{}) []string {
+	cfg := i.(*PublishConfig)
+	return resources(cfg.Broker)
+}
+
+func execPublish(stepName string, config interface{}, ctx interface{}) (interface{}, interface{}, error) {
+	cfg := config.(*PublishConfig)
+
+	if utask.FDebug {
+		fmt.Println(cfg.Payload)
+	}
+
+	if cfg.Timeout == "" {
+		cfg.Timeout = PublishTimeoutDefault
+	}
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse timeout: %s", err)
+	}
+
+	brokerCfg, err := loadBrokerConfig(cfg.Broker)
+	if err != nil {
+		return nil, nil, err
+	}
+	if brokerCfg.Type != BrokerAMQP && cfg.Topic == "" {
+		return nil, nil, badRequest(errors.New("missing topic"))
+	}
+
+	b, err := dial(brokerCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't connect to broker %q: %s", cfg.Broker, err)
+	}
+	defer b.close()
+
+	msg := &message{
+		Topic:   cfg.Topic,
+		Key:     cfg.Key,
+		Headers: map[string]string{},
+		Payload: []byte(cfg.Payload),
+	}
+	for _, h := range cfg.Headers {
+		msg.Headers[h.Name] = h.Value
+	}
+
+	publishCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	info, err := b.publish(publishCtx, msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	output := map[string]interface{}{
+		"topic": cfg.Topic,
+		"key":   cfg.Key,
+	}
+	for k, v := range info {
+		output[k] = v
+	}
+	return output, nil, nil
+}
@@ -0,0 +1,36 @@
+package script
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/pkg/plugins"
+)
+
+var (
+	Init = &ScriptInit{}
+)
+
+// ScriptInit handles the plugin initialization: resolution of the sandbox configured for the instance
+type ScriptInit struct{}
+
+func (si *ScriptInit) Init(s *plugins.Service) error {
+	cfg, err := utask.Config(s.Store)
+	if err != nil {
+		return fmt.Errorf("unable to load configuration: %s", err)
+	}
+	sandbox = cfg.ScriptSandbox
+
+	if sandbox != nil && sandbox.UID == nil {
+		// scripts of the same user can read the environment of the µTask process through /proc
+		logrus.Warn("script plugin: script_sandbox has no uid, scripts run as the µTask process' user and can still read its environment")
+	}
+
+	return nil
+}
+
+func (si *ScriptInit) Description() string {
+	return "Script plugin: sandbox applied to script executions"
+}
@@ -0,0 +1,86 @@
+package script
+
+import (
+	"fmt"
+	"os"
+	gexec "os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ovh/utask"
+)
+
+// MaxInlineContentSize is the maximum size of a script's inline content, in bytes
+const MaxInlineContentSize = 64 * 1024
+
+const defaultInterpreter = "sh"
+
+// interpreters able to run an inline script content, and their executable
+var interpreters = map[string]string{
+	"sh":     "/bin/sh",
+	"bash":   "bash",
+	"python": "python3",
+}
+
+func validInlineScript(cfg *Config) error {
+	if len(cfg.Content) > MaxInlineContentSize {
+		return fmt.Errorf("content can't be longer than %d bytes", MaxInlineContentSize)
+	}
+
+	if cfg.Interpreter != "" {
+		if _, ok := interpreters[cfg.Interpreter]; !ok {
+			names := make([]string, 0, len(interpreters))
+			for name := range interpreters {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("invalid value %q for interpreter, allowed values are: %s", cfg.Interpreter, strings.Join(names, ", "))
+		}
+	}
+
+	return nil
+}
+
+// writeInlineScript writes the content of a script to a private temporary file,
+// readable by the sandbox's user if any. It returns the interpreter to run it with,
+// the path of the file and a function removing it.
+func writeInlineScript(cfg *Config, sb *utask.ScriptSandbox) (string, string, func(), error) {
+	name := cfg.Interpreter
+	if name == "" {
+		name = defaultInterpreter
+	}
+	interpreter, err := gexec.LookPath(interpreters[name])
+	if err != nil {
+		return "", "", nil, fmt.Errorf("interpreter %q not available: %s", name, err)
+	}
+
+	var dir string
+	if sb != nil {
+		dir, err = privateWorkdir(sb)
+	} else {
+		dir, err = os.MkdirTemp("", "utask-script-")
+	}
+	if err != nil {
+		return "", "", nil, fmt.Errorf("unable to create script directory: %s", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	scriptFile := filepath.Join(dir, "script")
+	if err := os.WriteFile(scriptFile, []byte(cfg.Content), 0400); err != nil {
+		cleanup()
+		return "", "", nil, fmt.Errorf("unable to write script: %s", err)
+	}
+	if sb != nil && sb.UID != nil {
+		gid := os.Getgid()
+		if sb.GID != nil {
+			gid = int(*sb.GID)
+		}
+		if err := os.Chown(scriptFile, int(*sb.UID), gid); err != nil {
+			cleanup()
+			return "", "", nil, fmt.Errorf("unable to write script: %s", err)
+		}
+	}
+
+	return interpreter, scriptFile, cleanup, nil
+}
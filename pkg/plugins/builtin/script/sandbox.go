@@ -0,0 +1,181 @@
+package script
+
+import (
+	"bytes"
+	"os"
+	gexec "os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/ovh/utask"
+)
+
+// sandbox holds the sandbox configured for the instance, nil if scripts aren't sandboxed.
+// It is resolved once, by the plugin's initializer.
+var sandbox *utask.ScriptSandbox
+
+// limits that can be exceeded by a sandboxed script, named after their configuration field
+const (
+	limitOutputSize = "max_output_size"
+	limitCPUTime    = "max_cpu_time"
+	limitFileSize   = "max_file_size"
+)
+
+const (
+	defaultSandboxPath = "/usr/local/bin:/usr/bin:/bin"
+	sandboxWaitDelay   = time.Second
+	// sandboxShim holds the script until a byte is written on fd 3, then executes it
+	sandboxShim = `read -r x <&3 || exit 126; exec 3<&-; exec "$0" "$@"`
+)
+
+// sandboxEnviron keeps the variables of the environment listed in the allowlist
+func sandboxEnviron(sb *utask.ScriptSandbox, environ []string) []string {
+	env := []string{}
+	hasPath := false
+	for _, kv := range environ {
+		k, _, _ := strings.Cut(kv, "=")
+		for _, allowed := range sb.EnvAllowlist {
+			if k == allowed {
+				env = append(env, kv)
+				hasPath = hasPath || k == "PATH"
+				break
+			}
+		}
+	}
+	if !hasPath {
+		env = append(env, "PATH="+defaultSandboxPath)
+	}
+	return env
+}
+
+// applySandbox configures a command to run as the sandbox's user, in its own process group,
+// which is killed altogether when the execution is canceled
+func applySandbox(sb *utask.ScriptSandbox, cmd *gexec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if sb.UID != nil {
+		gid := uint32(os.Getgid())
+		if sb.GID != nil {
+			gid = *sb.GID
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: *sb.UID, Gid: gid, Groups: []uint32{}}
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = sandboxWaitDelay
+}
+
+// gateCommand wraps a command so that it only starts executing once the returned pipe is written to:
+// resource limits can only be set on a started process, they must be applied before the script runs
+func gateCommand(cmd *gexec.Cmd) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	cmd.Args = append([]string{"/bin/sh", "-c", sandboxShim, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+	return w, nil
+}
+
+// privateWorkdir creates a temporary directory for an execution, owned by the sandbox's user
+func privateWorkdir(sb *utask.ScriptSandbox) (string, error) {
+	dir, err := os.MkdirTemp(sb.WorkdirRoot, "utask-script-")
+	if err != nil {
+		return "", err
+	}
+	if sb.UID != nil {
+		gid := os.Getgid()
+		if sb.GID != nil {
+			gid = int(*sb.GID)
+		}
+		if err := os.Chown(dir, int(*sb.UID), gid); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// limitExceeded tells which limit made the sandbox kill a script, if any
+func limitExceeded(sb *utask.ScriptSandbox, state *os.ProcessState, output *limitedBuffer) string {
+	if output.exceeded {
+		return limitOutputSize
+	}
+	if state == nil {
+		return ""
+	}
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return ""
+	}
+	signal := ws.Signal()
+	if ws.Exited() {
+		// a shell reports a child killed by a signal with an exit code of 128+signal
+		signal = syscall.Signal(ws.ExitStatus() - 128)
+		if signal != syscall.SIGXCPU && signal != syscall.SIGXFSZ {
+			return ""
+		}
+	}
+	switch signal {
+	case syscall.SIGXCPU:
+		return limitCPUTime
+	case syscall.SIGKILL:
+		// the hard limit on cpu time is enforced with SIGKILL
+		if sb.MaxCPUTimeDuration > 0 && state.UserTime()+state.SystemTime() >= sb.MaxCPUTimeDuration {
+			return limitCPUTime
+		}
+	case syscall.SIGXFSZ:
+		return limitFileSize
+	}
+	return ""
+}
+
+func limitError(sb *utask.ScriptSandbox, limit string) error {
+	switch limit {
+	case limitOutputSize:
+		return errors.BadRequestf("script output exceeded the sandbox max_output_size (%d bytes)", sb.MaxOutputSize)
+	case limitCPUTime:
+		return errors.BadRequestf("script exceeded the sandbox max_cpu_time (%s)", sb.MaxCPUTime)
+	case limitFileSize:
+		return errors.BadRequestf("script exceeded the sandbox max_file_size (%d bytes)", sb.MaxFileSize)
+	}
+	return nil
+}
+
+// limitedBuffer collects the output of a script, up to max bytes (0 means no limit);
+// onExceed is called once when the limit is reached, the remaining output is discarded
+type limitedBuffer struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	max      int
+	exceeded bool
+	onExceed func()
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.max > 0 && b.buf.Len()+len(p) > b.max {
+		b.buf.Write(p[:b.max-b.buf.Len()])
+		if !b.exceeded {
+			b.exceeded = true
+			if b.onExceed != nil {
+				b.onExceed()
+			}
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,37 @@
+package script
+
+import (
+	"math"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ovh/utask"
+)
+
+// setLimits applies the sandbox's resource limits to a started process
+func setLimits(sb *utask.ScriptSandbox, pid int) error {
+	limits := map[int]uint64{
+		unix.RLIMIT_AS:     sb.MaxMemory,
+		unix.RLIMIT_NPROC:  sb.MaxProcesses,
+		unix.RLIMIT_NOFILE: sb.MaxOpenFiles,
+		unix.RLIMIT_FSIZE:  sb.MaxFileSize,
+	}
+	for resource, limit := range limits {
+		if limit == 0 {
+			continue
+		}
+		if err := unix.Prlimit(pid, resource, &unix.Rlimit{Cur: limit, Max: limit}, nil); err != nil {
+			return err
+		}
+	}
+
+	if sb.MaxCPUTimeDuration > 0 {
+		// SIGXCPU is sent when reaching the soft limit, SIGKILL one second later
+		secs := uint64(math.Ceil(sb.MaxCPUTimeDuration.Seconds()))
+		if err := unix.Prlimit(pid, unix.RLIMIT_CPU, &unix.Rlimit{Cur: secs, Max: secs + 1}, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
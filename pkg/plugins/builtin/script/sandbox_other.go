@@ -0,0 +1,17 @@
+//go:build !linux
+
+package script
+
+import (
+	"github.com/juju/errors"
+
+	"github.com/ovh/utask"
+)
+
+// setLimits applies the sandbox's resource limits to a started process
+func setLimits(sb *utask.ScriptSandbox, pid int) error {
+	if sb.MaxMemory > 0 || sb.MaxProcesses > 0 || sb.MaxOpenFiles > 0 || sb.MaxFileSize > 0 || sb.MaxCPUTimeDuration > 0 {
+		return errors.NotSupportedf("script sandbox resource limits on this platform")
+	}
+	return nil
+}
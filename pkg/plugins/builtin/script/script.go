@@ -20,7 +20,7 @@ import (
 
 // the script plugin execute scripts
 var (
-	Plugin = taskplugin.New("script", "0.2", exec,
+	Plugin = taskplugin.New("script", "0.3", exec,
 		taskplugin.WithConfig(validConfig, Config{}),
 		taskplugin.WithContextFunc(ctx),
 		taskplugin.WithResources(resourcesscript),
@@ -33,6 +33,7 @@ const (
 	outputMetadataKey        string = "output"
 	executionTimeMetadataKey string = "execution_time"
 	errorMetadataKey         string = "error"
+	sandboxLimitMetadataKey  string = "sandbox_limit"
 )
 
 // Metadata represents the metadata of script execution
@@ -46,7 +47,9 @@ type Metadata struct {
 
 // Config is the configuration needed to execute a script
 type Config struct {
-	File                   string                 `json:"file_path"`
+	File                   string                 `json:"file_path,omitempty"`
+	Content                string                 `json:"content,omitempty"`
+	Interpreter            string                 `json:"interpreter,omitempty"`
 	Argv                   []string               `json:"argv,omitempty"`
 	Timeout                string                 `json:"timeout,omitempty"`
 	Stdin                  string                 `json:"stdin,omitempty"`
@@ -72,6 +75,13 @@ func ctx(stepName string) interface{} {
 func resourcesscript(i interface{}) []string {
 	cfg := i.(*Config)
 
+	if cfg.Content != "" {
+		return []string{
+			"fork",
+			"script:inline",
+		}
+	}
+
 	return []string{
 		"fork",
 		fmt.Sprintf("script:%s", cfg.File),
@@ -81,19 +91,33 @@ func resourcesscript(i interface{}) []string {
 func validConfig(config interface{}) error {
 	cfg := config.(*Config)
 
-	if cfg.File == "" {
-		return errors.New("file is missing")
+	if cfg.File != "" && cfg.Content != "" {
+		return errors.New("file_path and content can't be set at the same time")
 	}
 
-	scriptPath := filepath.Join(utask.FScriptsFolder, cfg.File)
+	if cfg.Content != "" {
+		if err := validInlineScript(cfg); err != nil {
+			return err
+		}
+	} else {
+		if cfg.File == "" {
+			return errors.New("file is missing")
+		}
 
-	f, err := os.Stat(scriptPath)
-	if err != nil {
-		return fmt.Errorf("can't stat %q: %s", scriptPath, err.Error())
-	}
+		if cfg.Interpreter != "" {
+			return errors.New("interpreter can only be set along with content")
+		}
 
-	if f.Mode()&0111 == 0 {
-		return fmt.Errorf("%q is not executable", scriptPath)
+		scriptPath := filepath.Join(utask.FScriptsFolder, cfg.File)
+
+		f, err := os.Stat(scriptPath)
+		if err != nil {
+			return fmt.Errorf("can't stat %q: %s", scriptPath, err.Error())
+		}
+
+		if f.Mode()&0111 == 0 {
+			return fmt.Errorf("%q is not executable", scriptPath)
+		}
 	}
 
 	if cfg.Timeout != "" {
@@ -140,9 +164,10 @@ func validConfig(config interface{}) error {
 }
 
 func exec(stepName string, config interface{}, ctx interface{}) (interface{}, interface{}, error) {
-	cfg := config.(*Config)
-	scriptContext := ctx.(*ScriptContext)
+	return run(stepName, config.(*Config), ctx.(*ScriptContext), sandbox)
+}
 
+func run(stepName string, cfg *Config, scriptContext *ScriptContext, sb *utask.ScriptSandbox) (interface{}, interface{}, error) {
 	var timeout time.Duration
 
 	if cfg.Timeout != "" {
@@ -159,9 +184,24 @@ func exec(stepName string, config interface{}, ctx interface{}) (interface{}, in
 	ctxe, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	cmd := gexec.CommandContext(ctxe, fmt.Sprintf("./%s", cfg.File), cfg.Argv...)
+	name, argv := fmt.Sprintf("./%s", cfg.File), cfg.Argv
+	if cfg.Content != "" {
+		interpreter, scriptFile, cleanup, err := writeInlineScript(cfg, sb)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer cleanup()
+		name, argv = interpreter, append([]string{scriptFile}, cfg.Argv...)
+	}
+
+	cmd := gexec.CommandContext(ctxe, name, argv...)
+	environ := os.Environ()
+	if sb != nil {
+		environ = sandboxEnviron(sb, environ)
+		applySandbox(sb, cmd)
+	}
 	cmd.Env = append(
-		os.Environ(),
+		environ,
 		fmt.Sprintf("UTASK_TASK_ID=%s", scriptContext.TaskID),
 		fmt.Sprintf("UTASK_RESOLUTION_ID=%s", scriptContext.ResolutionID),
 		fmt.Sprintf("UTASK_STEP_NAME=%s", stepName),
@@ -169,17 +209,64 @@ func exec(stepName string, config interface{}, ctx interface{}) (interface{}, in
 	cmd.Dir = utask.FScriptsFolder
 	cmd.Stdin = strings.NewReader(cfg.Stdin)
 
+	if sb != nil && sb.PrivateWorkdir {
+		if cfg.Content == "" {
+			scriptPath, err := filepath.Abs(filepath.Join(utask.FScriptsFolder, cfg.File))
+			if err != nil {
+				return nil, nil, err
+			}
+			cmd.Path, cmd.Args[0] = scriptPath, scriptPath
+		}
+		workdir, err := privateWorkdir(sb)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to create script workdir: %s", err)
+		}
+		defer os.RemoveAll(workdir)
+		cmd.Dir = workdir
+	}
+
 	for k, v := range cfg.Environment {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
 	}
 
+	out := &limitedBuffer{onExceed: cancel}
+	if sb != nil {
+		out.max = sb.MaxOutputSize
+	}
+	cmd.Stdout, cmd.Stderr = out, out
+
+	var gate *os.File
+	if sb != nil {
+		var err error
+		if gate, err = gateCommand(cmd); err != nil {
+			return nil, nil, err
+		}
+		defer gate.Close()
+	}
+
 	exitCode := 0
 	metaError := ""
 
 	// start exec time timer
 	timer := time.Now()
 	// execute script
-	out, err := cmd.CombinedOutput()
+	err := cmd.Start()
+	if err == nil && sb != nil {
+		cmd.ExtraFiles[0].Close()
+		if err := setLimits(sb, cmd.Process.Pid); err != nil {
+			_ = cmd.Cancel()
+			_ = cmd.Wait()
+			return nil, nil, fmt.Errorf("unable to set script resource limits: %s", err)
+		}
+		if _, err = gate.Write([]byte("\n")); err != nil {
+			_ = cmd.Cancel()
+			_ = cmd.Wait()
+		}
+		gate.Close()
+	}
+	if err == nil {
+		err = cmd.Wait()
+	}
 	// evaluate exec time
 	execTime := time.Since(timer)
 
@@ -196,7 +283,7 @@ func exec(stepName string, config interface{}, ctx interface{}) (interface{}, in
 
 	pState := cmd.ProcessState.String()
 
-	outStr := string(out)
+	outStr := out.String()
 
 	metadata := map[string]interface{}{
 		exitCodeMetadataKey:      fmt.Sprint(exitCode),
@@ -206,6 +293,13 @@ func exec(stepName string, config interface{}, ctx interface{}) (interface{}, in
 		errorMetadataKey:         metaError,
 	}
 
+	if sb != nil {
+		if limit := limitExceeded(sb, cmd.ProcessState, out); limit != "" {
+			metadata[sandboxLimitMetadataKey] = limit
+			return nil, metadata, limitError(sb, limit)
+		}
+	}
+
 	output := make(map[string]interface{})
 
 	if resultLine, err := scriptutil.ParseOutput(outStr, cfg.OutputMode, cfg.OutputManualDelimiters); err != nil {
@@ -0,0 +1,142 @@
+package script
+
+import (
+	"os"
+	gexec "os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/maxatome/go-testdeep/td"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/pkg/plugins/builtin/scriptutil"
+)
+
+func writeScript(t *testing.T, name, content string) {
+	err := os.WriteFile(filepath.Join(utask.FScriptsFolder, name), []byte("#!/bin/sh\n"+content), 0755)
+	td.Require(t).CmpNoError(err)
+}
+
+func runScript(t *testing.T, name string, sb *utask.ScriptSandbox) (map[string]interface{}, error) {
+	cfg := &Config{File: name, OutputMode: scriptutil.OutputModeDisabled}
+	td.Require(t).CmpNoError(validConfig(cfg))
+	_, metadata, err := run("step", cfg, &ScriptContext{TaskID: "t", ResolutionID: "r"}, sb)
+	m, _ := metadata.(map[string]interface{})
+	return m, err
+}
+
+func TestSandbox(t *testing.T) {
+	folder, err := filepath.EvalSymlinks(t.TempDir())
+	td.Require(t).CmpNoError(err)
+	utask.FScriptsFolder = folder
+	t.Setenv("UTASK_TEST_SECRET", "s3cr3t")
+	t.Setenv("UTASK_TEST_ALLOWED", "yes")
+
+	writeScript(t, "env.sh", `echo "secret=$UTASK_TEST_SECRET allowed=$UTASK_TEST_ALLOWED step=$UTASK_STEP_NAME"`)
+
+	metadata, err := runScript(t, "env.sh", nil)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, metadata["output"], "secret=s3cr3t allowed=yes step=step\n")
+
+	sb := &utask.ScriptSandbox{EnvAllowlist: []string{"UTASK_TEST_ALLOWED"}}
+	metadata, err = runScript(t, "env.sh", sb)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, metadata["output"], "secret= allowed=yes step=step\n")
+
+	// private working directory, removed after the execution
+	writeScript(t, "pwd.sh", `pwd; touch created`)
+	metadata, err = runScript(t, "pwd.sh", &utask.ScriptSandbox{PrivateWorkdir: true, WorkdirRoot: t.TempDir()})
+	td.Require(t).CmpNoError(err)
+	workdir := filepath.Clean(metadata["output"].(string)[:len(metadata["output"].(string))-1])
+	td.CmpNot(t, workdir, folder)
+	_, err = os.Stat(workdir)
+	td.CmpTrue(t, os.IsNotExist(err))
+
+	// output size
+	writeScript(t, "verbose.sh", `while true; do echo aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa; done`)
+	metadata, err = runScript(t, "verbose.sh", &utask.ScriptSandbox{MaxOutputSize: 1024})
+	td.CmpContains(t, err, "max_output_size")
+	td.CmpTrue(t, errors.IsBadRequest(err))
+	td.Cmp(t, metadata["sandbox_limit"], limitOutputSize)
+	td.CmpLen(t, metadata["output"], 1024)
+
+	// written file size
+	writeScript(t, "write.sh", `head -c 1000000 /dev/zero > big`)
+	metadata, err = runScript(t, "write.sh", &utask.ScriptSandbox{PrivateWorkdir: true, MaxFileSize: 1024})
+	td.CmpContains(t, err, "max_file_size")
+	td.Cmp(t, metadata["sandbox_limit"], limitFileSize)
+
+	// cpu time
+	writeScript(t, "busy.sh", `while true; do :; done`)
+	metadata, err = runScript(t, "busy.sh", &utask.ScriptSandbox{MaxCPUTime: "1s", MaxCPUTimeDuration: time.Second})
+	td.CmpContains(t, err, "max_cpu_time")
+	td.Cmp(t, metadata["sandbox_limit"], limitCPUTime)
+
+	// unprivileged user
+	if os.Getuid() != 0 {
+		t.Skip("switching user requires root")
+	}
+	td.Require(t).CmpNoError(os.Chmod(filepath.Dir(folder), 0755))
+	td.Require(t).CmpNoError(os.Chmod(folder, 0755))
+	writeScript(t, "id.sh", `id -u; id -g`)
+	nobody := uint32(65534)
+	metadata, err = runScript(t, "id.sh", &utask.ScriptSandbox{UID: &nobody, GID: &nobody, PrivateWorkdir: true})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, metadata["output"], "65534\n65534\n")
+}
+
+func TestInlineContent(t *testing.T) {
+	utask.FScriptsFolder = t.TempDir()
+	writeScript(t, "exists.sh", "true")
+
+	for _, cfg := range []*Config{
+		{},
+		{File: "exists.sh", Content: "echo"},
+		{File: "exists.sh", Interpreter: "bash"},
+		{Content: "echo", Interpreter: "perl"},
+		{Content: strings.Repeat("a", MaxInlineContentSize+1)},
+	} {
+		td.CmpError(t, validConfig(cfg))
+	}
+	td.CmpNoError(t, validConfig(&Config{Content: `echo '{{.input.foo}}'`, Interpreter: "bash"}))
+
+	cfg := &Config{
+		Content:     "echo \"arg=$1 env=$FOO\"\necho '{\"done\":true}'\n",
+		Argv:        []string{"bar"},
+		Environment: map[string]interface{}{"FOO": "foo"},
+	}
+	td.Require(t).CmpNoError(validConfig(cfg))
+	output, metadata, err := run("step", cfg, &ScriptContext{}, nil)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, output, map[string]interface{}{"done": true})
+	td.Cmp(t, metadata.(map[string]interface{})["output"], "arg=bar env=foo\n{\"done\":true}\n")
+
+	cfg = &Config{Content: "exit 3", ExitCodesUnrecoverable: []string{"3"}}
+	td.Require(t).CmpNoError(validConfig(cfg))
+	_, _, err = run("step", cfg, &ScriptContext{}, nil)
+	td.CmpTrue(t, errors.IsBadRequest(err))
+
+	if _, err := gexec.LookPath("python3"); err == nil {
+		cfg = &Config{Content: "import json\nprint(json.dumps({'sum': 1 + 2}))", Interpreter: "python"}
+		td.Require(t).CmpNoError(validConfig(cfg))
+		output, _, err = run("step", cfg, &ScriptContext{}, nil)
+		td.Require(t).CmpNoError(err)
+		td.Cmp(t, output, map[string]interface{}{"sum": float64(3)})
+	}
+
+	// the private file is readable by the sandbox's user, and removed afterwards
+	if os.Getuid() == 0 {
+		nobody := uint32(65534)
+		cfg = &Config{Content: "id -u; echo $0", OutputMode: scriptutil.OutputModeDisabled}
+		td.Require(t).CmpNoError(validConfig(cfg))
+		_, metadata, err = run("step", cfg, &ScriptContext{}, &utask.ScriptSandbox{UID: &nobody, PrivateWorkdir: true})
+		td.Require(t).CmpNoError(err)
+		lines := strings.Split(metadata.(map[string]interface{})["output"].(string), "\n")
+		td.Cmp(t, lines[0], "65534")
+		_, err = os.Stat(lines[1])
+		td.CmpTrue(t, os.IsNotExist(err))
+	}
+}
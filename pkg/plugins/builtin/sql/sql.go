@@ -0,0 +1,424 @@
+package pluginsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+	"github.com/lib/pq"
+	"github.com/ovh/configstore"
+
+	"github.com/ovh/utask/engine/values"
+	"github.com/ovh/utask/pkg/plugins/taskplugin"
+)
+
+// the sql plugin runs queries against Postgres and MySQL databases
+var (
+	Plugin = taskplugin.New("sql", "0.1", exec,
+		taskplugin.WithConfig(validConfig, Config{}),
+		taskplugin.WithResources(resourcessql),
+	)
+)
+
+// supported drivers
+const (
+	DriverPostgres = "postgres"
+	DriverMySQL    = "mysql"
+)
+
+// query configuration values
+const (
+	DefaultMaxRows = 1000
+	MaxRows        = 100000
+	DefaultTimeout = 30 * time.Second
+)
+
+// Config holds the configuration needed to run a query
+// database: key to retrieve the connection from configstore
+// query:    the statement, with placeholders ($1 for postgres, ? for mysql)
+// args:     the values of the placeholders
+type Config struct {
+	Database string        `json:"database"`
+	Query    string        `json:"query"`
+	Args     []interface{} `json:"args,omitempty"`
+	Exec     bool          `json:"exec,omitempty"`
+	MaxRows  int           `json:"max_rows,omitempty"`
+	ReadOnly bool          `json:"read_only,omitempty"`
+	Timeout  string        `json:"timeout,omitempty"`
+}
+
+// dbConfig holds the connection to a database, stored in configstore
+type dbConfig struct {
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+}
+
+func validConfig(config interface{}) error {
+	cfg := config.(*Config)
+
+	if cfg.Database == "" {
+		return errors.New("missing database")
+	}
+
+	if cfg.Query == "" {
+		return errors.New("missing query")
+	}
+
+	if cfg.MaxRows < 0 || cfg.MaxRows > MaxRows {
+		return fmt.Errorf("max_rows must be between 0 and %d", MaxRows)
+	}
+
+	if cfg.Exec && cfg.MaxRows != 0 {
+		return errors.New("max_rows can't be set along with exec")
+	}
+
+	if cfg.Exec && cfg.ReadOnly {
+		return errors.New("read_only can't be set along with exec")
+	}
+
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return fmt.Errorf("can't parse timeout field %q: %s", cfg.Timeout, err)
+		}
+		if d <= 0 {
+			return errors.New("timeout must be positive")
+		}
+	}
+
+	// If the database is a template, try to parse it.
+	if !strings.Contains(cfg.Database, "{{") {
+		if _, err := loadDBConfig(cfg.Database); err != nil {
+			return err
+		}
+	} else {
+		v := values.NewValues()
+		if _, err := v.Apply(cfg.Database, nil, ""); err != nil {
+			return fmt.Errorf("failed to parse database template: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func loadDBConfig(name string) (*dbConfig, error) {
+	str, err := configstore.GetItemValue(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't retrieve database from configstore: %s", err)
+	}
+
+	var dbcfg dbConfig
+	if err := json.Unmarshal([]byte(str), &dbcfg); err != nil {
+		return nil, fmt.Errorf("can't unmarshal database from configstore: %s", err)
+	}
+
+	switch dbcfg.Driver {
+	case DriverPostgres, DriverMySQL:
+	default:
+		return nil, fmt.Errorf("invalid driver %q for database %q, allowed values are: %s, %s", dbcfg.Driver, name, DriverPostgres, DriverMySQL)
+	}
+
+	if dbcfg.DSN == "" {
+		return nil, fmt.Errorf("missing dsn for database %q", name)
+	}
+
+	return &dbcfg, nil
+}
+
+func resourcessql(i interface{}) []string {
+	cfg := i.(*Config)
+	resources := []string{
+		"socket",
+	}
+
+	dbcfg, err := loadDBConfig(cfg.Database)
+	if err != nil {
+		return resources
+	}
+
+	return append(resources, "sql:"+dbcfg.target())
+}
+
+var (
+	poolsMu sync.Mutex
+	pools   = map[dbConfig]*sql.DB{}
+)
+
+// openDB returns the connection pool of a database, shared by all executions
+var openDB = func(dbcfg *dbConfig) (*sql.DB, error) {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+
+	if db, ok := pools[*dbcfg]; ok {
+		return db, nil
+	}
+
+	db, err := sql.Open(dbcfg.Driver, dbcfg.DSN)
+	if err != nil {
+		return nil, errors.NewBadRequest(err, "sql plugin: invalid dsn")
+	}
+	pools[*dbcfg] = db
+
+	return db, nil
+}
+
+func exec(stepName string, config interface{}, ctx interface{}) (interface{}, interface{}, error) {
+	cfg := config.(*Config)
+
+	dbcfg, err := loadDBConfig(cfg.Database)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := openDB(dbcfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeout := DefaultTimeout
+	if cfg.Timeout != "" {
+		timeout, _ = time.ParseDuration(cfg.Timeout)
+	}
+
+	maxRows := cfg.MaxRows
+	if maxRows == 0 {
+		maxRows = DefaultMaxRows
+	}
+
+	args, err := queryArgs(cfg.Args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	qctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	tx, err := db.BeginTx(qctx, &sql.TxOptions{ReadOnly: cfg.ReadOnly})
+	if err != nil {
+		return nil, nil, interpret(err, qctx)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if err := setStatementTimeout(qctx, tx, dbcfg.Driver, timeout); err != nil {
+		return nil, nil, interpret(err, qctx)
+	}
+
+	var output, metadata map[string]interface{}
+	if cfg.Exec {
+		output, metadata, err = execStatement(qctx, tx, cfg.Query, args)
+	} else {
+		output, metadata, err = query(qctx, tx, withExecutionTimeHint(cfg.Query, dbcfg.Driver, timeout), args, maxRows)
+	}
+	if err != nil {
+		return nil, nil, interpret(err, qctx)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, interpret(err, qctx)
+	}
+
+	metadata["execution_time"] = time.Since(start).String()
+
+	return output, metadata, nil
+}
+
+// setStatementTimeout bounds the execution time of the statement on the server side,
+// on top of the cancellation of its context
+// the setting is local to the transaction, it doesn't leak into the pooled connection
+func setStatementTimeout(ctx context.Context, tx *sql.Tx, driver string, timeout time.Duration) error {
+	if driver != DriverPostgres {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout.Milliseconds()))
+	return err
+}
+
+// withExecutionTimeHint bounds the execution time of a MySQL SELECT statement on the server side,
+// through an optimizer hint which only applies to the statement itself
+// other statements are only bounded by the cancellation of their context
+func withExecutionTimeHint(q, driver string, timeout time.Duration) string {
+	trimmed := strings.TrimLeft(q, " \t\r\n")
+	if driver != DriverMySQL || len(trimmed) < len("SELECT") || !strings.EqualFold(trimmed[:len("SELECT")], "SELECT") {
+		return q
+	}
+	return fmt.Sprintf("%s /*+ MAX_EXECUTION_TIME(%d) */%s", trimmed[:len("SELECT")], timeout.Milliseconds(), trimmed[len("SELECT"):])
+}
+
+func query(ctx context.Context, tx *sql.Tx, q string, args []interface{}, maxRows int) (map[string]interface{}, map[string]interface{}, error) {
+	rows, err := tx.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := []map[string]interface{}{}
+	truncated := false
+	for rows.Next() {
+		if len(result) == maxRows {
+			truncated = true
+			break
+		}
+
+		vals := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, nil, err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, c := range columns {
+			row[c] = jsonValue(vals[i])
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	output := map[string]interface{}{
+		"columns": columns,
+		"rows":    result,
+	}
+	metadata := map[string]interface{}{
+		"row_count": len(result),
+		"truncated": truncated,
+	}
+	return output, metadata, nil
+}
+
+func execStatement(ctx context.Context, tx *sql.Tx, q string, args []interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	res, err := tx.ExecContext(ctx, q, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	output := map[string]interface{}{
+		"rows_affected": affected,
+	}
+	return output, map[string]interface{}{}, nil
+}
+
+// queryArgs converts the arguments of the configuration into values accepted by the drivers:
+// numbers are converted to int64 or float64, objects and lists are encoded as JSON
+func queryArgs(in []interface{}) ([]interface{}, error) {
+	args := make([]interface{}, len(in))
+	for i, a := range in {
+		switch v := a.(type) {
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				args[i] = n
+			} else if f, err := v.Float64(); err == nil {
+				args[i] = f
+			} else {
+				return nil, errors.BadRequestf("sql plugin: invalid number argument %q", v)
+			}
+		case map[string]interface{}, []interface{}:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, errors.NewBadRequest(err, "sql plugin: invalid argument")
+			}
+			args[i] = string(b)
+		default:
+			args[i] = v
+		}
+	}
+	return args, nil
+}
+
+// jsonValue converts a column's value to a type marshalled in a readable way
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	default:
+		return t
+	}
+}
+
+// interpret tells errors due to the query itself, which won't succeed if retried, from transient ones
+func interpret(err error, ctx context.Context) error {
+	if stderrors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("sql plugin: statement timeout: %s", err)
+	}
+
+	var pqErr *pq.Error
+	if stderrors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		// data exception, integrity constraint violation, read-only transaction, syntax error or access rule violation
+		case "22", "23", "25", "42":
+			return errors.NewBadRequest(err, "sql plugin")
+		}
+		if pqErr.Code == "57014" {
+			return fmt.Errorf("sql plugin: statement timeout: %s", err)
+		}
+	}
+
+	var myErr *mysql.MySQLError
+	if stderrors.As(err, &myErr) {
+		switch myErr.Number {
+		// duplicate entry, syntax error, unknown column or table, foreign key constraints, null violations, read-only transaction
+		case 1048, 1054, 1062, 1064, 1146, 1364, 1451, 1452, 1792:
+			return errors.NewBadRequest(err, "sql plugin")
+		case 3024:
+			return fmt.Errorf("sql plugin: statement timeout: %s", err)
+		}
+	}
+
+	return err
+}
+
+// target identifies the database server and schema a connection points to,
+// without its credentials
+func (d *dbConfig) target() string {
+	switch d.Driver {
+	case DriverMySQL:
+		if c, err := mysql.ParseDSN(d.DSN); err == nil {
+			return c.Addr + "/" + c.DBName
+		}
+	case DriverPostgres:
+		if strings.HasPrefix(d.DSN, "postgres://") || strings.HasPrefix(d.DSN, "postgresql://") {
+			if u, err := url.Parse(d.DSN); err == nil {
+				return u.Host + u.Path
+			}
+			break
+		}
+		// key=value connection string
+		params := map[string]string{"host": "localhost"}
+		for _, kv := range strings.Fields(d.DSN) {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				params[k] = strings.Trim(v, "'")
+			}
+		}
+		host := params["host"]
+		if port, ok := params["port"]; ok {
+			host += ":" + port
+		}
+		return host + "/" + params["dbname"]
+	}
+	return d.Driver
+}
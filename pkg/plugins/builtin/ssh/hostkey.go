@@ -0,0 +1,188 @@
+package pluginssh
+
+import (
+	"bytes"
+	stderrors "errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/ovh/utask/pkg/utils"
+)
+
+// host key verification modes, applied to every hop and to the target
+const (
+	// HostKeyCheckStrict only accepts hosts listed in known_hosts or matching a pinned fingerprint
+	HostKeyCheckStrict = "strict"
+	// HostKeyCheckTOFU trusts the key presented on first connection to a host, and stores it in DB.
+	// Hosts listed in known_hosts or pinned fingerprints are still verified against them.
+	HostKeyCheckTOFU = "tofu"
+	// HostKeyCheckInsecure doesn't verify host keys at all
+	HostKeyCheckInsecure = "insecure"
+)
+
+var (
+	hostKeyCheckModes = []string{HostKeyCheckStrict, HostKeyCheckTOFU, HostKeyCheckInsecure}
+
+	// defaultHostKeyCheck is the mode of the steps without host key configuration,
+	// set by the instance configuration (ssh_host_key_check)
+	defaultHostKeyCheck = HostKeyCheckInsecure
+)
+
+func (cfg *ConfigSSH) hostKeyCheckMode() string {
+	if cfg.HostKeyCheck != "" {
+		return cfg.HostKeyCheck
+	}
+	if cfg.KnownHosts != "" || cfg.KnownHostsPath != "" || len(cfg.HostKeyFingerprints) > 0 {
+		return HostKeyCheckStrict
+	}
+	return defaultHostKeyCheck
+}
+
+func validHostKeyConfig(cfg *ConfigSSH) error {
+	hasReference := cfg.KnownHosts != "" || cfg.KnownHostsPath != "" || len(cfg.HostKeyFingerprints) > 0
+
+	switch cfg.HostKeyCheck {
+	case "", HostKeyCheckTOFU:
+	case HostKeyCheckStrict:
+		if !hasReference {
+			return errors.New("host_key_check \"strict\" requires known_hosts, known_hosts_path or host_key_fingerprints")
+		}
+	case HostKeyCheckInsecure:
+		if hasReference {
+			return errors.New("host_key_check \"insecure\" can't be used along with known_hosts, known_hosts_path or host_key_fingerprints")
+		}
+	default:
+		return fmt.Errorf("invalid value %q for host_key_check, allowed values are: %s", cfg.HostKeyCheck, strings.Join(hostKeyCheckModes, ", "))
+	}
+
+	for _, fp := range cfg.HostKeyFingerprints {
+		if !strings.HasPrefix(fp, "SHA256:") {
+			return fmt.Errorf("invalid host key fingerprint %q, expected format is \"SHA256:...\"", fp)
+		}
+	}
+
+	return nil
+}
+
+// hostKeyVerifier checks the keys presented by the hops and the target the plugin connects to
+type hostKeyVerifier struct {
+	mode         string
+	fingerprints []string
+	knownHosts   ssh.HostKeyCallback
+	store        knownHostStore
+	// fingerprint of the last verified key
+	fingerprint string
+}
+
+func newHostKeyVerifier(cfg *ConfigSSH) (*hostKeyVerifier, error) {
+	v := &hostKeyVerifier{
+		mode:         cfg.hostKeyCheckMode(),
+		fingerprints: cfg.HostKeyFingerprints,
+		store:        hostStore,
+	}
+
+	files := []string{}
+	if cfg.KnownHostsPath != "" {
+		files = append(files, cfg.KnownHostsPath)
+	}
+	if cfg.KnownHosts != "" {
+		// knownhosts only reads files, the content is written to a private temporary file
+		f, err := os.CreateTemp("", "utask-known-hosts-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(cfg.KnownHosts)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f.Name())
+	}
+	if len(files) > 0 {
+		cb, err := knownhosts.New(files...)
+		if err != nil {
+			return nil, errors.NewBadRequest(err, "ssh plugin: known_hosts")
+		}
+		v.knownHosts = cb
+	}
+
+	return v, nil
+}
+
+// hostKeyAlgorithms returns the algorithms the host should present its key with:
+// once a key was trusted for a host, the host must not be able to switch to another key type
+func (v *hostKeyVerifier) hostKeyAlgorithms(address string) ([]string, error) {
+	if v.mode != HostKeyCheckTOFU || len(v.fingerprints) > 0 {
+		return nil, nil
+	}
+	key, err := v.store.lookup(knownhosts.Normalize(address))
+	if err != nil || key == nil {
+		return nil, err
+	}
+	if key.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}, nil
+	}
+	return []string{key.Type()}, nil
+}
+
+// check implements ssh.HostKeyCallback
+func (v *hostKeyVerifier) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	v.fingerprint = ssh.FingerprintSHA256(key)
+
+	if v.mode == HostKeyCheckInsecure {
+		return nil
+	}
+
+	if len(v.fingerprints) > 0 {
+		if utils.ListContainsString(v.fingerprints, v.fingerprint) {
+			return nil
+		}
+		return mismatchError(hostname, v.fingerprint)
+	}
+
+	if v.knownHosts != nil {
+		err := v.knownHosts(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		switch {
+		case err == nil:
+			return nil
+		case stderrors.As(err, &keyErr) && len(keyErr.Want) > 0:
+			return mismatchError(hostname, v.fingerprint)
+		case stderrors.As(err, &keyErr) && v.mode == HostKeyCheckTOFU:
+			// unknown host, trust it on first use
+		case stderrors.As(err, &keyErr):
+			return utils.NewFatalError(nil, fmt.Sprintf("ssh host key verification failed: host %q is not in known_hosts", hostname))
+		default:
+			return utils.NewFatalError(err, fmt.Sprintf("ssh host key verification failed for host %q", hostname))
+		}
+	}
+
+	if v.mode != HostKeyCheckTOFU {
+		return utils.NewFatalError(nil, fmt.Sprintf("ssh host key verification failed: no trusted key for host %q", hostname))
+	}
+
+	trusted, err := v.store.trust(knownhosts.Normalize(hostname), key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(trusted.Marshal(), key.Marshal()) {
+		return mismatchError(hostname, v.fingerprint)
+	}
+	return nil
+}
+
+func mismatchError(hostname, fingerprint string) error {
+	return utils.NewFatalError(nil, fmt.Sprintf(
+		"ssh host key verification failed: host %q presented key %s, which doesn't match its trusted key; it may have been reinstalled, or the connection may be intercepted",
+		hostname, fingerprint,
+	))
+}
@@ -0,0 +1,38 @@
+package pluginssh
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/pkg/plugins"
+	"github.com/ovh/utask/pkg/utils"
+)
+
+var (
+	Init = &SSHInit{}
+)
+
+// SSHInit handles the plugin initialization: host key verification mode configured for the instance
+type SSHInit struct{}
+
+func (si *SSHInit) Init(s *plugins.Service) error {
+	cfg, err := utask.Config(s.Store)
+	if err != nil {
+		return fmt.Errorf("unable to load configuration: %s", err)
+	}
+
+	if cfg.SSHHostKeyCheck == "" {
+		return nil
+	}
+	if !utils.ListContainsString(hostKeyCheckModes, cfg.SSHHostKeyCheck) {
+		return fmt.Errorf("invalid value %q for ssh_host_key_check, allowed values are: %s", cfg.SSHHostKeyCheck, strings.Join(hostKeyCheckModes, ", "))
+	}
+	defaultHostKeyCheck = cfg.SSHHostKeyCheck
+
+	return nil
+}
+
+func (si *SSHInit) Description() string {
+	return "SSH plugin: default host key verification mode"
+}
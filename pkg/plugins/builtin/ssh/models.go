@@ -0,0 +1,89 @@
+package pluginssh
+
+import (
+	"database/sql"
+	stderrors "errors"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/loopfz/gadgeto/zesty"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ovh/utask"
+	"github.com/ovh/utask/db/pgjuju"
+	"github.com/ovh/utask/db/sqlgenerator"
+	"github.com/ovh/utask/pkg/now"
+)
+
+// knownHostStore keeps the host keys trusted on first use
+type knownHostStore interface {
+	// lookup returns the key trusted for a host, nil if there isn't any
+	lookup(host string) (ssh.PublicKey, error)
+	// trust stores the key of a host if none was trusted yet,
+	// and returns the key trusted for the host
+	trust(host string, key ssh.PublicKey) (ssh.PublicKey, error)
+}
+
+var hostStore knownHostStore = dbKnownHostStore{}
+
+type knownHost struct {
+	Host        string    `db:"host"`
+	PublicKey   string    `db:"public_key"`
+	Fingerprint string    `db:"fingerprint"`
+	Created     time.Time `db:"created"`
+}
+
+type dbKnownHostStore struct{}
+
+func (dbKnownHostStore) lookup(host string) (ssh.PublicKey, error) {
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+	return loadKnownHost(dbp, host)
+}
+
+func (dbKnownHostStore) trust(host string, key ssh.PublicKey) (ssh.PublicKey, error) {
+	dbp, err := zesty.NewDBProvider(utask.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	// concurrent first connections to a host all end up comparing to the same key
+	query, args, err := sqlgenerator.PGsql.
+		Insert(`"ssh_known_host"`).
+		Columns(`"host"`, `"public_key"`, `"fingerprint"`, `"created"`).
+		Values(host, string(ssh.MarshalAuthorizedKey(key)), ssh.FingerprintSHA256(key), now.Get()).
+		Suffix(`ON CONFLICT ("host") DO NOTHING`).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dbp.DB().Exec(query, args...); err != nil {
+		return nil, pgjuju.Interpret(err)
+	}
+
+	return loadKnownHost(dbp, host)
+}
+
+func loadKnownHost(dbp zesty.DBProvider, host string) (ssh.PublicKey, error) {
+	query, args, err := sqlgenerator.PGsql.
+		Select(`"host"`, `"public_key"`, `"fingerprint"`, `"created"`).
+		From(`"ssh_known_host"`).
+		Where(squirrel.Eq{`"host"`: host}).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var kh knownHost
+	if err := dbp.DB().SelectOne(&kh, query, args...); err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, pgjuju.Interpret(err)
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(kh.PublicKey))
+	return key, err
+}
@@ -26,7 +26,7 @@ const (
 
 // ssh plugin opens an ssh connection and runs commands on target machine
 var (
-	Plugin = taskplugin.New("ssh", "0.2", execssh,
+	Plugin = taskplugin.New("ssh", "0.3", execssh,
 		taskplugin.WithConfig(configssh, ConfigSSH{}),
 		taskplugin.WithResources(resourcesssh),
 	)
@@ -46,6 +46,13 @@ type ConfigSSH struct {
 	KeyPassphrase          string            `json:"ssh_key_passphrase"`
 	ExitCodesUnrecoverable []string          `json:"exit_codes_unrecoverable"`
 	Timeout                string            `json:"timeout,omitempty"`
+	KnownHosts             string            `json:"known_hosts,omitempty"`
+	KnownHostsPath         string            `json:"known_hosts_path,omitempty"`
+	HostKeyFingerprints    []string          `json:"host_key_fingerprints,omitempty"`
+	HostKeyCheck           string            `json:"host_key_check,omitempty"`
+	Upload                 []FileUpload      `json:"upload,omitempty"`
+	Download               []FileDownload    `json:"download,omitempty"`
+	MaxFileSize            int               `json:"max_file_size,omitempty"`
 }
 
 func resourcesssh(i interface{}) []string {
@@ -81,6 +88,18 @@ func configssh(i interface{}) error {
 		return fmt.Errorf("ssh too many hops (max %d)", MaxHops)
 	}
 
+	if cfg.Script == "" && len(cfg.Upload) == 0 && len(cfg.Download) == 0 {
+		return errors.New("missing ssh script, upload or download")
+	}
+
+	if err := validHostKeyConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := validTransferConfig(cfg); err != nil {
+		return err
+	}
+
 	if cfg.Timeout != "" {
 		dur, err := time.ParseDuration(cfg.Timeout)
 		if err != nil {
@@ -157,101 +176,217 @@ func execssh(stepName string, i interface{}, ctx interface{}) (interface{}, inte
 		executionTimeout = DefaultCmdTimeout
 	}
 
+	verifier, err := newHostKeyVerifier(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	config := &ssh.ClientConfig{
 		User: cfg.User,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: verifier.check,
 		Timeout:         ConnTimeout,
 	}
 
-	var target string
-	hops := []string{}
-	if len(cfg.Hops) > 0 {
-		// Start with first hop
-		target = cfg.Hops[0]
-		hops = append(hops, cfg.Hops[1:]...)
-		hops = append(hops, cfg.Target)
+	var client *ssh.Client
+	// commands passed to the first hop, for it to reach the target by itself
+	extraCmd := ""
+	if verifier.mode == HostKeyCheckInsecure && len(cfg.Hops) > 0 {
+		// Start with first hop, which connects to the next ones
+		target, err := hostPort(cfg.Hops[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		client, err = ssh.Dial("tcp", target, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer client.Close()
+		extraCmd = strings.Join(append(append([]string{}, cfg.Hops[1:]...), cfg.Target), " -- ")
 	} else {
-		target = cfg.Target
-	}
-
-	var firstErr error
-	for {
-		_, _, err := net.SplitHostPort(target)
+		// hops are jumped through from µTask, for the key of each of them to be verified
+		clients, err := dialHops(append(append([]string{}, cfg.Hops...), cfg.Target), config, verifier)
 		if err != nil {
-			// port may be missing, append it and retry
-			if firstErr != nil {
-				return nil, nil, errors.NewBadRequest(firstErr, "ssh plugin: host port")
-			}
-			target = net.JoinHostPort(target, "22")
-			firstErr = err
-		} else {
-			break
+			return nil, nil, err
 		}
+		defer closeClients(clients)
+		client = clients[len(clients)-1]
 	}
 
-	client, err := ssh.Dial("tcp", target, config)
-	if err != nil {
-		return nil, nil, err
+	// file transfers are run by a shell reading its script from stdin,
+	// directly on the target or through the bastion
+	transferCmd := extraCmd
+	if extraCmd == "" {
+		transferCmd = transferShell
 	}
-	defer client.Close()
 
-	session, err := client.NewSession()
-	if err != nil {
-		return nil, nil, err
+	metadata := map[string]interface{}{
+		"output":               "",
+		"exit_code":            "0",
+		"exit_signal":          "",
+		"exit_msg":             "",
+		"host_key_fingerprint": verifier.fingerprint,
 	}
-	defer session.Close()
+	output := make(map[string]interface{})
 
-	execStr := cfg.Script
-
-	// resulting JSON, able to compute commands like:
-	// {
-	//     "pwd": $(pwd)
-	// }
-	injectPL := `'{'`
-	idx := 0
-	for k, v := range cfg.Result {
-		if idx > 0 {
-			injectPL += `,`
+	if len(cfg.Upload) > 0 {
+		uploaded, err := uploadFiles(client, transferCmd, cfg, executionTimeout)
+		metadata["uploads"] = uploaded
+		if err != nil {
+			return nil, metadata, err
 		}
-		injectPL += fmt.Sprintf(`'"%s":"'"%s"'"'`, strings.Replace(k, "\"", "", -1), strings.Replace(v, "\"", "", -1))
-		idx++
 	}
-	injectPL += `'}'`
 
-	if cfg.OutputMode == scriptutil.OutputModeAutoResult {
-		execStr = fmt.Sprintf(`
+	if cfg.Script != "" {
+		execStr := cfg.Script
+
+		// resulting JSON, able to compute commands like:
+		// {
+		//     "pwd": $(pwd)
+		// }
+		injectPL := `'{'`
+		idx := 0
+		for k, v := range cfg.Result {
+			if idx > 0 {
+				injectPL += `,`
+			}
+			injectPL += fmt.Sprintf(`'"%s":"'"%s"'"'`, strings.Replace(k, "\"", "", -1), strings.Replace(v, "\"", "", -1))
+			idx++
+		}
+		injectPL += `'}'`
+
+		if cfg.OutputMode == scriptutil.OutputModeAutoResult {
+			execStr = fmt.Sprintf(`
 function printResultJSON {
 echo -n %s | sed --posix -z 's/\n/\\n/g'
 }
 trap printResultJSON EXIT
 `, injectPL) + execStr
+		}
+
+		// Directly execute the command
+		cmd := extraCmd
+		if extraCmd == "" {
+			cmd = execStr
+		}
+
+		outStr, exitCode, cmdErr, err := runSession(client, cmd, execStr, executionTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		metadata["output"] = outStr
+		metadata["exit_code"] = strconv.Itoa(exitCode)
+		if cmdErr != nil {
+			metadata["exit_signal"] = cmdErr.Waitmsg.Signal()
+			metadata["exit_msg"] = cmdErr.Waitmsg.Msg()
+		}
+
+		if resultLine, err := scriptutil.ParseOutput(outStr, cfg.OutputMode, cfg.OutputManualDelimiters); err != nil {
+			return nil, metadata, err
+		} else if resultLine != "" {
+			err = json.Unmarshal([]byte(resultLine), &output)
+			if err != nil && exitCode == 0 {
+				return nil, metadata, err
+			}
+		}
+		if exitCode != 0 {
+			return output, metadata, scriptutil.FormatErrorExitCode(exitCode, cfg.ExitCodesUnrecoverable, cmdErr)
+		}
 	}
 
-	in := bytes.NewBuffer([]byte(execStr))
-	session.Stdin = in
+	if len(cfg.Download) > 0 {
+		contents, downloaded, err := downloadFiles(client, transferCmd, cfg, executionTimeout)
+		metadata["downloads"] = downloaded
+		if err != nil {
+			return output, metadata, err
+		}
+		output[DownloadsOutputKey] = contents
+	}
 
-	extraCmd := ""
-	for i, hop := range hops {
-		if i > 0 {
-			extraCmd += " -- "
+	return output, metadata, nil
+}
+
+// hostPort adds the default ssh port to an address missing one
+func hostPort(address string) (string, error) {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address, nil
+	}
+	withPort := net.JoinHostPort(address, "22")
+	if _, _, err := net.SplitHostPort(withPort); err != nil {
+		return "", errors.NewBadRequest(err, "ssh plugin: host port")
+	}
+	return withPort, nil
+}
+
+// dialHops connects to the first host, then to each of the next ones through a tunnel
+// opened from the previous one, the key of every host being checked by the verifier.
+// The clients are returned in order, the last one being connected to the target.
+func dialHops(hosts []string, config *ssh.ClientConfig, verifier *hostKeyVerifier) (clients []*ssh.Client, err error) {
+	defer func() {
+		if err != nil {
+			closeClients(clients)
+		}
+	}()
+
+	for _, host := range hosts {
+		address, err := hostPort(host)
+		if err != nil {
+			return clients, err
 		}
-		extraCmd += hop
+
+		hostConfig := *config
+		hostConfig.HostKeyAlgorithms, err = verifier.hostKeyAlgorithms(address)
+		if err != nil {
+			return clients, err
+		}
+
+		if len(clients) == 0 {
+			client, err := ssh.Dial("tcp", address, &hostConfig)
+			if err != nil {
+				return clients, err
+			}
+			clients = append(clients, client)
+			continue
+		}
+
+		conn, err := clients[len(clients)-1].Dial("tcp", address)
+		if err != nil {
+			return clients, fmt.Errorf("can't reach %s through the previous hop: %s", address, err)
+		}
+		c, chans, reqs, err := ssh.NewClientConn(conn, address, &hostConfig)
+		if err != nil {
+			conn.Close()
+			return clients, err
+		}
+		clients = append(clients, ssh.NewClient(c, chans, reqs))
 	}
+	return clients, nil
+}
 
-	exitCode := 0
-	exitSignal := ""
-	exitMessage := ""
+// closeClients closes connections opened through each other, the last opened first
+func closeClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
 
-	// Directly execute the command
-	if len(cfg.Hops) == 0 {
-		extraCmd = execStr
+// runSession runs a command in a new session of the client, with the given stdin.
+// The session is killed if it doesn't terminate before timeout.
+// A non-zero exit code is reported along with its *ssh.ExitError, any other failure as an error.
+func runSession(client *ssh.Client, cmd, stdin string, timeout time.Duration) (string, int, *ssh.ExitError, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", 0, nil, err
 	}
+	defer session.Close()
+
+	session.Stdin = bytes.NewBufferString(stdin)
 
 	exit := make(chan struct{}, 1)
-	timer := time.NewTimer(executionTimeout)
+	timer := time.NewTimer(timeout)
 
 	go func() {
 		select {
@@ -263,7 +398,7 @@ trap printResultJSON EXIT
 		case <-exit:
 		}
 	}()
-	cmdOutput, cmdErr := session.CombinedOutput(extraCmd)
+	cmdOutput, cmdErr := session.CombinedOutput(cmd)
 	if !timer.Stop() {
 		logrus.Debugf("session run error: %s", cmdErr)
 		cmdErr = ErrSessionTimeout
@@ -272,34 +407,11 @@ trap printResultJSON EXIT
 
 	if cmdErr != nil {
 		exitErr, ok := cmdErr.(*ssh.ExitError)
-		if ok {
-			exitCode = exitErr.Waitmsg.ExitStatus()
-			exitSignal = exitErr.Waitmsg.Signal()
-			exitMessage = exitErr.Waitmsg.Msg()
-		} else {
-			return nil, nil, cmdErr
+		if !ok {
+			return "", 0, nil, cmdErr
 		}
+		return string(cmdOutput), exitErr.Waitmsg.ExitStatus(), exitErr, nil
 	}
-	outStr := string(cmdOutput)
-
-	metadata := map[string]interface{}{
-		"output":      outStr,
-		"exit_code":   strconv.Itoa(exitCode),
-		"exit_signal": exitSignal,
-		"exit_msg":    exitMessage,
-	}
-	output := make(map[string]interface{})
 
-	if resultLine, err := scriptutil.ParseOutput(outStr, cfg.OutputMode, cfg.OutputManualDelimiters); err != nil {
-		return nil, metadata, err
-	} else if resultLine != "" {
-		err = json.Unmarshal([]byte(resultLine), &output)
-		if err != nil && exitCode == 0 {
-			return nil, metadata, err
-		}
-	}
-	if exitCode != 0 {
-		return output, metadata, scriptutil.FormatErrorExitCode(exitCode, cfg.ExitCodesUnrecoverable, cmdErr)
-	}
-	return output, metadata, nil
+	return string(cmdOutput), 0, nil, nil
 }
@@ -0,0 +1,405 @@
+package pluginssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/ovh/utask/pkg/plugins/builtin/scriptutil"
+	"github.com/ovh/utask/pkg/utils"
+)
+
+type memKnownHostStore struct {
+	sync.Mutex
+	keys map[string]ssh.PublicKey
+}
+
+func (m *memKnownHostStore) lookup(host string) (ssh.PublicKey, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.keys[host], nil
+}
+
+func (m *memKnownHostStore) trust(host string, key ssh.PublicKey) (ssh.PublicKey, error) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.keys[host]; !ok {
+		m.keys[host] = key
+	}
+	return m.keys[host], nil
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	td.Require(t).CmpNoError(err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	td.Require(t).CmpNoError(err)
+	return signer
+}
+
+func clientKey(t *testing.T) string {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	td.Require(t).CmpNoError(err)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	td.Require(t).CmpNoError(err)
+	return string(pem.EncodeToMemory(block))
+}
+
+// startServer runs an ssh server executing commands with the local shell
+func startServer(t *testing.T, hostKey ssh.Signer) string {
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	td.Require(t).CmpNoError(err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn, cfg)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() == "direct-tcpip" {
+			// acting as a bastion, forwarding a connection to another server
+			go forward(nc)
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		for req := range chReqs {
+			_ = req.Reply(req.Type == "exec", nil)
+			if req.Type != "exec" {
+				continue
+			}
+			var payload struct{ Command string }
+			_ = ssh.Unmarshal(req.Payload, &payload)
+
+			cmd := exec.Command("/bin/sh", "-c", payload.Command)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = ch, ch, ch.Stderr()
+			_ = cmd.Run()
+
+			status := make([]byte, 4)
+			binary.BigEndian.PutUint32(status, uint32(cmd.ProcessState.ExitCode()))
+			_, _ = ch.SendRequest("exit-status", false, status)
+			ch.Close()
+			break
+		}
+	}
+}
+
+func forward(nc ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		_, _ = io.Copy(conn, ch)
+		conn.Close()
+	}()
+	_, _ = io.Copy(ch, conn)
+	ch.Close()
+}
+
+func run(t *testing.T, cfg ConfigSSH) (interface{}, error) {
+	if cfg.User == "" {
+		cfg.User = "utask"
+	}
+	if cfg.Key == "" {
+		cfg.Key = clientKey(t)
+	}
+	if cfg.Script == "" {
+		cfg.Script = "echo ok"
+	}
+	cfg.OutputMode = scriptutil.OutputModeDisabled
+	if err := configssh(&cfg); err != nil {
+		return nil, err
+	}
+	_, metadata, err := execssh("test", &cfg, nil)
+	return metadata, err
+}
+
+func TestConfigHostKey(t *testing.T) {
+	base := ConfigSSH{User: "utask", Target: "example.org", Key: "key", Script: "true"}
+
+	for _, tc := range []struct {
+		name string
+		set  func(*ConfigSSH)
+		ok   bool
+	}{
+		{"default", func(*ConfigSSH) {}, true},
+		{"strict without reference", func(c *ConfigSSH) { c.HostKeyCheck = HostKeyCheckStrict }, false},
+		{"strict with fingerprint", func(c *ConfigSSH) {
+			c.HostKeyCheck = HostKeyCheckStrict
+			c.HostKeyFingerprints = []string{"SHA256:abc"}
+		}, true},
+		{"insecure with known_hosts", func(c *ConfigSSH) {
+			c.HostKeyCheck = HostKeyCheckInsecure
+			c.KnownHosts = "example.org ssh-ed25519 AAAA"
+		}, false},
+		{"strict with hops", func(c *ConfigSSH) {
+			c.HostKeyCheck = HostKeyCheckStrict
+			c.HostKeyFingerprints = []string{"SHA256:abc"}
+			c.Hops = []string{"bastion.example.org"}
+		}, true},
+		{"known_hosts with hops", func(c *ConfigSSH) {
+			c.KnownHosts = "bastion.example.org ssh-ed25519 AAAA"
+			c.Hops = []string{"bastion.example.org"}
+		}, true},
+		{"unknown mode", func(c *ConfigSSH) { c.HostKeyCheck = "foo" }, false},
+		{"invalid fingerprint", func(c *ConfigSSH) { c.HostKeyFingerprints = []string{"aa:bb"} }, false},
+	} {
+		cfg := base
+		tc.set(&cfg)
+		err := configssh(&cfg)
+		if tc.ok {
+			td.CmpNoError(t, err, tc.name)
+		} else {
+			td.CmpError(t, err, tc.name)
+		}
+	}
+
+	// host keys are only verified when asked to, by the step or the instance
+	cfg := base
+	td.Cmp(t, cfg.hostKeyCheckMode(), HostKeyCheckInsecure)
+	defaultHostKeyCheck = HostKeyCheckTOFU
+	td.Cmp(t, cfg.hostKeyCheckMode(), HostKeyCheckTOFU)
+	defaultHostKeyCheck = HostKeyCheckInsecure
+	cfg.KnownHostsPath = "/etc/ssh/ssh_known_hosts"
+	td.Cmp(t, cfg.hostKeyCheckMode(), HostKeyCheckStrict)
+	cfg.Hops = []string{"bastion.example.org"}
+	td.Cmp(t, cfg.hostKeyCheckMode(), HostKeyCheckStrict)
+}
+
+func TestHostKeyTOFU(t *testing.T) {
+	store := &memKnownHostStore{keys: map[string]ssh.PublicKey{}}
+	hostStore = store
+	defer func() { hostStore = dbKnownHostStore{} }()
+
+	hostKey := newSigner(t)
+	addr := startServer(t, hostKey)
+
+	defaultHostKeyCheck = HostKeyCheckTOFU
+	defer func() { defaultHostKeyCheck = HostKeyCheckInsecure }()
+
+	metadata, err := run(t, ConfigSSH{Target: addr})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, metadata, td.SuperMapOf(map[string]interface{}{
+		"output":               "ok\n",
+		"host_key_fingerprint": ssh.FingerprintSHA256(hostKey.PublicKey()),
+	}, nil))
+	td.Cmp(t, store.keys[knownhosts.Normalize(addr)].Marshal(), hostKey.PublicKey().Marshal())
+
+	// same key, still trusted
+	_, err = run(t, ConfigSSH{Target: addr})
+	td.CmpNoError(t, err)
+
+	// the host now presents another key on the same address
+	store.keys[knownhosts.Normalize(addr)] = newSigner(t).PublicKey()
+	_, err = run(t, ConfigSSH{Target: addr})
+	td.CmpContains(t, err, "doesn't match its trusted key")
+	td.CmpTrue(t, utils.IsFatalError(err))
+
+	// hops are verified too
+	_, err = run(t, ConfigSSH{Target: "unreachable.example.org", Hops: []string{addr}})
+	td.CmpTrue(t, utils.IsFatalError(err))
+
+	// unless asked not to
+	_, err = run(t, ConfigSSH{Target: addr, HostKeyCheck: HostKeyCheckInsecure})
+	td.CmpNoError(t, err)
+}
+
+func TestHostKeyHops(t *testing.T) {
+	store := &memKnownHostStore{keys: map[string]ssh.PublicKey{}}
+	hostStore = store
+	defer func() { hostStore = dbKnownHostStore{} }()
+
+	bastionKey, targetKey := newSigner(t), newSigner(t)
+	bastion, target := startServer(t, bastionKey), startServer(t, targetKey)
+	fingerprints := []string{ssh.FingerprintSHA256(bastionKey.PublicKey()), ssh.FingerprintSHA256(targetKey.PublicKey())}
+
+	// each host is reached through the previous one, and verified
+	metadata, err := run(t, ConfigSSH{Target: target, Hops: []string{bastion, bastion}, HostKeyFingerprints: fingerprints})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, metadata, td.SuperMapOf(map[string]interface{}{
+		"output":               "ok\n",
+		"host_key_fingerprint": fingerprints[1],
+	}, nil))
+
+	_, err = run(t, ConfigSSH{Target: target, Hops: []string{bastion}, HostKeyFingerprints: fingerprints[:1]})
+	td.CmpContains(t, err, "doesn't match its trusted key")
+	td.CmpTrue(t, utils.IsFatalError(err))
+
+	_, err = run(t, ConfigSSH{Target: target, Hops: []string{bastion}, HostKeyCheck: HostKeyCheckTOFU})
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, store.keys[knownhosts.Normalize(bastion)].Marshal(), bastionKey.PublicKey().Marshal())
+	td.Cmp(t, store.keys[knownhosts.Normalize(target)].Marshal(), targetKey.PublicKey().Marshal())
+
+	// a bastion presenting another key is refused
+	store.keys[knownhosts.Normalize(bastion)] = newSigner(t).PublicKey()
+	_, err = run(t, ConfigSSH{Target: target, Hops: []string{bastion}, HostKeyCheck: HostKeyCheckTOFU})
+	td.CmpContains(t, err, "doesn't match its trusted key")
+}
+
+func TestHostKeyPinned(t *testing.T) {
+	hostKey := newSigner(t)
+	addr := startServer(t, hostKey)
+
+	_, err := run(t, ConfigSSH{Target: addr, HostKeyFingerprints: []string{ssh.FingerprintSHA256(hostKey.PublicKey())}})
+	td.CmpNoError(t, err)
+
+	_, err = run(t, ConfigSSH{Target: addr, HostKeyFingerprints: []string{ssh.FingerprintSHA256(newSigner(t).PublicKey())}})
+	td.CmpContains(t, err, "doesn't match its trusted key")
+	td.CmpTrue(t, utils.IsFatalError(err))
+}
+
+func TestHostKeyKnownHosts(t *testing.T) {
+	hostKey := newSigner(t)
+	addr := startServer(t, hostKey)
+
+	line := func(key ssh.PublicKey) string {
+		return knownhosts.Line([]string{knownhosts.Normalize(addr)}, key) + "\n"
+	}
+
+	_, err := run(t, ConfigSSH{Target: addr, KnownHosts: line(hostKey.PublicKey())})
+	td.CmpNoError(t, err)
+
+	_, err = run(t, ConfigSSH{Target: addr, KnownHosts: line(newSigner(t).PublicKey())})
+	td.CmpContains(t, err, "doesn't match its trusted key")
+	td.CmpTrue(t, utils.IsFatalError(err))
+
+	other := knownhosts.Line([]string{"other.example.org"}, hostKey.PublicKey()) + "\n"
+	_, err = run(t, ConfigSSH{Target: addr, KnownHosts: other})
+	td.CmpContains(t, err, "is not in known_hosts")
+	td.CmpTrue(t, utils.IsFatalError(err))
+
+	// unknown hosts fall back to trust on first use when asked to
+	store := &memKnownHostStore{keys: map[string]ssh.PublicKey{}}
+	hostStore = store
+	defer func() { hostStore = dbKnownHostStore{} }()
+	_, err = run(t, ConfigSSH{Target: addr, KnownHosts: other, HostKeyCheck: HostKeyCheckTOFU})
+	td.CmpNoError(t, err)
+	td.CmpLen(t, store.keys, 1)
+}
+
+func TestFileTransfer(t *testing.T) {
+	hostKey := newSigner(t)
+	addr := startServer(t, hostKey)
+	pin := []string{ssh.FingerprintSHA256(hostKey.PublicKey())}
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "app's.conf")
+	result := filepath.Join(dir, "result.json")
+
+	cfg := ConfigSSH{
+		Target:              addr,
+		HostKeyFingerprints: pin,
+		Upload: []FileUpload{
+			{Path: conf, Content: "listen: 8080\n", Mode: "0640"},
+		},
+		Script: "cat " + shellQuote(conf) + " > " + result,
+		Download: []FileDownload{
+			{Path: result, Name: "result"},
+			{Path: conf, Base64: true},
+		},
+	}
+	cfg.User, cfg.Key, cfg.OutputMode = "utask", clientKey(t), scriptutil.OutputModeDisabled
+	td.Require(t).CmpNoError(configssh(&cfg))
+
+	output, metadata, err := execssh("test", &cfg, nil)
+	td.Require(t).CmpNoError(err)
+
+	td.Cmp(t, output, map[string]interface{}{
+		DownloadsOutputKey: map[string]interface{}{
+			"result": "listen: 8080\n",
+			conf:     "bGlzdGVuOiA4MDgwCg==",
+		},
+	})
+	sum := checksum([]byte("listen: 8080\n"))
+	td.Cmp(t, metadata, td.SuperMapOf(map[string]interface{}{
+		"uploads": []transferredFile{{Path: conf, Size: 13, SHA256: sum, Mode: "0640"}},
+		"downloads": []transferredFile{
+			{Path: result, Size: 13, SHA256: sum},
+			{Path: conf, Size: 13, SHA256: sum},
+		},
+	}, nil))
+
+	fi, err := os.Stat(conf)
+	td.Require(t).CmpNoError(err)
+	td.Cmp(t, fi.Mode().Perm(), os.FileMode(0640))
+
+	// size limits are enforced both ways
+	cfg.MaxFileSize = 4
+	_, _, err = execssh("test", &cfg, nil)
+	td.CmpContains(t, err, "exceeds max_file_size")
+
+	cfg.Upload, cfg.Script = nil, ""
+	_, _, err = execssh("test", &cfg, nil)
+	td.CmpContains(t, err, "exceeds max_file_size")
+
+	// missing files fail the step
+	cfg.MaxFileSize = 0
+	cfg.Download = []FileDownload{{Path: filepath.Join(dir, "missing")}}
+	_, _, err = execssh("test", &cfg, nil)
+	td.CmpContains(t, err, "download failed")
+
+	// invalid configurations
+	for _, c := range []ConfigSSH{
+		{User: "u", Target: "t", Key: "k"},
+		{User: "u", Target: "t", Key: "k", Upload: []FileUpload{{Path: "/a", Mode: "rw"}}},
+		{User: "u", Target: "t", Key: "k", Download: []FileDownload{{Path: "/a"}, {Path: "/b", Name: "/a"}}},
+		{User: "u", Target: "t", Key: "k", Download: []FileDownload{{Path: "/a"}}, MaxFileSize: MaxFileSize + 1},
+	} {
+		td.CmpError(t, configssh(&c))
+	}
+}
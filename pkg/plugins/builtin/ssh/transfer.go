@@ -0,0 +1,270 @@
+package pluginssh
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// file transfer configuration values
+const (
+	DefaultMaxFileSize = 1 << 20
+	MaxFileSize        = 16 << 20
+	DefaultFileMode    = "0600"
+
+	// DownloadsOutputKey is the key of the step output holding the content of downloaded files
+	DownloadsOutputKey = "downloads"
+
+	transferShell    = "/bin/sh -s"
+	markerChecksum   = "__UTASK_SHA256__"
+	markerFileBegin  = "__UTASK_FILE_BEGIN__"
+	markerFileEnd    = "__UTASK_FILE_END__"
+	markerTooLarge   = "__UTASK_FILE_TOO_LARGE__"
+	heredocDelimiter = "__UTASK_EOF__"
+)
+
+var fileModeRegexp = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+// FileUpload describes a file to be written on the target
+type FileUpload struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	// Base64 indicates that content is base64 encoded, for binary files
+	Base64 bool   `json:"base64,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+}
+
+// FileDownload describes a file to be read from the target
+type FileDownload struct {
+	Path string `json:"path"`
+	// Name is the key under which the content is exposed in the output, defaults to path
+	Name string `json:"name,omitempty"`
+	// Base64 keeps the content base64 encoded in the output, for binary files
+	Base64 bool `json:"base64,omitempty"`
+}
+
+type transferredFile struct {
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+	Mode   string `json:"mode,omitempty"`
+}
+
+func (cfg *ConfigSSH) maxFileSize() int {
+	if cfg.MaxFileSize > 0 {
+		return cfg.MaxFileSize
+	}
+	return DefaultMaxFileSize
+}
+
+func validTransferConfig(cfg *ConfigSSH) error {
+	if cfg.MaxFileSize < 0 || cfg.MaxFileSize > MaxFileSize {
+		return fmt.Errorf("max_file_size must be between 0 and %d", MaxFileSize)
+	}
+
+	for _, u := range cfg.Upload {
+		if u.Path == "" {
+			return errors.New("missing upload path")
+		}
+		if u.Mode != "" && !fileModeRegexp.MatchString(u.Mode) {
+			return fmt.Errorf("invalid mode %q for upload %q, expected an octal mode such as \"0644\"", u.Mode, u.Path)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, d := range cfg.Download {
+		if d.Path == "" {
+			return errors.New("missing download path")
+		}
+		name := d.name()
+		if names[name] {
+			return fmt.Errorf("duplicate download name %q", name)
+		}
+		names[name] = true
+	}
+
+	return nil
+}
+
+func (d FileDownload) name() string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return d.Path
+}
+
+func (u FileUpload) mode() string {
+	if u.Mode != "" {
+		return u.Mode
+	}
+	return DefaultFileMode
+}
+
+// shellQuote protects a value to be used as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func checksum(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// uploadFiles writes files on the target through a shell script:
+// each file is written to a temporary path, then moved over its destination once complete,
+// its checksum is computed remotely and compared to the one of the content sent
+func uploadFiles(client *ssh.Client, cmd string, cfg *ConfigSSH, timeout time.Duration) ([]transferredFile, error) {
+	var script strings.Builder
+	script.WriteString("set -e\numask 077\n")
+
+	uploaded := make([]transferredFile, 0, len(cfg.Upload))
+	for _, u := range cfg.Upload {
+		content := []byte(u.Content)
+		if u.Base64 {
+			var err error
+			content, err = base64.StdEncoding.DecodeString(u.Content)
+			if err != nil {
+				return nil, errors.NewBadRequest(err, fmt.Sprintf("ssh plugin: upload %q: invalid base64 content", u.Path))
+			}
+		}
+		if len(content) > cfg.maxFileSize() {
+			return nil, errors.BadRequestf("ssh plugin: upload %q: size %d exceeds max_file_size %d", u.Path, len(content), cfg.maxFileSize())
+		}
+
+		path := shellQuote(u.Path)
+		tmp := shellQuote(u.Path + ".utask-tmp")
+		fmt.Fprintf(&script, "base64 -d > %s <<'%s'\n", tmp, heredocDelimiter)
+		encoded := base64.StdEncoding.EncodeToString(content)
+		for len(encoded) > 76 {
+			script.WriteString(encoded[:76] + "\n")
+			encoded = encoded[76:]
+		}
+		script.WriteString(encoded + "\n" + heredocDelimiter + "\n")
+		fmt.Fprintf(&script, "chmod %s %s\nmv -f %s %s\n", u.mode(), tmp, tmp, path)
+		fmt.Fprintf(&script, "echo %s $(sha256sum < %s | cut -d' ' -f1)\n", markerChecksum, path)
+
+		uploaded = append(uploaded, transferredFile{
+			Path:   u.Path,
+			Size:   len(content),
+			SHA256: checksum(content),
+			Mode:   u.mode(),
+		})
+	}
+
+	out, exitCode, _, err := runSession(client, cmd, script.String(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return nil, fmt.Errorf("ssh plugin: upload failed with exit code %d: %s", exitCode, strings.TrimSpace(out))
+	}
+
+	sums := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == markerChecksum {
+			sums = append(sums, fields[1])
+		}
+	}
+	if len(sums) != len(uploaded) {
+		return nil, fmt.Errorf("ssh plugin: upload: expected %d checksums, got %d", len(uploaded), len(sums))
+	}
+	for i, f := range uploaded {
+		if sums[i] != f.SHA256 {
+			return nil, fmt.Errorf("ssh plugin: upload %q: checksum mismatch, sent %s, written %s", f.Path, f.SHA256, sums[i])
+		}
+	}
+
+	return uploaded, nil
+}
+
+// downloadFiles reads files from the target through a shell script:
+// files larger than max_file_size are refused before being sent,
+// each file is sent base64 encoded along with its checksum, verified once decoded
+func downloadFiles(client *ssh.Client, cmd string, cfg *ConfigSSH, timeout time.Duration) (map[string]interface{}, []transferredFile, error) {
+	var script strings.Builder
+	script.WriteString("set -e\n")
+	for _, d := range cfg.Download {
+		path := shellQuote(d.Path)
+		fmt.Fprintf(&script, "size=$(wc -c < %s | tr -d ' ')\n", path)
+		fmt.Fprintf(&script, "if [ \"$size\" -gt %d ]; then echo %s $size; exit 1; fi\n", cfg.maxFileSize(), markerTooLarge)
+		fmt.Fprintf(&script, "echo %s $size $(sha256sum < %s | cut -d' ' -f1)\n", markerFileBegin, path)
+		fmt.Fprintf(&script, "base64 < %s\necho\necho %s\n", path, markerFileEnd)
+	}
+
+	out, exitCode, _, err := runSession(client, cmd, script.String(), timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contents := map[string]interface{}{}
+	downloaded := make([]transferredFile, 0, len(cfg.Download))
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 2*MaxFileSize)
+	var current *transferredFile
+	var encoded strings.Builder
+	// lines outside of the files' content, such as error messages
+	var messages []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(downloaded) == len(cfg.Download) {
+			messages = append(messages, line)
+			continue
+		}
+		switch {
+		case len(fields) == 2 && fields[0] == markerTooLarge:
+			d := cfg.Download[len(downloaded)]
+			return nil, downloaded, errors.BadRequestf("ssh plugin: download %q: size %s exceeds max_file_size %d", d.Path, fields[1], cfg.maxFileSize())
+		case len(fields) == 3 && fields[0] == markerFileBegin:
+			size, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, downloaded, fmt.Errorf("ssh plugin: download: invalid size %q", fields[1])
+			}
+			current = &transferredFile{Path: cfg.Download[len(downloaded)].Path, Size: size, SHA256: fields[2]}
+			encoded.Reset()
+		case current != nil && line == markerFileEnd:
+			d := cfg.Download[len(downloaded)]
+			content, err := base64.StdEncoding.DecodeString(encoded.String())
+			if err != nil {
+				return nil, downloaded, fmt.Errorf("ssh plugin: download %q: invalid content: %s", d.Path, err)
+			}
+			if len(content) != current.Size || checksum(content) != current.SHA256 {
+				return nil, downloaded, fmt.Errorf("ssh plugin: download %q: checksum mismatch, expected %s, received %s", d.Path, current.SHA256, checksum(content))
+			}
+			if d.Base64 {
+				contents[d.name()] = base64.StdEncoding.EncodeToString(content)
+			} else {
+				contents[d.name()] = string(content)
+			}
+			downloaded = append(downloaded, *current)
+			current = nil
+		case current != nil:
+			encoded.WriteString(strings.TrimSpace(line))
+		default:
+			messages = append(messages, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, downloaded, err
+	}
+
+	if exitCode != 0 {
+		return nil, downloaded, fmt.Errorf("ssh plugin: download failed with exit code %d: %s", exitCode, strings.Join(messages, "\n"))
+	}
+	if len(downloaded) != len(cfg.Download) {
+		return nil, downloaded, fmt.Errorf("ssh plugin: download: expected %d files, got %d", len(cfg.Download), len(downloaded))
+	}
+
+	return contents, downloaded, nil
+}
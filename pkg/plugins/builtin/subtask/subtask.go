@@ -41,6 +41,7 @@ type SubtaskConfig struct {
 	WatcherGroups     string                 `json:"watcher_groups"`
 	Delay             *string                `json:"delay"`
 	Tags              map[string]string      `json:"tags"`
+	ChildrenPolicy    string                 `json:"children_policy,omitempty"`
 }
 
 // SubtaskContext is the metadata inherited from the "parent" task"
@@ -67,6 +68,10 @@ func validConfig(config interface{}) error {
 		return err
 	}
 
+	if err := taskutils.ValidChildrenPolicy(cfg.ChildrenPolicy); err != nil {
+		return err
+	}
+
 	dbp, err := zesty.NewDBProvider(utask.DBName)
 	if err != nil {
 		return fmt.Errorf("can't retrieve connexion to DB: %s", err)
@@ -12,6 +12,7 @@ import (
 
 	"github.com/ovh/utask/api"
 	"github.com/ovh/utask/engine/step"
+	"github.com/ovh/utask/engine/values"
 )
 
 // TaskPlugin represents the interface for every executor for µtask step actions
@@ -21,6 +22,11 @@ type TaskPlugin interface {
 	PluginVersion() string
 }
 
+// TemplateFunctionsPlugin is implemented by plugins contributing functions to the templating language
+type TemplateFunctionsPlugin interface {
+	TemplateFunctions() []values.TemplateFunction
+}
+
 // ExecutorsFromFolder loads a collection of TaskPlugin from compiled .so plugins
 // found in a folder, then registers each TaskPlugin as a step runner
 // to be used by the task execution engine
@@ -30,7 +36,7 @@ func ExecutorsFromFolder(path string) error {
 		if !ok {
 			return fmt.Errorf("failed to assert type of plugin '%s': expected TaskPlugin got %T", fileName, p)
 		}
-		if err := step.RegisterRunner(plugExec.PluginName(), plugExec); err != nil {
+		if err := RegisterExecutor(plugExec); err != nil {
 			return err
 		}
 		logrus.Infof("Registered plugin '%s' (%s)", plugExec.PluginName(), plugExec.PluginVersion())
@@ -38,6 +44,24 @@ func ExecutorsFromFolder(path string) error {
 	})
 }
 
+// RegisterExecutor registers a TaskPlugin as a step runner,
+// along with the templating functions it contributes
+func RegisterExecutor(p TaskPlugin) error {
+	if err := step.RegisterRunner(p.PluginName(), p); err != nil {
+		return err
+	}
+	fp, ok := p.(TemplateFunctionsPlugin)
+	if !ok {
+		return nil
+	}
+	for _, f := range fp.TemplateFunctions() {
+		if err := values.RegisterFunction(p.PluginName(), f); err != nil {
+			return fmt.Errorf("failed to register templating function of plugin '%s': %s", p.PluginName(), err)
+		}
+	}
+	return nil
+}
+
 // Service encapsulates the objects accessible to an initialization plugin
 // this allows for custom configuration of the api server, and for the declaration
 // of additional configstore providers
@@ -7,6 +7,7 @@ import (
 	"reflect"
 
 	"github.com/juju/errors"
+	"github.com/ovh/utask/engine/values"
 	"github.com/ovh/utask/pkg/jsonschema"
 	"github.com/ovh/utask/pkg/utils"
 )
@@ -29,6 +30,7 @@ type PluginExecutor struct {
 	contextFactory func(string) interface{}
 	metadataSchema json.RawMessage
 	tagsFunc       tagsFunc
+	functions      []values.TemplateFunction
 }
 
 // Context generates a context payload to pass to Exec()
@@ -119,6 +121,11 @@ func (r PluginExecutor) PluginVersion() string {
 	return r.pluginVersion
 }
 
+// TemplateFunctions returns the functions contributed by the plugin to the templating language
+func (r PluginExecutor) TemplateFunctions() []values.TemplateFunction {
+	return r.functions
+}
+
 // MetadataSchema returns json schema to validate the metadata returned on execution
 func (r PluginExecutor) MetadataSchema() json.RawMessage {
 	return r.metadataSchema
@@ -135,6 +142,7 @@ type PluginOpt struct {
 	resourcesFunc   func(interface{}) []string
 	metadataFunc    func() string
 	tagsFunc        tagsFunc
+	functions       []values.TemplateFunction
 }
 
 // WithConfig defines the configuration struct and validation function
@@ -174,6 +182,14 @@ func WithTags(fn tagsFunc) func(*PluginOpt) {
 	}
 }
 
+// WithTemplateFunctions defines functions contributed by the plugin to the templating language,
+// available in every template once the plugin is registered
+func WithTemplateFunctions(functions ...values.TemplateFunction) func(*PluginOpt) {
+	return func(o *PluginOpt) {
+		o.functions = append(o.functions, functions...)
+	}
+}
+
 // WithResources defines a function indicating what resources will be needed by the plugin
 func WithResources(resourcesFunc func(interface{}) []string) func(*PluginOpt) {
 	return func(o *PluginOpt) {
@@ -199,6 +215,11 @@ func New(pluginName string, pluginVersion string, execfunc ExecFunc, opts ...fun
 	if pOpt.configObj != nil && pOpt.configCheckFunc == nil {
 		panic(fmt.Sprintf("plugin executor '%s': nil config check function", pluginName))
 	}
+	for _, f := range pOpt.functions {
+		if f.Func == nil {
+			panic(fmt.Sprintf("plugin executor '%s': nil templating function '%s'", pluginName, f.Name))
+		}
+	}
 	if pOpt.contextObj != nil && pOpt.contextFunc != nil {
 		panic(fmt.Sprintf("plugin executor '%s': conflicting context object + factory", pluginName))
 	}
@@ -255,5 +276,6 @@ func New(pluginName string, pluginVersion string, execfunc ExecFunc, opts ...fun
 		contextFactory: contextFactory,
 		metadataSchema: schema,
 		tagsFunc:       pOpt.tagsFunc,
+		functions:      pOpt.functions,
 	}
 }
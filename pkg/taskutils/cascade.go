@@ -0,0 +1,253 @@
+package taskutils
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/loopfz/gadgeto/zesty"
+
+	"github.com/ovh/utask/models/resolution"
+	"github.com/ovh/utask/models/task"
+	"github.com/ovh/utask/pkg/constants"
+)
+
+// Policies applied to the tasks spawned by a subtask or batch step, when the resolution of their parent is cancelled or paused,
+// set through the "children_policy" field of the step's configuration
+const (
+	// ChildrenPolicyCascade cancels or pauses the children along with their parent (default)
+	ChildrenPolicyCascade = "cascade"
+	// ChildrenPolicyDetach lets the children run: they are unlinked from a cancelled parent, and left alone by a pause
+	ChildrenPolicyDetach = "detach"
+	// ChildrenPolicyRefuse refuses to cancel or pause the parent while its children are not done
+	ChildrenPolicyRefuse = "refuse"
+)
+
+// ValidChildrenPolicy asserts that a children policy is known, an empty policy meaning the default one
+func ValidChildrenPolicy(policy string) error {
+	switch policy {
+	case "", ChildrenPolicyCascade, ChildrenPolicyDetach, ChildrenPolicyRefuse:
+		return nil
+	}
+	return errors.BadRequestf("children_policy %q is not valid, expected one of %q, %q or %q",
+		policy, ChildrenPolicyCascade, ChildrenPolicyDetach, ChildrenPolicyRefuse)
+}
+
+// CascadeCancel applies the children policies of a resolution's steps to the unfinished tasks they spawned,
+// as the resolution is being cancelled: children are cancelled recursively, or detached from their parent,
+// or the cancellation is refused. The action taken is recorded as a comment of each child, on behalf of username.
+func CascadeCancel(dbp zesty.DBProvider, t *task.Task, r *resolution.Resolution, username string) error {
+	return cascade(dbp, t, r, username, true, false, map[string]bool{t.PublicID: true}, 0)
+}
+
+// CascadePause applies the children policies of a resolution's steps to the unfinished tasks they spawned,
+// as the resolution is being paused: children are paused recursively, or left running, or the pause is refused.
+// Children whose resolution is running are only paused when force is set, as their parent.
+// The action taken is recorded as a comment of each child, on behalf of username.
+func CascadePause(dbp zesty.DBProvider, t *task.Task, r *resolution.Resolution, username string, force bool) error {
+	return cascade(dbp, t, r, username, false, force, map[string]bool{t.PublicID: true}, 0)
+}
+
+// CascadeResume resumes the children which were paused along with a task, as its paused resolution is run again:
+// their resolution is handed over to the autorun collector, recursively.
+// The action taken is recorded as a comment of each child, on behalf of username.
+func CascadeResume(dbp zesty.DBProvider, t *task.Task, username string) error {
+	return resume(dbp, t, username, map[string]bool{t.PublicID: true}, 0)
+}
+
+func cascade(dbp zesty.DBProvider, parent *task.Task, r *resolution.Resolution, username string, cancel, force bool, visited map[string]bool, depth int) error {
+	if depth >= MaxTreeDepth {
+		return nil
+	}
+
+	children, err := task.ListChildren(dbp, parent.PublicID)
+	if err != nil {
+		return err
+	}
+	if len(children) == 0 {
+		return nil
+	}
+
+	action := "pause"
+	if cancel {
+		action = "cancel"
+	}
+
+	steps := resolutionSpawningSteps(r)
+	for _, child := range children {
+		if visited[child.PublicID] {
+			continue
+		}
+		visited[child.PublicID] = true
+
+		switch child.State {
+		case task.StateDone, task.StateCancelled, task.StateWontfix:
+			continue
+		}
+
+		stepName := childSpawningStep(steps, child)
+		switch childrenPolicy(r, stepName) {
+		case ChildrenPolicyRefuse:
+			return errors.BadRequestf("Can't %s resolution: task %s spawned by step %q is in state %s", action, child.PublicID, stepName, child.State)
+		case ChildrenPolicyDetach:
+			err = detachChild(dbp, parent, child, username, cancel)
+		default:
+			err = interruptChild(dbp, parent, child, username, cancel, force, visited, depth)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// childrenPolicy returns the policy configured on the step which spawned a child task
+func childrenPolicy(r *resolution.Resolution, stepName string) string {
+	s, ok := r.Steps[stepName]
+	if !ok {
+		return ChildrenPolicyCascade
+	}
+	var cfg struct {
+		ChildrenPolicy string `json:"children_policy"`
+	}
+	if err := json.Unmarshal(s.Action.Configuration, &cfg); err != nil || cfg.ChildrenPolicy == "" {
+		return ChildrenPolicyCascade
+	}
+	return cfg.ChildrenPolicy
+}
+
+func detachChild(dbp zesty.DBProvider, parent, child *task.Task, username string, cancel bool) error {
+	comment := fmt.Sprintf("left running while parent task %s is paused", parent.PublicID)
+	if cancel {
+		// a detached child doesn't wake up its parent anymore
+		if err := setChildTag(dbp, child, constants.SubtaskTagParentTaskID, ""); err != nil {
+			return err
+		}
+		comment = fmt.Sprintf("detached from parent task %s, which was cancelled", parent.PublicID)
+	}
+
+	_, err := task.CreateComment(dbp, child, username, comment)
+	return err
+}
+
+func interruptChild(dbp zesty.DBProvider, parent, child *task.Task, username string, cancel, force bool, visited map[string]bool, depth int) error {
+	if child.Resolution != nil {
+		cr, err := resolution.LoadFromPublicID(dbp, *child.Resolution)
+		if err != nil {
+			return err
+		}
+
+		if cr.State == resolution.StateRunning && (cancel || !force) {
+			return errors.BadRequestf("Can't interrupt task %s spawned by task %s: its resolution is currently running, retry later", child.PublicID, parent.PublicID)
+		}
+
+		switch cr.State {
+		case resolution.StateCancelled, resolution.StateDone:
+			// nothing left to interrupt
+		case resolution.StatePaused:
+			if !cancel {
+				return nil
+			}
+			fallthrough
+		default:
+			cr, err = resolution.LoadLockedNoWaitFromPublicID(dbp, cr.PublicID)
+			if err != nil {
+				return err
+			}
+			if err := cascade(dbp, child, cr, username, cancel, force, visited, depth+1); err != nil {
+				return err
+			}
+			if cancel {
+				cr.SetState(resolution.StateCancelled)
+			} else {
+				cr.SetState(resolution.StatePaused)
+			}
+			if err := cr.Update(dbp); err != nil {
+				return err
+			}
+		}
+	} else if !cancel {
+		// not started yet, nothing to pause
+		return nil
+	}
+
+	comment := fmt.Sprintf("paused along with parent task %s", parent.PublicID)
+	if !cancel {
+		// remember who paused the child, to resume it along with its parent
+		if err := setChildTag(dbp, child, constants.SubtaskTagPausedWithParentTaskID, parent.PublicID); err != nil {
+			return err
+		}
+	} else {
+		child.SetState(task.StateCancelled)
+		if err := child.Update(dbp, true, true); err != nil {
+			return err
+		}
+		comment = fmt.Sprintf("cancelled along with parent task %s", parent.PublicID)
+	}
+
+	_, err := task.CreateComment(dbp, child, username, comment)
+	return err
+}
+
+func resume(dbp zesty.DBProvider, parent *task.Task, username string, visited map[string]bool, depth int) error {
+	if depth >= MaxTreeDepth {
+		return nil
+	}
+
+	children, err := task.ListChildren(dbp, parent.PublicID)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if visited[child.PublicID] || child.Tags[constants.SubtaskTagPausedWithParentTaskID] != parent.PublicID {
+			continue
+		}
+		visited[child.PublicID] = true
+
+		if err := setChildTag(dbp, child, constants.SubtaskTagPausedWithParentTaskID, ""); err != nil {
+			return err
+		}
+
+		if child.Resolution == nil {
+			continue
+		}
+		cr, err := resolution.LoadLockedNoWaitFromPublicID(dbp, *child.Resolution)
+		if err != nil {
+			return err
+		}
+		if cr.State != resolution.StatePaused {
+			// resumed or cancelled in the meantime
+			continue
+		}
+		if err := resume(dbp, child, username, visited, depth+1); err != nil {
+			return err
+		}
+		cr.SetState(resolution.StateToAutorun)
+		if err := cr.Update(dbp); err != nil {
+			return err
+		}
+
+		if _, err := task.CreateComment(dbp, child, username, fmt.Sprintf("resumed along with parent task %s", parent.PublicID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setChildTag sets a tag of a child task, or removes it when value is empty
+func setChildTag(dbp zesty.DBProvider, child *task.Task, key, value string) error {
+	tags := make(map[string]string, len(child.Tags)+1)
+	for k, v := range child.Tags {
+		if k != key {
+			tags[k] = v
+		}
+	}
+	if value != "" {
+		tags[key] = value
+	}
+	if err := child.SetTags(tags, nil); err != nil {
+		return err
+	}
+	return child.Update(dbp, true, false)
+}
@@ -0,0 +1,177 @@
+package taskutils
+
+import (
+	"github.com/juju/errors"
+	"github.com/loopfz/gadgeto/zesty"
+
+	"github.com/ovh/utask/models/resolution"
+	"github.com/ovh/utask/models/task"
+	"github.com/ovh/utask/pkg/constants"
+)
+
+// MaxTreeDepth is the depth beyond which the children of a task are not explored
+const MaxTreeDepth = 32
+
+// TreeNode is a task within a tree of tasks spawned by the subtask and batch plugins
+// RollupState summarizes the state of the task and of its descendants:
+// a task is BLOCKED as soon as one of its descendants is, RUNNING as soon as one of them runs, and so on
+type TreeNode struct {
+	ID           string      `json:"id"`
+	Title        string      `json:"title,omitempty"`
+	TemplateName string      `json:"template_name"`
+	State        string      `json:"state"`
+	StepsDone    int         `json:"steps_done"`
+	StepsTotal   int         `json:"steps_total"`
+	Resolution   *string     `json:"resolution,omitempty"`
+	Batch        *string     `json:"batch,omitempty"`
+	ParentStep   string      `json:"parent_step,omitempty"`
+	RollupState  string      `json:"rollup_state"`
+	BlockedTasks []string    `json:"blocked_tasks,omitempty"`
+	Truncated    bool        `json:"truncated,omitempty"`
+	Children     []*TreeNode `json:"children,omitempty"`
+}
+
+// rollupPriority ranks the states of tasks still in progress, the highest taking precedence in a roll-up
+// final states are not listed: a finished task is never the reason why its ancestors are stuck
+var rollupPriority = map[string]int{
+	task.StateTODO:    1,
+	task.StateDelayed: 2,
+	task.StateWaiting: 3,
+	task.StateRunning: 4,
+	task.StateBlocked: 5,
+}
+
+// Tree returns the tree of tasks including t: the tree is rooted on t's oldest ancestor,
+// and descends recursively into the tasks spawned by each task
+// the details of the tasks which can't be viewed, according to canView, are left out
+func Tree(dbp zesty.DBProvider, t *task.Task, canView func(*task.Task) bool) (*TreeNode, error) {
+	root := t
+	visited := map[string]bool{root.PublicID: true}
+	for depth := 0; depth < MaxTreeDepth; depth++ {
+		parentID, ok := root.Tags[constants.SubtaskTagParentTaskID]
+		if !ok || visited[parentID] {
+			break
+		}
+		parent, err := task.LoadFromPublicID(dbp, parentID)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				// the parent task has been deleted, the tree is rooted on the orphan
+				break
+			}
+			return nil, err
+		}
+		visited[parentID] = true
+		root = parent
+	}
+
+	return buildTreeNode(dbp, root, "", 0, map[string]bool{}, canView)
+}
+
+func buildTreeNode(dbp zesty.DBProvider, t *task.Task, parentStep string, depth int, visited map[string]bool, canView func(*task.Task) bool) (*TreeNode, error) {
+	visited[t.PublicID] = true
+
+	n := &TreeNode{
+		ID:           t.PublicID,
+		TemplateName: t.TemplateName,
+		State:        t.State,
+		StepsDone:    t.StepsDone,
+		StepsTotal:   t.StepsTotal,
+		Resolution:   t.Resolution,
+		Batch:        t.Batch,
+		ParentStep:   parentStep,
+	}
+	if canView(t) {
+		n.Title = t.Title
+	}
+
+	children, err := task.ListChildren(dbp, t.PublicID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(children) > 0 {
+		if depth >= MaxTreeDepth {
+			n.Truncated = true
+		} else {
+			steps, err := spawningSteps(dbp, t)
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				if visited[child.PublicID] {
+					continue
+				}
+				childNode, err := buildTreeNode(dbp, child, childSpawningStep(steps, child), depth+1, visited, canView)
+				if err != nil {
+					return nil, err
+				}
+				n.Children = append(n.Children, childNode)
+			}
+		}
+	}
+
+	n.rollup()
+	return n, nil
+}
+
+// spawningSteps maps the tasks and batches spawned by a task to the step that spawned them
+func spawningSteps(dbp zesty.DBProvider, t *task.Task) (map[string]string, error) {
+	if t.Resolution == nil {
+		return map[string]string{}, nil
+	}
+
+	r, err := resolution.LoadFromPublicID(dbp, *t.Resolution)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	return resolutionSpawningSteps(r), nil
+}
+
+// resolutionSpawningSteps maps the tasks and batches spawned by a resolution to the step that spawned them,
+// out of the outputs of subtask steps and the metadata of batch steps
+func resolutionSpawningSteps(r *resolution.Resolution) map[string]string {
+	ret := map[string]string{}
+	for name, s := range r.Steps {
+		if output, ok := s.Output.(map[string]interface{}); ok {
+			if id, ok := output["id"].(string); ok && id != "" {
+				ret[id] = name
+			}
+		}
+		if metadata, ok := s.Metadata.(map[string]interface{}); ok {
+			if id, ok := metadata["batch_id"].(string); ok && id != "" {
+				ret[id] = name
+			}
+		}
+	}
+	return ret
+}
+
+// childSpawningStep returns the step of the parent's resolution which spawned a child task
+func childSpawningStep(steps map[string]string, child *task.Task) string {
+	if step, ok := steps[child.PublicID]; ok {
+		return step
+	}
+	if child.Batch != nil {
+		return steps[*child.Batch]
+	}
+	return ""
+}
+
+// rollup computes the roll-up state of a node, out of its own state and those of its children
+func (n *TreeNode) rollup() {
+	n.RollupState = n.State
+	if n.State == task.StateBlocked {
+		n.BlockedTasks = append(n.BlockedTasks, n.ID)
+	}
+
+	_, inProgress := rollupPriority[n.State]
+	for _, c := range n.Children {
+		n.BlockedTasks = append(n.BlockedTasks, c.BlockedTasks...)
+		if inProgress && rollupPriority[c.RollupState] > rollupPriority[n.RollupState] {
+			n.RollupState = c.RollupState
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	stderrors "errors"
+)
+
+// fatalError is an error that retrying an action can't fix,
+// and that should halt a step's execution altogether
+type fatalError struct {
+	msg   string
+	cause error
+}
+
+func (e *fatalError) Error() string {
+	if e.cause == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.cause.Error()
+}
+
+func (e *fatalError) Unwrap() error {
+	return e.cause
+}
+
+// NewFatalError returns an error which will put the step in FATAL_ERROR state
+// when returned by a plugin, instead of having it retried
+func NewFatalError(cause error, msg string) error {
+	return &fatalError{msg: msg, cause: cause}
+}
+
+// IsFatalError asserts that an error was created with NewFatalError
+func IsFatalError(err error) bool {
+	var fe *fatalError
+	return stderrors.As(err, &fe)
+}
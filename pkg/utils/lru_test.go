@@ -0,0 +1,34 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/maxatome/go-testdeep/td"
+
+	"github.com/ovh/utask/pkg/utils"
+)
+
+func TestLRU(t *testing.T) {
+	c := utils.NewLRU[string, int](2)
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+	v, ok := c.Get("a")
+	td.CmpTrue(t, ok)
+	td.Cmp(t, v, 1)
+
+	// "b" is the least recently used entry
+	c.Add("c", 3)
+	td.Cmp(t, c.Len(), 2)
+	_, ok = c.Get("b")
+	td.CmpFalse(t, ok)
+
+	c.Add("a", 4)
+	v, _ = c.Get("a")
+	td.Cmp(t, v, 4)
+
+	c.Remove("a")
+	_, ok = c.Get("a")
+	td.CmpFalse(t, ok)
+	td.Cmp(t, c.Len(), 1)
+}
@@ -0,0 +1,25 @@
+-- +migrate Up
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION "utask_resolution_notify"() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.state = NEW.state THEN
+        RETURN NULL;
+    END IF;
+    PERFORM pg_notify('utask_resolution', json_build_object('id', NEW.public_id, 'state', NEW.state, 'next_retry', NEW.next_retry)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+CREATE TRIGGER "resolution_notify" AFTER INSERT OR UPDATE OF state ON "resolution"
+    FOR EACH ROW EXECUTE PROCEDURE "utask_resolution_notify"();
+
+INSERT INTO "utask_sql_migrations" VALUES ('v1.21.1-migration012');
+
+-- +migrate Down
+
+DROP TRIGGER IF EXISTS "resolution_notify" ON "resolution";
+DROP FUNCTION IF EXISTS "utask_resolution_notify"();
+
+DELETE FROM "utask_sql_migrations" WHERE current_migration_applied = 'v1.21.1-migration012';
@@ -0,0 +1,20 @@
+-- +migrate Up
+
+CREATE TABLE "secret" (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    allowed_templates JSONB NOT NULL DEFAULT '[]',
+    created TIMESTAMP with time zone DEFAULT now() NOT NULL,
+    updated TIMESTAMP with time zone DEFAULT now() NOT NULL,
+    encrypted_value BYTEA NOT NULL
+);
+CREATE INDEX ON "secret" USING gin (allowed_templates jsonb_path_ops);
+
+INSERT INTO "utask_sql_migrations" VALUES ('v1.21.1-migration013');
+
+-- +migrate Down
+
+DROP TABLE "secret" CASCADE;
+
+DELETE FROM "utask_sql_migrations" WHERE current_migration_applied = 'v1.21.1-migration013';
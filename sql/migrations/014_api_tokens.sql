@@ -0,0 +1,31 @@
+-- +migrate Up
+
+CREATE TABLE "api_token" (
+    id BIGSERIAL PRIMARY KEY,
+    public_id UUID UNIQUE NOT NULL,
+    name TEXT NOT NULL,
+    owner_username TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    groups JSONB NOT NULL DEFAULT '[]',
+    scopes JSONB NOT NULL DEFAULT '[]',
+    token_hash TEXT UNIQUE NOT NULL,
+    created TIMESTAMP with time zone DEFAULT now() NOT NULL,
+    expires_at TIMESTAMP with time zone,
+    last_used TIMESTAMP with time zone
+);
+CREATE INDEX ON "api_token"(owner_username);
+
+CREATE TABLE "api_token_owner" (
+    username TEXT PRIMARY KEY,
+    groups JSONB NOT NULL DEFAULT '[]',
+    updated TIMESTAMP with time zone DEFAULT now() NOT NULL
+);
+
+INSERT INTO "utask_sql_migrations" VALUES ('v1.21.1-migration014');
+
+-- +migrate Down
+
+DROP TABLE "api_token" CASCADE;
+DROP TABLE "api_token_owner" CASCADE;
+
+DELETE FROM "utask_sql_migrations" WHERE current_migration_applied = 'v1.21.1-migration014';
@@ -0,0 +1,16 @@
+-- +migrate Up
+
+CREATE TABLE "ssh_known_host" (
+    host TEXT PRIMARY KEY,
+    public_key TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    created TIMESTAMP with time zone DEFAULT now() NOT NULL
+);
+
+INSERT INTO "utask_sql_migrations" VALUES ('v1.21.1-migration015');
+
+-- +migrate Down
+
+DROP TABLE "ssh_known_host" CASCADE;
+
+DELETE FROM "utask_sql_migrations" WHERE current_migration_applied = 'v1.21.1-migration015';
@@ -0,0 +1,19 @@
+-- +migrate Up
+
+CREATE TABLE "resolution_step_attempt" (
+    id BIGSERIAL PRIMARY KEY,
+    id_resolution BIGINT NOT NULL REFERENCES "resolution"(id) ON DELETE CASCADE,
+    step_name TEXT NOT NULL,
+    created TIMESTAMP with time zone DEFAULT now() NOT NULL,
+    encrypted_content BYTEA NOT NULL
+);
+CREATE INDEX ON "resolution_step_attempt"(id_resolution, step_name, id);
+CREATE INDEX ON "resolution_step_attempt"(created);
+
+INSERT INTO "utask_sql_migrations" VALUES ('v1.21.1-migration016');
+
+-- +migrate Down
+
+DROP TABLE "resolution_step_attempt" CASCADE;
+
+DELETE FROM "utask_sql_migrations" WHERE current_migration_applied = 'v1.21.1-migration016';
@@ -0,0 +1,31 @@
+-- +migrate Up
+
+CREATE TABLE "audit_event" (
+    id BIGSERIAL PRIMARY KEY,
+    created TIMESTAMP with time zone DEFAULT now() NOT NULL,
+    actor TEXT NOT NULL DEFAULT '',
+    token_id TEXT NOT NULL DEFAULT '',
+    sudo BOOLEAN NOT NULL DEFAULT false,
+    action TEXT NOT NULL,
+    method TEXT NOT NULL,
+    path TEXT NOT NULL,
+    status INTEGER NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    task_id TEXT NOT NULL DEFAULT '',
+    resolution_id TEXT NOT NULL DEFAULT '',
+    template_name TEXT NOT NULL DEFAULT '',
+    old_state TEXT NOT NULL DEFAULT '',
+    new_state TEXT NOT NULL DEFAULT '',
+    metadata JSONB NOT NULL DEFAULT '{}'
+);
+CREATE INDEX ON "audit_event"(task_id, id);
+CREATE INDEX ON "audit_event"(actor, id);
+CREATE INDEX ON "audit_event"(created);
+
+INSERT INTO "utask_sql_migrations" VALUES ('v1.21.1-migration017');
+
+-- +migrate Down
+
+DROP TABLE "audit_event" CASCADE;
+
+DELETE FROM "utask_sql_migrations" WHERE current_migration_applied = 'v1.21.1-migration017';
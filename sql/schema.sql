@@ -142,6 +142,90 @@ CREATE TABLE "cache" (
 
 CREATE INDEX "cache_expires_at_idx" ON "cache" ("expires_at") WHERE "expires_at" IS NOT NULL;
 
-INSERT INTO "utask_sql_migrations" VALUES ('v1.21.1-migration011');
+CREATE OR REPLACE FUNCTION "utask_resolution_notify"() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.state = NEW.state THEN
+        RETURN NULL;
+    END IF;
+    PERFORM pg_notify('utask_resolution', json_build_object('id', NEW.public_id, 'state', NEW.state, 'next_retry', NEW.next_retry)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER "resolution_notify" AFTER INSERT OR UPDATE OF state ON "resolution"
+    FOR EACH ROW EXECUTE PROCEDURE "utask_resolution_notify"();
+
+CREATE TABLE "secret" (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    allowed_templates JSONB NOT NULL DEFAULT '[]',
+    created TIMESTAMP with time zone DEFAULT now() NOT NULL,
+    updated TIMESTAMP with time zone DEFAULT now() NOT NULL,
+    encrypted_value BYTEA NOT NULL
+);
+CREATE INDEX ON "secret" USING gin (allowed_templates jsonb_path_ops);
+
+CREATE TABLE "api_token" (
+    id BIGSERIAL PRIMARY KEY,
+    public_id UUID UNIQUE NOT NULL,
+    name TEXT NOT NULL,
+    owner_username TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    groups JSONB NOT NULL DEFAULT '[]',
+    scopes JSONB NOT NULL DEFAULT '[]',
+    token_hash TEXT UNIQUE NOT NULL,
+    created TIMESTAMP with time zone DEFAULT now() NOT NULL,
+    expires_at TIMESTAMP with time zone,
+    last_used TIMESTAMP with time zone
+);
+CREATE INDEX ON "api_token"(owner_username);
+
+CREATE TABLE "api_token_owner" (
+    username TEXT PRIMARY KEY,
+    groups JSONB NOT NULL DEFAULT '[]',
+    updated TIMESTAMP with time zone DEFAULT now() NOT NULL
+);
+
+CREATE TABLE "ssh_known_host" (
+    host TEXT PRIMARY KEY,
+    public_key TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    created TIMESTAMP with time zone DEFAULT now() NOT NULL
+);
+
+CREATE TABLE "resolution_step_attempt" (
+    id BIGSERIAL PRIMARY KEY,
+    id_resolution BIGINT NOT NULL REFERENCES "resolution"(id) ON DELETE CASCADE,
+    step_name TEXT NOT NULL,
+    created TIMESTAMP with time zone DEFAULT now() NOT NULL,
+    encrypted_content BYTEA NOT NULL
+);
+CREATE INDEX ON "resolution_step_attempt"(id_resolution, step_name, id);
+CREATE INDEX ON "resolution_step_attempt"(created);
+
+CREATE TABLE "audit_event" (
+    id BIGSERIAL PRIMARY KEY,
+    created TIMESTAMP with time zone DEFAULT now() NOT NULL,
+    actor TEXT NOT NULL DEFAULT '',
+    token_id TEXT NOT NULL DEFAULT '',
+    sudo BOOLEAN NOT NULL DEFAULT false,
+    action TEXT NOT NULL,
+    method TEXT NOT NULL,
+    path TEXT NOT NULL,
+    status INTEGER NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    task_id TEXT NOT NULL DEFAULT '',
+    resolution_id TEXT NOT NULL DEFAULT '',
+    template_name TEXT NOT NULL DEFAULT '',
+    old_state TEXT NOT NULL DEFAULT '',
+    new_state TEXT NOT NULL DEFAULT '',
+    metadata JSONB NOT NULL DEFAULT '{}'
+);
+CREATE INDEX ON "audit_event"(task_id, id);
+CREATE INDEX ON "audit_event"(actor, id);
+CREATE INDEX ON "audit_event"(created);
+
+INSERT INTO "utask_sql_migrations" VALUES ('v1.21.1-migration017');
 
 END;
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"golang.org/x/sync/semaphore"
 
 	"github.com/ovh/configstore"
@@ -88,6 +90,10 @@ const (
 
 	defaultResourceAcquireTimeout = time.Minute
 
+	defaultAuditLogRetention = "2160h" // 90 days
+
+	minQueueDepthInterval = 5 * time.Second
+
 	// This is the key used in Values for a step to refer to itself
 	This = "this"
 
@@ -139,6 +145,11 @@ type Cfg struct {
 	DashboardSentryDSN                         string                   `json:"dashboard_sentry_dsn"`
 	StepsCompressionAlg                        string                   `json:"steps_compression_algorithm"`
 	ServerOptions                              ServerOpt                `json:"server_options"`
+	ScriptSandbox                              *ScriptSandbox           `json:"script_sandbox"`
+	SSHHostKeyCheck                            string                   `json:"ssh_host_key_check"`
+	AuditLog                                   AuditLog                 `json:"audit_log"`
+	QueueDepthInterval                         string                   `json:"queue_depth_interval"`
+	QueueDepthIntervalDuration                 time.Duration            `json:"-"`
 
 	resourceSemaphores map[string]*semaphore.Weighted
 	executionSemaphore *semaphore.Weighted
@@ -150,6 +161,40 @@ type ServerOpt struct {
 	MaxBodyBytes int64 `json:"max_body_bytes"`
 }
 
+// ScriptSandbox holds the isolation settings applied to every execution of the script plugin
+// the scripts' environment is cleared, except for the variables listed in EnvAllowlist
+type ScriptSandbox struct {
+	EnvAllowlist   []string `json:"env_allowlist"`
+	UID            *uint32  `json:"uid"`
+	GID            *uint32  `json:"gid"`
+	MaxCPUTime     string   `json:"max_cpu_time"`
+	MaxMemory      uint64   `json:"max_memory"`
+	MaxProcesses   uint64   `json:"max_processes"`
+	MaxOpenFiles   uint64   `json:"max_open_files"`
+	MaxFileSize    uint64   `json:"max_file_size"`
+	MaxOutputSize  int      `json:"max_output_size"`
+	PrivateWorkdir bool     `json:"private_workdir"`
+	WorkdirRoot    string   `json:"workdir_root"`
+
+	MaxCPUTimeDuration time.Duration `json:"-"`
+}
+
+// AuditLog holds the settings of the audit log, recording the actions performed through the API
+// events are kept in DB for the Retention period, and optionally forwarded to a webhook
+type AuditLog struct {
+	Disabled  bool             `json:"disabled"`
+	Retention string           `json:"retention"`
+	Webhook   *AuditLogWebhook `json:"webhook"`
+
+	RetentionDuration time.Duration `json:"-"`
+}
+
+// AuditLogWebhook holds the configuration of the webhook receiving every audit event
+type AuditLogWebhook struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
 // NotifyBackend holds configuration for instantiating a notify client
 type NotifyBackend struct {
 	Type                           string                                    `json:"type"`
@@ -244,6 +289,8 @@ var (
 	ErrDeadResource = errors.New("resource is not available, as configured with 0 concurrent execution")
 	// ErrFailedAcquireResource is returned when tried to acquire a resource, but the resource is not available
 	ErrFailedAcquireResource = errors.New("failed to acquire the requested resource")
+
+	resourceWaitTimes = promauto.NewHistogramVec(prometheus.HistogramOpts{Name: "utask_resource_wait_seconds"}, []string{"resource"})
 )
 
 // AcquireResource takes a semaphore slot for a named resource
@@ -267,7 +314,11 @@ func AcquireResource(ctx context.Context, name string) error {
 		defer cancelFunc()
 		semaphoreCtx = ctx
 	}
-	return s.Acquire(semaphoreCtx, 1)
+
+	start := time.Now()
+	err := s.Acquire(semaphoreCtx, 1)
+	resourceWaitTimes.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	return err
 }
 
 // TryAcquireResource takes a semaphore slot for a named resource
@@ -402,6 +453,37 @@ func Config(store *configstore.Store) (*Cfg, error) {
 			global.StepsCompressionAlg = DefaultCompressionAlgorithm
 		}
 
+		if global.ScriptSandbox != nil && global.ScriptSandbox.MaxCPUTime != "" {
+			global.ScriptSandbox.MaxCPUTimeDuration, err = time.ParseDuration(global.ScriptSandbox.MaxCPUTime)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse \"script_sandbox.max_cpu_time\": %s", err)
+			}
+			if global.ScriptSandbox.MaxCPUTimeDuration < time.Second {
+				return nil, errors.New("script_sandbox.max_cpu_time can't be less than 1s")
+			}
+		}
+
+		if global.QueueDepthInterval != "" {
+			global.QueueDepthIntervalDuration, err = time.ParseDuration(global.QueueDepthInterval)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse \"queue_depth_interval\": %s", err)
+			}
+			if global.QueueDepthIntervalDuration < minQueueDepthInterval {
+				return nil, fmt.Errorf("queue_depth_interval can't be less than %s", minQueueDepthInterval)
+			}
+		}
+
+		if global.AuditLog.Retention == "" {
+			global.AuditLog.Retention = defaultAuditLogRetention
+		}
+		global.AuditLog.RetentionDuration, err = time.ParseDuration(global.AuditLog.Retention)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse \"audit_log.retention\": %s", err)
+		}
+		if global.AuditLog.Webhook != nil && global.AuditLog.Webhook.URL == "" {
+			return nil, errors.New("audit_log.webhook.url can't be empty")
+		}
+
 		App = global.ApplicationName
 
 		global.buildLimits()